@@ -0,0 +1,120 @@
+package mqtt
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// ackBatcher delays acknowledgments of written messages and sends them
+// together when it has size acknowledgments or interval has passed, so that
+// PUBACKs are sent in bursts instead of one by one at high message rates.
+// The number of written but unacknowledged messages, which the broker
+// redelivers after a failure, is bounded by size. Acknowledgments of QoS 1
+// and 2 messages dropped without being written are batched as well so that
+// they aren't sent ahead of written messages waiting in the batch.
+type ackBatcher struct {
+	size     int
+	interval time.Duration
+
+	m       sync.Mutex
+	pending []func()
+
+	// flushing serializes flushes since PUBACKs must be sent in the order
+	// messages are received.
+	flushing sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// parseAckBatcher parses ack_batch_size and ack_batch_interval parameters.
+// It returns nil when ack_batch_size isn't given or 1.
+func parseAckBatcher(params data.Map) (*ackBatcher, error) {
+	v, ok := params["ack_batch_size"]
+	if !ok {
+		if _, ok := params["ack_batch_interval"]; ok {
+			return nil, errors.New("ack_batch_interval requires ack_batch_size")
+		}
+		return nil, nil
+	}
+	n, err := data.AsInt(v)
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 {
+		return nil, errors.New("ack_batch_size must be positive")
+	}
+	if n == 1 {
+		return nil, nil
+	}
+
+	a := &ackBatcher{
+		size:     int(n),
+		interval: 100 * time.Millisecond,
+	}
+	if v, ok := params["ack_batch_interval"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, errors.New("ack_batch_interval must be positive")
+		}
+		a.interval = d
+	}
+	return a, nil
+}
+
+// start starts sending acknowledgments periodically.
+func (a *ackBatcher) start() {
+	a.stop = make(chan struct{})
+	a.done = make(chan struct{})
+	go func() {
+		defer close(a.done)
+		t := time.NewTicker(a.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-t.C:
+				a.flush()
+			}
+		}
+	}()
+}
+
+// close stops sending acknowledgments periodically and sends pending ones.
+func (a *ackBatcher) close() {
+	close(a.stop)
+	<-a.done
+	a.flush()
+}
+
+// add adds an acknowledgment of a written message.
+func (a *ackBatcher) add(ack func()) {
+	a.m.Lock()
+	a.pending = append(a.pending, ack)
+	full := len(a.pending) >= a.size
+	a.m.Unlock()
+	if full {
+		a.flush()
+	}
+}
+
+// flush sends pending acknowledgments in the order they were added.
+func (a *ackBatcher) flush() {
+	a.flushing.Lock()
+	defer a.flushing.Unlock()
+
+	a.m.Lock()
+	acks := a.pending
+	a.pending = nil
+	a.m.Unlock()
+	for _, ack := range acks {
+		ack()
+	}
+}
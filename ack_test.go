@@ -0,0 +1,86 @@
+package mqtt
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestAckBatcher(t *testing.T) {
+	a, err := parseAckBatcher(data.Map{
+		"ack_batch_size":     data.Int(3),
+		"ack_batch_interval": data.String("1h"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.start()
+
+	var (
+		m     sync.Mutex
+		acked []int
+	)
+	ack := func(i int) func() {
+		return func() {
+			m.Lock()
+			defer m.Unlock()
+			acked = append(acked, i)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		a.add(ack(i))
+	}
+	if len(acked) != 3 {
+		t.Errorf("a full batch should be acknowledged: %v", acked)
+	}
+	a.close()
+	if len(acked) != 4 {
+		t.Fatalf("pending acknowledgments should be sent on close: %v", acked)
+	}
+	for i, n := range acked {
+		if n != i {
+			t.Errorf("acknowledgments should be sent in order: %v", acked)
+			break
+		}
+	}
+}
+
+func TestAckBatcherInterval(t *testing.T) {
+	a, err := parseAckBatcher(data.Map{
+		"ack_batch_size":     data.Int(100),
+		"ack_batch_interval": data.String("10ms"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.start()
+	defer a.close()
+
+	acked := make(chan struct{})
+	a.add(func() {
+		close(acked)
+	})
+	select {
+	case <-acked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the acknowledgment should be sent after the interval")
+	}
+}
+
+func TestParseAckBatcher(t *testing.T) {
+	if a, err := parseAckBatcher(data.Map{"ack_batch_size": data.Int(1)}); err != nil || a != nil {
+		t.Error("a batch of one acknowledgment should disable batching")
+	}
+	for _, params := range []data.Map{
+		{"ack_batch_size": data.Int(0)},
+		{"ack_batch_interval": data.String("1s")},
+		{"ack_batch_size": data.Int(10), "ack_batch_interval": data.String("0s")},
+	} {
+		if _, err := parseAckBatcher(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
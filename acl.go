@@ -0,0 +1,105 @@
+package mqtt
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// aclCache remembers topics to which the broker refused to authorize a
+// publish so that messages to them are skipped quickly instead of waiting for
+// each of them to fail. Only MQTT 5 brokers tell the client that a publish is
+// unauthorized with a reason code in PUBACK. Other errors such as timeouts
+// and lost connections don't deny topics.
+type aclCache struct {
+	ttl time.Duration
+
+	m      sync.Mutex
+	denied map[string]time.Time
+
+	// skipped is the number of messages skipped because their topics were
+	// denied. It must be accessed atomically.
+	skipped int64
+}
+
+// parseACLCache parses the acl_cache_ttl parameter. It returns nil when the
+// parameter isn't given or 0.
+func parseACLCache(params data.Map) (*aclCache, error) {
+	v, ok := params["acl_cache_ttl"]
+	if !ok {
+		return nil, nil
+	}
+	d, err := data.ToDuration(v)
+	if err != nil {
+		return nil, err
+	}
+	if d < 0 {
+		return nil, errors.New("acl_cache_ttl must not be negative")
+	}
+	if d == 0 {
+		return nil, nil
+	}
+	return &aclCache{
+		ttl:    d,
+		denied: map[string]time.Time{},
+	}, nil
+}
+
+// allowed returns false and counts the message as skipped when publishing to
+// the topic failed within the TTL.
+func (a *aclCache) allowed(topic string, now time.Time) bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+	expiry, ok := a.denied[topic]
+	if !ok {
+		return true
+	}
+	if !now.Before(expiry) {
+		delete(a.denied, topic)
+		return true
+	}
+	atomic.AddInt64(&a.skipped, 1)
+	return false
+}
+
+// deny records that the broker didn't authorize publishing to the topic. It
+// returns false when the topic has already been denied.
+func (a *aclCache) deny(topic string, now time.Time) bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if expiry, ok := a.denied[topic]; ok && now.Before(expiry) {
+		return false
+	}
+	for t, expiry := range a.denied {
+		if !now.Before(expiry) {
+			delete(a.denied, t)
+		}
+	}
+	a.denied[topic] = now.Add(a.ttl)
+	return true
+}
+
+// Reason codes of PUBACK telling that the client isn't authorized to publish
+// to the topic.
+const (
+	v5NotAuthorized    byte = 0x87
+	v5TopicNameInvalid byte = 0x90
+)
+
+// unauthorized returns true when err is caused by PUBACK having the reason
+// code 0x87 (Not authorized) or 0x90 (Topic Name invalid).
+func unauthorized(err error) bool {
+	code, ok := v5ReasonCode(err)
+	return ok && (code == v5NotAuthorized || code == v5TopicNameInvalid)
+}
+
+// stats returns the number of topics currently denied and the number of
+// messages skipped so far.
+func (a *aclCache) stats() (denied int, skipped int64) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return len(a.denied), atomic.LoadInt64(&a.skipped)
+}
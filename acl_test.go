@@ -0,0 +1,80 @@
+package mqtt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestACLCache(t *testing.T) {
+	a, err := parseACLCache(data.Map{"acl_cache_ttl": data.String("1m")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	if !a.allowed("devices/1/commands", now) {
+		t.Error("a topic should be allowed before it's denied")
+	}
+	if !a.deny("devices/1/commands", now) {
+		t.Error("the topic should be newly denied")
+	}
+	if a.deny("devices/1/commands", now) {
+		t.Error("the topic has already been denied")
+	}
+	if a.allowed("devices/1/commands", now.Add(time.Second)) {
+		t.Error("the denied topic should be skipped")
+	}
+	if !a.allowed("devices/2/commands", now.Add(time.Second)) {
+		t.Error("other topics should be allowed")
+	}
+	if denied, skipped := a.stats(); denied != 1 || skipped != 1 {
+		t.Errorf("wrong stats: %v, %v", denied, skipped)
+	}
+
+	if !a.allowed("devices/1/commands", now.Add(time.Minute)) {
+		t.Error("the topic should be allowed after the TTL")
+	}
+	if denied, _ := a.stats(); denied != 0 {
+		t.Errorf("the expired topic should be removed: %v", denied)
+	}
+
+	if a, err := parseACLCache(data.Map{}); err != nil || a != nil {
+		t.Error("the cache should be disabled by default")
+	}
+	if _, err := parseACLCache(data.Map{"acl_cache_ttl": data.String("-1s")}); err == nil {
+		t.Error("a negative TTL should be rejected")
+	}
+}
+
+func TestNewSinkACLCacheRequiresV5(t *testing.T) {
+	_, err := NewSink(core.NewContext(nil), &bql.IOParams{}, data.Map{
+		"acl_cache_ttl": data.String("1m"),
+	})
+	if err == nil || !strings.Contains(err.Error(), "protocol_version") {
+		t.Errorf("acl_cache_ttl should require MQTT 5: %v", err)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	cases := []struct {
+		err          error
+		unauthorized bool
+	}{
+		{&v5ReasonError{code: v5NotAuthorized, err: errors.New("not authorized")}, true},
+		{&v5ReasonError{code: v5TopicNameInvalid, err: errors.New("topic name invalid")}, true},
+		{&v5ReasonError{code: v5QuotaExceeded, err: errors.New("quota exceeded")}, false},
+		{errors.New("publishing a message to 'a' timed out after 1s"), false},
+		{errors.New("not connected"), false},
+	}
+	for _, c := range cases {
+		if unauthorized(c.err) != c.unauthorized {
+			t.Errorf("%v: unauthorized should be %v", c.err, c.unauthorized)
+		}
+	}
+}
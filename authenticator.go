@@ -0,0 +1,136 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// Authenticator performs MQTT 5 enhanced authentication, such as SCRAM, by
+// exchanging AUTH packets with the broker. An Authenticator is registered by
+// RegisterAuthenticator with the name of its authentication method, and it's
+// referred by the auth_method parameter of the source and the sink.
+type Authenticator interface {
+	// Start starts an exchange for a new connection. It returns the exchange
+	// and Authentication Data sent in CONNECT, which may be nil. It's called
+	// every time the client connects, so state of the exchange must be kept
+	// in the returned AuthExchange.
+	Start() (AuthExchange, []byte, error)
+}
+
+// AuthExchange is an exchange of AUTH packets on a connection.
+type AuthExchange interface {
+	// Continue returns Authentication Data replying to the one sent by the
+	// broker in AUTH. The connection is closed when it returns an error.
+	Continue(data []byte) ([]byte, error)
+
+	// Finish is called with Authentication Data of CONNACK when the broker
+	// accepts the connection, for example, to verify the final message of
+	// the broker. The connection is closed when it returns an error.
+	Finish(data []byte) error
+}
+
+var (
+	authenticatorsMutex sync.RWMutex
+	authenticators      = map[string]Authenticator{}
+)
+
+// RegisterAuthenticator registers an Authenticator with the name of its
+// authentication method such as "SCRAM-SHA-256". It fails when an
+// authenticator is already registered with the method.
+func RegisterAuthenticator(method string, a Authenticator) error {
+	authenticatorsMutex.Lock()
+	defer authenticatorsMutex.Unlock()
+
+	if _, ok := authenticators[method]; ok {
+		return fmt.Errorf("authenticator '%v' is already registered", method)
+	}
+	authenticators[method] = a
+	return nil
+}
+
+// MustRegisterAuthenticator is like RegisterAuthenticator but panics on
+// failure.
+func MustRegisterAuthenticator(method string, a Authenticator) {
+	if err := RegisterAuthenticator(method, a); err != nil {
+		panic(err)
+	}
+}
+
+func lookupAuthenticator(method string) (Authenticator, error) {
+	authenticatorsMutex.RLock()
+	defer authenticatorsMutex.RUnlock()
+
+	a, ok := authenticators[method]
+	if !ok {
+		return nil, fmt.Errorf("authenticator '%v' isn't registered", method)
+	}
+	return a, nil
+}
+
+// v5Auther adapts an AuthExchange to paho.golang. paho.golang doesn't let
+// the handler fail, so the connection is closed on an error, which is kept
+// to be returned instead of the error of the closed connection.
+type v5Auther struct {
+	method   string
+	exchange AuthExchange
+	conn     net.Conn
+
+	m   sync.Mutex
+	err error
+}
+
+// Authenticate replies to AUTH sent by the broker.
+func (a *v5Auther) Authenticate(p *paho.Auth) *paho.Auth {
+	var (
+		res []byte
+		err error
+	)
+	if p.Properties == nil || p.Properties.AuthMethod != a.method {
+		err = errors.New("the broker sent AUTH of another authentication method")
+	} else {
+		res, err = a.exchange.Continue(p.Properties.AuthData)
+	}
+	if err != nil {
+		a.fail(err)
+	}
+	return &paho.Auth{
+		ReasonCode: packets.AuthContinueAuthentication,
+		Properties: &paho.AuthProperties{
+			AuthMethod: a.method,
+			AuthData:   res,
+		},
+	}
+}
+
+// Authenticated is called when CONNACK is received. The exchange is
+// finished by finish since paho.golang doesn't pass CONNACK to it.
+func (a *v5Auther) Authenticated() {}
+
+// finish finishes the exchange with Authentication Data of CONNACK.
+func (a *v5Auther) finish(data []byte) error {
+	if err := a.exchange.Finish(data); err != nil {
+		return fmt.Errorf("authentication method '%v' failed: %v", a.method, err)
+	}
+	return nil
+}
+
+func (a *v5Auther) fail(err error) {
+	a.m.Lock()
+	if a.err == nil {
+		a.err = fmt.Errorf("authentication method '%v' failed: %v", a.method, err)
+	}
+	a.m.Unlock()
+	a.conn.Close()
+}
+
+// error returns the error with which the exchange failed if any.
+func (a *v5Auther) error() error {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.err
+}
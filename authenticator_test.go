@@ -0,0 +1,101 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// testAuthenticator exchanges fixed messages like SCRAM.
+type testAuthenticator struct {
+	finished chan []byte
+}
+
+func (a *testAuthenticator) Start() (AuthExchange, []byte, error) {
+	return &testAuthExchange{finished: a.finished}, []byte("client-first"), nil
+}
+
+type testAuthExchange struct {
+	finished chan []byte
+}
+
+func (e *testAuthExchange) Continue(data []byte) ([]byte, error) {
+	if string(data) != "server-first" {
+		return nil, errors.New("wrong challenge")
+	}
+	return []byte("client-final"), nil
+}
+
+func (e *testAuthExchange) Finish(data []byte) error {
+	e.finished <- data
+	if string(data) != "server-final" {
+		return errors.New("wrong final message")
+	}
+	return nil
+}
+
+func TestAuthenticator(t *testing.T) {
+	a := &testAuthenticator{finished: make(chan []byte, 2)}
+	if err := RegisterAuthenticator("TEST-SCRAM", a); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterAuthenticator("TEST-SCRAM", a); err == nil {
+		t.Error("an authenticator shouldn't be registered twice")
+	}
+
+	b := startFakeV5Broker(t, &fakeV5Broker{
+		challenge:  []byte("server-first"),
+		properties: &packets.Properties{AuthMethod: "TEST-SCRAM", AuthData: []byte("server-final")},
+	})
+	defer b.l.Close()
+
+	ctx := core.NewContext(nil)
+	snk, err := NewSink(ctx, &bql.IOParams{}, data.Map{
+		"broker":           data.String(b.url()),
+		"protocol_version": data.String("5"),
+		"auth_method":      data.String("TEST-SCRAM"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snk.Close(ctx)
+
+	connect := b.next(t, packets.CONNECT).Content.(*packets.Connect)
+	if p := connect.Properties; p.AuthMethod != "TEST-SCRAM" || string(p.AuthData) != "client-first" {
+		t.Errorf("auth_method should be sent in CONNECT: %v, %q", p.AuthMethod, p.AuthData)
+	}
+	auth := b.next(t, packets.AUTH).Content.(*packets.Auth)
+	if auth.ReasonCode != packets.AuthContinueAuthentication || string(auth.Properties.AuthData) != "client-final" {
+		t.Errorf("the client should reply to the challenge: %v", auth)
+	}
+	if d := <-a.finished; string(d) != "server-final" {
+		t.Errorf("the exchange should be finished with CONNACK: %q", d)
+	}
+
+	// the final message of the broker is rejected
+	b2 := startFakeV5Broker(t, &fakeV5Broker{
+		challenge:  []byte("server-first"),
+		properties: &packets.Properties{AuthMethod: "TEST-SCRAM", AuthData: []byte("forged")},
+	})
+	defer b2.l.Close()
+	if _, err := NewSink(ctx, &bql.IOParams{}, data.Map{
+		"broker":           data.String(b2.url()),
+		"protocol_version": data.String("5"),
+		"auth_method":      data.String("TEST-SCRAM"),
+	}); err == nil {
+		t.Error("the sink shouldn't connect when the exchange fails")
+	}
+
+	for _, params := range []data.Map{
+		{"auth_method": data.String("TEST-SCRAM")},
+		{"auth_method": data.String("NOT-REGISTERED"), "protocol_version": data.String("5")},
+	} {
+		if _, err := NewSink(ctx, &bql.IOParams{}, params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package mqtt
+
+import (
+	"fmt"
+	"sync"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+)
+
+// TopicAction is an operation on a topic authorized by an Authorizer.
+type TopicAction int
+
+const (
+	// ActionSubscribe is subscribing to a topic filter by a source.
+	ActionSubscribe TopicAction = iota
+
+	// ActionPublish is publishing a message to a topic by a sink.
+	ActionPublish
+)
+
+func (a TopicAction) String() string {
+	switch a {
+	case ActionSubscribe:
+		return "subscribe"
+	case ActionPublish:
+		return "publish"
+	default:
+		return "unknown"
+	}
+}
+
+// Authorizer allows programs embedding the plugin to veto subscriptions and
+// publishes, for example, by consulting their own ACL service of tenants. It's
+// called before the source subscribes to the topic and before the sink
+// publishes each message, so denied operations never reach the broker. An
+// Authorizer is registered by RegisterAuthorizer and referred by the
+// authorizer parameter of the source and the sink.
+type Authorizer interface {
+	// Authorize returns an error when the action on the topic isn't allowed.
+	// It's called concurrently and should return quickly since publishes of
+	// the sink wait for it.
+	Authorize(ctx *core.Context, action TopicAction, topic string) error
+}
+
+// AuthorizerFunc is a function implementing Authorizer.
+type AuthorizerFunc func(ctx *core.Context, action TopicAction, topic string) error
+
+// Authorize calls the function.
+func (f AuthorizerFunc) Authorize(ctx *core.Context, action TopicAction, topic string) error {
+	return f(ctx, action, topic)
+}
+
+var (
+	authorizersMutex sync.RWMutex
+	authorizers      = map[string]Authorizer{}
+)
+
+// RegisterAuthorizer registers an Authorizer with the name. It fails when an
+// authorizer is already registered with the name.
+func RegisterAuthorizer(name string, a Authorizer) error {
+	authorizersMutex.Lock()
+	defer authorizersMutex.Unlock()
+
+	if _, ok := authorizers[name]; ok {
+		return fmt.Errorf("authorizer '%v' is already registered", name)
+	}
+	authorizers[name] = a
+	return nil
+}
+
+// MustRegisterAuthorizer is like RegisterAuthorizer but panics on failure.
+func MustRegisterAuthorizer(name string, a Authorizer) {
+	if err := RegisterAuthorizer(name, a); err != nil {
+		panic(err)
+	}
+}
+
+func lookupAuthorizer(name string) (Authorizer, error) {
+	authorizersMutex.RLock()
+	defer authorizersMutex.RUnlock()
+
+	a, ok := authorizers[name]
+	if !ok {
+		return nil, fmt.Errorf("authorizer '%v' isn't registered", name)
+	}
+	return a, nil
+}
+
+// authorize returns an error when the authorizer denies the action. It
+// allows everything when the authorizer is nil.
+func authorize(ctx *core.Context, a Authorizer, action TopicAction, topic string) error {
+	if a == nil {
+		return nil
+	}
+	if err := a.Authorize(ctx, action, topic); err != nil {
+		return fmt.Errorf("%v '%v' isn't authorized: %v", action, topic, err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package mqtt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+)
+
+func TestAuthorizer(t *testing.T) {
+	a := AuthorizerFunc(func(ctx *core.Context, action TopicAction, topic string) error {
+		if action == ActionPublish && strings.HasPrefix(topic, "tenants/other/") {
+			return errors.New("another tenant's topic")
+		}
+		return nil
+	})
+	if err := RegisterAuthorizer("test_tenant", a); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterAuthorizer("test_tenant", a); err == nil {
+		t.Error("an authorizer cannot be registered twice")
+	}
+	if _, err := lookupAuthorizer("test_undefined"); err == nil {
+		t.Error("an unregistered authorizer shouldn't be found")
+	}
+
+	r, err := lookupAuthorizer("test_tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := core.NewContext(nil)
+	if err := authorize(ctx, r, ActionPublish, "tenants/me/commands"); err != nil {
+		t.Error(err)
+	}
+	if err := authorize(ctx, r, ActionSubscribe, "tenants/other/#"); err != nil {
+		t.Error(err)
+	}
+	if err := authorize(ctx, r, ActionPublish, "tenants/other/commands"); err == nil {
+		t.Error("the publish should be denied")
+	}
+	if err := authorize(ctx, nil, ActionPublish, "tenants/other/commands"); err != nil {
+		t.Error("everything should be allowed without an authorizer")
+	}
+}
@@ -0,0 +1,182 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// batchConfig has parameters of micro-batching tuples written by a source.
+type batchConfig struct {
+	// size is the maximum number of tuples in a batch.
+	size int
+
+	// interval is the maximum time a tuple waits in a batch.
+	interval time.Duration
+
+	// array is true when a batch is written as a single tuple having an
+	// array of messages. Otherwise, tuples in a batch are written one after
+	// another.
+	array bool
+}
+
+// parseBatchConfig parses batch_size, batch_interval, and batch_mode
+// parameters. It returns nil when batch_size isn't given or 0.
+func parseBatchConfig(params data.Map) (*batchConfig, error) {
+	v, ok := params["batch_size"]
+	if !ok {
+		for _, k := range []string{"batch_interval", "batch_mode"} {
+			if _, ok := params[k]; ok {
+				return nil, errors.New(k + " requires batch_size")
+			}
+		}
+		return nil, nil
+	}
+
+	c := &batchConfig{
+		interval: 100 * time.Millisecond,
+	}
+	size, err := data.AsInt(v)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, errors.New("batch_size must not be negative")
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	c.size = int(size)
+
+	if v, ok := params["batch_interval"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, errors.New("batch_interval must be positive")
+		}
+		c.interval = d
+	}
+
+	if v, ok := params["batch_mode"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		switch str {
+		case "array":
+			c.array = true
+		case "writes":
+		default:
+			return nil, fmt.Errorf("unknown batch_mode: %v", str)
+		}
+	}
+	return c, nil
+}
+
+// newWriter creates a batchWriter writing batches to w. The writer must be
+// closed to flush the last batch.
+func (c *batchConfig) newWriter(ctx *core.Context, w core.Writer) *batchWriter {
+	b := &batchWriter{
+		config: c,
+		ctx:    ctx,
+		w:      w,
+		tuples: make([]*core.Tuple, 0, c.size),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// batchWriter is a core.Writer grouping tuples into batches. A batch is
+// flushed when it has batch_size tuples or batch_interval has passed.
+type batchWriter struct {
+	config *batchConfig
+	ctx    *core.Context
+	w      core.Writer
+
+	// m also serializes flushes so that batches are written in order.
+	m      sync.Mutex
+	tuples []*core.Tuple
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (b *batchWriter) Write(ctx *core.Context, t *core.Tuple) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.tuples = append(b.tuples, t)
+	if len(b.tuples) < b.config.size {
+		return nil
+	}
+	return b.flush()
+}
+
+func (b *batchWriter) run() {
+	defer close(b.done)
+	t := time.NewTicker(b.config.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-t.C:
+			b.m.Lock()
+			err := b.flush()
+			b.m.Unlock()
+			if err != nil {
+				b.ctx.ErrLog(err).Error("Cannot write a batch of tuples")
+			}
+		}
+	}
+}
+
+// flush writes the current batch. The caller must hold the lock.
+func (b *batchWriter) flush() error {
+	if len(b.tuples) == 0 {
+		return nil
+	}
+	defer func() {
+		b.tuples = b.tuples[:0]
+	}()
+
+	if !b.config.array {
+		var err error
+		for _, t := range b.tuples {
+			if e := b.w.Write(b.ctx, t); e != nil {
+				err = e
+			}
+		}
+		return err
+	}
+
+	msgs := make(data.Array, len(b.tuples))
+	for i, t := range b.tuples {
+		msgs[i] = t.Data
+	}
+	t := core.NewTuple(data.Map{
+		"messages": msgs,
+		"count":    data.Int(len(msgs)),
+	})
+	t.Timestamp = b.tuples[0].Timestamp
+	return b.w.Write(b.ctx, t)
+}
+
+// close stops flushing batches periodically and writes the last batch.
+func (b *batchWriter) close() {
+	close(b.stop)
+	<-b.done
+
+	b.m.Lock()
+	defer b.m.Unlock()
+	if err := b.flush(); err != nil {
+		b.ctx.ErrLog(err).Error("Cannot write a batch of tuples")
+	}
+}
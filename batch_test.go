@@ -0,0 +1,103 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseBatchConfig(t *testing.T) {
+	cases := []struct {
+		params data.Map
+		ok     bool
+	}{
+		{data.Map{}, true},
+		{data.Map{"batch_size": data.Int(100)}, true},
+		{data.Map{"batch_size": data.Int(100), "batch_interval": data.String("1s"), "batch_mode": data.String("array")}, true},
+		{data.Map{"batch_size": data.Int(-1)}, false},
+		{data.Map{"batch_size": data.Int(100), "batch_interval": data.String("0s")}, false},
+		{data.Map{"batch_size": data.Int(100), "batch_mode": data.String("bulk")}, false},
+		{data.Map{"batch_interval": data.String("1s")}, false},
+	}
+	for _, c := range cases {
+		_, err := parseBatchConfig(c.params)
+		if c.ok && err != nil {
+			t.Errorf("%v: %v", c.params, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%v: should fail", c.params)
+		}
+	}
+}
+
+func TestBatchWriter(t *testing.T) {
+	ctx := core.NewContext(nil)
+
+	t.Run("writes", func(t *testing.T) {
+		w := &testWriter{}
+		b := (&batchConfig{size: 3, interval: time.Hour}).newWriter(ctx, w)
+		for i := 0; i < 4; i++ {
+			b.Write(ctx, core.NewTuple(data.Map{"i": data.Int(i)}))
+		}
+		if len(w.tuples) != 3 {
+			t.Errorf("a full batch should be written: %v", len(w.tuples))
+		}
+		b.close()
+		if len(w.tuples) != 4 {
+			t.Fatalf("the last batch should be written on close: %v", len(w.tuples))
+		}
+		for i, tu := range w.tuples {
+			if !data.Equal(tu.Data["i"], data.Int(i)) {
+				t.Errorf("tuples should be written in order: %v", tu.Data)
+			}
+		}
+	})
+
+	t.Run("array", func(t *testing.T) {
+		w := &testWriter{}
+		b := (&batchConfig{size: 100, interval: 10 * time.Millisecond, array: true}).newWriter(ctx, w)
+		defer b.close()
+		for i := 0; i < 2; i++ {
+			b.Write(ctx, core.NewTuple(data.Map{"i": data.Int(i)}))
+		}
+
+		// the batch is flushed by the interval
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			w.m.Lock()
+			n := len(w.tuples)
+			w.m.Unlock()
+			if n > 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("the batch should be flushed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		w.m.Lock()
+		defer w.m.Unlock()
+		expected := data.Map{
+			"messages": data.Array{data.Map{"i": data.Int(0)}, data.Map{"i": data.Int(1)}},
+			"count":    data.Int(2),
+		}
+		if len(w.tuples) != 1 || !data.Equal(expected, w.tuples[0].Data) {
+			t.Errorf("the batch should be a tuple: %v", w.tuples)
+		}
+	})
+}
+
+func TestNewSourceRejectsAckAfterWriteWithBatch(t *testing.T) {
+	_, err := NewSource(core.NewContext(nil), &bql.IOParams{}, data.Map{
+		"topic":           data.String("a"),
+		"qos":             data.Int(1),
+		"ack_after_write": data.Bool(true),
+		"batch_size":      data.Int(10),
+	})
+	if err == nil {
+		t.Error("ack_after_write shouldn't be used with batch_size")
+	}
+}
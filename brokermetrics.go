@@ -0,0 +1,190 @@
+package mqtt
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// brokerMetrics decodes well-known $SYS topics of Mosquitto and EMQX into
+// numeric fields, and emits a snapshot of the latest metrics of each broker
+// node at most once per interval. Since brokers publish $SYS topics
+// periodically, snapshots are emitted periodically as well.
+type brokerMetrics struct {
+	interval time.Duration
+
+	// now returns the current time. It's replaced in tests.
+	now func() time.Time
+
+	m     sync.Mutex
+	nodes map[string]*brokerNodeMetrics
+}
+
+// brokerNodeMetrics has the latest metrics of a broker node.
+type brokerNodeMetrics struct {
+	metrics data.Map
+	emitted time.Time
+}
+
+const (
+	sysTopicFilter               = "$SYS/#"
+	defaultBrokerMetricsInterval = 10 * time.Second
+	mosquittoSysPrefix           = "$SYS/broker/"
+	emqxSysPrefix                = "$SYS/brokers/"
+)
+
+// mosquittoMetrics is a map from $SYS topics of Mosquitto without
+// "$SYS/broker/" to fields.
+var mosquittoMetrics = map[string]string{
+	"clients/connected":           "clients_connected",
+	"clients/disconnected":        "clients_disconnected",
+	"clients/total":               "clients_total",
+	"clients/maximum":             "clients_maximum",
+	"messages/received":           "messages_received",
+	"messages/sent":               "messages_sent",
+	"messages/stored":             "messages_stored",
+	"store/messages/count":        "messages_stored",
+	"retained messages/count":     "retained_messages",
+	"subscriptions/count":         "subscriptions",
+	"bytes/received":              "bytes_received",
+	"bytes/sent":                  "bytes_sent",
+	"publish/messages/dropped":    "messages_dropped",
+	"heap/current":                "heap_bytes",
+	"load/messages/received/1min": "messages_received_1min",
+	"load/messages/sent/1min":     "messages_sent_1min",
+	"load/bytes/received/1min":    "bytes_received_1min",
+	"load/bytes/sent/1min":        "bytes_sent_1min",
+	"load/connections/1min":       "connections_1min",
+	"uptime":                      "uptime_seconds",
+	"version":                     "version",
+}
+
+// emqxMetrics is a map from $SYS topics of EMQX without
+// "$SYS/brokers/<node>/" to fields.
+var emqxMetrics = map[string]string{
+	"stats/connections/count":   "clients_connected",
+	"stats/connections/max":     "clients_maximum",
+	"stats/subscriptions/count": "subscriptions",
+	"stats/retained/count":      "retained_messages",
+	"metrics/messages/received": "messages_received",
+	"metrics/messages/sent":     "messages_sent",
+	"metrics/messages/dropped":  "messages_dropped",
+	"metrics/bytes/received":    "bytes_received",
+	"metrics/bytes/sent":        "bytes_sent",
+	"uptime":                    "uptime_seconds",
+	"version":                   "version",
+}
+
+func newBrokerMetrics(interval time.Duration) *brokerMetrics {
+	return &brokerMetrics{
+		interval: interval,
+		now:      time.Now,
+		nodes:    map[string]*brokerNodeMetrics{},
+	}
+}
+
+func (b *brokerMetrics) String() string {
+	return "broker_metrics"
+}
+
+func (b *brokerMetrics) decode(topic string, payload []byte) ([]data.Map, error) {
+	node, field, ok := brokerMetricField(topic)
+	if !ok || len(payload) == 0 {
+		return nil, nil
+	}
+	v := brokerMetricValue(field, string(payload))
+
+	b.m.Lock()
+	defer b.m.Unlock()
+	n, ok := b.nodes[node]
+	if !ok {
+		n = &brokerNodeMetrics{metrics: data.Map{}}
+		b.nodes[node] = n
+	}
+	n.metrics[field] = v
+
+	now := b.now()
+	if now.Sub(n.emitted) < b.interval {
+		return nil, nil
+	}
+	n.emitted = now
+	d := n.metrics.Copy()
+	d["timestamp"] = data.Timestamp(now)
+	if node != "" {
+		d["node"] = data.String(node)
+	}
+	return []data.Map{d}, nil
+}
+
+// brokerMetricField returns the node and the field of a $SYS topic. The node
+// is empty for Mosquitto. It returns false when the topic isn't a known
+// metric.
+func brokerMetricField(topic string) (node, field string, ok bool) {
+	if strings.HasPrefix(topic, mosquittoSysPrefix) {
+		field, ok = mosquittoMetrics[topic[len(mosquittoSysPrefix):]]
+		return "", field, ok
+	}
+	if strings.HasPrefix(topic, emqxSysPrefix) {
+		rest := topic[len(emqxSysPrefix):]
+		i := strings.Index(rest, "/")
+		if i <= 0 {
+			return "", "", false
+		}
+		field, ok = emqxMetrics[rest[i+1:]]
+		return rest[:i], field, ok
+	}
+	return "", "", false
+}
+
+// brokerMetricValue converts a payload into a number. Uptimes like
+// "3600 seconds" or "1 hours, 2 minutes, 3 seconds" are converted into
+// seconds. Payloads which aren't numbers, such as versions, are emitted as
+// strings.
+func brokerMetricValue(field, payload string) data.Value {
+	payload = strings.TrimSpace(payload)
+	if field == "uptime_seconds" {
+		if secs, ok := parseUptime(payload); ok {
+			return data.Int(secs)
+		}
+	}
+	if field != "version" {
+		if i, err := strconv.ParseInt(payload, 10, 64); err == nil {
+			return data.Int(i)
+		}
+		if f, err := strconv.ParseFloat(payload, 64); err == nil {
+			return data.Float(f)
+		}
+	}
+	return data.String(payload)
+}
+
+var uptimeUnits = map[string]int64{
+	"second": 1,
+	"minute": 60,
+	"hour":   60 * 60,
+	"day":    24 * 60 * 60,
+}
+
+// parseUptime parses uptimes consisting of pairs of numbers and units.
+func parseUptime(s string) (int64, bool) {
+	fields := strings.Fields(strings.Replace(s, ",", " ", -1))
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return 0, false
+	}
+	var secs int64
+	for i := 0; i < len(fields); i += 2 {
+		n, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		unit, ok := uptimeUnits[strings.TrimSuffix(fields[i+1], "s")]
+		if !ok {
+			return 0, false
+		}
+		secs += n * unit
+	}
+	return secs, true
+}
@@ -0,0 +1,110 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestBrokerMetricValue(t *testing.T) {
+	cases := []struct {
+		field    string
+		payload  string
+		expected data.Value
+	}{
+		{"clients_connected", "12", data.Int(12)},
+		{"messages_received_1min", " 1.50\n", data.Float(1.5)},
+		{"uptime_seconds", "3600 seconds", data.Int(3600)},
+		{"uptime_seconds", "1 days, 2 hours, 3 minutes, 4 seconds", data.Int(93784)},
+		{"uptime_seconds", "forever", data.String("forever")},
+		{"version", "5.0", data.String("5.0")},
+	}
+	for _, c := range cases {
+		if v := brokerMetricValue(c.field, c.payload); !data.Equal(c.expected, v) {
+			t.Errorf("%v %q: expected %v, actual %v", c.field, c.payload, c.expected, v)
+		}
+	}
+}
+
+func TestBrokerMetricsDecode(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	b := newBrokerMetrics(10 * time.Second)
+	b.now = func() time.Time { return now }
+
+	ds, err := b.decode("$SYS/broker/clients/connected", []byte("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := data.Map{
+		"timestamp":         data.Timestamp(now),
+		"clients_connected": data.Int(3),
+	}
+	if len(ds) != 1 || !data.Equal(expected, ds[0]) {
+		t.Errorf("expected %v, actual %v", expected, ds)
+	}
+
+	// metrics within the interval are only tracked
+	now = now.Add(5 * time.Second)
+	if ds, err := b.decode("$SYS/broker/uptime", []byte("60 seconds")); err != nil || ds != nil {
+		t.Errorf("the snapshot shouldn't be emitted within the interval: %v, %v", ds, err)
+	}
+	for _, topic := range []string{"$SYS/broker/unknown", "$SYS/brokers", "sensors/1"} {
+		if ds, err := b.decode(topic, []byte("1")); err != nil || ds != nil {
+			t.Errorf("%v shouldn't be emitted: %v, %v", topic, ds, err)
+		}
+	}
+
+	now = now.Add(5 * time.Second)
+	ds, err = b.decode("$SYS/broker/subscriptions/count", []byte("7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = data.Map{
+		"timestamp":         data.Timestamp(now),
+		"clients_connected": data.Int(3),
+		"uptime_seconds":    data.Int(60),
+		"subscriptions":     data.Int(7),
+	}
+	if len(ds) != 1 || !data.Equal(expected, ds[0]) {
+		t.Errorf("expected %v, actual %v", expected, ds)
+	}
+
+	// EMQX nodes have their own snapshots
+	ds, err = b.decode("$SYS/brokers/emqx@10.0.0.1/stats/connections/count", []byte("5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = data.Map{
+		"timestamp":         data.Timestamp(now),
+		"node":              data.String("emqx@10.0.0.1"),
+		"clients_connected": data.Int(5),
+	}
+	if len(ds) != 1 || !data.Equal(expected, ds[0]) {
+		t.Errorf("expected %v, actual %v", expected, ds)
+	}
+}
+
+func TestSourceBrokerMetrics(t *testing.T) {
+	ctx := core.NewContext(nil)
+	src, err := newSource(ctx, &bql.IOParams{}, data.Map{"convention": data.String("broker_metrics")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := src.Config()
+	if !data.Equal(c["topic"], data.String("$SYS/#")) || !data.Equal(c["metrics_interval"], data.String("10s")) {
+		t.Errorf("wrong config: %v", c)
+	}
+
+	for _, params := range []data.Map{
+		{"convention": data.String("broker_metrics"), "system_topics": data.String("drop")},
+		{"convention": data.String("broker_metrics"), "metrics_interval": data.String("-1s")},
+		{"topic": data.String("#"), "metrics_interval": data.String("1s")},
+	} {
+		if _, err := NewSource(ctx, &bql.IOParams{}, params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
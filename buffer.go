@@ -0,0 +1,530 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// MemoryBudget limits the total size of messages buffered in memory by
+// sources and sinks sharing it. Sources and sinks which don't refer to a
+// mqtt_memory_budget state share DefaultMemoryBudget.
+type MemoryBudget struct {
+	m     sync.Mutex
+	limit int64
+	used  int64
+}
+
+// DefaultMemoryBudget is the budget shared by all sources and sinks in the
+// process which don't have the memory_budget parameter. It's unlimited by
+// default. Programs embedding the plugin can limit it by SetLimit.
+var DefaultMemoryBudget = &MemoryBudget{}
+
+// NewMemoryBudget creates a new MemoryBudget state:
+//
+//	CREATE STATE mqtt_budget TYPE mqtt_memory_budget WITH limit = 104857600;
+//
+// The state has following required parameters:
+//
+//	* limit: the maximum total size of buffered messages in bytes, 0 means unlimited
+func NewMemoryBudget(ctx *core.Context, params data.Map) (core.SharedState, error) {
+	v, ok := params["limit"]
+	if !ok {
+		return nil, errors.New("limit parameter is missing")
+	}
+	l, err := data.AsInt(v)
+	if err != nil {
+		return nil, err
+	}
+	if l < 0 {
+		return nil, errors.New("limit must not be negative")
+	}
+	return &MemoryBudget{limit: l}, nil
+}
+
+// SetLimit changes the maximum total size of buffered messages in bytes.
+// 0 means unlimited. Messages already buffered are kept even if they exceed
+// the new limit.
+func (b *MemoryBudget) SetLimit(limit int64) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.limit = limit
+}
+
+// Limit returns the maximum total size of buffered messages in bytes.
+func (b *MemoryBudget) Limit() int64 {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.limit
+}
+
+// Used returns the total size of messages currently buffered in bytes.
+func (b *MemoryBudget) Used() int64 {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.used
+}
+
+func (b *MemoryBudget) reserve(n int64) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.limit > 0 && b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *MemoryBudget) release(n int64) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.used -= n
+}
+
+// Terminate terminates the state.
+func (b *MemoryBudget) Terminate(ctx *core.Context) error {
+	return nil
+}
+
+func lookupMemoryBudget(ctx *core.Context, name string) (*MemoryBudget, error) {
+	st, err := ctx.SharedStates.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := st.(*MemoryBudget)
+	if !ok {
+		return nil, fmt.Errorf("state '%v' isn't a mqtt_memory_budget", name)
+	}
+	return b, nil
+}
+
+// overflowPolicy decides what to do when a messageQueue is full.
+type overflowPolicy int
+
+const (
+	// dropNewest drops a message being added.
+	dropNewest overflowPolicy = iota
+
+	// dropOldest drops the oldest messages to make room for a new message.
+	dropOldest
+
+	// spill writes messages to a file until the buffer in memory has room.
+	spill
+
+	// block waits until the buffer has room. It's backpressure to the
+	// producer of messages.
+	block
+)
+
+func parseOverflowPolicy(s string) (overflowPolicy, error) {
+	switch s {
+	case "drop_newest":
+		return dropNewest, nil
+	case "drop_oldest":
+		return dropOldest, nil
+	case "spill":
+		return spill, nil
+	case "block":
+		return block, nil
+	default:
+		return 0, fmt.Errorf("unknown buffer policy: %v", s)
+	}
+}
+
+func (p overflowPolicy) String() string {
+	switch p {
+	case dropOldest:
+		return "drop_oldest"
+	case spill:
+		return "spill"
+	case block:
+		return "block"
+	default:
+		return "drop_newest"
+	}
+}
+
+// bufferConfig has parameters of a messageQueue.
+type bufferConfig struct {
+	size     int
+	policy   overflowPolicy
+	spillDir string
+	budget   *MemoryBudget
+}
+
+// parseBufferParams parses buffer_size, buffer_policy, spill_dir, and
+// memory_budget parameters. The size is 0 when buffering is disabled.
+func parseBufferParams(ctx *core.Context, params data.Map) (*bufferConfig, error) {
+	c := &bufferConfig{
+		size:   0,
+		policy: dropNewest,
+		budget: DefaultMemoryBudget,
+	}
+
+	if v, ok := params["buffer_size"]; ok {
+		n, err := data.AsInt(v)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errors.New("buffer_size must not be negative")
+		}
+		c.size = int(n)
+	}
+
+	if v, ok := params["buffer_policy"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		c.policy, err = parseOverflowPolicy(str)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if v, ok := params["spill_dir"]; ok {
+		if c.policy != spill {
+			return nil, errors.New("spill_dir requires the spill buffer policy")
+		}
+		d, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		c.spillDir = d
+	}
+
+	if v, ok := params["memory_budget"]; ok {
+		name, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		c.budget, err = lookupMemoryBudget(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *bufferConfig) newQueue() (*messageQueue, error) {
+	return newMessageQueue(c.size, c.budget, c.policy, c.spillDir)
+}
+
+// messageOverhead is the approximate size of a message excluding its topic
+// and payload.
+const messageOverhead = 64
+
+func (m *message) size() int64 {
+	return int64(len(m.topic) + len(m.broker) + len(m.payload) + messageOverhead)
+}
+
+// messageQueue buffers messages received by the source or to be published by
+// the sink. Its capacity is limited by both the number of messages and a
+// MemoryBudget. Messages exceeding the capacity are handled by the overflow
+// policy.
+type messageQueue struct {
+	m      sync.Mutex
+	cond   *sync.Cond
+	msgs   []*message
+	closed bool
+
+	// space is signaled when a message is removed so that push blocked by
+	// the block policy can retry.
+	space *sync.Cond
+
+	maxSize int
+	budget  *MemoryBudget
+	policy  overflowPolicy
+
+	// spill is only used with the spill policy. Once a message is spilled,
+	// all following messages are also spilled until the spill file gets
+	// empty so that the order of messages is preserved.
+	spill *spillFile
+
+	dropped int64
+}
+
+func newMessageQueue(maxSize int, budget *MemoryBudget, policy overflowPolicy, spillDir string) (*messageQueue, error) {
+	o := &messageQueue{
+		maxSize: maxSize,
+		budget:  budget,
+		policy:  policy,
+	}
+	o.cond = sync.NewCond(&o.m)
+	o.space = sync.NewCond(&o.m)
+	if policy == spill {
+		f, err := newSpillFile(spillDir)
+		if err != nil {
+			return nil, err
+		}
+		o.spill = f
+	}
+	return o, nil
+}
+
+// push adds a message to the queue. With the block policy, it waits while
+// the queue is full.
+func (o *messageQueue) push(m *message) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+	if o.closed {
+		return errors.New("the queue is already closed")
+	}
+	defer o.cond.Signal()
+	m.queuedAt = time.Now()
+
+	if o.spill != nil && o.spill.count > 0 {
+		return o.spill.write(m)
+	}
+
+	size := m.size()
+	for len(o.msgs) >= o.maxSize || !o.budget.reserve(size) {
+		switch o.policy {
+		case dropOldest:
+			if len(o.msgs) == 0 {
+				// The message itself is larger than the budget.
+				o.dropped++
+				return nil
+			}
+			o.budget.release(o.msgs[0].size())
+			o.msgs[0] = nil
+			o.msgs = o.msgs[1:]
+			o.dropped++
+
+		case spill:
+			return o.spill.write(m)
+
+		case block:
+			if len(o.msgs) == 0 {
+				// Nothing in the queue can make room for the message.
+				o.dropped++
+				return nil
+			}
+			o.space.Wait()
+			if o.closed {
+				return errors.New("the queue is already closed")
+			}
+
+		default:
+			o.dropped++
+			return nil
+		}
+	}
+	o.msgs = append(o.msgs, m)
+	return nil
+}
+
+// pop removes the oldest message from the queue. It blocks while the queue
+// is empty. It returns false when the queue is closed and empty. When it
+// fails to read a spilled message, it drops all spilled messages and returns
+// the error. The queue can still be used after the error.
+func (o *messageQueue) pop() (*message, bool, error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	for len(o.msgs) == 0 && (o.spill == nil || o.spill.count == 0) {
+		if o.closed {
+			return nil, false, nil
+		}
+		o.cond.Wait()
+	}
+
+	if len(o.msgs) > 0 {
+		m := o.msgs[0]
+		o.msgs[0] = nil
+		o.msgs = o.msgs[1:]
+		o.budget.release(m.size())
+		o.space.Signal()
+		return m, true, nil
+	}
+	m, err := o.spill.read()
+	if err != nil {
+		// The file is broken and remaining messages cannot be read.
+		o.dropped += int64(o.spill.count)
+		if e := o.spill.reset(); e != nil {
+			return nil, false, e
+		}
+		return nil, false, err
+	}
+	return m, true, nil
+}
+
+// close closes the queue. Messages remaining in the queue can still be
+// popped.
+func (o *messageQueue) close() {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.closed = true
+	o.cond.Broadcast()
+	o.space.Broadcast()
+}
+
+// stats returns the number of buffered messages including spilled ones and
+// the number of messages dropped so far.
+func (o *messageQueue) stats() (int, int64) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	n := len(o.msgs)
+	if o.spill != nil {
+		n += o.spill.count
+	}
+	return n, o.dropped
+}
+
+// discard drops all remaining messages and releases resources. It returns the
+// number of messages discarded.
+func (o *messageQueue) discard() (int, error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	n := len(o.msgs)
+	for _, m := range o.msgs {
+		o.budget.release(m.size())
+	}
+	o.msgs = nil
+	if o.spill != nil {
+		n += o.spill.count
+		if err := o.spill.remove(); err != nil {
+			return n, err
+		}
+		o.spill = nil
+	}
+	o.dropped += int64(n)
+	return n, nil
+}
+
+// spillFile is a FIFO queue of messages stored in a temporary file. The file
+// is truncated whenever all messages in it are read.
+type spillFile struct {
+	f        *os.File
+	readPos  int64
+	writePos int64
+	count    int
+}
+
+func newSpillFile(dir string) (*spillFile, error) {
+	f, err := ioutil.TempFile(dir, "sensorbee-mqtt-spill-")
+	if err != nil {
+		return nil, err
+	}
+	return &spillFile{f: f}, nil
+}
+
+// spillRecordOverhead is the size of a record in a spill file excluding the
+// topic, the broker, and the payload.
+const spillRecordOverhead = 30
+
+// write appends a message. The format of a record is:
+//
+//	topic length (uint32) | topic | qos (byte) | retained (byte) |
+//	queued time in Unix nanoseconds (int64) | broker length (uint32) |
+//	broker | generation (int64) | payload length (uint32) | payload
+func (s *spillFile) write(m *message) error {
+	b := make([]byte, 0, spillRecordOverhead+len(m.topic)+len(m.broker)+len(m.payload))
+	var l [4]byte
+	var ts [8]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(m.topic)))
+	b = append(b, l[:]...)
+	b = append(b, m.topic...)
+	retained := byte(0)
+	if m.retained {
+		retained = 1
+	}
+	b = append(b, m.qos, retained)
+	binary.BigEndian.PutUint64(ts[:], uint64(m.queuedAt.UnixNano()))
+	b = append(b, ts[:]...)
+	binary.BigEndian.PutUint32(l[:], uint32(len(m.broker)))
+	b = append(b, l[:]...)
+	b = append(b, m.broker...)
+	binary.BigEndian.PutUint64(ts[:], uint64(m.generation))
+	b = append(b, ts[:]...)
+	binary.BigEndian.PutUint32(l[:], uint32(len(m.payload)))
+	b = append(b, l[:]...)
+	b = append(b, m.payload...)
+
+	if _, err := s.f.WriteAt(b, s.writePos); err != nil {
+		return err
+	}
+	s.writePos += int64(len(b))
+	s.count++
+	return nil
+}
+
+// read removes the oldest message from the file.
+func (s *spillFile) read() (*message, error) {
+	r := io.NewSectionReader(s.f, s.readPos, s.writePos-s.readPos)
+	var l uint32
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+	topic := make([]byte, l)
+	if _, err := io.ReadFull(r, topic); err != nil {
+		return nil, err
+	}
+	var flags [2]byte
+	if _, err := io.ReadFull(r, flags[:]); err != nil {
+		return nil, err
+	}
+	var queuedAt int64
+	if err := binary.Read(r, binary.BigEndian, &queuedAt); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+	broker := make([]byte, l)
+	if _, err := io.ReadFull(r, broker); err != nil {
+		return nil, err
+	}
+	var generation int64
+	if err := binary.Read(r, binary.BigEndian, &generation); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, l)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	s.readPos += int64(spillRecordOverhead + len(topic) + len(broker) + len(payload))
+	s.count--
+	if s.count == 0 {
+		if err := s.reset(); err != nil {
+			return nil, err
+		}
+	}
+	return &message{
+		topic:      string(topic),
+		qos:        flags[0],
+		retained:   flags[1] != 0,
+		payload:    payload,
+		queuedAt:   time.Unix(0, queuedAt),
+		broker:     string(broker),
+		generation: generation,
+	}, nil
+}
+
+// reset removes all messages from the file.
+func (s *spillFile) reset() error {
+	s.readPos = 0
+	s.writePos = 0
+	s.count = 0
+	return s.f.Truncate(0)
+}
+
+// remove closes and removes the file.
+func (s *spillFile) remove() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(s.f.Name())
+}
@@ -0,0 +1,227 @@
+package mqtt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func pushMessages(t *testing.T, o *messageQueue, from, to int) {
+	for i := from; i < to; i++ {
+		if err := o.push(&message{topic: fmt.Sprint(i), qos: 1, retained: i%2 == 0, payload: []byte{byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func popTopics(t *testing.T, o *messageQueue) []string {
+	o.close()
+	var topics []string
+	for {
+		m, ok, err := o.pop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return topics
+		}
+		if m.qos != 1 || m.topic != fmt.Sprint(m.payload[0]) || m.retained != (m.payload[0]%2 == 0) {
+			t.Errorf("message %v is broken: %+v", m.topic, m)
+		}
+		topics = append(topics, m.topic)
+	}
+}
+
+func TestMessageQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensorbee-mqtt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	size := (&message{topic: "0", payload: []byte{0}}).size()
+	cases := []struct {
+		title    string
+		maxSize  int
+		limit    int64
+		policy   overflowPolicy
+		expected string
+		dropped  int64
+	}{
+		{"drop_newest by size", 3, 0, dropNewest, "[0 1 2]", 2},
+		{"drop_oldest by size", 3, 0, dropOldest, "[2 3 4]", 2},
+		{"drop_newest by budget", 10, 2 * size, dropNewest, "[0 1]", 3},
+		{"drop_oldest by budget", 10, 2 * size, dropOldest, "[3 4]", 3},
+		{"spill", 2, 0, spill, "[0 1 2 3 4]", 0},
+	}
+
+	for _, c := range cases {
+		budget := &MemoryBudget{limit: c.limit}
+		o, err := newMessageQueue(c.maxSize, budget, c.policy, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pushMessages(t, o, 0, 5)
+		if res := fmt.Sprint(popTopics(t, o)); res != c.expected {
+			t.Errorf("%v: expected %v, actual %v", c.title, c.expected, res)
+		}
+		if o.dropped != c.dropped {
+			t.Errorf("%v: %v messages should be dropped but %v were", c.title, c.dropped, o.dropped)
+		}
+		if budget.Used() != 0 {
+			t.Errorf("%v: budget isn't released: %v", c.title, budget.Used())
+		}
+		if _, err := o.discard(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if fs, err := ioutil.ReadDir(dir); err != nil {
+		t.Error(err)
+	} else if len(fs) != 0 {
+		t.Errorf("spill files aren't removed: %v", len(fs))
+	}
+}
+
+func TestMessageQueueBlock(t *testing.T) {
+	size := (&message{topic: "0", payload: []byte{0}}).size()
+	o, err := newMessageQueue(2, &MemoryBudget{limit: 10 * size}, block, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pushMessages(t, o, 0, 2)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := o.push(&message{topic: "2", qos: 1, retained: true, payload: []byte{2}}); err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case <-done:
+		t.Fatal("push should block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if m, _, err := o.pop(); err != nil {
+		t.Fatal(err)
+	} else if m.topic != "0" {
+		t.Errorf("wrong message: %v", m.topic)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("push should be unblocked by pop")
+	}
+	if res := fmt.Sprint(popTopics(t, o)); res != "[1 2]" {
+		t.Errorf("wrong messages: %v", res)
+	}
+	if o.dropped != 0 {
+		t.Errorf("no message should be dropped: %v", o.dropped)
+	}
+
+	// A blocked push fails when the queue is closed.
+	o, err = newMessageQueue(1, DefaultMemoryBudget, block, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushMessages(t, o, 0, 1)
+	errs := make(chan error)
+	go func() {
+		errs <- o.push(&message{topic: "1"})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	o.close()
+	if err := <-errs; err == nil {
+		t.Error("push should fail after the queue is closed")
+	}
+	o.discard()
+}
+
+func TestMessageQueueSpillOrder(t *testing.T) {
+	o, err := newMessageQueue(2, &MemoryBudget{}, spill, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.discard()
+
+	pushMessages(t, o, 0, 4)
+	for _, e := range []string{"0", "1"} {
+		m, _, err := o.pop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.topic != e {
+			t.Errorf("expected %v, actual %v", e, m.topic)
+		}
+	}
+
+	// 4 and 5 must be spilled while 2 and 3 are in the spill file.
+	pushMessages(t, o, 4, 6)
+	m, _, err := o.pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.topic != "2" {
+		t.Errorf("expected 2, actual %v", m.topic)
+	}
+	pushMessages(t, o, 6, 7)
+	if res := fmt.Sprint(popTopics(t, o)); res != "[3 4 5 6]" {
+		t.Errorf("wrong order: %v", res)
+	}
+}
+
+func TestSpillFileKeepsMetadata(t *testing.T) {
+	f, err := newSpillFile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.remove()
+
+	queuedAt := time.Unix(1500000000, 123456789)
+	for i := 0; i < 2; i++ {
+		if err := f.write(&message{topic: "a", payload: []byte("b"), queuedAt: queuedAt,
+			broker: "ssl://broker:8883", generation: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		m, err := f.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !m.queuedAt.Equal(queuedAt) {
+			t.Errorf("expected %v, actual %v", queuedAt, m.queuedAt)
+		}
+		if m.broker != "ssl://broker:8883" || m.generation != int64(i) || string(m.payload) != "b" {
+			t.Errorf("wrong message: %+v", m)
+		}
+	}
+}
+
+func TestParseBufferParams(t *testing.T) {
+	cases := []struct {
+		params data.Map
+		ok     bool
+	}{
+		{data.Map{}, true},
+		{data.Map{"buffer_size": data.Int(10), "buffer_policy": data.String("drop_oldest")}, true},
+		{data.Map{"buffer_size": data.Int(10), "buffer_policy": data.String("spill"), "spill_dir": data.String("/tmp")}, true},
+		{data.Map{"buffer_size": data.Int(-1)}, false},
+		{data.Map{"buffer_policy": data.String("block_forever")}, false},
+		{data.Map{"spill_dir": data.String("/tmp")}, false},
+	}
+	for _, c := range cases {
+		_, err := parseBufferParams(nil, c.params)
+		if c.ok && err != nil {
+			t.Errorf("%v should be accepted: %v", c.params, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%v should be rejected", c.params)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// parseCharset returns the encoding having the given label such as
+// "latin1" or "shift_jis". Labels are ones defined by the WHATWG Encoding
+// Standard, and they're case-insensitive. It returns nil for UTF-8 since
+// payloads don't have to be converted.
+func parseCharset(label string) (encoding.Encoding, error) {
+	e, err := htmlindex.Get(strings.TrimSpace(label))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset: %v", label)
+	}
+	if e == unicode.UTF8 {
+		return nil, nil
+	}
+	return e, nil
+}
+
+// charsetName returns the canonical name of the charset. nil means UTF-8.
+func charsetName(e encoding.Encoding) string {
+	if e == nil {
+		return "utf-8"
+	}
+	name, err := htmlindex.Name(e)
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
+
+// toUTF8 converts text encoded in the charset to UTF-8. Decoders aren't
+// shared since they aren't safe for concurrent use.
+func toUTF8(e encoding.Encoding, b []byte) ([]byte, error) {
+	return e.NewDecoder().Bytes(b)
+}
@@ -0,0 +1,77 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseCharset(t *testing.T) {
+	for _, l := range []string{"utf-8", "UTF8", "unicode-1-1-utf-8"} {
+		e, err := parseCharset(l)
+		if err != nil {
+			t.Errorf("%v: %v", l, err)
+		} else if e != nil {
+			t.Errorf("%v: UTF-8 shouldn't be converted", l)
+		}
+	}
+
+	cases := map[string]string{
+		"latin1":    "windows-1252",
+		"Shift_JIS": "shift_jis",
+		"sjis":      "shift_jis",
+	}
+	for l, name := range cases {
+		e, err := parseCharset(l)
+		if err != nil {
+			t.Errorf("%v: %v", l, err)
+			continue
+		}
+		if n := charsetName(e); n != name {
+			t.Errorf("%v: expected %v, actual %v", l, name, n)
+		}
+	}
+
+	if _, err := parseCharset("no-such-charset"); err == nil {
+		t.Error("an unknown charset should be rejected")
+	}
+}
+
+func TestSourceCharset(t *testing.T) {
+	sjis, err := parseCharset("shift_jis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	latin1, err := parseCharset("latin1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		source   *source
+		payload  []byte
+		expected data.Value
+	}{
+		{
+			&source{charset: latin1},
+			[]byte{'c', 'a', 'f', 0xe9},
+			data.String("café"),
+		},
+		{
+			&source{charset: sjis, format: jsonFormat},
+			// {"name":"温度"}
+			[]byte{'{', '"', 'n', 'a', 'm', 'e', '"', ':', '"', 0x89, 0xb7, 0x93, 0x78, '"', '}'},
+			data.Map{"name": data.String("温度")},
+		},
+	}
+	for _, c := range cases {
+		d, err := c.source.decode(nil, "a", c.payload)
+		if err != nil {
+			t.Errorf("%v: %v", c.expected, err)
+			continue
+		}
+		if !data.Equal(c.expected, d["payload"]) {
+			t.Errorf("expected %v, actual %v", c.expected, d["payload"])
+		}
+	}
+}
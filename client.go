@@ -0,0 +1,455 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/oauth2"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// clientConfig has parameters which are common to the source and the sink
+// to connect to a broker.
+type clientConfig struct {
+	broker   string
+	user     string
+	password string
+
+	// credentials overrides user and password, and provides TLS material
+	// if it isn't nil.
+	credentials *Credentials
+
+	// pins are SHA-256 fingerprints of the broker's certificate or public
+	// key. The certificate is verified by CA certificates in addition to
+	// pins unless verifyCA is false.
+	pins     [][]byte
+	verifyCA bool
+
+	// tokenSource provides OAuth2 access tokens passed as the password if it
+	// isn't nil.
+	tokenSource oauth2.TokenSource
+
+	// vault issues client certificates if it isn't nil.
+	vault *vaultPKI
+
+	// storeDir is the directory where in-flight QoS 1 and 2 messages of the
+	// sink are stored. They're stored in memory when it's empty. Only the sink
+	// accepts it.
+	storeDir string
+
+	// greengrass finds a local Greengrass core to connect to instead of the
+	// broker if it isn't nil. The broker is used when the discovery fails.
+	greengrass *greengrassDiscovery
+
+	// dialer establishes connections to brokers instead of
+	// paho.mqtt.golang if it isn't nil.
+	dialer Dialer
+
+	// authorizer vetoes subscriptions and publishes if it isn't nil.
+	authorizer Authorizer
+
+	// authenticator performs enhanced authentication with the method
+	// authMethod if it isn't nil. It's only used with MQTT 5.
+	authMethod    string
+	authenticator Authenticator
+
+	// tracer creates spans around handled and published messages if it
+	// isn't nil.
+	tracer Tracer
+
+	// logLevel is the minimum level of logs written by the node, and
+	// pahoLogLevel is the verbosity of internal logs of MQTT clients.
+	logLevel     logLevel
+	pahoLogLevel pahoLogLevel
+}
+
+func newClientConfig() clientConfig {
+	return clientConfig{
+		broker:   "tcp://127.0.0.1:1883",
+		user:     "",
+		password: "",
+		verifyCA: true,
+		logLevel: infoLevel,
+	}
+}
+
+// parseParams parses broker, user, password, password_file, credentials,
+// tls_pinned_sha256, tls_verify_ca, oauth2_*, vault_*, greengrass_*,
+// store_dir, dialer, authorizer, auth_method, tracer, log_level, and
+// paho_log_level parameters.
+func (c *clientConfig) parseParams(ctx *core.Context, params data.Map) error {
+	if v, ok := params["broker"]; ok {
+		b, err := data.AsString(v)
+		if err != nil {
+			return err
+		}
+		c.broker, err = adjustOldBrokerURL(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	if u, ok, err := parseUser(params); err != nil {
+		return err
+	} else if ok {
+		c.user = u
+	}
+
+	if p, ok, err := parsePassword(params); err != nil {
+		return err
+	} else if ok {
+		c.password = p
+	}
+
+	if v, ok := params["credentials"]; ok {
+		for _, k := range []string{"user", "password", "password_file"} {
+			if _, ok := params[k]; ok {
+				return fmt.Errorf("%v and credentials parameters cannot be specified at once", k)
+			}
+		}
+		name, err := data.AsString(v)
+		if err != nil {
+			return err
+		}
+		cred, err := lookupCredentials(ctx, name)
+		if err != nil {
+			return err
+		}
+		c.credentials = cred
+	}
+
+	if v, ok := params["tls_pinned_sha256"]; ok {
+		if !isTLSBroker(c.broker) {
+			return errors.New("tls_pinned_sha256 requires a broker URL using TLS")
+		}
+		pins, err := parsePins(v)
+		if err != nil {
+			return err
+		}
+		c.pins = pins
+	}
+
+	if v, ok := params["tls_verify_ca"]; ok {
+		b, err := data.AsBool(v)
+		if err != nil {
+			return err
+		}
+		if !b && c.pins == nil {
+			return errors.New("tls_verify_ca can be false only when tls_pinned_sha256 is given")
+		}
+		c.verifyCA = b
+	}
+
+	ts, err := newOAuth2TokenSource(params)
+	if err != nil {
+		return err
+	}
+	if ts != nil {
+		for _, k := range []string{"password", "password_file", "credentials"} {
+			if _, ok := params[k]; ok {
+				return fmt.Errorf("%v and oauth2_token_url parameters cannot be specified at once", k)
+			}
+		}
+		c.tokenSource = ts
+	}
+
+	vault, err := newVaultPKI(params)
+	if err != nil {
+		return err
+	}
+	if vault != nil {
+		if !isTLSBroker(c.broker) {
+			return errors.New("vault_addr requires a broker URL using TLS")
+		}
+		c.vault = vault
+	}
+
+	if v, ok := params["store_dir"]; ok {
+		dir, err := data.AsString(v)
+		if err != nil {
+			return err
+		}
+		if dir == "" {
+			return errors.New("store_dir must not be empty")
+		}
+		c.storeDir = dir
+	}
+
+	gg, err := newGreengrassDiscovery(params)
+	if err != nil {
+		return err
+	}
+	if gg != nil {
+		if !isTLSBroker(c.broker) {
+			return errors.New("greengrass_thing_name requires a broker URL using TLS")
+		}
+		c.greengrass = gg
+	}
+
+	if v, ok := params["dialer"]; ok {
+		name, err := data.AsString(v)
+		if err != nil {
+			return err
+		}
+		d, err := lookupDialer(name)
+		if err != nil {
+			return err
+		}
+		c.dialer = d
+	}
+
+	if v, ok := params["authorizer"]; ok {
+		name, err := data.AsString(v)
+		if err != nil {
+			return err
+		}
+		a, err := lookupAuthorizer(name)
+		if err != nil {
+			return err
+		}
+		c.authorizer = a
+	}
+
+	if v, ok := params["auth_method"]; ok {
+		method, err := data.AsString(v)
+		if err != nil {
+			return err
+		}
+		a, err := lookupAuthenticator(method)
+		if err != nil {
+			return err
+		}
+		c.authMethod = method
+		c.authenticator = a
+	}
+
+	if v, ok := params["tracer"]; ok {
+		name, err := data.AsString(v)
+		if err != nil {
+			return err
+		}
+		t, err := lookupTracer(name)
+		if err != nil {
+			return err
+		}
+		c.tracer = t
+	}
+
+	if v, ok := params["log_level"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return err
+		}
+		l, err := parseLogLevel(str)
+		if err != nil {
+			return err
+		}
+		c.logLevel = l
+	}
+
+	if v, ok := params["paho_log_level"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return err
+		}
+		l, err := parsePahoLogLevel(str)
+		if err != nil {
+			return err
+		}
+		c.pahoLogLevel = l
+	}
+	return nil
+}
+
+// config returns the effective connection parameters. Secrets are masked.
+func (c *clientConfig) config() data.Map {
+	m := data.Map{
+		"broker":            data.String(redactBroker(c.broker)),
+		"user":              data.String(c.user),
+		"password":          maskSecret(c.password),
+		"credentials":       data.Bool(c.credentials != nil),
+		"tls_pinned_sha256": data.Int(len(c.pins)),
+		"tls_verify_ca":     data.Bool(c.verifyCA),
+		"oauth2":            data.Bool(c.tokenSource != nil),
+		"store_dir":         data.String(c.storeDir),
+		"dialer":            data.Bool(c.dialer != nil),
+		"authorizer":        data.Bool(c.authorizer != nil),
+		"auth_method":       data.String(c.authMethod),
+		"tracer":            data.Bool(c.tracer != nil),
+		"log_level":         data.String(c.logLevel.String()),
+		"paho_log_level":    data.String(c.pahoLogLevel.String()),
+	}
+	if c.vault != nil {
+		m["vault"] = data.Map{
+			"url":         data.String(c.vault.url),
+			"token":       maskSecret(c.vault.token),
+			"common_name": data.String(c.vault.commonName),
+			"ttl":         data.String(c.vault.ttl),
+		}
+	}
+	if c.greengrass != nil {
+		m["greengrass_discovery_url"] = data.String(c.greengrass.url)
+	}
+	return m
+}
+
+// maskSecret hides a secret in configurations reported to users. An empty
+// secret is reported as it is so that users can see it isn't set.
+func maskSecret(s string) data.Value {
+	if s == "" {
+		return data.String("")
+	}
+	return data.String("********")
+}
+
+// redactBroker removes the user information from the broker URL so that
+// credentials embedded in it aren't logged or reported.
+func redactBroker(broker string) string {
+	u, err := url.Parse(broker)
+	if err != nil || u.User == nil {
+		return broker
+	}
+	u.User = nil
+	return u.String()
+}
+
+// parseUser parses the user parameter. It returns false when the parameter
+// isn't given.
+func parseUser(params data.Map) (string, bool, error) {
+	v, ok := params["user"]
+	if !ok {
+		return "", false, nil
+	}
+	u, err := data.AsString(v)
+	if err != nil {
+		return "", false, err
+	}
+	u, err = expandEnv(u)
+	if err != nil {
+		return "", false, err
+	}
+	return u, true, nil
+}
+
+// parsePassword parses password and password_file parameters. It returns
+// false when neither of them is given.
+func parsePassword(params data.Map) (string, bool, error) {
+	if v, ok := params["password"]; ok {
+		if _, ok := params["password_file"]; ok {
+			return "", false, errors.New("password and password_file parameters cannot be specified at once")
+		}
+		p, err := data.AsString(v)
+		if err != nil {
+			return "", false, err
+		}
+		p, err = expandEnv(p)
+		if err != nil {
+			return "", false, err
+		}
+		return p, true, nil
+	}
+
+	if v, ok := params["password_file"]; ok {
+		path, err := data.AsString(v)
+		if err != nil {
+			return "", false, err
+		}
+		p, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", false, err
+		}
+		// Editors usually add a newline at the end of a file.
+		return strings.TrimRight(string(p), "\r\n"), true, nil
+	}
+	return "", false, nil
+}
+
+// clientOptions returns options of a new client connecting to the broker. It
+// fails when TLS material cannot be obtained.
+func (c *clientConfig) clientOptions(ctx *core.Context) (*mqtt.ClientOptions, error) {
+	opts := mqtt.NewClientOptions()
+	if c.dialer != nil {
+		opts.SetCustomOpenConnectionFn(openConnectionFunc(c.dialer))
+	}
+	if c.user != "" {
+		opts.Username = c.user
+		opts.Password = c.password
+	}
+	var cfg *tls.Config
+	if cred := c.credentials; cred != nil {
+		opts.SetCredentialsProvider(cred.userPassword)
+		cfg = cred.tlsConfig()
+	}
+	if c.tokenSource != nil {
+		opts.SetCredentialsProvider(oauth2CredentialsProvider(ctx, c.user, c.tokenSource))
+	}
+	if c.vault != nil {
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if err := c.vault.apply(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if c.greengrass != nil {
+		brokers, pool, err := c.greengrass.discover(cfg)
+		if err == nil {
+			for _, b := range brokers {
+				opts.AddBroker(b)
+			}
+			// Local cores are verified by group CAs instead of pins.
+			if cfg == nil {
+				cfg = &tls.Config{}
+			} else {
+				cfg = cfg.Clone()
+			}
+			cfg.RootCAs = pool
+			opts.SetTLSConfig(cfg)
+			return opts, nil
+		}
+		ctx.ErrLog(err).WithField("broker", redactBroker(c.broker)).
+			Warn("Greengrass discovery failed, falling back to the broker")
+	}
+	opts.AddBroker(c.broker)
+	if c.pins != nil {
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		cfg.VerifyPeerCertificate = verifyPinnedCertificate(c.pins)
+		// VerifyPeerCertificate is still called when CA verification is
+		// skipped, so the certificate is verified only by pins.
+		cfg.InsecureSkipVerify = !c.verifyCA
+	}
+	if cfg != nil {
+		opts.SetTLSConfig(cfg)
+	}
+	return opts, nil
+}
+
+var envVarPattern = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// expandEnv replaces ${NAME} in the string with the value of the environment
+// variable NAME. It fails when the variable isn't set.
+func expandEnv(s string) (string, error) {
+	var err error
+	res := envVarPattern.ReplaceAllStringFunc(s, func(m string) string {
+		name := m[2 : len(m)-1]
+		v, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable '%v' isn't set", name)
+		}
+		return v
+	})
+	if err != nil {
+		return "", err
+	}
+	return res, nil
+}
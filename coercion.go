@@ -0,0 +1,225 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// coercion converts a field in decoded payloads into a type.
+type coercion struct {
+	typ data.TypeID
+
+	// format is the format of timestamps. It's "unix", "unix_ms", or a
+	// layout of time.Parse.
+	format string
+}
+
+// coercions has coercions of fields in decoded payloads.
+type coercions map[string]*coercion
+
+// parseCoercions parses the coercions parameter, which is a map from field
+// names to type names or maps having type and format.
+func parseCoercions(v data.Value) (coercions, error) {
+	m, err := data.AsMap(v)
+	if err != nil {
+		return nil, err
+	}
+
+	cs := coercions{}
+	for field, v := range m {
+		c, err := parseCoercion(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid coercion of '%v': %v", field, err)
+		}
+		cs[field] = c
+	}
+	return cs, nil
+}
+
+func parseCoercion(v data.Value) (*coercion, error) {
+	var typ string
+	c := &coercion{
+		format: time.RFC3339Nano,
+	}
+	if v.Type() == data.TypeMap {
+		spec, _ := data.AsMap(v)
+		for k, v := range spec {
+			var err error
+			switch k {
+			case "type":
+				typ, err = data.AsString(v)
+			case "format":
+				c.format, err = data.AsString(v)
+			default:
+				err = fmt.Errorf("unknown key '%v'", k)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if typ == "" {
+			return nil, errors.New("type is missing")
+		}
+	} else {
+		t, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		typ = t
+	}
+
+	switch typ {
+	case "int":
+		c.typ = data.TypeInt
+	case "float":
+		c.typ = data.TypeFloat
+	case "bool":
+		c.typ = data.TypeBool
+	case "string":
+		c.typ = data.TypeString
+	case "timestamp":
+		c.typ = data.TypeTimestamp
+	default:
+		return nil, fmt.Errorf("unsupported type: %v", typ)
+	}
+	return c, nil
+}
+
+// apply coerces fields in the payload, which must be a map. Fields which
+// don't exist or are null are ignored.
+func (cs coercions) apply(payload data.Value) error {
+	m, err := data.AsMap(payload)
+	if err != nil {
+		return errors.New("coercions can only be applied to a map")
+	}
+	for field, c := range cs {
+		v, ok := m[field]
+		if !ok || v.Type() == data.TypeNull {
+			continue
+		}
+		x, err := c.coerce(v)
+		if err != nil {
+			return fmt.Errorf("cannot coerce field '%v': %v", field, err)
+		}
+		m[field] = x
+	}
+	return nil
+}
+
+func (c *coercion) coerce(v data.Value) (data.Value, error) {
+	// Devices often send numbers as strings with surrounding spaces.
+	var str string
+	isString := v.Type() == data.TypeString
+	if isString {
+		s, _ := data.AsString(v)
+		str = strings.TrimSpace(s)
+	}
+
+	switch c.typ {
+	case data.TypeInt:
+		if isString {
+			if i, err := strconv.ParseInt(str, 10, 64); err == nil {
+				return data.Int(i), nil
+			}
+			f, err := strconv.ParseFloat(str, 64)
+			if err != nil {
+				return nil, err
+			}
+			return data.Int(int64(f)), nil
+		}
+		i, err := data.ToInt(v)
+		if err != nil {
+			return nil, err
+		}
+		return data.Int(i), nil
+
+	case data.TypeFloat:
+		if isString {
+			f, err := strconv.ParseFloat(str, 64)
+			if err != nil {
+				return nil, err
+			}
+			return data.Float(f), nil
+		}
+		f, err := data.ToFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		return data.Float(f), nil
+
+	case data.TypeBool:
+		if isString {
+			v = data.String(str)
+		}
+		b, err := data.ToBool(v)
+		if err != nil {
+			return nil, err
+		}
+		return data.Bool(b), nil
+
+	case data.TypeString:
+		s, err := data.ToString(v)
+		if err != nil {
+			return nil, err
+		}
+		return data.String(s), nil
+
+	case data.TypeTimestamp:
+		return c.coerceTimestamp(v, str, isString)
+	}
+	return nil, fmt.Errorf("unsupported type: %v", c.typ)
+}
+
+func (c *coercion) coerceTimestamp(v data.Value, str string, isString bool) (data.Value, error) {
+	switch c.format {
+	case "unix", "unix_ms":
+		unit := time.Second
+		if c.format == "unix_ms" {
+			unit = time.Millisecond
+		}
+
+		// Integers are converted exactly.
+		if isString {
+			if i, err := strconv.ParseInt(str, 10, 64); err == nil {
+				return data.Timestamp(time.Unix(0, i*int64(unit))), nil
+			}
+		} else if v.Type() == data.TypeInt {
+			i, _ := data.AsInt(v)
+			return data.Timestamp(time.Unix(0, i*int64(unit))), nil
+		}
+
+		var f float64
+		if isString {
+			x, err := strconv.ParseFloat(str, 64)
+			if err != nil {
+				return nil, err
+			}
+			f = x
+		} else {
+			x, err := data.ToFloat(v)
+			if err != nil {
+				return nil, err
+			}
+			f = x
+		}
+		return data.Timestamp(time.Unix(0, int64(f*float64(unit)))), nil
+
+	default:
+		if !isString {
+			if v.Type() == data.TypeTimestamp {
+				return v, nil
+			}
+			return nil, fmt.Errorf("a timestamp in '%v' format must be a string", c.format)
+		}
+		t, err := time.Parse(c.format, str)
+		if err != nil {
+			return nil, err
+		}
+		return data.Timestamp(t), nil
+	}
+}
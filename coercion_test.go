@@ -0,0 +1,67 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestCoercions(t *testing.T) {
+	cs, err := parseCoercions(data.Map{
+		"count":  data.String("int"),
+		"temp":   data.String("float"),
+		"on":     data.String("bool"),
+		"id":     data.String("string"),
+		"ts":     data.Map{"type": data.String("timestamp"), "format": data.String("unix_ms")},
+		"date":   data.Map{"type": data.String("timestamp"), "format": data.String("2006-01-02 15:04:05")},
+		"iso":    data.String("timestamp"),
+		"absent": data.String("int"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := data.Map{
+		"count": data.String(" 42 "),
+		"temp":  data.String("21.5"),
+		"on":    data.String("true"),
+		"id":    data.Int(7),
+		"ts":    data.Int(1500000000123),
+		"date":  data.String("2017-07-14 02:40:00"),
+		"iso":   data.String("2017-07-14T02:40:00Z"),
+		"null":  data.Null{},
+	}
+	if err := cs.apply(m); err != nil {
+		t.Fatal(err)
+	}
+	expected := data.Map{
+		"count": data.Int(42),
+		"temp":  data.Float(21.5),
+		"on":    data.Bool(true),
+		"id":    data.String("7"),
+		"ts":    data.Timestamp(time.Unix(1500000000, 123000000)),
+		"date":  data.Timestamp(time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)),
+		"iso":   data.Timestamp(time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)),
+		"null":  data.Null{},
+	}
+	for k, e := range expected {
+		if v := m[k]; !data.Equal(e, v) {
+			t.Errorf("%v: expected %v, actual %v", k, e, v)
+		}
+	}
+
+	if err := cs.apply(data.Map{"temp": data.String("warm")}); err == nil {
+		t.Error("an invalid number should be rejected")
+	}
+
+	for _, v := range []data.Value{
+		data.Map{"a": data.String("decimal")},
+		data.Map{"a": data.Map{"format": data.String("unix")}},
+		data.Map{"a": data.Int(1)},
+	} {
+		if _, err := parseCoercions(v); err == nil {
+			t.Errorf("%v should be rejected", v)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+var confirmPath = data.MustCompilePath("confirm")
+
+// commandGuard prevents a sink publishing to command topics from actuating
+// devices by mistake, for example, because of a buggy query.
+type commandGuard struct {
+	// allowlist has topic filters to which messages can be published. All
+	// topics are allowed when it's empty.
+	allowlist []string
+
+	// requireConfirm is true when tuples must have the confirm field being
+	// true.
+	requireConfirm bool
+
+	// window is the time within which a second tuple having the same topic
+	// and payload must arrive before the message is published. It's disabled
+	// when it's 0.
+	window time.Duration
+
+	m sync.Mutex
+
+	// pending has the time when the first tuple of each topic and payload
+	// arrived.
+	pending map[string]time.Time
+}
+
+// parseCommandGuard parses topic_allowlist, require_confirm, and
+// confirm_window parameters. It returns nil when none of them is given.
+func parseCommandGuard(params data.Map) (*commandGuard, error) {
+	g := &commandGuard{
+		pending: map[string]time.Time{},
+	}
+	given := false
+
+	if v, ok := params["topic_allowlist"]; ok {
+		a, err := data.AsArray(v)
+		if err != nil {
+			return nil, err
+		}
+		if len(a) == 0 {
+			return nil, errors.New("topic_allowlist must have at least one topic filter")
+		}
+		for _, e := range a {
+			f, err := data.AsString(e)
+			if err != nil {
+				return nil, err
+			}
+			if err := validateTopicFilter(f); err != nil {
+				return nil, fmt.Errorf("topic_allowlist has an invalid topic filter: %v", err)
+			}
+			g.allowlist = append(g.allowlist, f)
+		}
+		given = true
+	}
+
+	if v, ok := params["require_confirm"]; ok {
+		b, err := data.AsBool(v)
+		if err != nil {
+			return nil, err
+		}
+		g.requireConfirm = b
+		given = true
+	}
+
+	if v, ok := params["confirm_window"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d < 0 {
+			return nil, errors.New("confirm_window must not be negative")
+		}
+		g.window = d
+		given = true
+	}
+
+	if !given {
+		return nil, nil
+	}
+	return g, nil
+}
+
+// check returns true when the message can be published. It returns an error
+// when the tuple violates the guard, and false without an error when the
+// message waits for the second tuple.
+func (g *commandGuard) check(t *core.Tuple, m *message) (bool, error) {
+	if len(g.allowlist) > 0 && !g.allowed(m.topic) {
+		return false, fmt.Errorf("topic '%v' isn't in topic_allowlist", m.topic)
+	}
+
+	if g.requireConfirm {
+		v, err := t.Data.Get(confirmPath)
+		if err != nil {
+			return false, errors.New("the tuple doesn't have the confirm field")
+		}
+		if b, err := data.AsBool(v); err != nil || !b {
+			return false, errors.New("the confirm field of the tuple isn't true")
+		}
+	}
+
+	if g.window == 0 {
+		return true, nil
+	}
+	return g.confirm(m, time.Now()), nil
+}
+
+func (g *commandGuard) allowed(topic string) bool {
+	for _, f := range g.allowlist {
+		if topicMatches(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// confirm returns true when the same message arrived within the window
+// before now. Otherwise, the message is recorded as pending.
+func (g *commandGuard) confirm(m *message, now time.Time) bool {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	for k, first := range g.pending {
+		if now.Sub(first) > g.window {
+			delete(g.pending, k)
+		}
+	}
+
+	// the topic cannot have a null character
+	k := m.topic + "\x00" + string(m.payload)
+	if _, ok := g.pending[k]; ok {
+		delete(g.pending, k)
+		return true
+	}
+	g.pending[k] = now
+	return false
+}
@@ -0,0 +1,89 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseCommandGuard(t *testing.T) {
+	if g, err := parseCommandGuard(data.Map{}); err != nil || g != nil {
+		t.Errorf("commandGuard shouldn't be created without parameters: %v, %v", g, err)
+	}
+
+	for _, params := range []data.Map{
+		{"topic_allowlist": data.Array{}},
+		{"topic_allowlist": data.Array{data.String("a/#/b")}},
+		{"topic_allowlist": data.String("a/b")},
+		{"confirm_window": data.String("-1s")},
+	} {
+		if _, err := parseCommandGuard(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
+
+func TestCommandGuard(t *testing.T) {
+	g, err := parseCommandGuard(data.Map{
+		"topic_allowlist": data.Array{data.String("devices/+/set")},
+		"require_confirm": data.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		topic   string
+		confirm data.Value
+		ok      bool
+	}{
+		{"devices/valve/set", data.Bool(true), true},
+		{"devices/valve/reset", data.Bool(true), false},
+		{"devices/valve/set", data.Bool(false), false},
+		{"devices/valve/set", data.String("true"), false},
+		{"devices/valve/set", nil, false},
+	}
+	for _, c := range cases {
+		d := data.Map{}
+		if c.confirm != nil {
+			d["confirm"] = c.confirm
+		}
+		ok, err := g.check(core.NewTuple(d), &message{topic: c.topic})
+		if c.ok != ok || c.ok != (err == nil) {
+			t.Errorf("%v, %v: expected %v, actual %v, %v", c.topic, c.confirm, c.ok, ok, err)
+		}
+	}
+}
+
+func TestCommandGuardConfirmWindow(t *testing.T) {
+	g := &commandGuard{
+		window:  time.Second,
+		pending: map[string]time.Time{},
+	}
+	now := time.Now()
+	open := &message{topic: "valve", payload: []byte("open")}
+	closeValve := &message{topic: "valve", payload: []byte("close")}
+
+	if g.confirm(open, now) {
+		t.Error("the first message shouldn't be published")
+	}
+	if g.confirm(closeValve, now.Add(100*time.Millisecond)) {
+		t.Error("a different message shouldn't confirm the first one")
+	}
+	if !g.confirm(open, now.Add(500*time.Millisecond)) {
+		t.Error("the second message within the window should be published")
+	}
+
+	// The pending message expires.
+	if g.confirm(open, now.Add(2*time.Second)) {
+		t.Error("the first message shouldn't be published")
+	}
+	if g.confirm(closeValve, now.Add(3500*time.Millisecond)) {
+		t.Error("the expired message shouldn't be confirmed")
+	}
+	if len(g.pending) != 1 {
+		t.Errorf("expired messages should be removed: %v", g.pending)
+	}
+}
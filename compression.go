@@ -0,0 +1,246 @@
+package mqtt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// compression compresses payloads in the sink and decompresses them in the
+// source.
+type compression interface {
+	compress(b []byte) ([]byte, error)
+	decompress(b []byte) ([]byte, error)
+
+	// close releases resources used by the compression.
+	close()
+}
+
+// newCompression creates a compression from compression and
+// compression_dictionary parameters. It returns nil when the compression
+// parameter isn't given.
+func newCompression(params data.Map) (compression, error) {
+	v, ok := params["compression"]
+	if !ok {
+		if _, ok := params["compression_dictionary"]; ok {
+			return nil, errors.New("compression_dictionary requires compression")
+		}
+		return nil, nil
+	}
+	name, err := data.AsString(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var dict []byte
+	if v, ok := params["compression_dictionary"]; ok {
+		path, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		dict, err = ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if dict != nil && name != "zstd" && name != "auto" {
+		return nil, fmt.Errorf("compression_dictionary isn't supported by %v", name)
+	}
+
+	switch name {
+	case "gzip":
+		return gzipCompression{}, nil
+	case "zlib":
+		return zlibCompression{}, nil
+	case "zstd":
+		return newZstdCompression(dict)
+	case "snappy":
+		return snappyCompression{}, nil
+	case "auto":
+		z, err := newZstdCompression(dict)
+		if err != nil {
+			return nil, err
+		}
+		return &autoCompression{zstd: z}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression: %v", name)
+	}
+}
+
+// gzipCompression is a compression using gzip.
+type gzipCompression struct{}
+
+func (gzipCompression) compress(b []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompression) decompress(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return readAllAndClose(r)
+}
+
+func (gzipCompression) close() {
+}
+
+// zlibCompression is a compression using zlib.
+type zlibCompression struct{}
+
+func (zlibCompression) compress(b []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	w := zlib.NewWriter(buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (zlibCompression) decompress(b []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return readAllAndClose(r)
+}
+
+func (zlibCompression) close() {
+}
+
+func readAllAndClose(r io.ReadCloser) ([]byte, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	if err := r.Close(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// snappyCompression is a compression using the snappy block format, which
+// doesn't have a header.
+type snappyCompression struct{}
+
+func (snappyCompression) compress(b []byte) ([]byte, error) {
+	return snappy.Encode(nil, b), nil
+}
+
+func (snappyCompression) decompress(b []byte) ([]byte, error) {
+	return snappy.Decode(nil, b)
+}
+
+func (snappyCompression) close() {
+}
+
+// autoCompression detects the algorithm of each payload by its magic bytes.
+// It supports gzip, zlib, and zstd. Payloads which don't start with any of
+// the magic bytes are returned as they are, so devices can send compressed
+// and uncompressed payloads to the same topic. Snappy blocks can't be detected
+// since they don't have a header. It can only decompress payloads.
+type autoCompression struct {
+	zstd *zstdCompression
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// isZlib returns true when b starts with a zlib header using deflate.
+func isZlib(b []byte) bool {
+	if len(b) < 2 || b[0]&0x0f != 8 || b[0]>>4 > 7 {
+		return false
+	}
+	return (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
+
+func (a *autoCompression) compress(b []byte) ([]byte, error) {
+	return nil, errors.New("compression \"auto\" cannot compress payloads")
+}
+
+func (a *autoCompression) decompress(b []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(b, gzipMagic):
+		return gzipCompression{}.decompress(b)
+	case bytes.HasPrefix(b, zstdMagic):
+		return a.zstd.decompress(b)
+	case isZlib(b):
+		return zlibCompression{}.decompress(b)
+	default:
+		return b, nil
+	}
+}
+
+func (a *autoCompression) close() {
+	a.zstd.close()
+}
+
+// zstdCompression is a compression using zstd. It optionally uses a trained
+// dictionary, which dramatically improves the compression ratio of small
+// messages similar to each other such as JSON telemetry. The source and the
+// sink must use the same dictionary.
+type zstdCompression struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func newZstdCompression(dict []byte) (*zstdCompression, error) {
+	var (
+		eopts []zstd.EOption
+		dopts []zstd.DOption
+	)
+	if dict != nil {
+		eopts = append(eopts, zstd.WithEncoderDict(dict))
+		dopts = append(dopts, zstd.WithDecoderDicts(dict))
+	}
+
+	enc, err := zstd.NewWriter(nil, eopts...)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil, dopts...)
+	if err != nil {
+		enc.Close()
+		return nil, err
+	}
+	return &zstdCompression{
+		enc: enc,
+		dec: dec,
+	}, nil
+}
+
+func (z *zstdCompression) compress(b []byte) ([]byte, error) {
+	return z.enc.EncodeAll(b, nil), nil
+}
+
+func (z *zstdCompression) decompress(b []byte) ([]byte, error) {
+	return z.dec.DecodeAll(b, nil)
+}
+
+func (z *zstdCompression) close() {
+	z.enc.Close()
+	z.dec.Close()
+}
@@ -0,0 +1,113 @@
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestCompression(t *testing.T) {
+	c, err := newCompression(data.Map{"compression": data.String("zstd")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	payload := []byte(`{"temperature":21.5,"humidity":40,"temperature_unit":"celsius"}`)
+	b, err := c.compress(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.decompress(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, res) {
+		t.Errorf("expected %v, actual %v", string(payload), string(res))
+	}
+
+	if _, err := c.decompress(payload); err == nil {
+		t.Error("decompressing uncompressed data should fail")
+	}
+}
+
+func TestCompressionAlgorithms(t *testing.T) {
+	payload := []byte(`{"temperature":21.5,"humidity":40,"temperature_unit":"celsius"}`)
+	for _, name := range []string{"gzip", "zlib", "zstd", "snappy"} {
+		c, err := newCompression(data.Map{"compression": data.String(name)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := c.compress(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := c.decompress(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload, res) {
+			t.Errorf("%v: expected %v, actual %v", name, string(payload), string(res))
+		}
+		c.close()
+	}
+}
+
+func TestAutoCompression(t *testing.T) {
+	a, err := newCompression(data.Map{"compression": data.String("auto")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+
+	payload := []byte(`{"temperature":21.5,"humidity":40,"temperature_unit":"celsius"}`)
+	for _, name := range []string{"gzip", "zlib", "zstd"} {
+		c, err := newCompression(data.Map{"compression": data.String(name)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := c.compress(payload)
+		c.close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := a.decompress(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload, res) {
+			t.Errorf("%v: expected %v, actual %v", name, string(payload), string(res))
+		}
+	}
+
+	res, err := a.decompress(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, res) {
+		t.Errorf("uncompressed payload should be returned as it is: %v", string(res))
+	}
+
+	if _, err := a.compress(payload); err == nil {
+		t.Error("auto shouldn't compress payloads")
+	}
+}
+
+func TestNewCompression(t *testing.T) {
+	if c, err := newCompression(data.Map{}); err != nil || c != nil {
+		t.Errorf("compression shouldn't be created without the parameter: %v, %v", c, err)
+	}
+
+	for _, params := range []data.Map{
+		{"compression": data.String("unknown")},
+		{"compression": data.Int(1)},
+		{"compression_dictionary": data.String("dict")},
+		{"compression": data.String("zstd"), "compression_dictionary": data.String("/no/such/file")},
+		{"compression": data.String("gzip"), "compression_dictionary": data.String("compression_test.go")},
+	} {
+		if _, err := newCompression(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
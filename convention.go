@@ -0,0 +1,117 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// convention decodes messages following a topic and payload convention of an
+// IoT ecosystem, such as Homie, into normalized tuples. It's called
+// concurrently when the source decodes messages in parallel.
+type convention interface {
+	// decode returns the data of tuples from a message. It returns nil when
+	// the message isn't emitted, for example, because it only describes a
+	// device. Empty payloads are also passed to it since some conventions
+	// use them to remove attributes.
+	decode(topic string, payload []byte) ([]data.Map, error)
+
+	// String returns the name of the convention.
+	String() string
+}
+
+// parseConvention parses the convention parameter. It returns nil when the
+// parameter isn't given or "none".
+func parseConvention(params data.Map) (convention, error) {
+	name := "none"
+	if v, ok := params["convention"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		name = str
+	}
+
+	prefix := defaultDiscoveryPrefix
+	if v, ok := params["discovery_prefix"]; ok {
+		if name != "home_assistant" {
+			return nil, errors.New("discovery_prefix requires convention to be \"home_assistant\"")
+		}
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateTopicName(str); err != nil {
+			return nil, fmt.Errorf("invalid discovery_prefix: %v", err)
+		}
+		prefix = str
+	}
+
+	baseTopic := defaultZigbee2MQTTBaseTopic
+	if v, ok := params["base_topic"]; ok {
+		if name != "zigbee2mqtt" {
+			return nil, errors.New("base_topic requires convention to be \"zigbee2mqtt\"")
+		}
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateTopicName(str); err != nil {
+			return nil, fmt.Errorf("invalid base_topic: %v", err)
+		}
+		baseTopic = str
+	}
+
+	enrichDevices := true
+	if v, ok := params["enrich_devices"]; ok {
+		if name != "zigbee2mqtt" {
+			return nil, errors.New("enrich_devices requires convention to be \"zigbee2mqtt\"")
+		}
+		b, err := data.AsBool(v)
+		if err != nil {
+			return nil, err
+		}
+		enrichDevices = b
+	}
+
+	interval := defaultBrokerMetricsInterval
+	if v, ok := params["metrics_interval"]; ok {
+		if name != "broker_metrics" {
+			return nil, errors.New("metrics_interval requires convention to be \"broker_metrics\"")
+		}
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d < 0 {
+			return nil, errors.New("metrics_interval must not be negative")
+		}
+		interval = d
+	}
+
+	switch name {
+	case "none":
+		return nil, nil
+	case "homie":
+		return newHomie(), nil
+	case "home_assistant":
+		return newHomeAssistant(prefix), nil
+	case "tasmota":
+		return tasmota{}, nil
+	case "owntracks":
+		return ownTracks{}, nil
+	case "ttn":
+		return ttn{}, nil
+	case "hono":
+		return hono{}, nil
+	case "ngsi":
+		return ngsi{}, nil
+	case "broker_metrics":
+		return newBrokerMetrics(interval), nil
+	case "zigbee2mqtt":
+		return newZigbee2MQTT(baseTopic, enrichDevices), nil
+	default:
+		return nil, fmt.Errorf("unknown convention: %v", name)
+	}
+}
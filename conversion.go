@@ -0,0 +1,101 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// unitConversion converts a numeric field into value * multiply + offset and
+// renames it if rename isn't empty.
+type unitConversion struct {
+	multiply float64
+	offset   float64
+	rename   string
+
+	// numeric is true when multiply or offset is given. Values are only
+	// renamed when it's false.
+	numeric bool
+}
+
+// conversions has unitConversions of fields in decoded payloads.
+type conversions map[string]*unitConversion
+
+// parseConversions parses the conversions parameter, which is a map from
+// field names to maps having multiply, offset, and rename.
+func parseConversions(v data.Value) (conversions, error) {
+	m, err := data.AsMap(v)
+	if err != nil {
+		return nil, err
+	}
+
+	cs := conversions{}
+	for field, v := range m {
+		spec, err := data.AsMap(v)
+		if err != nil {
+			return nil, fmt.Errorf("conversion of '%v' must be a map: %v", field, err)
+		}
+		c := &unitConversion{
+			multiply: 1,
+		}
+		for k, v := range spec {
+			switch k {
+			case "multiply":
+				c.multiply, err = data.ToFloat(v)
+				c.numeric = true
+			case "offset":
+				c.offset, err = data.ToFloat(v)
+				c.numeric = true
+			case "rename":
+				c.rename, err = data.AsString(v)
+				if err == nil && c.rename == "" {
+					err = errors.New("rename must not be empty")
+				}
+			default:
+				err = fmt.Errorf("unknown key '%v'", k)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid conversion of '%v': %v", field, err)
+			}
+		}
+		cs[field] = c
+	}
+	return cs, nil
+}
+
+// apply converts fields in the payload, which must be a map. Fields which
+// don't exist or are null are ignored.
+func (cs conversions) apply(payload data.Value) error {
+	m, err := data.AsMap(payload)
+	if err != nil {
+		return errors.New("conversions can only be applied to a map")
+	}
+
+	// Converted values are set after all fields are read so that a renamed
+	// field isn't converted twice.
+	res := make(data.Map, len(cs))
+	for field, c := range cs {
+		v, ok := m[field]
+		if !ok || v.Type() == data.TypeNull {
+			continue
+		}
+		if c.numeric {
+			if t := v.Type(); t != data.TypeInt && t != data.TypeFloat {
+				return fmt.Errorf("field '%v' isn't a number: %v", field, v)
+			}
+			f, _ := data.ToFloat(v)
+			v = data.Float(f*c.multiply + c.offset)
+		}
+		name := field
+		if c.rename != "" {
+			name = c.rename
+			delete(m, field)
+		}
+		res[name] = v
+	}
+	for k, v := range res {
+		m[k] = v
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestConversions(t *testing.T) {
+	cs, err := parseConversions(data.Map{
+		"adc":    data.Map{"multiply": data.Float(0.001), "rename": data.String("volts")},
+		"temp_f": data.Map{"multiply": data.Float(5.0 / 9), "offset": data.Float(-160.0 / 9), "rename": data.String("temp_c")},
+		"id":     data.Map{"rename": data.String("device_id")},
+		"absent": data.Map{"multiply": data.Int(2)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := data.Map{
+		"adc":    data.Int(1500),
+		"temp_f": data.Float(212),
+		"id":     data.String("d1"),
+		"other":  data.Int(1),
+	}
+	if err := cs.apply(m); err != nil {
+		t.Fatal(err)
+	}
+	expected := data.Map{
+		"volts":     data.Float(1.5),
+		"temp_c":    data.Float(100),
+		"device_id": data.String("d1"),
+		"other":     data.Int(1),
+	}
+	if len(m) != len(expected) {
+		t.Fatalf("wrong fields: %v", m)
+	}
+	for k, e := range expected {
+		v, ok := m[k]
+		if !ok {
+			t.Errorf("%v is missing", k)
+			continue
+		}
+		if e.Type() == data.TypeFloat {
+			f, _ := data.AsFloat(v)
+			ef, _ := data.AsFloat(e)
+			if f-ef > 1e-9 || ef-f > 1e-9 {
+				t.Errorf("%v: expected %v, actual %v", k, e, v)
+			}
+		} else if !data.Equal(e, v) {
+			t.Errorf("%v: expected %v, actual %v", k, e, v)
+		}
+	}
+
+	if err := cs.apply(data.Map{"adc": data.String("1500")}); err == nil {
+		t.Error("a string shouldn't be converted")
+	}
+	if err := cs.apply(data.Blob("raw")); err == nil {
+		t.Error("conversions shouldn't be applied to a blob")
+	}
+
+	for _, v := range []data.Value{
+		data.Map{"a": data.Float(1)},
+		data.Map{"a": data.Map{"scale": data.Float(1)}},
+		data.Map{"a": data.Map{"rename": data.String("")}},
+		data.Map{"a": data.Map{"multiply": data.String("x")}},
+	} {
+		if _, err := parseConversions(v); err == nil {
+			t.Errorf("%v should be rejected", v)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// Credentials is a shared state holding credentials used to connect to
+// brokers. Sources and sinks refer to it by the credentials parameter so that
+// several of them can share the same credentials, which can be rotated at
+// once by UPDATE STATE.
+type Credentials struct {
+	m        sync.RWMutex
+	user     string
+	password string
+	files    tlsFiles
+	tls      *tls.Config
+}
+
+// NewCredentials creates a new Credentials state:
+//
+//	CREATE STATE mqtt_creds TYPE mqtt_credentials
+//	    WITH user = "sensorbee", password_file = "/etc/sensorbee/mqtt_password";
+//
+// The state has following optional parameters:
+//
+//	* user: the user name to be connected (default: "")
+//	* password: the password of the user (default: "")
+//	* password_file: the path to a file containing the password (default: "")
+//	* tls_ca_file: the path to a PEM file having CA certificates to verify brokers (default: "")
+//	* tls_cert_file: the path to a PEM file having a client certificate (default: "")
+//	* tls_key_file: the path to a PEM file having the private key of the client certificate (default: "")
+//
+// ${NAME} in user and password is replaced with the value of the environment
+// variable NAME. TLS material is only used when the broker URL has a scheme
+// using TLS such as ssl://.
+func NewCredentials(ctx *core.Context, params data.Map) (core.SharedState, error) {
+	c := &Credentials{}
+	if err := c.Update(ctx, params); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Update updates credentials. It accepts the same parameters as
+// NewCredentials. Credentials which aren't given as parameters are kept as
+// they are. Sources and sinks use new credentials from their next connection.
+func (c *Credentials) Update(ctx *core.Context, params data.Map) error {
+	user, hasUser, err := parseUser(params)
+	if err != nil {
+		return err
+	}
+	password, hasPassword, err := parsePassword(params)
+	if err != nil {
+		return err
+	}
+
+	c.m.RLock()
+	files := c.files
+	c.m.RUnlock()
+	for k, f := range map[string]*string{
+		"tls_ca_file":   &files.caFile,
+		"tls_cert_file": &files.certFile,
+		"tls_key_file":  &files.keyFile,
+	} {
+		if v, ok := params[k]; ok {
+			path, err := data.AsString(v)
+			if err != nil {
+				return err
+			}
+			*f = path
+		}
+	}
+	cfg, err := files.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if hasUser {
+		c.user = user
+	}
+	if hasPassword {
+		c.password = password
+	}
+	c.files = files
+	c.tls = cfg
+	return nil
+}
+
+// userPassword returns the current user and password. It can be used as
+// mqtt.CredentialsProvider.
+func (c *Credentials) userPassword() (string, string) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.user, c.password
+}
+
+// tlsConfig returns a copy of the current TLS configuration. It returns nil
+// when no TLS material is given.
+func (c *Credentials) tlsConfig() *tls.Config {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if c.tls == nil {
+		return nil
+	}
+	return c.tls.Clone()
+}
+
+// Terminate terminates the state.
+func (c *Credentials) Terminate(ctx *core.Context) error {
+	return nil
+}
+
+func lookupCredentials(ctx *core.Context, name string) (*Credentials, error) {
+	st, err := ctx.SharedStates.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := st.(*Credentials)
+	if !ok {
+		return nil, fmt.Errorf("state '%v' isn't a mqtt_credentials", name)
+	}
+	return c, nil
+}
@@ -0,0 +1,44 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestCredentials(t *testing.T) {
+	st, err := NewCredentials(nil, data.Map{
+		"user":     data.String("user"),
+		"password": data.String("pass1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := st.(*Credentials)
+	if u, p := c.userPassword(); u != "user" || p != "pass1" {
+		t.Errorf("wrong credentials: %v, %v", u, p)
+	}
+	if cfg := c.tlsConfig(); cfg != nil {
+		t.Error("TLS configuration shouldn't be created without TLS material")
+	}
+
+	if err := c.Update(nil, data.Map{"password": data.String("pass2")}); err != nil {
+		t.Fatal(err)
+	}
+	if u, p := c.userPassword(); u != "user" || p != "pass2" {
+		t.Errorf("only the password should be updated: %v, %v", u, p)
+	}
+
+	for _, params := range []data.Map{
+		{"password": data.String("a"), "password_file": data.String("b")},
+		{"tls_ca_file": data.String("/no/such/file")},
+		{"tls_cert_file": data.String("/no/such/file")},
+	} {
+		if err := c.Update(nil, params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+	if u, p := c.userPassword(); u != "user" || p != "pass2" {
+		t.Errorf("failed updates shouldn't change credentials: %v, %v", u, p)
+	}
+}
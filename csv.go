@@ -0,0 +1,129 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// csvConfig has parameters of decoding CSV payloads. Each row of a payload is
+// emitted as a tuple.
+type csvConfig struct {
+	delimiter rune
+
+	// header is true when the first row of each payload has column names.
+	header bool
+
+	// columns are names of columns. They override the header row if it's
+	// given. Rows are emitted as arrays when it's empty and header is false.
+	columns []string
+}
+
+// parseCSVConfig parses csv_delimiter, csv_header, and csv_columns
+// parameters. It returns nil when the format isn't CSV.
+func parseCSVConfig(params data.Map, f payloadFormat) (*csvConfig, error) {
+	if f != csvFormat {
+		for _, k := range []string{"csv_delimiter", "csv_header", "csv_columns"} {
+			if _, ok := params[k]; ok {
+				return nil, errors.New(k + " requires format to be \"csv\"")
+			}
+		}
+		return nil, nil
+	}
+
+	c := &csvConfig{
+		delimiter: ',',
+	}
+	if v, ok := params["csv_delimiter"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		r, n := utf8.DecodeRuneInString(str)
+		if n == 0 || n != len(str) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+			return nil, fmt.Errorf("invalid csv_delimiter: %q", str)
+		}
+		c.delimiter = r
+	}
+
+	if v, ok := params["csv_header"]; ok {
+		b, err := data.AsBool(v)
+		if err != nil {
+			return nil, err
+		}
+		c.header = b
+	}
+
+	if v, ok := params["csv_columns"]; ok {
+		a, err := data.AsArray(v)
+		if err != nil {
+			return nil, err
+		}
+		if len(a) == 0 {
+			return nil, errors.New("csv_columns must have at least one column")
+		}
+		for _, e := range a {
+			name, err := data.AsString(e)
+			if err != nil {
+				return nil, err
+			}
+			c.columns = append(c.columns, name)
+		}
+	}
+	return c, nil
+}
+
+// decode decodes rows of a CSV payload into maps from column names to values,
+// or arrays of values when there's no column name. Values are strings, which
+// can be converted by coercions. When the payload is malformed, it returns
+// rows before the malformed one with an error.
+func (c *csvConfig) decode(b []byte) ([]data.Value, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	r.Comma = c.delimiter
+	r.FieldsPerRecord = -1
+
+	columns := c.columns
+	if c.header {
+		h, err := r.Read()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if columns == nil {
+			columns = h
+		}
+	}
+
+	var rows []data.Value
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return rows, nil
+		} else if err != nil {
+			return rows, err
+		}
+
+		if columns == nil {
+			a := make(data.Array, len(rec))
+			for i, v := range rec {
+				a[i] = data.String(v)
+			}
+			rows = append(rows, a)
+			continue
+		}
+		if len(rec) > len(columns) {
+			return rows, fmt.Errorf("a row has %v fields but there are %v columns", len(rec), len(columns))
+		}
+		m := make(data.Map, len(rec))
+		for i, v := range rec {
+			m[columns[i]] = data.String(v)
+		}
+		rows = append(rows, m)
+	}
+}
@@ -0,0 +1,125 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseCSVConfig(t *testing.T) {
+	if c, err := parseCSVConfig(data.Map{}, jsonFormat); err != nil || c != nil {
+		t.Errorf("the config shouldn't be created unless the format is csv: %v, %v", c, err)
+	}
+
+	cases := []struct {
+		params data.Map
+		format payloadFormat
+	}{
+		{data.Map{"csv_header": data.Bool(true)}, jsonFormat},
+		{data.Map{"csv_delimiter": data.String("")}, csvFormat},
+		{data.Map{"csv_delimiter": data.String(";;")}, csvFormat},
+		{data.Map{"csv_delimiter": data.String("\"")}, csvFormat},
+		{data.Map{"csv_columns": data.Array{}}, csvFormat},
+		{data.Map{"csv_columns": data.Array{data.Int(1)}}, csvFormat},
+	}
+	for _, c := range cases {
+		if _, err := parseCSVConfig(c.params, c.format); err == nil {
+			t.Errorf("%v should be rejected", c.params)
+		}
+	}
+}
+
+func TestCSVDecode(t *testing.T) {
+	cases := []struct {
+		params   data.Map
+		payload  string
+		expected []data.Value
+		fail     bool
+	}{
+		{
+			data.Map{},
+			"a,1\nb,2\n",
+			[]data.Value{
+				data.Array{data.String("a"), data.String("1")},
+				data.Array{data.String("b"), data.String("2")},
+			},
+			false,
+		},
+		{
+			data.Map{"csv_header": data.Bool(true), "csv_delimiter": data.String(";")},
+			"name;value\r\na;1\nb\n",
+			[]data.Value{
+				data.Map{"name": data.String("a"), "value": data.String("1")},
+				data.Map{"name": data.String("b")},
+			},
+			false,
+		},
+		{
+			data.Map{"csv_header": data.Bool(true), "csv_columns": data.Array{data.String("x"), data.String("y")}},
+			"name,value\n\"a,b\",1\n",
+			[]data.Value{
+				data.Map{"x": data.String("a,b"), "y": data.String("1")},
+			},
+			false,
+		},
+		{
+			data.Map{"csv_columns": data.Array{data.String("x")}},
+			"a\nb,c\nd\n",
+			[]data.Value{
+				data.Map{"x": data.String("a")},
+			},
+			true,
+		},
+		{
+			data.Map{"csv_header": data.Bool(true)},
+			"",
+			nil,
+			false,
+		},
+	}
+	for i, c := range cases {
+		conf, err := parseCSVConfig(c.params, csvFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := conf.decode([]byte(c.payload))
+		if c.fail && err == nil {
+			t.Errorf("%v: the malformed row should be reported", i)
+		} else if !c.fail && err != nil {
+			t.Errorf("%v: %v", i, err)
+		}
+		if !data.Equal(data.Array(c.expected), data.Array(rows)) {
+			t.Errorf("%v: expected %v, actual %v", i, c.expected, rows)
+		}
+	}
+}
+
+func TestSourceCSV(t *testing.T) {
+	conf, err := parseCSVConfig(data.Map{"csv_header": data.Bool(true)}, csvFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	co, err := parseCoercions(data.Map{"value": data.String("float")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &source{format: csvFormat, csv: conf, coercions: co}
+
+	ds, err := s.decodeMessage(core.NewContext(nil), "loggers/1", []byte("name,value\na,1.5\nb,2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []data.Map{
+		{"topic": data.String("loggers/1"), "payload": data.Map{"name": data.String("a"), "value": data.Float(1.5)}},
+		{"topic": data.String("loggers/1"), "payload": data.Map{"name": data.String("b"), "value": data.Float(2)}},
+	}
+	if len(ds) != len(expected) {
+		t.Fatalf("each row should be emitted as a tuple: %v", ds)
+	}
+	for i, d := range ds {
+		if !data.Equal(expected[i], d) {
+			t.Errorf("expected %v, actual %v", expected[i], d)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package mqtt
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// deadLetter republishes messages which the source cannot emit, such as
+// undecodable or oversized ones, to the dead-letter topic so that they can be
+// inspected and replayed later. A dead letter is a JSON object like below,
+// where payload is the original payload encoded in base64:
+//
+//	{
+//		"topic": "sensors/1",
+//		"error": "decode_failed",
+//		"error_message": "unexpected end of JSON input",
+//		"received_at": "2016-01-01T00:00:00Z",
+//		"payload": "eyJ0ZW1w"
+//	}
+type deadLetter struct {
+	topic string
+	qos   byte
+
+	m      sync.Mutex
+	client publisher
+
+	// published and failed are numbers of dead letters, which must be
+	// accessed atomically.
+	published int64
+	failed    int64
+}
+
+// parseDeadLetter parses dead_letter_topic and dead_letter_qos parameters. It
+// returns nil when dead_letter_topic isn't given.
+func parseDeadLetter(params data.Map) (*deadLetter, error) {
+	v, ok := params["dead_letter_topic"]
+	if !ok {
+		if _, ok := params["dead_letter_qos"]; ok {
+			return nil, errors.New("dead_letter_qos requires dead_letter_topic")
+		}
+		return nil, nil
+	}
+
+	d := &deadLetter{}
+	t, err := data.AsString(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateTopicName(t); err != nil {
+		return nil, err
+	}
+	d.topic = t
+
+	if v, ok := params["dead_letter_qos"]; ok {
+		q, err := data.AsInt(v)
+		if err != nil {
+			return nil, err
+		}
+		if q < 0 || q > 2 {
+			return nil, errors.New("dead_letter_qos must be 0, 1, or 2")
+		}
+		d.qos = byte(q)
+	}
+	return d, nil
+}
+
+// attach sets the client by which dead letters are published. It's called
+// whenever a client connects to the broker.
+func (d *deadLetter) attach(c publisher) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.client = c
+}
+
+// publish publishes a dead letter of the message received from the topic.
+// reason is the value of the error field. It doesn't wait for the message to
+// be delivered because it's called from message handlers of the client.
+func (d *deadLetter) publish(ctx *core.Context, topic string, payload []byte, reason string, cause error) {
+	d.m.Lock()
+	c := d.client
+	d.m.Unlock()
+	if c == nil {
+		atomic.AddInt64(&d.failed, 1)
+		return
+	}
+
+	l := data.Map{
+		"topic":       data.String(topic),
+		"error":       data.String(reason),
+		"received_at": data.Timestamp(time.Now()),
+		"payload":     data.Blob(payload),
+	}
+	if cause != nil {
+		l["error_message"] = data.String(cause.Error())
+	}
+	b, err := (*jsonEncoding)(nil).marshal(l)
+	if err != nil {
+		atomic.AddInt64(&d.failed, 1)
+		ctx.ErrLog(err).WithField("topic", topic).Error("Cannot encode a dead letter")
+		return
+	}
+
+	tok := c.Publish(d.topic, d.qos, false, b)
+	go func() {
+		if err := waitToken(tok, 10*time.Second); err != nil {
+			atomic.AddInt64(&d.failed, 1)
+			ctx.ErrLog(err).WithField("topic", d.topic).Warn("Cannot publish a dead letter")
+			return
+		}
+		atomic.AddInt64(&d.published, 1)
+	}()
+}
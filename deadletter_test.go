@@ -0,0 +1,75 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseDeadLetter(t *testing.T) {
+	if d, err := parseDeadLetter(data.Map{}); err != nil || d != nil {
+		t.Errorf("the dead letter shouldn't be created without dead_letter_topic: %v, %v", d, err)
+	}
+
+	for _, params := range []data.Map{
+		{"dead_letter_qos": data.Int(1)},
+		{"dead_letter_topic": data.String("")},
+		{"dead_letter_topic": data.String("dead/#")},
+		{"dead_letter_topic": data.String("dead"), "dead_letter_qos": data.Int(3)},
+	} {
+		if _, err := parseDeadLetter(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	d, err := parseDeadLetter(data.Map{
+		"dead_letter_topic": data.String("dead"),
+		"dead_letter_qos":   data.Int(1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := core.NewContext(nil)
+
+	// dead letters are counted as failures before a client connects
+	d.publish(ctx, "a", []byte("{"), "decode_failed", errors.New("bad"))
+
+	r := &statusRecorder{}
+	d.attach(r)
+	d.publish(ctx, "a", []byte("{"), "decode_failed", errors.New("bad"))
+	d.publish(ctx, "b", []byte("large"), "payload_too_large", nil)
+
+	msgs := r.published()
+	if len(msgs) != 2 {
+		t.Fatalf("wrong number of dead letters: %v", len(msgs))
+	}
+	for _, m := range msgs {
+		if m.topic != "dead" || m.qos != 1 || m.retained {
+			t.Errorf("wrong dead letter: %+v", m)
+		}
+	}
+	var l map[string]interface{}
+	if err := json.Unmarshal(msgs[0].payload, &l); err != nil {
+		t.Fatal(err)
+	}
+	if l["topic"] != "a" || l["error"] != "decode_failed" || l["error_message"] != "bad" || l["payload"] != "ew==" {
+		t.Errorf("wrong dead letter: %v", l)
+	}
+
+	for i := 0; i < 100; i++ {
+		if atomic.LoadInt64(&d.published) == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if p, f := atomic.LoadInt64(&d.published), atomic.LoadInt64(&d.failed); p != 2 || f != 1 {
+		t.Errorf("wrong counters: published %v, failed %v", p, f)
+	}
+}
@@ -0,0 +1,69 @@
+package mqtt
+
+import (
+	"fmt"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// decodeErrorPolicy is what a source does with a message whose payload
+// cannot be decoded.
+type decodeErrorPolicy int
+
+const (
+	// dropDecodeErrors logs the error and drops the message.
+	dropDecodeErrors decodeErrorPolicy = iota
+
+	// emitDecodeErrors emits an error tuple having the raw payload instead
+	// of the message.
+	emitDecodeErrors
+
+	// routeDecodeErrors writes the error tuple to the route of the router
+	// so that it's emitted by a separate mqtt_route source.
+	routeDecodeErrors
+)
+
+func parseDecodeErrorPolicy(s string) (decodeErrorPolicy, error) {
+	switch s {
+	case "drop":
+		return dropDecodeErrors, nil
+	case "emit":
+		return emitDecodeErrors, nil
+	case "route":
+		return routeDecodeErrors, nil
+	default:
+		return 0, fmt.Errorf("unknown decode_error_policy: %v", s)
+	}
+}
+
+func (p decodeErrorPolicy) String() string {
+	switch p {
+	case emitDecodeErrors:
+		return "emit"
+	case routeDecodeErrors:
+		return "route"
+	default:
+		return "drop"
+	}
+}
+
+// emitDecodeError writes an error tuple of the message which couldn't be
+// decoded depending on the decode error policy.
+func (s *source) emitDecodeError(ctx *core.Context, w core.Writer, m *message, err error) {
+	if s.decodeErrorPolicy == dropDecodeErrors {
+		return
+	}
+	// the payload is copied since messages are reused
+	t := core.NewTuple(data.Map{
+		"topic":         data.String(m.topic),
+		"error":         data.String("decode_failed"),
+		"error_message": data.String(err.Error()),
+		"payload":       data.Blob(append([]byte(nil), m.payload...)),
+	})
+	if s.decodeErrorPolicy == routeDecodeErrors {
+		s.router.write(ctx, s.decodeErrorRoute, t)
+		return
+	}
+	s.writeTuple(ctx, w, t)
+}
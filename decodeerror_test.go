@@ -0,0 +1,69 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseDecodeErrorPolicy(t *testing.T) {
+	for _, p := range []decodeErrorPolicy{dropDecodeErrors, emitDecodeErrors, routeDecodeErrors} {
+		actual, err := parseDecodeErrorPolicy(p.String())
+		if err != nil {
+			t.Error(err)
+		} else if actual != p {
+			t.Errorf("expected %v, actual %v", p, actual)
+		}
+	}
+	if _, err := parseDecodeErrorPolicy("ignore"); err == nil {
+		t.Error("an unknown policy should be rejected")
+	}
+}
+
+func TestEmitDecodeError(t *testing.T) {
+	st, err := NewRouter(nil, data.Map{
+		"routes": data.Map{"errors": data.String("$errors")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := st.(*Router)
+
+	var routed, written []*core.Tuple
+	if err := r.attach("errors", core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+		routed = append(routed, t)
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+	w := core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+		written = append(written, t)
+		return nil
+	})
+
+	m := &message{topic: "a/b", payload: []byte("{")}
+	decodeErr := errors.New("unexpected end of JSON input")
+	for _, p := range []decodeErrorPolicy{dropDecodeErrors, emitDecodeErrors, routeDecodeErrors} {
+		s := &source{router: r, decodeErrorPolicy: p, decodeErrorRoute: "errors"}
+		s.emitDecodeError(nil, w, m, decodeErr)
+	}
+	if len(written) != 1 || len(routed) != 1 {
+		t.Fatalf("wrong number of error tuples: written %v, routed %v", len(written), len(routed))
+	}
+
+	m.payload[0] = '['
+	for _, tu := range []*core.Tuple{written[0], routed[0]} {
+		if s, _ := data.AsString(tu.Data["error"]); s != "decode_failed" {
+			t.Errorf("wrong error: %v", tu.Data["error"])
+		}
+		if s, _ := data.AsString(tu.Data["error_message"]); s != decodeErr.Error() {
+			t.Errorf("wrong error message: %v", tu.Data["error_message"])
+		}
+		if b, _ := data.AsBlob(tu.Data["payload"]); !bytes.Equal(b, []byte("{")) {
+			t.Errorf("the payload should be copied: %v", tu.Data["payload"])
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package mqtt
+
+import (
+	"sync"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// decodePool decodes messages in several goroutines so that decoding
+// payloads of high-rate topics scales across cores. Decoded messages are
+// written by a single goroutine in the order they're submitted, so the pool
+// doesn't change the order of tuples.
+type decodePool struct {
+	decode func(m *message) ([]data.Map, error)
+	write  func(m *message, ds []data.Map, err error)
+
+	// jobs are messages waiting to be decoded.
+	jobs chan *decodeJob
+
+	// pending are messages in the order they're submitted. The writer waits
+	// until the head of them is decoded.
+	pending chan *decodeJob
+
+	// m protects closed and makes sending a job to both channels atomic.
+	m      sync.Mutex
+	closed bool
+
+	workers sync.WaitGroup
+	done    chan struct{}
+}
+
+type decodeJob struct {
+	msg *message
+	ds  []data.Map
+	err error
+
+	// decoded is closed when ds and err are set.
+	decoded chan struct{}
+}
+
+// newDecodePool creates a pool having the given number of workers and starts
+// them. At most twice as many messages as workers are in progress at once.
+// submit blocks when the pool is full.
+func newDecodePool(workers int, decode func(m *message) ([]data.Map, error),
+	write func(m *message, ds []data.Map, err error)) *decodePool {
+	p := &decodePool{
+		decode:  decode,
+		write:   write,
+		jobs:    make(chan *decodeJob, workers),
+		pending: make(chan *decodeJob, 2*workers),
+		done:    make(chan struct{}),
+	}
+	p.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.runWorker()
+	}
+	go p.runWriter()
+	return p
+}
+
+func (p *decodePool) runWorker() {
+	defer p.workers.Done()
+	for j := range p.jobs {
+		j.ds, j.err = p.decode(j.msg)
+		close(j.decoded)
+	}
+}
+
+func (p *decodePool) runWriter() {
+	defer close(p.done)
+	for j := range p.pending {
+		<-j.decoded
+		p.write(j.msg, j.ds, j.err)
+	}
+}
+
+// submit adds a message to the pool. Messages submitted after close are
+// ignored.
+func (p *decodePool) submit(m *message) {
+	j := &decodeJob{
+		msg:     m,
+		decoded: make(chan struct{}),
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.closed {
+		return
+	}
+	// the job is added to pending first so that the writer can wait for it
+	// while workers are decoding it
+	p.pending <- j
+	p.jobs <- j
+}
+
+// close waits until all submitted messages are written and stops the pool.
+func (p *decodePool) close() {
+	p.m.Lock()
+	if p.closed {
+		p.m.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.jobs)
+	close(p.pending)
+	p.m.Unlock()
+
+	p.workers.Wait()
+	<-p.done
+}
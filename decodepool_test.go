@@ -0,0 +1,54 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestDecodePool(t *testing.T) {
+	var (
+		m       sync.Mutex
+		written []string
+		failed  int
+	)
+	p := newDecodePool(4, func(msg *message) ([]data.Map, error) {
+		// later messages are decoded faster to shuffle the completion order
+		time.Sleep(time.Duration(100-len(msg.payload)) * 10 * time.Microsecond)
+		if msg.topic == "error" {
+			return nil, errors.New("cannot decode")
+		}
+		return []data.Map{{"topic": data.String(msg.topic)}}, nil
+	}, func(msg *message, ds []data.Map, err error) {
+		m.Lock()
+		defer m.Unlock()
+		if err != nil {
+			failed++
+			return
+		}
+		written = append(written, msg.topic)
+	})
+
+	for i := 0; i < 100; i++ {
+		p.submit(&message{topic: fmt.Sprint(i), payload: make([]byte, i)})
+	}
+	p.submit(&message{topic: "error"})
+	p.close()
+	p.submit(&message{topic: "closed"})
+
+	if len(written) != 100 {
+		t.Fatalf("all messages should be written: %v", len(written))
+	}
+	for i, topic := range written {
+		if topic != fmt.Sprint(i) {
+			t.Fatalf("messages should be written in order: %v", written)
+		}
+	}
+	if failed != 1 {
+		t.Errorf("the error should be passed to write: %v", failed)
+	}
+}
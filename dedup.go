@@ -0,0 +1,135 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// dedupKey is what identifies duplicate messages.
+type dedupKey int
+
+const (
+	// dedupByPayload regards messages having the same topic and payload as
+	// duplicates. It suppresses duplicates made by broker bridges as well.
+	dedupByPayload dedupKey = iota
+
+	// dedupByMessageID regards QoS 1 and 2 messages redelivered with the DUP
+	// flag as duplicates when a message having the same topic and packet
+	// identifier has been received. Identifiers are reused for new messages,
+	// so only redeliveries are suppressed.
+	dedupByMessageID
+)
+
+// deduplicator drops messages which are the same as a message received
+// within the window.
+type deduplicator struct {
+	window time.Duration
+	key    dedupKey
+
+	m    sync.Mutex
+	seen map[uint64]time.Time
+
+	// order has keys in the order they're seen to expire them.
+	order []dedupEntry
+}
+
+type dedupEntry struct {
+	key  uint64
+	seen time.Time
+}
+
+// parseDeduplicator parses dedup_window and dedup_key parameters. It returns
+// nil when dedup_window isn't given or 0.
+func parseDeduplicator(params data.Map) (*deduplicator, error) {
+	v, ok := params["dedup_window"]
+	if !ok {
+		if _, ok := params["dedup_key"]; ok {
+			return nil, errors.New("dedup_key requires dedup_window")
+		}
+		return nil, nil
+	}
+	w, err := data.ToDuration(v)
+	if err != nil {
+		return nil, err
+	}
+	if w < 0 {
+		return nil, errors.New("dedup_window must not be negative")
+	}
+	if w == 0 {
+		return nil, nil
+	}
+
+	d := &deduplicator{
+		window: w,
+		seen:   map[uint64]time.Time{},
+	}
+	if v, ok := params["dedup_key"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		switch str {
+		case "payload":
+			d.key = dedupByPayload
+		case "message_id":
+			d.key = dedupByMessageID
+		default:
+			return nil, fmt.Errorf("unknown dedup_key: %v", str)
+		}
+	}
+	return d, nil
+}
+
+// duplicate returns true when the same message has been received within the
+// window.
+func (d *deduplicator) duplicate(m *message, now time.Time) bool {
+	h := fnv.New64a()
+	h.Write([]byte(m.topic))
+	h.Write([]byte{0})
+	switch d.key {
+	case dedupByMessageID:
+		if m.qos == 0 {
+			// QoS 0 messages don't have identifiers
+			return false
+		}
+		h.Write([]byte{byte(m.id >> 8), byte(m.id)})
+	default:
+		h.Write(m.payload)
+	}
+	key := h.Sum64()
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.expire(now)
+	if _, ok := d.seen[key]; ok && (d.key == dedupByPayload || m.duplicate) {
+		return true
+	}
+	// a reused identifier is seen again as a new message
+	d.seen[key] = now
+	d.order = append(d.order, dedupEntry{key, now})
+	return false
+}
+
+// expire forgets messages received before the window. The caller must hold
+// the lock.
+func (d *deduplicator) expire(now time.Time) {
+	n := 0
+	for _, e := range d.order {
+		if now.Sub(e.seen) < d.window {
+			break
+		}
+		// the identifier may have been reused after the entry was added
+		if d.seen[e.key].Equal(e.seen) {
+			delete(d.seen, e.key)
+		}
+		n++
+	}
+	if n > 0 {
+		d.order = append(d.order[:0], d.order[n:]...)
+	}
+}
@@ -0,0 +1,72 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestDeduplicatorPayload(t *testing.T) {
+	d, err := parseDeduplicator(data.Map{"dedup_window": data.String("10s")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	m := &message{topic: "a", payload: []byte("1")}
+
+	if d.duplicate(m, now) {
+		t.Error("the first message isn't a duplicate")
+	}
+	if !d.duplicate(&message{topic: "a", payload: []byte("1")}, now.Add(time.Second)) {
+		t.Error("the same message should be a duplicate")
+	}
+	if d.duplicate(&message{topic: "b", payload: []byte("1")}, now.Add(time.Second)) {
+		t.Error("a message of another topic isn't a duplicate")
+	}
+	if d.duplicate(m, now.Add(10*time.Second)) {
+		t.Error("the message should be forgotten after the window")
+	}
+}
+
+func TestDeduplicatorMessageID(t *testing.T) {
+	d, err := parseDeduplicator(data.Map{
+		"dedup_window": data.String("10s"),
+		"dedup_key":    data.String("message_id"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	if d.duplicate(&message{topic: "a", qos: 1, id: 1, payload: []byte("1")}, now) {
+		t.Error("the first message isn't a duplicate")
+	}
+	if !d.duplicate(&message{topic: "a", qos: 1, id: 1, duplicate: true, payload: []byte("1")}, now) {
+		t.Error("the redelivery should be a duplicate")
+	}
+	if d.duplicate(&message{topic: "b", qos: 1, id: 1, duplicate: true, payload: []byte("1")}, now) {
+		t.Error("a message of another topic isn't a duplicate")
+	}
+	if d.duplicate(&message{topic: "a", qos: 1, id: 1, payload: []byte("2")}, now) {
+		t.Error("a new message reusing the identifier isn't a duplicate")
+	}
+	if d.duplicate(&message{topic: "a", qos: 0, duplicate: true}, now) {
+		t.Error("QoS 0 messages don't have identifiers")
+	}
+	if d.duplicate(&message{topic: "a", qos: 1, id: 1, duplicate: true}, now.Add(10*time.Second)) {
+		t.Error("the identifier should be forgotten after the window")
+	}
+}
+
+func TestParseDeduplicator(t *testing.T) {
+	for _, params := range []data.Map{
+		{"dedup_key": data.String("payload")},
+		{"dedup_window": data.String("-1s")},
+		{"dedup_window": data.String("1s"), "dedup_key": data.String("hash")},
+	} {
+		if _, err := parseDeduplicator(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
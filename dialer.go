@@ -0,0 +1,75 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// Dialer establishes network connections to brokers. It replaces the transport
+// of paho.mqtt.golang so that clients can connect to brokers through gateways,
+// tunnels, or in-memory pipes. A Dialer is registered by RegisterDialer and
+// referred by the dialer parameter of the source and the sink.
+type Dialer interface {
+	// Dial connects to the broker. tlsCfg is the TLS configuration built from
+	// connection parameters, or nil when the broker doesn't use TLS. It's up
+	// to the Dialer whether it's used. timeout is the connect timeout of the
+	// client.
+	Dial(broker *url.URL, tlsCfg *tls.Config, timeout time.Duration) (net.Conn, error)
+}
+
+// DialerFunc is a function implementing Dialer.
+type DialerFunc func(broker *url.URL, tlsCfg *tls.Config, timeout time.Duration) (net.Conn, error)
+
+// Dial calls the function.
+func (f DialerFunc) Dial(broker *url.URL, tlsCfg *tls.Config, timeout time.Duration) (net.Conn, error) {
+	return f(broker, tlsCfg, timeout)
+}
+
+var (
+	dialersMutex sync.RWMutex
+	dialers      = map[string]Dialer{}
+)
+
+// RegisterDialer registers a Dialer with the name. It fails when a dialer is
+// already registered with the name.
+func RegisterDialer(name string, d Dialer) error {
+	dialersMutex.Lock()
+	defer dialersMutex.Unlock()
+
+	if _, ok := dialers[name]; ok {
+		return fmt.Errorf("dialer '%v' is already registered", name)
+	}
+	dialers[name] = d
+	return nil
+}
+
+// MustRegisterDialer is like RegisterDialer but panics on failure.
+func MustRegisterDialer(name string, d Dialer) {
+	if err := RegisterDialer(name, d); err != nil {
+		panic(err)
+	}
+}
+
+func lookupDialer(name string) (Dialer, error) {
+	dialersMutex.RLock()
+	defer dialersMutex.RUnlock()
+
+	d, ok := dialers[name]
+	if !ok {
+		return nil, fmt.Errorf("dialer '%v' isn't registered", name)
+	}
+	return d, nil
+}
+
+// openConnectionFunc adapts the Dialer to paho.mqtt.golang.
+func openConnectionFunc(d Dialer) mqtt.OpenConnectionFunc {
+	return func(uri *url.URL, opts mqtt.ClientOptions) (net.Conn, error) {
+		return d.Dial(uri, opts.TLSConfig, opts.ConnectTimeout)
+	}
+}
@@ -0,0 +1,57 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestDialer(t *testing.T) {
+	var dialed *url.URL
+	server, client := net.Pipe()
+	defer server.Close()
+	if err := RegisterDialer("test_pipe", DialerFunc(func(broker *url.URL, tlsCfg *tls.Config, timeout time.Duration) (net.Conn, error) {
+		dialed = broker
+		return client, nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterDialer("test_pipe", DialerFunc(nil)); err == nil {
+		t.Error("a dialer shouldn't be registered twice")
+	}
+
+	ctx := core.NewContext(nil)
+	c := newClientConfig()
+	if err := c.parseParams(ctx, data.Map{
+		"broker": data.String("pipe://gateway:1"),
+		"dialer": data.String("test_pipe"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := c.clientOptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.CustomOpenConnectionFn == nil {
+		t.Fatal("the dialer should be set to the options")
+	}
+	conn, err := opts.CustomOpenConnectionFn(opts.Servers[0], *opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn != client {
+		t.Error("the connection should be established by the dialer")
+	}
+	if dialed == nil || dialed.String() != "pipe://gateway:1" {
+		t.Errorf("wrong broker: %v", dialed)
+	}
+
+	if err := c.parseParams(ctx, data.Map{"dialer": data.String("not_registered")}); err == nil {
+		t.Error("an unregistered dialer should be rejected")
+	}
+}
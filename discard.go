@@ -0,0 +1,267 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// Reasons why messages are discarded.
+const (
+	discardBufferFull   = "buffer_full"
+	discardRateLimit    = "rate_limit"
+	discardAgeLimit     = "age_limit"
+	discardUnauthorized = "unauthorized"
+	discardSizeLimit    = "size_limit"
+	discardDuplicate    = "duplicate"
+	discardPaused       = "paused"
+	discardDisconnected = "disconnected"
+)
+
+// discardCounter returns the number of messages discarded so far by reason.
+type discardCounter func() map[string]int64
+
+// DiscardMonitor is a shared state summarizing messages discarded by MQTT
+// sources and sinks having the discard_monitor parameter. It periodically
+// emits a tuple for each node and reason having discarded messages in the
+// window to mqtt_discards sources, so that loss is observable in the topology.
+type DiscardMonitor struct {
+	ctx    *core.Context
+	window time.Duration
+
+	m        sync.Mutex
+	counters map[discardKey]discardCounter
+	last     map[discardKey]map[string]int64
+	writer   core.Writer
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type discardKey struct {
+	nodeType string
+	name     string
+}
+
+// NewDiscardMonitor creates a new DiscardMonitor:
+//
+//	CREATE STATE discards TYPE mqtt_discard_monitor WITH window = "1m";
+//	CREATE SOURCE mqtt_src TYPE mqtt WITH topic = "sensors/#",
+//	  buffer_size = 1000, discard_monitor = "discards";
+//	CREATE SOURCE discard_alerts TYPE mqtt_discards WITH monitor = "discards";
+//
+// The state has following optional parameters:
+//
+//	* window: the interval at which discarded messages are summarized in Go duration format (default: 10s)
+func NewDiscardMonitor(ctx *core.Context, params data.Map) (core.SharedState, error) {
+	d := &DiscardMonitor{
+		ctx:      ctx,
+		window:   10 * time.Second,
+		counters: map[discardKey]discardCounter{},
+		last:     map[discardKey]map[string]int64{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if v, ok := params["window"]; ok {
+		w, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if w <= 0 {
+			return nil, errors.New("window must be positive")
+		}
+		d.window = w
+	}
+
+	go d.run()
+	return d, nil
+}
+
+func (d *DiscardMonitor) run() {
+	defer close(d.done)
+	t := time.NewTicker(d.window)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case now := <-t.C:
+			d.summarize(now)
+		}
+	}
+}
+
+// summarize writes a tuple for each node and reason having discarded
+// messages since the last call.
+func (d *DiscardMonitor) summarize(now time.Time) {
+	d.m.Lock()
+	var tuples []*core.Tuple
+	for k, c := range d.counters {
+		counts := c()
+		last := d.last[k]
+		reasons := make([]string, 0, len(counts))
+		for r := range counts {
+			reasons = append(reasons, r)
+		}
+		sort.Strings(reasons)
+		for _, r := range reasons {
+			n := counts[r] - last[r]
+			if n <= 0 {
+				continue
+			}
+			t := core.NewTuple(data.Map{
+				"node_type": data.String(k.nodeType),
+				"name":      data.String(k.name),
+				"reason":    data.String(r),
+				"count":     data.Int(n),
+				"window":    data.Float(d.window.Seconds()),
+			})
+			t.Timestamp = now
+			tuples = append(tuples, t)
+		}
+		d.last[k] = counts
+	}
+	w := d.writer
+	d.m.Unlock()
+
+	if w == nil {
+		return
+	}
+	for _, t := range tuples {
+		if err := w.Write(d.ctx, t); err != nil {
+			d.ctx.ErrLog(err).Error("Cannot write a discard alert")
+		}
+	}
+}
+
+// register registers a counter of a source or a sink.
+func (d *DiscardMonitor) register(nodeType, name string, c discardCounter) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	k := discardKey{nodeType, name}
+	if _, ok := d.counters[k]; ok {
+		return fmt.Errorf("%v '%v' is already registered to the discard monitor", nodeType, name)
+	}
+	d.counters[k] = c
+	d.last[k] = c()
+	return nil
+}
+
+func (d *DiscardMonitor) unregister(nodeType, name string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	k := discardKey{nodeType, name}
+	delete(d.counters, k)
+	delete(d.last, k)
+}
+
+func (d *DiscardMonitor) attach(w core.Writer) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.writer != nil {
+		return errors.New("the discard monitor already has a source")
+	}
+	d.writer = w
+	return nil
+}
+
+func (d *DiscardMonitor) detach() {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.writer = nil
+}
+
+// Terminate stops summarizing discarded messages.
+func (d *DiscardMonitor) Terminate(ctx *core.Context) error {
+	close(d.stop)
+	<-d.done
+	return nil
+}
+
+func lookupDiscardMonitor(ctx *core.Context, name string) (*DiscardMonitor, error) {
+	st, err := ctx.SharedStates.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := st.(*DiscardMonitor)
+	if !ok {
+		return nil, fmt.Errorf("state '%v' isn't a mqtt_discard_monitor", name)
+	}
+	return d, nil
+}
+
+// parseDiscardMonitor parses the discard_monitor parameter. It returns nil
+// when the parameter isn't given.
+func parseDiscardMonitor(ctx *core.Context, params data.Map) (*DiscardMonitor, error) {
+	v, ok := params["discard_monitor"]
+	if !ok {
+		return nil, nil
+	}
+	name, err := data.AsString(v)
+	if err != nil {
+		return nil, err
+	}
+	return lookupDiscardMonitor(ctx, name)
+}
+
+type discardSource struct {
+	monitor *DiscardMonitor
+	stop    chan struct{}
+}
+
+func (s *discardSource) GenerateStream(ctx *core.Context, w core.Writer) error {
+	if err := s.monitor.attach(w); err != nil {
+		return err
+	}
+	defer s.monitor.detach()
+	<-s.stop
+	return nil
+}
+
+func (s *discardSource) Stop(ctx *core.Context) error {
+	close(s.stop)
+	return nil
+}
+
+// NewDiscardSource creates a source emitting tuples summarizing discarded
+// messages:
+//
+//	{
+//		"node_type": "source",
+//		"name": "mqtt_src",
+//		"reason": "buffer_full",
+//		"count": 42,
+//		"window": 60.0
+//	}
+//
+// The reason is one of "buffer_full", "rate_limit", "age_limit",
+// "unauthorized", "size_limit", and "duplicate". The window is the length of the window in seconds.
+//
+// The source has following required parameters:
+//
+//	* monitor: the name of the mqtt_discard_monitor state
+func NewDiscardSource(ctx *core.Context, ioParams *bql.IOParams, params data.Map) (core.Source, error) {
+	v, ok := params["monitor"]
+	if !ok {
+		return nil, errors.New("monitor parameter is missing")
+	}
+	name, err := data.AsString(v)
+	if err != nil {
+		return nil, err
+	}
+	m, err := lookupDiscardMonitor(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return core.ImplementSourceStop(&discardSource{
+		monitor: m,
+		stop:    make(chan struct{}),
+	}), nil
+}
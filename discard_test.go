@@ -0,0 +1,85 @@
+package mqtt
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+type testWriter struct {
+	m      sync.Mutex
+	tuples []*core.Tuple
+}
+
+func (w *testWriter) Write(ctx *core.Context, t *core.Tuple) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.tuples = append(w.tuples, t)
+	return nil
+}
+
+func TestDiscardMonitor(t *testing.T) {
+	ctx := core.NewContext(nil)
+	st, err := NewDiscardMonitor(ctx, data.Map{"window": data.String("1h")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := st.(*DiscardMonitor)
+	defer d.Terminate(ctx)
+
+	counts := map[string]int64{discardBufferFull: 3, discardRateLimit: 0}
+	if err := d.register("source", "src", func() map[string]int64 {
+		c := map[string]int64{}
+		for k, v := range counts {
+			c[k] = v
+		}
+		return c
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.register("source", "src", nil); err == nil {
+		t.Error("a node shouldn't be registered twice")
+	}
+	w := &testWriter{}
+	if err := d.attach(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.attach(w); err == nil {
+		t.Error("the monitor shouldn't have two sources")
+	}
+
+	// Messages discarded before the registration aren't reported.
+	counts[discardBufferFull] = 5
+	counts[discardRateLimit] = 10
+	d.summarize(time.Now())
+	if len(w.tuples) != 2 {
+		t.Fatalf("wrong number of tuples: %v", len(w.tuples))
+	}
+	expected := []data.Map{
+		{"node_type": data.String("source"), "name": data.String("src"), "reason": data.String("buffer_full"),
+			"count": data.Int(2), "window": data.Float(3600)},
+		{"node_type": data.String("source"), "name": data.String("src"), "reason": data.String("rate_limit"),
+			"count": data.Int(10), "window": data.Float(3600)},
+	}
+	for i, e := range expected {
+		if !data.Equal(e, w.tuples[i].Data) {
+			t.Errorf("tuple %v: expected %v, actual %v", i, e, w.tuples[i].Data)
+		}
+	}
+
+	// Nothing is emitted when nothing is discarded in the window.
+	d.summarize(time.Now())
+	if len(w.tuples) != 2 {
+		t.Errorf("no tuple should be emitted: %v", len(w.tuples))
+	}
+
+	d.unregister("source", "src")
+	counts[discardBufferFull] = 100
+	d.summarize(time.Now())
+	if len(w.tuples) != 2 {
+		t.Errorf("an unregistered node shouldn't be reported: %v", len(w.tuples))
+	}
+}
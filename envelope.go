@@ -0,0 +1,165 @@
+package mqtt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// envelope is a JSON object wrapping a payload together with the name and the
+// version of its schema:
+//
+//	{
+//		"schema": "temperature",
+//		"version": 2,
+//		"payload": {"celsius": 21.5}
+//	}
+//
+// When the payload is a blob, it's encoded in base64 and encoding is set to
+// "base64".
+type envelope struct {
+	Schema   string          `json:"schema"`
+	Version  int64           `json:"version"`
+	Encoding string          `json:"encoding,omitempty"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// wrapEnvelope wraps the payload in an envelope. Arrays and maps in the
+// payload are encoded by enc.
+func wrapEnvelope(schema string, version int64, p data.Value, enc *jsonEncoding) ([]byte, error) {
+	e := &envelope{
+		Schema:  schema,
+		Version: version,
+	}
+
+	switch p.Type() {
+	case data.TypeString:
+		str, _ := data.AsString(p)
+		b, err := json.Marshal(str)
+		if err != nil {
+			return nil, err
+		}
+		e.Payload = b
+	case data.TypeBlob:
+		b, _ := data.AsBlob(p)
+		e.Encoding = "base64"
+		e.Payload = json.RawMessage(`"` + base64.StdEncoding.EncodeToString(b) + `"`)
+	case data.TypeArray, data.TypeMap:
+		b, err := enc.marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		e.Payload = b
+	default:
+		return nil, fmt.Errorf("data type '%v' cannot be used as payload", p.Type())
+	}
+	return json.Marshal(e)
+}
+
+// unwrapEnvelope decodes an envelope and returns its schema, version, and
+// payload. The payload is decoded by the SchemaDecoder registered for the
+// schema and the version if any.
+func unwrapEnvelope(ctx *core.Context, b []byte) (string, int64, data.Value, error) {
+	e := &envelope{}
+	if err := json.Unmarshal(b, e); err != nil {
+		return "", 0, nil, err
+	}
+	if e.Schema == "" {
+		return "", 0, nil, errors.New("schema is missing in the envelope")
+	}
+	if e.Payload == nil {
+		return "", 0, nil, errors.New("payload is missing in the envelope")
+	}
+
+	var p data.Value
+	switch e.Encoding {
+	case "":
+		v, err := decodeJSON(e.Payload)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		p = v
+	case "base64":
+		var str string
+		if err := json.Unmarshal(e.Payload, &str); err != nil {
+			return "", 0, nil, err
+		}
+		blob, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		p = data.Blob(blob)
+	default:
+		return "", 0, nil, fmt.Errorf("unsupported payload encoding in the envelope: %v", e.Encoding)
+	}
+
+	if d := lookupSchemaDecoder(e.Schema, e.Version); d != nil {
+		v, err := d.DecodeSchema(ctx, p)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		p = v
+	}
+	return e.Schema, e.Version, p, nil
+}
+
+// SchemaDecoder decodes a payload wrapped in an envelope having a specific
+// schema and version. It can be used to convert payloads of older versions
+// into the latest form so that BQL statements don't have to care about
+// versions.
+type SchemaDecoder interface {
+	// DecodeSchema decodes a payload. The payload is a blob when it was a blob
+	// in the sink. Otherwise, it's a value decoded from JSON.
+	DecodeSchema(ctx *core.Context, payload data.Value) (data.Value, error)
+}
+
+// SchemaDecoderFunc is a function implementing SchemaDecoder.
+type SchemaDecoderFunc func(ctx *core.Context, payload data.Value) (data.Value, error)
+
+// DecodeSchema calls the function.
+func (f SchemaDecoderFunc) DecodeSchema(ctx *core.Context, payload data.Value) (data.Value, error) {
+	return f(ctx, payload)
+}
+
+type schemaKey struct {
+	schema  string
+	version int64
+}
+
+var (
+	schemaDecodersMutex sync.RWMutex
+	schemaDecoders      = map[schemaKey]SchemaDecoder{}
+)
+
+// RegisterSchemaDecoder registers a SchemaDecoder for the schema and the
+// version. It fails when a decoder is already registered for them.
+func RegisterSchemaDecoder(schema string, version int64, d SchemaDecoder) error {
+	schemaDecodersMutex.Lock()
+	defer schemaDecodersMutex.Unlock()
+
+	k := schemaKey{schema, version}
+	if _, ok := schemaDecoders[k]; ok {
+		return fmt.Errorf("schema decoder for '%v' version %v is already registered", schema, version)
+	}
+	schemaDecoders[k] = d
+	return nil
+}
+
+// MustRegisterSchemaDecoder is like RegisterSchemaDecoder but panics on
+// failure.
+func MustRegisterSchemaDecoder(schema string, version int64, d SchemaDecoder) {
+	if err := RegisterSchemaDecoder(schema, version, d); err != nil {
+		panic(err)
+	}
+}
+
+func lookupSchemaDecoder(schema string, version int64) SchemaDecoder {
+	schemaDecodersMutex.RLock()
+	defer schemaDecodersMutex.RUnlock()
+	return schemaDecoders[schemaKey{schema, version}]
+}
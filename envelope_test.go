@@ -0,0 +1,78 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestEnvelope(t *testing.T) {
+	cases := []data.Value{
+		data.Map{"a": data.Int(1), "b": data.Array{data.Float(1.5), data.String("c")}},
+		data.Array{data.Int(1), data.Int(2)},
+		data.String("hoge"),
+		data.Blob([]byte{0, 1, 2, 255}),
+	}
+
+	for _, c := range cases {
+		b, err := wrapEnvelope("test", 3, c, nil)
+		if err != nil {
+			t.Errorf("cannot wrap %v: %v", c, err)
+			continue
+		}
+		schema, ver, p, err := unwrapEnvelope(nil, b)
+		if err != nil {
+			t.Errorf("cannot unwrap %v: %v", string(b), err)
+			continue
+		}
+		if schema != "test" || ver != 3 {
+			t.Errorf("wrong schema: %v version %v", schema, ver)
+		}
+		if !data.Equal(c, p) {
+			t.Errorf("expected %v, actual %v", c, p)
+		}
+	}
+
+	if _, err := wrapEnvelope("test", 1, data.Int(1), nil); err == nil {
+		t.Error("an integer payload should be rejected")
+	}
+	for _, b := range []string{`{"version":1,"payload":1}`, `{"schema":"a"}`, `{"schema":"a","payload":"x","encoding":"hex"}`, `hoge`} {
+		if _, _, _, err := unwrapEnvelope(nil, []byte(b)); err == nil {
+			t.Errorf("%v should be rejected", b)
+		}
+	}
+}
+
+func TestSchemaDecoder(t *testing.T) {
+	MustRegisterSchemaDecoder("test_decoder", 1, SchemaDecoderFunc(func(ctx *core.Context, p data.Value) (data.Value, error) {
+		return data.Map{"converted": p}, nil
+	}))
+	if err := RegisterSchemaDecoder("test_decoder", 1, nil); err == nil {
+		t.Error("registering a decoder twice should fail")
+	}
+
+	b, err := wrapEnvelope("test_decoder", 1, data.String("v1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, p, err := unwrapEnvelope(nil, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := (data.Map{"converted": data.String("v1")}); !data.Equal(e, p) {
+		t.Errorf("expected %v, actual %v", e, p)
+	}
+
+	b, err = wrapEnvelope("test_decoder", 2, data.String("v2"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, p, err = unwrapEnvelope(nil, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := data.String("v2"); !data.Equal(e, p) {
+		t.Errorf("a payload without a decoder should be as is: %v", p)
+	}
+}
@@ -0,0 +1,175 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// payloadFilter drops decoded payloads which don't satisfy all of its
+// conditions before they're emitted.
+type payloadFilter []*filterCondition
+
+// filterCondition compares a field of decoded payloads with a constant.
+type filterCondition struct {
+	expr  string
+	path  data.Path
+	op    string
+	value data.Value
+}
+
+var filterPattern = regexp.MustCompile(`^\s*(.+?)\s*(==|!=|<=|>=|<|>)\s*(.+?)\s*$`)
+
+// parseFilter parses the filter parameter, which is a condition like
+// "temperature > 30" or an array of conditions all of which must be
+// satisfied.
+func parseFilter(v data.Value) (payloadFilter, error) {
+	var exprs []string
+	if v.Type() == data.TypeArray {
+		a, _ := data.AsArray(v)
+		for _, e := range a {
+			str, err := data.AsString(e)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, str)
+		}
+	} else {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, str)
+	}
+	if len(exprs) == 0 {
+		return nil, errors.New("filter must have at least one condition")
+	}
+
+	f := make(payloadFilter, 0, len(exprs))
+	for _, e := range exprs {
+		c, err := parseFilterCondition(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter '%v': %v", e, err)
+		}
+		f = append(f, c)
+	}
+	return f, nil
+}
+
+func parseFilterCondition(expr string) (*filterCondition, error) {
+	m := filterPattern.FindStringSubmatch(expr)
+	if m == nil {
+		return nil, errors.New("a condition must be like 'path op value'")
+	}
+	p, err := data.CompilePath(m[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var v data.Value
+	lit := m[3]
+	if len(lit) >= 2 && lit[0] == '\'' && lit[len(lit)-1] == '\'' {
+		v = data.String(lit[1 : len(lit)-1])
+	} else if v, err = decodeJSON([]byte(lit)); err != nil {
+		return nil, fmt.Errorf("the value must be a number, a string, true, false, or null: %v", lit)
+	}
+	switch v.Type() {
+	case data.TypeArray, data.TypeMap:
+		return nil, errors.New("the value cannot be an array or a map")
+	case data.TypeNull, data.TypeBool:
+		if m[2] != "==" && m[2] != "!=" {
+			return nil, fmt.Errorf("%v cannot be compared by %v", lit, m[2])
+		}
+	}
+	return &filterCondition{
+		expr:  strings.TrimSpace(expr),
+		path:  p,
+		op:    m[2],
+		value: v,
+	}, nil
+}
+
+// match returns true when the payload satisfies all conditions. Payloads
+// which aren't maps or don't have the field don't satisfy a condition.
+func (f payloadFilter) match(payload data.Value) bool {
+	m, ok := payload.(data.Map)
+	if !ok {
+		return false
+	}
+	for _, c := range f {
+		v, err := m.Get(c.path)
+		if err != nil || !c.match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *filterCondition) match(v data.Value) bool {
+	cmp, ok := compareValues(v, c.value)
+	switch c.op {
+	case "==":
+		return ok && cmp == 0
+	case "!=":
+		return !ok || cmp != 0
+	}
+	if !ok {
+		return false
+	}
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// compareValues compares numbers or strings. Other values are only compared
+// for equality, in which case cmp is 0 when they're equal and 1 otherwise.
+// It returns false when the values cannot be compared.
+func compareValues(a, b data.Value) (cmp int, ok bool) {
+	if isNumber(a) && isNumber(b) {
+		x, _ := data.ToFloat(a)
+		y, _ := data.ToFloat(b)
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		default:
+			return 0, true
+		}
+	}
+	if a.Type() != b.Type() {
+		return 0, false
+	}
+	if a.Type() == data.TypeString {
+		x, _ := data.AsString(a)
+		y, _ := data.AsString(b)
+		return strings.Compare(x, y), true
+	}
+	if data.Equal(a, b) {
+		return 0, true
+	}
+	return 1, true
+}
+
+func isNumber(v data.Value) bool {
+	return v.Type() == data.TypeInt || v.Type() == data.TypeFloat
+}
+
+// conditions returns conditions of the filter.
+func (f payloadFilter) conditions() data.Array {
+	a := make(data.Array, len(f))
+	for i, c := range f {
+		a[i] = data.String(c.expr)
+	}
+	return a
+}
@@ -0,0 +1,97 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseFilter(t *testing.T) {
+	for _, v := range []data.Value{
+		data.Int(1),
+		data.Array{},
+		data.String("temperature"),
+		data.String("temperature > "),
+		data.String("temperature > hot"),
+		data.String("temperature > [1]"),
+		data.String("valid < true"),
+		data.String("valid >= null"),
+	} {
+		if _, err := parseFilter(v); err == nil {
+			t.Errorf("%v should be rejected", v)
+		}
+	}
+}
+
+func TestPayloadFilter(t *testing.T) {
+	payload := data.Map{
+		"temperature": data.Float(31.5),
+		"count":       data.Int(3),
+		"status":      data.String("active"),
+		"valid":       data.Bool(true),
+		"note":        data.Null{},
+	}
+	cases := []struct {
+		filter   string
+		expected bool
+	}{
+		{"temperature > 30", true},
+		{"temperature <= 30", false},
+		{"count == 3.0", true},
+		{"count != 3", false},
+		{"count>=3", true},
+		{"status == 'active'", true},
+		{`status == "active"`, true},
+		{"status < 'b'", true},
+		{"status > 'b'", false},
+		{"status == 1", false},
+		{"status != 1", true},
+		{"status > 1", false},
+		{"valid == true", true},
+		{"valid != false", true},
+		{"note == null", true},
+		{"missing == 1", false},
+		{"missing != 1", false},
+	}
+	for _, c := range cases {
+		f, err := parseFilter(data.String(c.filter))
+		if err != nil {
+			t.Errorf("%v: %v", c.filter, err)
+			continue
+		}
+		if actual := f.match(payload); actual != c.expected {
+			t.Errorf("%v: expected %v, actual %v", c.filter, c.expected, actual)
+		}
+	}
+
+	f, err := parseFilter(data.Array{data.String("temperature > 30"), data.String("count < 3")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.match(payload) {
+		t.Error("all conditions should be satisfied")
+	}
+	if f.match(data.String("a")) {
+		t.Error("a payload which isn't a map shouldn't match")
+	}
+}
+
+func TestSourceFilter(t *testing.T) {
+	f, err := parseFilter(data.String("temperature > 30"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &source{format: jsonFormat, filter: f}
+
+	d, err := s.decode(nil, "a", []byte(`{"temperature":20}`))
+	if err != nil || d != nil {
+		t.Errorf("the payload should be dropped: %v, %v", d, err)
+	}
+	d, err = s.decode(nil, "a", []byte(`{"temperature":40}`))
+	if err != nil || d == nil {
+		t.Errorf("the payload should be emitted: %v, %v", d, err)
+	}
+	if s.filtered != 1 {
+		t.Errorf("wrong number of filtered payloads: %v", s.filtered)
+	}
+}
@@ -0,0 +1,114 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// payloadFormat is the format of payloads decoded by the source.
+type payloadFormat int
+
+const (
+	// blobFormat emits payloads as blobs without decoding them.
+	blobFormat payloadFormat = iota
+
+	// jsonFormat decodes payloads as JSON.
+	jsonFormat
+
+	// csvFormat decodes payloads as CSV. Each row is emitted as a tuple, so
+	// the source decodes them by csvConfig instead of decode.
+	csvFormat
+)
+
+func parseFormat(s string) (payloadFormat, error) {
+	switch s {
+	case "blob":
+		return blobFormat, nil
+	case "json":
+		return jsonFormat, nil
+	case "csv":
+		return csvFormat, nil
+	default:
+		return 0, fmt.Errorf("unknown format: %v", s)
+	}
+}
+
+func (f payloadFormat) String() string {
+	switch f {
+	case jsonFormat:
+		return "json"
+	case csvFormat:
+		return "csv"
+	default:
+		return "blob"
+	}
+}
+
+// decode decodes a payload.
+func (f payloadFormat) decode(b []byte) (data.Value, error) {
+	switch f {
+	case jsonFormat:
+		return decodeJSON(b)
+	default:
+		return data.Blob(b), nil
+	}
+}
+
+// emptyPayload is how the source emits messages having zero-length payloads,
+// which are used as signals such as clearing retained messages. They're never
+// decoded.
+type emptyPayload int
+
+const (
+	// emptyAsBlob emits an empty blob as the payload.
+	emptyAsBlob emptyPayload = iota
+
+	// emptyAsNull emits null as the payload.
+	emptyAsNull
+
+	// dropEmpty doesn't emit messages having empty payloads.
+	dropEmpty
+)
+
+func parseEmptyPayload(s string) (emptyPayload, error) {
+	switch s {
+	case "blob":
+		return emptyAsBlob, nil
+	case "null":
+		return emptyAsNull, nil
+	case "drop":
+		return dropEmpty, nil
+	default:
+		return 0, fmt.Errorf("unknown empty_payload: %v", s)
+	}
+}
+
+func (e emptyPayload) String() string {
+	switch e {
+	case emptyAsNull:
+		return "null"
+	case dropEmpty:
+		return "drop"
+	default:
+		return "blob"
+	}
+}
+
+// decodeBase64 decodes a base64 payload, which some bridges use to carry
+// binary payloads as JSON-safe strings. Surrounding white spaces and double
+// quotes of a JSON string are ignored.
+func decodeBase64(b []byte) ([]byte, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) >= 2 && b[0] == '"' && b[len(b)-1] == '"' {
+		b = b[1 : len(b)-1]
+	}
+	res := make([]byte, base64.StdEncoding.DecodedLen(len(b)))
+	n, err := base64.StdEncoding.Decode(res, b)
+	if err != nil {
+		return nil, err
+	}
+	return res[:n], nil
+}
@@ -0,0 +1,77 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestSourceEmptyPayload(t *testing.T) {
+	cases := []struct {
+		empty    emptyPayload
+		expected data.Value
+	}{
+		{emptyAsBlob, data.Map{"topic": data.String("a"), "payload": data.Blob{}}},
+		{emptyAsNull, data.Map{"topic": data.String("a"), "payload": data.Null{}}},
+		{dropEmpty, nil},
+	}
+	for _, c := range cases {
+		// Empty payloads aren't decoded as JSON.
+		s := &source{format: jsonFormat, empty: c.empty}
+		d, err := s.decode(nil, "a", nil)
+		if err != nil {
+			t.Errorf("%v: %v", c.empty, err)
+			continue
+		}
+		if c.expected == nil {
+			if d != nil {
+				t.Errorf("%v: the message should be dropped: %v", c.empty, d)
+			}
+			continue
+		}
+		if !data.Equal(c.expected, d) {
+			t.Errorf("%v: expected %v, actual %v", c.empty, c.expected, d)
+		}
+	}
+
+	if _, err := parseEmptyPayload("empty"); err == nil {
+		t.Error("an unknown value should be rejected")
+	}
+}
+
+func TestSourceDecodeBase64(t *testing.T) {
+	s := &source{format: jsonFormat, base64: true}
+	for _, p := range []string{
+		`eyJhIjoxfQ==`,
+		`"eyJhIjoxfQ=="`,
+		" eyJhIjoxfQ==\n",
+	} {
+		d, err := s.decode(nil, "a", []byte(p))
+		if err != nil {
+			t.Errorf("%q: %v", p, err)
+			continue
+		}
+		expected := data.Map{"topic": data.String("a"), "payload": data.Map{"a": data.Int(1)}}
+		if !data.Equal(expected, d) {
+			t.Errorf("%q: expected %v, actual %v", p, expected, d)
+		}
+	}
+
+	if _, err := s.decode(nil, "a", []byte(`{"a":1}`)); err == nil {
+		t.Error("a payload which isn't base64 encoded should be rejected")
+	}
+}
+
+func TestMessageConverterNullPayload(t *testing.T) {
+	c := newMessageConverter()
+	c.defaultTopic = "a"
+	c.envelopeSchema = "test"
+	m, err := c.convert(core.NewTuple(data.Map{"payload": data.Null{}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.payload) != 0 {
+		t.Errorf("null should be published as an empty payload: %v", string(m.payload))
+	}
+}
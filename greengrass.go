@@ -0,0 +1,113 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// greengrassDiscovery finds the endpoint of the local AWS IoT Greengrass core
+// by the Greengrass discovery API.
+type greengrassDiscovery struct {
+	url string
+}
+
+// newGreengrassDiscovery creates a greengrassDiscovery from
+// greengrass_thing_name and greengrass_discovery_endpoint parameters. It
+// returns nil when neither of them is given.
+func newGreengrassDiscovery(params data.Map) (*greengrassDiscovery, error) {
+	tv, tok := params["greengrass_thing_name"]
+	ev, eok := params["greengrass_discovery_endpoint"]
+	if !tok && !eok {
+		return nil, nil
+	}
+	if !tok {
+		return nil, errors.New("greengrass_discovery_endpoint requires greengrass_thing_name")
+	}
+	if !eok {
+		return nil, errors.New("greengrass_thing_name requires greengrass_discovery_endpoint")
+	}
+
+	thing, err := data.AsString(tv)
+	if err != nil {
+		return nil, err
+	}
+	if thing == "" {
+		return nil, errors.New("greengrass_thing_name must not be empty")
+	}
+	endpoint, err := data.AsString(ev)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		// The discovery API listens on 8443 by default.
+		endpoint = net.JoinHostPort(endpoint, "8443")
+	}
+	return &greengrassDiscovery{
+		url: "https://" + endpoint + "/greengrass/discover/thing/" + url.PathEscape(thing),
+	}, nil
+}
+
+// discover returns the broker URLs of Greengrass cores and the pool of group
+// CAs verifying them. cfg is used to authenticate the thing by its client
+// certificate.
+func (g *greengrassDiscovery) discover(cfg *tls.Config) ([]string, *x509.CertPool, error) {
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: cfg},
+	}
+	res, err := client.Get(g.url)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("greengrass discovery returned status %v: %v", res.StatusCode, string(body))
+	}
+
+	var discovered struct {
+		GGGroups []struct {
+			Cores []struct {
+				Connectivity []struct {
+					HostAddress string `json:"HostAddress"`
+					PortNumber  int    `json:"PortNumber"`
+				} `json:"Connectivity"`
+			} `json:"Cores"`
+			CAs []string `json:"CAs"`
+		} `json:"GGGroups"`
+	}
+	if err := json.Unmarshal(body, &discovered); err != nil {
+		return nil, nil, err
+	}
+
+	var brokers []string
+	pool := x509.NewCertPool()
+	for _, g := range discovered.GGGroups {
+		for _, ca := range g.CAs {
+			pool.AppendCertsFromPEM([]byte(ca))
+		}
+		for _, c := range g.Cores {
+			for _, conn := range c.Connectivity {
+				brokers = append(brokers, "ssl://"+net.JoinHostPort(conn.HostAddress, strconv.Itoa(conn.PortNumber)))
+			}
+		}
+	}
+	if len(brokers) == 0 {
+		return nil, nil, errors.New("greengrass discovery didn't return any core")
+	}
+	return brokers, pool, nil
+}
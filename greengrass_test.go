@@ -0,0 +1,96 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestGreengrassDiscovery(t *testing.T) {
+	// The certificate of the test server is used as a group CA.
+	var caPEM string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := r.URL.EscapedPath(); p != "/greengrass/discover/thing/sensor%2F1" {
+			t.Errorf("wrong path: %v", p)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"GGGroups": []interface{}{
+				map[string]interface{}{
+					"GGGroupId": "group",
+					"Cores": []interface{}{
+						map[string]interface{}{
+							"thingArn": "arn:aws:iot:us-east-1:000000000000:thing/core",
+							"Connectivity": []interface{}{
+								map[string]interface{}{"HostAddress": "192.168.0.10", "PortNumber": 8883},
+								map[string]interface{}{"HostAddress": "::1", "PortNumber": 8883},
+							},
+						},
+					},
+					"CAs": []string{caPEM},
+				},
+			},
+		})
+	}))
+	defer server.Close()
+	caPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	g, err := newGreengrassDiscovery(data.Map{
+		"greengrass_thing_name":         data.String("sensor/1"),
+		"greengrass_discovery_endpoint": data.String(strings.TrimPrefix(server.URL, "https://")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	brokers, pool, err := g.discover(&tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(brokers) != 2 || brokers[0] != "ssl://192.168.0.10:8883" || brokers[1] != "ssl://[::1]:8883" {
+		t.Errorf("wrong brokers: %v", brokers)
+	}
+	if _, err := server.Certificate().Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+		t.Errorf("the pool should have the group CA: %v", err)
+	}
+
+	// The server isn't trusted without the CA.
+	if _, _, err := g.discover(&tls.Config{}); err == nil {
+		t.Error("the discovery should fail")
+	}
+}
+
+func TestNewGreengrassDiscovery(t *testing.T) {
+	if g, err := newGreengrassDiscovery(data.Map{}); err != nil || g != nil {
+		t.Errorf("greengrassDiscovery shouldn't be created without the parameter: %v, %v", g, err)
+	}
+
+	g, err := newGreengrassDiscovery(data.Map{
+		"greengrass_thing_name":         data.String("sensor"),
+		"greengrass_discovery_endpoint": data.String("greengrass-ats.iot.us-east-1.amazonaws.com"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.url != "https://greengrass-ats.iot.us-east-1.amazonaws.com:8443/greengrass/discover/thing/sensor" {
+		t.Errorf("wrong URL: %v", g.url)
+	}
+
+	for _, params := range []data.Map{
+		{"greengrass_thing_name": data.String("sensor")},
+		{"greengrass_discovery_endpoint": data.String("greengrass-ats.iot.us-east-1.amazonaws.com")},
+		{"greengrass_thing_name": data.String(""), "greengrass_discovery_endpoint": data.String("localhost")},
+	} {
+		if _, err := newGreengrassDiscovery(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+const defaultDiscoveryPrefix = "homeassistant"
+
+// homeAssistant decodes messages following the MQTT discovery of Home
+// Assistant. Entities are configured by retained messages published to
+//
+//	<discovery_prefix>/<component>/[<node_id>/]<object_id>/config
+//
+// and their states published to state topics given in the configs are
+// emitted with metadata of the entities.
+type homeAssistant struct {
+	prefix string
+
+	m sync.RWMutex
+
+	// entities is a map from config topics to entities.
+	entities map[string]*haEntity
+
+	// states is a map from state topics to config topics of entities having
+	// the state topic. Multiple entities can share a state topic and extract
+	// their states from JSON by value templates.
+	states map[string]map[string]struct{}
+}
+
+// haEntity is an entity configured by a discovery message.
+type haEntity struct {
+	id          string
+	component   string
+	name        string
+	unit        string
+	deviceClass string
+	stateTopic  string
+
+	// value is the path to the state in JSON given by value_template. It's
+	// nil when the state is emitted as it is.
+	value data.Path
+}
+
+func newHomeAssistant(prefix string) *homeAssistant {
+	return &homeAssistant{
+		prefix:   prefix,
+		entities: map[string]*haEntity{},
+		states:   map[string]map[string]struct{}{},
+	}
+}
+
+func (h *homeAssistant) String() string {
+	return "home_assistant"
+}
+
+func (h *homeAssistant) decode(topic string, payload []byte) ([]data.Map, error) {
+	if component, objectID, ok := h.parseConfigTopic(topic); ok {
+		if len(payload) == 0 {
+			// an empty config removes the entity
+			h.remove(topic)
+			return nil, nil
+		}
+		e, err := parseHAEntity(component, objectID, payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid discovery config: %v", err)
+		}
+		h.set(topic, e)
+		return nil, nil
+	}
+
+	entities := h.lookup(topic)
+	if len(entities) == 0 {
+		return nil, nil
+	}
+	var ds []data.Map
+	for _, e := range entities {
+		v, err := e.state(payload)
+		if err != nil {
+			return ds, fmt.Errorf("invalid state of %v: %v", e.id, err)
+		}
+		d := data.Map{
+			"topic":     data.String(topic),
+			"entity":    data.String(e.id),
+			"component": data.String(e.component),
+			"state":     v,
+		}
+		if e.name != "" {
+			d["name"] = data.String(e.name)
+		}
+		if e.unit != "" {
+			d["unit"] = data.String(e.unit)
+		}
+		if e.deviceClass != "" {
+			d["device_class"] = data.String(e.deviceClass)
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// parseConfigTopic returns the component and the object ID of a config
+// topic. It returns false when the topic isn't a config topic.
+func (h *homeAssistant) parseConfigTopic(topic string) (component, objectID string, ok bool) {
+	if !strings.HasPrefix(topic, h.prefix+"/") {
+		return "", "", false
+	}
+	levels := strings.Split(topic[len(h.prefix)+1:], "/")
+	if (len(levels) != 3 && len(levels) != 4) || levels[len(levels)-1] != "config" {
+		return "", "", false
+	}
+	return levels[0], levels[len(levels)-2], true
+}
+
+func (h *homeAssistant) set(configTopic string, e *haEntity) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.removeLocked(configTopic)
+	h.entities[configTopic] = e
+	ts, ok := h.states[e.stateTopic]
+	if !ok {
+		ts = map[string]struct{}{}
+		h.states[e.stateTopic] = ts
+	}
+	ts[configTopic] = struct{}{}
+}
+
+func (h *homeAssistant) remove(configTopic string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.removeLocked(configTopic)
+}
+
+func (h *homeAssistant) removeLocked(configTopic string) {
+	e, ok := h.entities[configTopic]
+	if !ok {
+		return
+	}
+	delete(h.entities, configTopic)
+	delete(h.states[e.stateTopic], configTopic)
+	if len(h.states[e.stateTopic]) == 0 {
+		delete(h.states, e.stateTopic)
+	}
+}
+
+// lookup returns entities having the state topic in the order of their
+// config topics.
+func (h *homeAssistant) lookup(stateTopic string) []*haEntity {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	ts := h.states[stateTopic]
+	configTopics := make([]string, 0, len(ts))
+	for t := range ts {
+		configTopics = append(configTopics, t)
+	}
+	sort.Strings(configTopics)
+	entities := make([]*haEntity, len(configTopics))
+	for i, t := range configTopics {
+		entities[i] = h.entities[t]
+	}
+	return entities
+}
+
+// haValueTemplate matches value templates which only refer to a field of
+// JSON states.
+var haValueTemplate = regexp.MustCompile(`^\{\{\s*value_json\.([A-Za-z_][A-Za-z0-9_.]*)\s*\}\}$`)
+
+// parseHAEntity parses a discovery config. Abbreviated keys and "~", which
+// is replaced with the base topic, are supported.
+func parseHAEntity(component, objectID string, payload []byte) (*haEntity, error) {
+	var c map[string]interface{}
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, err
+	}
+	str := func(keys ...string) string {
+		for _, k := range keys {
+			if s, ok := c[k].(string); ok {
+				return s
+			}
+		}
+		return ""
+	}
+
+	e := &haEntity{
+		id:          str("unique_id", "uniq_id"),
+		component:   component,
+		name:        str("name"),
+		unit:        str("unit_of_measurement", "unit_of_meas"),
+		deviceClass: str("device_class", "dev_cla"),
+		stateTopic:  str("state_topic", "stat_t"),
+	}
+	if e.id == "" {
+		e.id = objectID
+	}
+	if base := str("~"); base != "" {
+		if strings.HasPrefix(e.stateTopic, "~") {
+			e.stateTopic = base + e.stateTopic[1:]
+		} else if strings.HasSuffix(e.stateTopic, "~") {
+			e.stateTopic = e.stateTopic[:len(e.stateTopic)-1] + base
+		}
+	}
+	if e.stateTopic == "" {
+		return nil, fmt.Errorf("%v doesn't have state_topic", e.id)
+	}
+
+	if tmpl := str("value_template", "val_tpl"); tmpl != "" {
+		m := haValueTemplate.FindStringSubmatch(strings.TrimSpace(tmpl))
+		if m == nil {
+			return nil, fmt.Errorf("unsupported value_template of %v: %v", e.id, tmpl)
+		}
+		p, err := data.CompilePath(m[1])
+		if err != nil {
+			return nil, err
+		}
+		e.value = p
+	}
+	return e, nil
+}
+
+// state converts a state payload into a value. States are decoded as JSON
+// when possible, for example, "21.5" is converted to a float, and emitted as
+// strings like "ON" otherwise.
+func (e *haEntity) state(payload []byte) (data.Value, error) {
+	v, err := decodeJSON(payload)
+	if e.value == nil {
+		if err != nil {
+			return data.String(payload), nil
+		}
+		return v, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(data.Map)
+	if !ok {
+		return nil, fmt.Errorf("the state must be a JSON object: %v", v)
+	}
+	return m.Get(e.value)
+}
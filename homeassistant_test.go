@@ -0,0 +1,105 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseConventionDiscoveryPrefix(t *testing.T) {
+	for _, params := range []data.Map{
+		{"discovery_prefix": data.String("ha")},
+		{"convention": data.String("homie"), "discovery_prefix": data.String("ha")},
+		{"convention": data.String("home_assistant"), "discovery_prefix": data.String("ha/#")},
+	} {
+		if _, err := parseConvention(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+	c, err := parseConvention(data.Map{
+		"convention":       data.String("home_assistant"),
+		"discovery_prefix": data.String("ha"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.(*homeAssistant).prefix != "ha" {
+		t.Errorf("wrong discovery prefix: %v", c.(*homeAssistant).prefix)
+	}
+}
+
+func TestHomeAssistantDecode(t *testing.T) {
+	h := newHomeAssistant(defaultDiscoveryPrefix)
+	for topic, payload := range map[string]string{
+		"homeassistant/sensor/room/temperature/config": `{"name":"Temperature","uniq_id":"room_temperature","~":"room/sensor","stat_t":"~","unit_of_meas":"°C","dev_cla":"temperature","val_tpl":"{{ value_json.temperature }}"}`,
+		"homeassistant/sensor/room/humidity/config":    `{"name":"Humidity","state_topic":"room/sensor","unit_of_measurement":"%","value_template":"{{value_json.humidity}}"}`,
+		"homeassistant/switch/light/config":            `{"state_topic":"light/state"}`,
+	} {
+		ds, err := h.decode(topic, []byte(payload))
+		if err != nil || ds != nil {
+			t.Fatalf("%v shouldn't be emitted: %v, %v", topic, ds, err)
+		}
+	}
+
+	ds, err := h.decode("room/sensor", []byte(`{"temperature":21.5,"humidity":40}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []data.Map{
+		{
+			"topic":     data.String("room/sensor"),
+			"entity":    data.String("humidity"),
+			"component": data.String("sensor"),
+			"state":     data.Int(40),
+			"name":      data.String("Humidity"),
+			"unit":      data.String("%"),
+		},
+		{
+			"topic":        data.String("room/sensor"),
+			"entity":       data.String("room_temperature"),
+			"component":    data.String("sensor"),
+			"state":        data.Float(21.5),
+			"name":         data.String("Temperature"),
+			"unit":         data.String("°C"),
+			"device_class": data.String("temperature"),
+		},
+	}
+	if len(ds) != len(expected) {
+		t.Fatalf("a tuple should be emitted for each entity: %v", ds)
+	}
+	for i, d := range ds {
+		if !data.Equal(expected[i], d) {
+			t.Errorf("expected %v, actual %v", expected[i], d)
+		}
+	}
+
+	ds, err = h.decode("light/state", []byte("ON"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1 || !data.Equal(ds[0]["state"], data.String("ON")) {
+		t.Errorf("the state should be emitted as a string: %v", ds)
+	}
+
+	if ds, err := h.decode("unknown/state", []byte("1")); err != nil || ds != nil {
+		t.Errorf("states of unknown entities shouldn't be emitted: %v, %v", ds, err)
+	}
+
+	// an empty config removes the entity
+	if _, err := h.decode("homeassistant/switch/light/config", nil); err != nil {
+		t.Fatal(err)
+	}
+	if ds, err := h.decode("light/state", []byte("OFF")); err != nil || ds != nil {
+		t.Errorf("states of removed entities shouldn't be emitted: %v, %v", ds, err)
+	}
+
+	for _, payload := range []string{
+		`{"name":"x"}`,
+		`{"state_topic":"a","value_template":"{{ value | int }}"}`,
+		`[]`,
+	} {
+		if _, err := h.decode("homeassistant/sensor/x/config", []byte(payload)); err == nil {
+			t.Errorf("%v should be rejected", payload)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package mqtt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// homie decodes messages following the Homie convention 4.x, which describes
+// devices, their nodes, and properties of nodes by attribute topics starting
+// with "$":
+//
+//	homie/<device>/$name
+//	homie/<device>/<node>/$properties
+//	homie/<device>/<node>/<property>/$datatype
+//	homie/<device>/<node>/<property>
+//
+// Attributes are tracked and values of properties are emitted with the
+// device, the node, the property, and the datatype. The first level of topics
+// is regarded as the base topic, which is "homie" by default.
+type homie struct {
+	m sync.RWMutex
+
+	// attributes is a map from topics without "/$<attribute>" to attributes
+	// of devices, nodes, and properties.
+	attributes map[string]map[string]string
+}
+
+func newHomie() *homie {
+	return &homie{
+		attributes: map[string]map[string]string{},
+	}
+}
+
+func (h *homie) decode(topic string, payload []byte) ([]data.Map, error) {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 3 {
+		return nil, nil
+	}
+
+	last := levels[len(levels)-1]
+	if strings.HasPrefix(last, "$") {
+		// attributes of devices, nodes, or properties
+		h.setAttribute(strings.Join(levels[:len(levels)-1], "/"), last[1:], string(payload))
+		return nil, nil
+	}
+	if len(levels) != 4 {
+		// "set" topics of settable properties are commands to devices
+		return nil, nil
+	}
+
+	device, node, property := levels[1], levels[2], levels[3]
+	attrs := h.propertyAttributes(topic)
+	datatype := attrs["datatype"]
+	if datatype == "" {
+		datatype = "string"
+	}
+	v, err := homieValue(datatype, string(payload))
+	if err != nil {
+		return nil, fmt.Errorf("invalid value of %v: %v", datatype, err)
+	}
+
+	d := data.Map{
+		"topic":    data.String(topic),
+		"device":   data.String(device),
+		"node":     data.String(node),
+		"property": data.String(property),
+		"datatype": data.String(datatype),
+		"value":    v,
+	}
+	if name, ok := attrs["name"]; ok {
+		d["name"] = data.String(name)
+	}
+	if unit, ok := attrs["unit"]; ok {
+		d["unit"] = data.String(unit)
+	}
+	return []data.Map{d}, nil
+}
+
+func (h *homie) String() string {
+	return "homie"
+}
+
+// setAttribute sets an attribute of the device, the node, or the property
+// having the topic. An empty value removes the attribute.
+func (h *homie) setAttribute(topic, name, value string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	attrs, ok := h.attributes[topic]
+	if value == "" {
+		if ok {
+			delete(attrs, name)
+			if len(attrs) == 0 {
+				delete(h.attributes, topic)
+			}
+		}
+		return
+	}
+	if !ok {
+		attrs = map[string]string{}
+		h.attributes[topic] = attrs
+	}
+	attrs[name] = value
+}
+
+// propertyAttributes returns a copy of attributes of the property.
+func (h *homie) propertyAttributes(topic string) map[string]string {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	attrs := make(map[string]string, len(h.attributes[topic]))
+	for k, v := range h.attributes[topic] {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// homieValue converts a payload into a value of the datatype. Enums, colors,
+// and durations are emitted as strings.
+func homieValue(datatype, payload string) (data.Value, error) {
+	switch datatype {
+	case "integer":
+		i, err := strconv.ParseInt(payload, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return data.Int(i), nil
+	case "float":
+		f, err := strconv.ParseFloat(payload, 64)
+		if err != nil {
+			return nil, err
+		}
+		return data.Float(f), nil
+	case "boolean":
+		switch payload {
+		case "true":
+			return data.Bool(true), nil
+		case "false":
+			return data.Bool(false), nil
+		default:
+			return nil, fmt.Errorf("'%v' isn't a boolean", payload)
+		}
+	case "datetime":
+		t, err := time.Parse(time.RFC3339Nano, payload)
+		if err != nil {
+			return nil, err
+		}
+		return data.Timestamp(t), nil
+	default:
+		return data.String(payload), nil
+	}
+}
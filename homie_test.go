@@ -0,0 +1,150 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseConvention(t *testing.T) {
+	for _, params := range []data.Map{
+		{"convention": data.String("unknown")},
+		{"convention": data.Int(1)},
+	} {
+		if _, err := parseConvention(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+	if c, err := parseConvention(data.Map{"convention": data.String("none")}); err != nil || c != nil {
+		t.Errorf("none shouldn't create a convention: %v, %v", c, err)
+	}
+}
+
+func TestHomieDecode(t *testing.T) {
+	h := newHomie()
+	for topic, payload := range map[string]string{
+		"homie/thermostat/$name":                            "Thermostat",
+		"homie/thermostat/$nodes":                           "room",
+		"homie/thermostat/room/$properties":                 "temperature,open,since",
+		"homie/thermostat/room/temperature/$name":           "Temperature",
+		"homie/thermostat/room/temperature/$datatype":       "float",
+		"homie/thermostat/room/temperature/$unit":           "°C",
+		"homie/thermostat/room/open/$datatype":              "boolean",
+		"homie/thermostat/room/since/$datatype":             "datetime",
+		"homie/thermostat/room/temperature/$settable":       "true",
+		"homie/thermostat/room/temperature/set":             "25",
+		"homie/thermostat/room/temperature/$format":         "",
+		"homie/thermostat/room/temperature/$retained":       "true",
+		"homie/thermostat/room/temperature/$retained/extra": "x",
+	} {
+		d, err := h.decode(topic, []byte(payload))
+		if err != nil || d != nil {
+			t.Errorf("%v shouldn't be emitted: %v, %v", topic, d, err)
+		}
+	}
+
+	cases := []struct {
+		topic    string
+		payload  string
+		expected data.Map
+	}{
+		{
+			"homie/thermostat/room/temperature", "21.5",
+			data.Map{
+				"topic":    data.String("homie/thermostat/room/temperature"),
+				"device":   data.String("thermostat"),
+				"node":     data.String("room"),
+				"property": data.String("temperature"),
+				"datatype": data.String("float"),
+				"value":    data.Float(21.5),
+				"name":     data.String("Temperature"),
+				"unit":     data.String("°C"),
+			},
+		},
+		{
+			"homie/thermostat/room/open", "true",
+			data.Map{
+				"topic":    data.String("homie/thermostat/room/open"),
+				"device":   data.String("thermostat"),
+				"node":     data.String("room"),
+				"property": data.String("open"),
+				"datatype": data.String("boolean"),
+				"value":    data.Bool(true),
+			},
+		},
+		{
+			"homie/thermostat/room/since", "2024-01-02T03:04:05Z",
+			data.Map{
+				"topic":    data.String("homie/thermostat/room/since"),
+				"device":   data.String("thermostat"),
+				"node":     data.String("room"),
+				"property": data.String("since"),
+				"datatype": data.String("datetime"),
+				"value":    data.Timestamp(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)),
+			},
+		},
+		{
+			"homie/thermostat/room/mode", "auto",
+			data.Map{
+				"topic":    data.String("homie/thermostat/room/mode"),
+				"device":   data.String("thermostat"),
+				"node":     data.String("room"),
+				"property": data.String("mode"),
+				"datatype": data.String("string"),
+				"value":    data.String("auto"),
+			},
+		},
+	}
+	for _, c := range cases {
+		ds, err := h.decode(c.topic, []byte(c.payload))
+		if err != nil {
+			t.Errorf("%v: %v", c.topic, err)
+			continue
+		}
+		if len(ds) != 1 || !data.Equal(c.expected, ds[0]) {
+			t.Errorf("%v: expected %v, actual %v", c.topic, c.expected, ds)
+		}
+	}
+
+	if _, err := h.decode("homie/thermostat/room/open", []byte("yes")); err == nil {
+		t.Error("an invalid boolean should be rejected")
+	}
+
+	// an empty payload removes the attribute
+	if _, err := h.decode("homie/thermostat/room/temperature/$unit", nil); err != nil {
+		t.Fatal(err)
+	}
+	ds, err := h.decode("homie/thermostat/room/temperature", []byte("22"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ds[0]["unit"]; ok {
+		t.Errorf("the removed unit shouldn't be emitted: %v", ds)
+	}
+}
+
+func TestSourceHomie(t *testing.T) {
+	if _, err := NewSource(core.NewContext(nil), &bql.IOParams{}, data.Map{
+		"topic":      data.String("homie/#"),
+		"convention": data.String("homie"),
+		"format":     data.String("json"),
+	}); err == nil {
+		t.Error("convention shouldn't be specified with format")
+	}
+
+	s := &source{convention: newHomie()}
+	ctx := core.NewContext(nil)
+	if ds, err := s.decodeMessage(ctx, "homie/d/n/p/$datatype", []byte("integer")); err != nil || ds != nil {
+		t.Fatalf("the attribute shouldn't be emitted: %v, %v", ds, err)
+	}
+	ds, err := s.decodeMessage(ctx, "homie/d/n/p", []byte("42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1 || !data.Equal(ds[0]["value"], data.Int(42)) {
+		t.Errorf("the value should be emitted as an integer: %v", ds)
+	}
+}
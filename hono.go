@@ -0,0 +1,97 @@
+package mqtt
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"strings"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// hono decodes telemetry and events published to the MQTT adapter of Eclipse
+// Hono:
+//
+//	telemetry/<tenant>/<device>/?content-type=application%2Fjson
+//	event/<tenant>/<device>
+//
+// "t" and "e" are accepted as short names of telemetry and event. The tenant
+// and the device can be omitted when devices are authenticated, and the
+// property bag, which is the last level starting with "?", is optional.
+type hono struct{}
+
+func (hono) String() string {
+	return "hono"
+}
+
+func (hono) decode(topic string, payload []byte) ([]data.Map, error) {
+	levels := strings.Split(topic, "/")
+	var kind string
+	switch levels[0] {
+	case "telemetry", "t":
+		kind = "telemetry"
+	case "event", "e":
+		kind = "event"
+	default:
+		return nil, nil
+	}
+
+	var props url.Values
+	if last := levels[len(levels)-1]; strings.HasPrefix(last, "?") {
+		p, err := url.ParseQuery(last[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid property bag: %v", err)
+		}
+		props = p
+		levels = levels[:len(levels)-1]
+	}
+	if len(levels) != 1 && len(levels) != 3 {
+		return nil, nil
+	}
+
+	d := data.Map{
+		"topic": data.String(topic),
+		"kind":  data.String(kind),
+	}
+	if len(levels) == 3 {
+		if levels[1] != "" {
+			d["tenant"] = data.String(levels[1])
+		}
+		if levels[2] != "" {
+			d["device_id"] = data.String(levels[2])
+		}
+	}
+
+	contentType := props.Get("content-type")
+	if contentType == "" {
+		d["payload"] = data.Blob(payload)
+		return []data.Map{d}, nil
+	}
+	d["content_type"] = data.String(contentType)
+	v, err := honoPayload(contentType, payload)
+	if err != nil {
+		return nil, err
+	}
+	d["payload"] = v
+	return []data.Map{d}, nil
+}
+
+// honoPayload decodes the payload according to the content type. JSON is
+// decoded, text is emitted as a string, and others are emitted as blobs.
+func honoPayload(contentType string, payload []byte) (data.Value, error) {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content-type: %v", err)
+	}
+	switch {
+	case t == "application/json" || strings.HasSuffix(t, "+json"):
+		if len(payload) == 0 {
+			return data.Null{}, nil
+		}
+		return decodeJSON(payload)
+	case strings.HasPrefix(t, "text/"):
+		return data.String(payload), nil
+	default:
+		return data.Blob(payload), nil
+	}
+}
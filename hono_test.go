@@ -0,0 +1,66 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestHonoDecode(t *testing.T) {
+	cases := []struct {
+		topic    string
+		payload  string
+		expected data.Map
+	}{
+		{
+			"telemetry/DEFAULT_TENANT/4711/?content-type=application%2Fjson",
+			`{"temperature":21.5}`,
+			data.Map{
+				"topic":        data.String("telemetry/DEFAULT_TENANT/4711/?content-type=application%2Fjson"),
+				"kind":         data.String("telemetry"),
+				"tenant":       data.String("DEFAULT_TENANT"),
+				"device_id":    data.String("4711"),
+				"content_type": data.String("application/json"),
+				"payload":      data.Map{"temperature": data.Float(21.5)},
+			},
+		},
+		{
+			"e/?content-type=text%2Fplain%3B%20charset%3Dutf-8",
+			"alarm",
+			data.Map{
+				"topic":        data.String("e/?content-type=text%2Fplain%3B%20charset%3Dutf-8"),
+				"kind":         data.String("event"),
+				"content_type": data.String("text/plain; charset=utf-8"),
+				"payload":      data.String("alarm"),
+			},
+		},
+		{
+			"t",
+			"\x01",
+			data.Map{
+				"topic":   data.String("t"),
+				"kind":    data.String("telemetry"),
+				"payload": data.Blob{1},
+			},
+		},
+	}
+	for _, c := range cases {
+		ds, err := hono{}.decode(c.topic, []byte(c.payload))
+		if err != nil {
+			t.Errorf("%v: %v", c.topic, err)
+			continue
+		}
+		if len(ds) != 1 || !data.Equal(c.expected, ds[0]) {
+			t.Errorf("%v: expected %v, actual %v", c.topic, c.expected, ds)
+		}
+	}
+
+	for _, topic := range []string{"command/tenant/device", "telemetry/tenant", "telemetry/a/b/c"} {
+		if ds, err := (hono{}).decode(topic, []byte("1")); err != nil || ds != nil {
+			t.Errorf("%v shouldn't be emitted: %v, %v", topic, ds, err)
+		}
+	}
+	if _, err := (hono{}).decode("t/a/b/?content-type=application%2Fjson", []byte("{")); err == nil {
+		t.Error("invalid JSON should be rejected")
+	}
+}
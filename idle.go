@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// idleAction is what a source does when no message arrives for a while.
+type idleAction int
+
+const (
+	// idleReconnect disconnects the client and connects to the broker again.
+	idleReconnect idleAction = iota
+
+	// idleAlert emits an alert tuple.
+	idleAlert
+)
+
+func parseIdleAction(s string) (idleAction, error) {
+	switch s {
+	case "reconnect":
+		return idleReconnect, nil
+	case "alert":
+		return idleAlert, nil
+	default:
+		return 0, fmt.Errorf("unknown idle action: %v", s)
+	}
+}
+
+// idleWatchdog detects connections which look alive but don't deliver
+// messages, which happens behind some NATs dropping idle TCP connections
+// silently.
+type idleWatchdog struct {
+	timeout time.Duration
+	action  idleAction
+
+	// last is the time in Unix nanoseconds when a message arrived or the
+	// client connected. It must be accessed atomically.
+	last int64
+}
+
+// touch records that the connection is active.
+func (d *idleWatchdog) touch() {
+	atomic.StoreInt64(&d.last, time.Now().UnixNano())
+}
+
+// run calls onIdle with the idle time whenever the connection has been idle
+// for the timeout until stop is closed. The idle time is counted again from
+// onIdle.
+func (d *idleWatchdog) run(stop <-chan struct{}, onIdle func(idle time.Duration)) {
+	d.touch()
+	t := time.NewTimer(d.timeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&d.last)))
+		if idle >= d.timeout {
+			onIdle(idle)
+			d.touch()
+			idle = 0
+		}
+		t.Reset(d.timeout - idle)
+	}
+}
@@ -0,0 +1,67 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleWatchdog(t *testing.T) {
+	d := &idleWatchdog{timeout: 20 * time.Millisecond}
+	idle := make(chan time.Duration, 10)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.run(stop, func(i time.Duration) {
+			idle <- i
+		})
+	}()
+
+	// The watchdog doesn't fire while messages arrive.
+	for i := 0; i < 10; i++ {
+		time.Sleep(5 * time.Millisecond)
+		d.touch()
+	}
+	select {
+	case i := <-idle:
+		t.Fatalf("the watchdog shouldn't fire while active: %v", i)
+	default:
+	}
+
+	select {
+	case i := <-idle:
+		if i < d.timeout {
+			t.Errorf("the idle time should be at least the timeout: %v", i)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the watchdog should fire")
+	}
+
+	// The watchdog fires repeatedly while idle.
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Fatal("the watchdog should fire again")
+	}
+
+	close(stop)
+	<-done
+}
+
+func TestParseIdleAction(t *testing.T) {
+	cases := map[string]idleAction{
+		"reconnect": idleReconnect,
+		"alert":     idleAlert,
+	}
+	for s, expected := range cases {
+		a, err := parseIdleAction(s)
+		if err != nil {
+			t.Errorf("%v: %v", s, err)
+		} else if a != expected {
+			t.Errorf("%v: expected %v, actual %v", s, expected, a)
+		}
+	}
+	if _, err := parseIdleAction("ignore"); err == nil {
+		t.Error("an unknown action should be rejected")
+	}
+}
@@ -0,0 +1,109 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// topicInflight limits the number of messages published at once to each
+// topic matching a topic filter. It allows ordered command topics to be
+// published one at a time while other topics are published concurrently
+// when the sink is written by multiple streams.
+type topicInflight struct {
+	// limits is a map from topic filters to the maximum numbers of messages
+	// published at once to each topic matching them.
+	limits map[string]int
+
+	m    sync.Mutex
+	cond *sync.Cond
+
+	// inflight has the number of messages being published to each topic.
+	// Topics are removed when no message is being published to them.
+	inflight map[string]int
+}
+
+// parseTopicInflight parses the topic_inflight parameter. It returns nil when
+// the parameter isn't given.
+func parseTopicInflight(params data.Map) (*topicInflight, error) {
+	v, ok := params["topic_inflight"]
+	if !ok {
+		return nil, nil
+	}
+	m, err := data.AsMap(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(m) == 0 {
+		return nil, errors.New("topic_inflight must have at least one topic filter")
+	}
+
+	t := &topicInflight{
+		limits:   map[string]int{},
+		inflight: map[string]int{},
+	}
+	t.cond = sync.NewCond(&t.m)
+	for f, v := range m {
+		if err := validateTopicFilter(f); err != nil {
+			return nil, fmt.Errorf("topic_inflight has an invalid topic filter: %v", err)
+		}
+		n, err := data.AsInt(v)
+		if err != nil {
+			return nil, err
+		}
+		if n < 1 {
+			return nil, fmt.Errorf("topic_inflight of '%v' must be at least 1", f)
+		}
+		t.limits[f] = int(n)
+	}
+	return t, nil
+}
+
+// limit returns the maximum number of messages published to the topic at
+// once. When multiple topic filters match the topic, the smallest limit is
+// used. It returns 0 when the topic isn't limited.
+func (t *topicInflight) limit(topic string) int {
+	l := 0
+	for f, n := range t.limits {
+		if topicMatches(f, topic) && (l == 0 || n < l) {
+			l = n
+		}
+	}
+	return l
+}
+
+// acquire blocks until a message can be published to the topic. The returned
+// function must be called when the publish completes.
+func (t *topicInflight) acquire(topic string) func() {
+	l := t.limit(topic)
+	if l == 0 {
+		return func() {}
+	}
+
+	t.m.Lock()
+	for t.inflight[topic] >= l {
+		t.cond.Wait()
+	}
+	t.inflight[topic]++
+	t.m.Unlock()
+
+	return func() {
+		t.m.Lock()
+		defer t.m.Unlock()
+		if t.inflight[topic]--; t.inflight[topic] == 0 {
+			delete(t.inflight, topic)
+		}
+		t.cond.Broadcast()
+	}
+}
+
+// config returns the limits as a map.
+func (t *topicInflight) config() data.Map {
+	m := data.Map{}
+	for f, n := range t.limits {
+		m[f] = data.Int(n)
+	}
+	return m
+}
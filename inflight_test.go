@@ -0,0 +1,97 @@
+package mqtt
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseTopicInflight(t *testing.T) {
+	if ti, err := parseTopicInflight(data.Map{}); err != nil || ti != nil {
+		t.Errorf("the limit shouldn't be created without the parameter: %v, %v", ti, err)
+	}
+
+	for _, params := range []data.Map{
+		{"topic_inflight": data.Int(1)},
+		{"topic_inflight": data.Map{}},
+		{"topic_inflight": data.Map{"a/#/b": data.Int(1)}},
+		{"topic_inflight": data.Map{"a": data.Int(0)}},
+		{"topic_inflight": data.Map{"a": data.String("one")}},
+	} {
+		if _, err := parseTopicInflight(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+
+	ti, err := parseTopicInflight(data.Map{"topic_inflight": data.Map{
+		"cmd/#":       data.Int(4),
+		"cmd/+/reset": data.Int(1),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]int{
+		"cmd/a/set":   4,
+		"cmd/a/reset": 1,
+		"telemetry/a": 0,
+	}
+	for topic, l := range cases {
+		if actual := ti.limit(topic); actual != l {
+			t.Errorf("%v: expected %v, actual %v", topic, l, actual)
+		}
+	}
+}
+
+func TestTopicInflightAcquire(t *testing.T) {
+	ti, err := parseTopicInflight(data.Map{"topic_inflight": data.Map{"cmd/+": data.Int(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		inflight int32
+		peak     int32
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := ti.acquire("cmd/a")
+			defer release()
+			n := atomic.AddInt32(&inflight, 1)
+			for {
+				m := atomic.LoadInt32(&peak)
+				if n <= m || atomic.CompareAndSwapInt32(&peak, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&inflight, -1)
+		}()
+	}
+
+	// other topics aren't blocked by cmd/a
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ti.acquire("cmd/b")()
+		ti.acquire("telemetry")()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("other topics shouldn't be blocked")
+	}
+
+	wg.Wait()
+	if peak != 1 {
+		t.Errorf("at most one message should be published at once: %v", peak)
+	}
+	if len(ti.inflight) != 0 {
+		t.Errorf("topics should be removed after publishes complete: %v", ti.inflight)
+	}
+}
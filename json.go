@@ -0,0 +1,63 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// decodeJSON decodes JSON into a data.Value. Unlike data.NewValue with the
+// result of json.Unmarshal, integers are decoded as data.Int.
+func decodeJSON(b []byte) (data.Value, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("JSON has extra data after a value")
+	}
+	return newValueFromJSON(v)
+}
+
+func newValueFromJSON(v interface{}) (data.Value, error) {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return data.Int(i), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return data.Float(f), nil
+
+	case []interface{}:
+		a := make(data.Array, len(v))
+		for i, e := range v {
+			x, err := newValueFromJSON(e)
+			if err != nil {
+				return nil, err
+			}
+			a[i] = x
+		}
+		return a, nil
+
+	case map[string]interface{}:
+		m := make(data.Map, len(v))
+		for k, e := range v {
+			x, err := newValueFromJSON(e)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = x
+		}
+		return m, nil
+
+	default:
+		return data.NewValue(v)
+	}
+}
@@ -0,0 +1,131 @@
+package mqtt
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// jsonEncoding controls how values which JSON doesn't have are encoded in
+// payloads published by sinks. A nil *jsonEncoding encodes values in the
+// same way as data.Value.String, that is, timestamps in RFC3339 and blobs in
+// base64.
+type jsonEncoding struct {
+	// timestamp is "rfc3339", "unix", or "unix_ms".
+	timestamp string
+
+	// blob is "base64" or "hex".
+	blob string
+}
+
+// parseJSONEncoding parses json_timestamp_format and json_blob_encoding
+// parameters. It returns nil when neither of them is given.
+func parseJSONEncoding(params data.Map) (*jsonEncoding, error) {
+	tv, tok := params["json_timestamp_format"]
+	bv, bok := params["json_blob_encoding"]
+	if !tok && !bok {
+		return nil, nil
+	}
+
+	e := &jsonEncoding{
+		timestamp: "rfc3339",
+		blob:      "base64",
+	}
+	if tok {
+		str, err := data.AsString(tv)
+		if err != nil {
+			return nil, err
+		}
+		switch str {
+		case "rfc3339", "unix", "unix_ms":
+		default:
+			return nil, fmt.Errorf("unknown json_timestamp_format: %v", str)
+		}
+		e.timestamp = str
+	}
+	if bok {
+		str, err := data.AsString(bv)
+		if err != nil {
+			return nil, err
+		}
+		switch str {
+		case "base64", "hex":
+		default:
+			return nil, fmt.Errorf("unknown json_blob_encoding: %v", str)
+		}
+		e.blob = str
+	}
+	return e, nil
+}
+
+// marshal encodes the value in JSON.
+func (e *jsonEncoding) marshal(v data.Value) ([]byte, error) {
+	if e == nil {
+		return []byte(v.String()), nil // TODO: reduce this data copy
+	}
+	i, err := e.convert(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(i)
+}
+
+// convert converts the value into a value json.Marshal can encode.
+func (e *jsonEncoding) convert(v data.Value) (interface{}, error) {
+	switch v.Type() {
+	case data.TypeNull:
+		return nil, nil
+	case data.TypeBool:
+		return data.AsBool(v)
+	case data.TypeInt:
+		return data.AsInt(v)
+	case data.TypeFloat:
+		return data.AsFloat(v)
+	case data.TypeString:
+		return data.AsString(v)
+	case data.TypeBlob:
+		b, _ := data.AsBlob(v)
+		if e.blob == "hex" {
+			return hex.EncodeToString(b), nil
+		}
+		return base64.StdEncoding.EncodeToString(b), nil
+	case data.TypeTimestamp:
+		t, _ := data.AsTimestamp(v)
+		switch e.timestamp {
+		case "unix":
+			return float64(t.Unix()) + float64(t.Nanosecond())/float64(time.Second), nil
+		case "unix_ms":
+			return t.UnixNano() / int64(time.Millisecond), nil
+		default:
+			return t.Format(time.RFC3339Nano), nil
+		}
+	case data.TypeArray:
+		a, _ := data.AsArray(v)
+		res := make([]interface{}, len(a))
+		for i, elem := range a {
+			c, err := e.convert(elem)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = c
+		}
+		return res, nil
+	case data.TypeMap:
+		m, _ := data.AsMap(v)
+		res := make(map[string]interface{}, len(m))
+		for k, elem := range m {
+			c, err := e.convert(elem)
+			if err != nil {
+				return nil, err
+			}
+			res[k] = c
+		}
+		return res, nil
+	default:
+		return nil, fmt.Errorf("data type '%v' cannot be encoded in JSON", v.Type())
+	}
+}
@@ -0,0 +1,54 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestJSONEncoding(t *testing.T) {
+	ts := time.Date(2016, 1, 2, 15, 4, 5, 123000000, time.UTC)
+	v := data.Map{
+		"time": data.Timestamp(ts),
+		"blob": data.Array{data.Blob([]byte{0xde, 0xad})},
+		"null": data.Null{},
+	}
+
+	cases := []struct {
+		params   data.Map
+		expected string
+	}{
+		{data.Map{"json_timestamp_format": data.String("rfc3339")},
+			`{"blob":["3q0="],"null":null,"time":"2016-01-02T15:04:05.123Z"}`},
+		{data.Map{"json_timestamp_format": data.String("unix")},
+			`{"blob":["3q0="],"null":null,"time":1451747045.123}`},
+		{data.Map{"json_timestamp_format": data.String("unix_ms"), "json_blob_encoding": data.String("hex")},
+			`{"blob":["dead"],"null":null,"time":1451747045123}`},
+	}
+	for _, c := range cases {
+		e, err := parseJSONEncoding(c.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := e.marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != c.expected {
+			t.Errorf("%v: expected %v, actual %v", c.params, c.expected, string(b))
+		}
+	}
+
+	if e, err := parseJSONEncoding(data.Map{}); err != nil || e != nil {
+		t.Errorf("jsonEncoding shouldn't be created without parameters: %v, %v", e, err)
+	}
+	for _, params := range []data.Map{
+		{"json_timestamp_format": data.String("iso8601")},
+		{"json_blob_encoding": data.String("base32")},
+	} {
+		if _, err := parseJSONEncoding(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
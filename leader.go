@@ -0,0 +1,376 @@
+package mqtt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// Leader is a shared state electing a leader among SensorBee instances with a
+// retained message on a topic. The retained message has the ID of the
+// current leader. An instance claims leadership by publishing its ID with a
+// client having a will which clears the retained message, so that the other
+// instances notice when the leader is disconnected unexpectedly.
+//
+// The election is best-effort: two instances can believe they're leaders for
+// a moment until the message of the later claim reaches the other.
+type Leader struct {
+	clientConfig
+	ctx *core.Context
+
+	topic string
+	id    string
+
+	// retainedWait is the time to wait for a retained message after
+	// subscribing. The topic is assumed to have no leader when no message
+	// arrives in time.
+	retainedWait time.Duration
+
+	// keepalive is the keepalive interval of claim clients. The broker
+	// publishes the will within one and a half times of it after the leader
+	// is lost.
+	keepalive time.Duration
+
+	// newClaimClient creates a client having a will clearing the topic.
+	newClaimClient func() (supervisedClient, error)
+
+	watcher mqtt.Client
+
+	m sync.Mutex
+
+	// current is the ID of the current leader. It's empty when there's no
+	// leader.
+	current string
+
+	// claim is the client which published the claim of this instance. It's
+	// nil when this instance isn't claiming leadership.
+	claim supervisedClient
+
+	// claiming is true while a claim client is connecting.
+	claiming bool
+
+	// received is true when a message has arrived since the last connection
+	// of the watcher. generation is incremented on every connection.
+	received   bool
+	generation int64
+
+	terminated bool
+}
+
+// NewLeader creates a new Leader and starts participating in the election:
+//
+//	CREATE STATE leader TYPE mqtt_leader WITH topic = "sensorbee/leader";
+//	CREATE SINK commands TYPE mqtt WITH leader = "leader";
+//
+// The state has following required parameters:
+//
+//	* topic: the topic having the ID of the leader as a retained message
+//
+// The state has following optional parameters:
+//
+//	* instance_id: the ID of this instance (default: the host name and a random suffix)
+//	* keepalive: the keepalive interval of the client claiming leadership in Go duration format (default: 30s)
+//
+// The state also accepts connection parameters of the source and the sink.
+func NewLeader(ctx *core.Context, params data.Map) (core.SharedState, error) {
+	l := &Leader{
+		clientConfig: newClientConfig(),
+		ctx:          ctx,
+		retainedWait: 1 * time.Second,
+		keepalive:    30 * time.Second,
+	}
+	l.newClaimClient = l.newMQTTClaimClient
+
+	{ // This block is to suppress a golint warning.
+		v, ok := params["topic"]
+		if !ok {
+			return nil, errors.New("topic parameter is missing")
+		}
+		t, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateTopicName(t); err != nil {
+			return nil, err
+		}
+		l.topic = t
+	}
+
+	if v, ok := params["instance_id"]; ok {
+		id, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		if id == "" {
+			return nil, errors.New("instance_id must not be empty")
+		}
+		l.id = id
+	} else {
+		id, err := defaultInstanceID()
+		if err != nil {
+			return nil, err
+		}
+		l.id = id
+	}
+
+	if v, ok := params["keepalive"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d < time.Second {
+			return nil, errors.New("keepalive must be at least 1s")
+		}
+		l.keepalive = d
+	}
+
+	if err := l.clientConfig.parseParams(ctx, params); err != nil {
+		return nil, err
+	}
+	if l.storeDir != "" {
+		// the watcher and claim clients would share the directory
+		return nil, errors.New("store_dir cannot be used with mqtt_leader")
+	}
+
+	opts, err := l.clientOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	opts.SetOnConnectHandler(l.watch)
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		ctx.ErrLog(err).WithField("topic", l.topic).Info("Lost connection to MQTT broker watching the leader")
+	})
+	l.watcher = mqtt.NewClient(opts)
+	if err := waitToken(l.watcher.Connect(), 10*time.Second); err != nil {
+		l.watcher.Disconnect(0)
+		return nil, err
+	}
+	return l, nil
+}
+
+// defaultInstanceID returns the host name with a random suffix so that
+// instances running on hosts having the same name have different IDs.
+func defaultInstanceID() (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return host + "-" + hex.EncodeToString(b), nil
+}
+
+// validateTopicName returns an error when the topic cannot be published to.
+func validateTopicName(topic string) error {
+	if topic == "" {
+		return errors.New("a topic must not be empty")
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("a topic name cannot have wildcards: %v", topic)
+	}
+	return nil
+}
+
+// IsLeader returns true when this instance is the leader.
+func (l *Leader) IsLeader() bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.claim != nil && l.current == l.id
+}
+
+// watch subscribes to the topic every time the watcher connects. The topic is
+// assumed to have no leader when no retained message arrives.
+func (l *Leader) watch(c mqtt.Client) {
+	l.m.Lock()
+	l.generation++
+	gen := l.generation
+	l.received = false
+	l.m.Unlock()
+
+	// this is called in a goroutine of the client, so tokens can be waited
+	if err := waitToken(c.Subscribe(l.topic, 1, func(c mqtt.Client, m mqtt.Message) {
+		l.update(string(m.Payload()))
+	}), 10*time.Second); err != nil {
+		l.ctx.ErrLog(err).WithField("topic", l.topic).Error("Failed to subscribe to the leader topic")
+		return
+	}
+
+	time.AfterFunc(l.retainedWait, func() {
+		l.m.Lock()
+		noLeader := l.generation == gen && !l.received
+		l.m.Unlock()
+		if noLeader {
+			l.update("")
+		}
+	})
+}
+
+// update updates the current leader. This instance claims leadership when
+// there's no leader, and steps down when another instance is the leader.
+func (l *Leader) update(id string) {
+	l.m.Lock()
+	l.received = true
+	l.current = id
+	var stepDown, reclaim supervisedClient
+	claim := false
+	switch {
+	case l.terminated:
+	case id != "" && id != l.id:
+		stepDown, l.claim = l.claim, nil
+	case l.claim != nil:
+		if id == "" {
+			// the claim was cleared by a will of an old claim client
+			reclaim = l.claim
+		}
+	case !l.claiming:
+		l.claiming = true
+		claim = true
+	}
+	l.m.Unlock()
+
+	if stepDown != nil {
+		l.ctx.Log().WithField("topic", l.topic).WithField("leader", id).Info("Stepped down from the leader")
+		// a will isn't published on a graceful disconnect
+		stepDown.Disconnect(250)
+	}
+	if reclaim != nil {
+		go l.publishClaim(reclaim)
+	}
+	if claim {
+		go l.claimLeadership()
+	}
+}
+
+// claimLeadership connects a claim client and publishes the ID of this
+// instance.
+func (l *Leader) claimLeadership() {
+	c, err := l.newClaimClient()
+	if err == nil {
+		if err = waitToken(c.Connect(), 10*time.Second); err != nil {
+			c.Disconnect(0)
+		}
+	}
+	if err != nil {
+		l.ctx.ErrLog(err).WithField("topic", l.topic).Error("Failed to claim leadership")
+		l.m.Lock()
+		l.claiming = false
+		l.m.Unlock()
+		return
+	}
+	if err := l.publishClaim(c); err != nil {
+		c.Disconnect(0)
+		l.m.Lock()
+		l.claiming = false
+		l.m.Unlock()
+		return
+	}
+
+	l.m.Lock()
+	l.claiming = false
+	terminated := l.terminated
+	lost := l.current != "" && l.current != l.id
+	if !terminated && !lost {
+		l.claim = c
+	}
+	l.m.Unlock()
+	if terminated {
+		l.release(c)
+		return
+	}
+	if lost {
+		// another instance claimed leadership while connecting
+		c.Disconnect(250)
+		return
+	}
+	l.ctx.Log().WithField("topic", l.topic).WithField("id", l.id).Info("Claimed leadership")
+}
+
+func (l *Leader) publishClaim(c supervisedClient) error {
+	err := waitToken(c.Publish(l.topic, 1, true, []byte(l.id)), 10*time.Second)
+	if err != nil {
+		l.ctx.ErrLog(err).WithField("topic", l.topic).Error("Failed to publish the leadership claim")
+	}
+	return err
+}
+
+// newMQTTClaimClient creates a claim client connecting to the broker.
+func (l *Leader) newMQTTClaimClient() (supervisedClient, error) {
+	opts, err := l.clientOptions(l.ctx)
+	if err != nil {
+		return nil, err
+	}
+	opts.SetBinaryWill(l.topic, nil, 1, true)
+	opts.SetKeepAlive(l.keepalive)
+	opts.SetAutoReconnect(false)
+	opts.SetConnectionLostHandler(l.lost)
+	return mqtt.NewClient(opts), nil
+}
+
+// lost is called when the connection of a claim client is lost. The broker
+// publishes the will and another instance will be the leader.
+func (l *Leader) lost(c mqtt.Client, err error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.claim == supervisedClient(c) {
+		l.claim = nil
+		l.ctx.ErrLog(err).WithField("topic", l.topic).Warn("Lost leadership")
+	}
+}
+
+// Terminate releases leadership and disconnects from the broker.
+func (l *Leader) Terminate(ctx *core.Context) error {
+	l.m.Lock()
+	l.terminated = true
+	c := l.claim
+	l.claim = nil
+	l.m.Unlock()
+
+	if c != nil {
+		l.release(c)
+	}
+	l.watcher.Disconnect(250)
+	return nil
+}
+
+// release clears the claim of this instance and disconnects the claim client.
+// A graceful disconnect doesn't publish the will, so the claim is cleared
+// explicitly.
+func (l *Leader) release(c supervisedClient) {
+	if err := waitToken(c.Publish(l.topic, 1, true, []byte{}), 10*time.Second); err != nil {
+		l.ctx.ErrLog(err).WithField("topic", l.topic).Error("Failed to release leadership")
+	}
+	c.Disconnect(250)
+}
+
+func lookupLeader(ctx *core.Context, name string) (*Leader, error) {
+	st, err := ctx.SharedStates.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	l, ok := st.(*Leader)
+	if !ok {
+		return nil, fmt.Errorf("state '%v' isn't a mqtt_leader", name)
+	}
+	return l, nil
+}
+
+// IsLeader is a UDF returning true when this instance is the leader elected
+// by the Leader having the given name.
+func IsLeader(ctx *core.Context, name string) (bool, error) {
+	l, err := lookupLeader(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	return l.IsLeader(), nil
+}
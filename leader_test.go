@@ -0,0 +1,103 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+)
+
+func newTestLeader(id string, clients ...*testClient) *Leader {
+	l := &Leader{
+		ctx:   core.NewContext(nil),
+		topic: "leader",
+		id:    id,
+	}
+	l.newClaimClient = func() (supervisedClient, error) {
+		c := clients[0]
+		clients = clients[1:]
+		return c, nil
+	}
+	return l
+}
+
+// waitClaim waits until the leader finishes claiming leadership.
+func waitClaim(t *testing.T, l *Leader) {
+	for i := 0; i < 100; i++ {
+		l.m.Lock()
+		claiming := l.claiming
+		l.m.Unlock()
+		if !claiming {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("the claim doesn't finish")
+}
+
+func TestLeaderElection(t *testing.T) {
+	c1 := &testClient{
+		connect: []*testToken{{}},
+	}
+	c2 := &testClient{
+		connect: []*testToken{{}},
+	}
+	l := newTestLeader("me", c1, c2)
+
+	// There's no leader, so this instance claims leadership.
+	l.update("")
+	waitClaim(t, l)
+	if l.IsLeader() {
+		t.Error("this instance shouldn't be the leader until the claim is delivered")
+	}
+	l.update("me")
+	if !l.IsLeader() {
+		t.Error("this instance should be the leader")
+	}
+
+	// Another instance won the election.
+	l.update("other")
+	if l.IsLeader() {
+		t.Error("this instance should step down")
+	}
+	if !c1.disconnected {
+		t.Error("the claim client should be disconnected")
+	}
+
+	// The leader has gone.
+	l.update("")
+	waitClaim(t, l)
+	l.update("me")
+	if !l.IsLeader() {
+		t.Error("this instance should be the leader again")
+	}
+	if c2.disconnected {
+		t.Error("the new claim client shouldn't be disconnected")
+	}
+}
+
+func TestLeaderFailsToClaim(t *testing.T) {
+	c := &testClient{
+		connect: []*testToken{{timeout: true}},
+	}
+	l := newTestLeader("me", c)
+	l.update("")
+	waitClaim(t, l)
+	if l.IsLeader() {
+		t.Error("this instance shouldn't be the leader")
+	}
+	if !c.disconnected {
+		t.Error("the claim client should be disconnected")
+	}
+}
+
+func TestValidateTopicName(t *testing.T) {
+	if err := validateTopicName("sensorbee/leader"); err != nil {
+		t.Error(err)
+	}
+	for _, topic := range []string{"", "sensorbee/+", "sensorbee/#"} {
+		if err := validateTopicName(topic); err == nil {
+			t.Errorf("%v should be rejected", topic)
+		}
+	}
+}
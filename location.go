@@ -0,0 +1,182 @@
+package mqtt
+
+import (
+	"strconv"
+	"strings"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// latLonKeys are pairs of keys commonly used for latitude and longitude.
+var latLonKeys = [][2]string{
+	{"lat", "lon"},
+	{"lat", "lng"},
+	{"lat", "long"},
+	{"latitude", "longitude"},
+}
+
+// locationFields are names of fields commonly having a location.
+var locationFields = []string{"location", "position", "gps", "geometry", "coordinates", "latlng"}
+
+// normalizeLocation finds a location in the payload and sets it to the
+// location field as a map having lat, lon, and optionally alt:
+//
+//	{"lat": 35.68, "lon": 139.76}
+//
+// It recognizes following shapes:
+//
+//	* lat/lon pairs such as {"lat": 35.68, "lng": 139.76} or {"latitude": ..., "longitude": ...}
+//	* GeoJSON points and features having a point
+//	* comma-separated strings such as "35.68,139.76"
+//
+// They can be at the top level of the payload or in a field such as location,
+// position, or gps. It returns false and doesn't change the payload when no
+// location is found or the payload isn't a map.
+func normalizeLocation(payload data.Value) bool {
+	m, err := data.AsMap(payload)
+	if err != nil {
+		return false
+	}
+
+	loc, ok := findLocation(m)
+	if !ok {
+		for _, f := range locationFields {
+			v, exists := m[f]
+			if !exists {
+				continue
+			}
+			if loc, ok = parseLocation(v); ok {
+				break
+			}
+		}
+	}
+	if !ok {
+		return false
+	}
+	m["location"] = loc
+	return true
+}
+
+// parseLocation parses a value having a location.
+func parseLocation(v data.Value) (data.Map, bool) {
+	switch v.Type() {
+	case data.TypeMap:
+		m, _ := data.AsMap(v)
+		return findLocation(m)
+	case data.TypeString:
+		s, _ := data.AsString(v)
+		return parseLatLonString(s)
+	}
+	return nil, false
+}
+
+// findLocation finds a location in the map itself, that is, the map is a
+// GeoJSON object or has a lat/lon pair.
+func findLocation(m data.Map) (data.Map, bool) {
+	if t, ok := m["type"]; ok {
+		typ, _ := data.AsString(t)
+		switch typ {
+		case "Point":
+			return parseGeoJSONPoint(m)
+		case "Feature":
+			g, ok := m["geometry"]
+			if !ok {
+				return nil, false
+			}
+			gm, err := data.AsMap(g)
+			if err != nil {
+				return nil, false
+			}
+			return parseGeoJSONPoint(gm)
+		}
+	}
+
+	for _, keys := range latLonKeys {
+		lat, ok1 := m[keys[0]]
+		lon, ok2 := m[keys[1]]
+		if !ok1 || !ok2 {
+			continue
+		}
+		loc, ok := newLocation(lat, lon)
+		if !ok {
+			continue
+		}
+		for _, k := range []string{"alt", "altitude"} {
+			if a, ok := m[k]; ok {
+				if alt, err := toNumber(a); err == nil {
+					loc["alt"] = data.Float(alt)
+				}
+				break
+			}
+		}
+		return loc, true
+	}
+	return nil, false
+}
+
+// parseGeoJSONPoint parses a GeoJSON point. Its coordinates are in
+// [longitude, latitude, altitude] order.
+func parseGeoJSONPoint(m data.Map) (data.Map, bool) {
+	if t, _ := data.AsString(m["type"]); t != "Point" {
+		return nil, false
+	}
+	c, ok := m["coordinates"]
+	if !ok {
+		return nil, false
+	}
+	a, err := data.AsArray(c)
+	if err != nil || len(a) < 2 {
+		return nil, false
+	}
+	loc, ok := newLocation(a[1], a[0])
+	if !ok {
+		return nil, false
+	}
+	if len(a) > 2 {
+		if alt, err := toNumber(a[2]); err == nil {
+			loc["alt"] = data.Float(alt)
+		}
+	}
+	return loc, true
+}
+
+// parseLatLonString parses a string like "35.68,139.76".
+func parseLatLonString(s string) (data.Map, bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return nil, false
+	}
+	return newLocation(data.String(strings.TrimSpace(parts[0])), data.String(strings.TrimSpace(parts[1])))
+}
+
+// newLocation creates a location map. It returns false when the values aren't
+// numbers or are out of range.
+func newLocation(latV, lonV data.Value) (data.Map, bool) {
+	lat, err := toNumber(latV)
+	if err != nil || lat < -90 || lat > 90 {
+		return nil, false
+	}
+	lon, err := toNumber(lonV)
+	if err != nil || lon < -180 || lon > 180 {
+		return nil, false
+	}
+	return data.Map{
+		"lat": data.Float(lat),
+		"lon": data.Float(lon),
+	}, true
+}
+
+// toNumber converts an int, a float, or a string having a number into a
+// float64.
+func toNumber(v data.Value) (float64, error) {
+	switch v.Type() {
+	case data.TypeInt:
+		i, _ := data.AsInt(v)
+		return float64(i), nil
+	case data.TypeString:
+		s, _ := data.AsString(v)
+		return strconv.ParseFloat(strings.TrimSpace(s), 64)
+	default:
+		return data.AsFloat(v)
+	}
+}
@@ -0,0 +1,54 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestNormalizeLocation(t *testing.T) {
+	cases := []struct {
+		title    string
+		payload  data.Map
+		expected data.Value
+	}{
+		{"lat/lon", data.Map{"lat": data.Float(35.5), "lon": data.Float(139.5)},
+			data.Map{"lat": data.Float(35.5), "lon": data.Float(139.5)}},
+		{"latitude/longitude with altitude", data.Map{"latitude": data.String("35.5"), "longitude": data.Int(139), "altitude": data.Int(10)},
+			data.Map{"lat": data.Float(35.5), "lon": data.Float(139), "alt": data.Float(10)}},
+		{"nested lat/lng", data.Map{"gps": data.Map{"lat": data.Float(35.5), "lng": data.Float(139.5)}},
+			data.Map{"lat": data.Float(35.5), "lon": data.Float(139.5)}},
+		{"GeoJSON point", data.Map{"type": data.String("Point"), "coordinates": data.Array{data.Float(139.5), data.Float(35.5)}},
+			data.Map{"lat": data.Float(35.5), "lon": data.Float(139.5)}},
+		{"GeoJSON feature", data.Map{"type": data.String("Feature"), "geometry": data.Map{
+			"type": data.String("Point"), "coordinates": data.Array{data.Float(139.5), data.Float(35.5), data.Float(3)}}},
+			data.Map{"lat": data.Float(35.5), "lon": data.Float(139.5), "alt": data.Float(3)}},
+		{"nested GeoJSON point", data.Map{"position": data.Map{"type": data.String("Point"), "coordinates": data.Array{data.Int(139), data.Int(35)}}},
+			data.Map{"lat": data.Float(35), "lon": data.Float(139)}},
+		{"comma-separated string", data.Map{"location": data.String("35.5, 139.5")},
+			data.Map{"lat": data.Float(35.5), "lon": data.Float(139.5)}},
+		{"out of range", data.Map{"lat": data.Float(139.5), "lon": data.Float(35.5)}, nil},
+		{"no location", data.Map{"temperature": data.Float(20)}, nil},
+		{"invalid string", data.Map{"location": data.String("Tokyo")}, data.String("Tokyo")},
+	}
+
+	for _, c := range cases {
+		ok := normalizeLocation(c.payload)
+		if c.expected == nil || c.expected.Type() != data.TypeMap {
+			if ok {
+				t.Errorf("%v: no location should be found: %v", c.title, c.payload["location"])
+			}
+			if c.expected != nil && !data.Equal(c.expected, c.payload["location"]) {
+				t.Errorf("%v: the location field shouldn't be changed: %v", c.title, c.payload["location"])
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%v: a location should be found", c.title)
+			continue
+		}
+		if !data.Equal(c.expected, c.payload["location"]) {
+			t.Errorf("%v: expected %v, actual %v", c.title, c.expected, c.payload["location"])
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// logLevel is the minimum level of logs written by a source or a sink. Errors
+// are always logged.
+type logLevel int
+
+const (
+	debugLevel logLevel = iota
+	infoLevel
+	warnLevel
+	errorLevel
+)
+
+func parseLogLevel(s string) (logLevel, error) {
+	switch s {
+	case "debug":
+		return debugLevel, nil
+	case "info":
+		return infoLevel, nil
+	case "warn":
+		return warnLevel, nil
+	case "error":
+		return errorLevel, nil
+	default:
+		return 0, fmt.Errorf("unknown log_level: %v", s)
+	}
+}
+
+func (l logLevel) String() string {
+	switch l {
+	case debugLevel:
+		return "debug"
+	case warnLevel:
+		return "warn"
+	case errorLevel:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// enabled returns true when logs of the level are written.
+func (l logLevel) enabled(level logLevel) bool {
+	return level >= l
+}
+
+// logThrottle limits how often a repeated log, such as a failure to connect
+// during a long outage, is written. The zero value writes every log.
+type logThrottle struct {
+	interval time.Duration
+
+	// last is the time the log was written last time, and suppressed is the
+	// number of logs suppressed since then.
+	last       time.Time
+	suppressed int64
+}
+
+// parseLogThrottle parses the reconnect_log_interval parameter.
+func parseLogThrottle(params data.Map) (*logThrottle, error) {
+	t := &logThrottle{
+		interval: time.Minute,
+	}
+	if v, ok := params["reconnect_log_interval"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d < 0 {
+			return nil, errors.New("reconnect_log_interval must not be negative")
+		}
+		t.interval = d
+	}
+	return t, nil
+}
+
+// allow returns true when the log should be written now, and the number of
+// logs suppressed since the last one written.
+func (t *logThrottle) allow(now time.Time) (bool, int64) {
+	if !t.last.IsZero() && now.Sub(t.last) < t.interval {
+		t.suppressed++
+		return false, 0
+	}
+	n := t.suppressed
+	t.last = now
+	t.suppressed = 0
+	return true, n
+}
+
+// reset makes the next log written regardless of the interval.
+func (t *logThrottle) reset() {
+	t.last = time.Time{}
+	t.suppressed = 0
+}
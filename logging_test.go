@@ -0,0 +1,58 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for _, l := range []logLevel{debugLevel, infoLevel, warnLevel, errorLevel} {
+		actual, err := parseLogLevel(l.String())
+		if err != nil {
+			t.Error(err)
+		} else if actual != l {
+			t.Errorf("expected %v, actual %v", l, actual)
+		}
+	}
+	if _, err := parseLogLevel("trace"); err == nil {
+		t.Error("an unknown level should be rejected")
+	}
+
+	if !warnLevel.enabled(errorLevel) || !warnLevel.enabled(warnLevel) || warnLevel.enabled(infoLevel) {
+		t.Error("only logs at the level or higher should be enabled")
+	}
+}
+
+func TestLogThrottle(t *testing.T) {
+	lt, err := parseLogThrottle(data.Map{"reconnect_log_interval": data.String("10s")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, c := range []struct {
+		elapsed    time.Duration
+		allowed    bool
+		suppressed int64
+	}{
+		{0, true, 0},
+		{time.Second, false, 0},
+		{5 * time.Second, false, 0},
+		{10 * time.Second, true, 2},
+		{11 * time.Second, false, 0},
+	} {
+		ok, n := lt.allow(now.Add(c.elapsed))
+		if ok != c.allowed || n != c.suppressed {
+			t.Errorf("%v: expected %v and %v, actual %v and %v", c.elapsed, c.allowed, c.suppressed, ok, n)
+		}
+	}
+	lt.reset()
+	if ok, n := lt.allow(now.Add(12 * time.Second)); !ok || n != 0 {
+		t.Errorf("the log should be written after reset: %v, %v", ok, n)
+	}
+
+	if _, err := parseLogThrottle(data.Map{"reconnect_log_interval": data.String("-1s")}); err == nil {
+		t.Error("a negative interval should be rejected")
+	}
+}
@@ -0,0 +1,231 @@
+package mqtt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricType is the type of a Metric.
+type MetricType int
+
+const (
+	// CounterMetric is a value which only increases while the node is
+	// active.
+	CounterMetric MetricType = iota
+
+	// GaugeMetric is a value which can go up and down.
+	GaugeMetric
+
+	// HistogramMetric is a distribution of observed values.
+	HistogramMetric
+)
+
+func (t MetricType) String() string {
+	switch t {
+	case CounterMetric:
+		return "counter"
+	case GaugeMetric:
+		return "gauge"
+	case HistogramMetric:
+		return "histogram"
+	default:
+		return "untyped"
+	}
+}
+
+// Metric is a sample of a metric of an active MQTT source or sink. Metrics
+// follow the naming convention of Prometheus, and Node is reported as the
+// "node" label.
+type Metric struct {
+	Name string
+	Help string
+	Type MetricType
+	Node string
+
+	// Value is the value of a counter or a gauge.
+	Value float64
+
+	// Buckets has cumulative counts of observations less than or equal to
+	// the upper bounds in UpperBounds. Sum and Count are the sum and the
+	// number of all observations. They're only set for histograms.
+	UpperBounds []float64
+	Buckets     []uint64
+	Sum         float64
+	Count       uint64
+}
+
+// metricsNode is a Node reporting metrics.
+type metricsNode interface {
+	metrics() []Metric
+}
+
+// CollectMetrics returns metrics of MQTT sources and sinks which are
+// currently active. Programs embedding the plugin can call it from their
+// own registry, such as a prometheus.Collector, to export the metrics with
+// the rest of their metrics.
+func CollectMetrics() []Metric {
+	var ms []Metric
+	for _, n := range Nodes() {
+		if mn, ok := n.(metricsNode); ok {
+			ms = append(ms, mn.metrics()...)
+		}
+	}
+	return ms
+}
+
+// WriteMetrics writes metrics returned by CollectMetrics in the text
+// exposition format of Prometheus.
+func WriteMetrics(w io.Writer) error {
+	ms := CollectMetrics()
+	sort.SliceStable(ms, func(i, j int) bool {
+		return ms[i].Name < ms[j].Name
+	})
+
+	bw := bufio.NewWriter(w)
+	for i, m := range ms {
+		if i == 0 || ms[i-1].Name != m.Name {
+			fmt.Fprintf(bw, "# HELP %v %v\n", m.Name, escapeMetricHelp(m.Help))
+			fmt.Fprintf(bw, "# TYPE %v %v\n", m.Name, m.Type)
+		}
+		node := strconv.Quote(m.Node)
+		if m.Type != HistogramMetric {
+			fmt.Fprintf(bw, "%v{node=%v} %v\n", m.Name, node, formatMetricValue(m.Value))
+			continue
+		}
+		for i, b := range m.UpperBounds {
+			fmt.Fprintf(bw, "%v_bucket{node=%v,le=\"%v\"} %v\n", m.Name, node, formatMetricValue(b), m.Buckets[i])
+		}
+		fmt.Fprintf(bw, "%v_bucket{node=%v,le=\"+Inf\"} %v\n", m.Name, node, m.Count)
+		fmt.Fprintf(bw, "%v_sum{node=%v} %v\n", m.Name, node, formatMetricValue(m.Sum))
+		fmt.Fprintf(bw, "%v_count{node=%v} %v\n", m.Name, node, m.Count)
+	}
+	return bw.Flush()
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// MetricsHandler returns an http.Handler serving metrics written by
+// WriteMetrics, so that Prometheus can scrape them directly.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteMetrics(w)
+	})
+}
+
+// latencyBuckets are upper bounds of buckets of latencyHistogram in seconds.
+// They're the default buckets of Prometheus.
+var latencyBuckets = [...]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// latencyHistogram is a histogram of durations. The zero value is ready to
+// use.
+type latencyHistogram struct {
+	m      sync.Mutex
+	counts [len(latencyBuckets) + 1]uint64 // the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	s := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets[:], s)
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.counts[i]++
+	h.sum += s
+	h.count++
+}
+
+// metric returns the histogram as a metric having cumulative buckets.
+func (h *latencyHistogram) metric(name, help, node string) Metric {
+	h.m.Lock()
+	defer h.m.Unlock()
+	m := Metric{
+		Name:        name,
+		Help:        help,
+		Type:        HistogramMetric,
+		Node:        node,
+		UpperBounds: latencyBuckets[:],
+		Buckets:     make([]uint64, len(latencyBuckets)),
+		Sum:         h.sum,
+		Count:       h.count,
+	}
+	n := uint64(0)
+	for i := range latencyBuckets {
+		n += h.counts[i]
+		m.Buckets[i] = n
+	}
+	return m
+}
+
+func counterMetric(name, help, node string, v int64) Metric {
+	return Metric{Name: name, Help: help, Type: CounterMetric, Node: node, Value: float64(v)}
+}
+
+func gaugeMetric(name, help, node string, v float64) Metric {
+	return Metric{Name: name, Help: help, Type: GaugeMetric, Node: node, Value: v}
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (s *source) metrics() []Metric {
+	connected, reconnects := s.connection.state()
+	return []Metric{
+		counterMetric("mqtt_source_received_messages_total", "Messages delivered by the broker.",
+			s.name, atomic.LoadInt64(&s.received)),
+		counterMetric("mqtt_source_received_bytes_total", "Total size of payloads delivered by the broker.",
+			s.name, atomic.LoadInt64(&s.receivedBytes)),
+		counterMetric("mqtt_source_decode_errors_total", "Messages, records, and rows which couldn't be decoded.",
+			s.name, atomic.LoadInt64(&s.decodeErrors)),
+		counterMetric("mqtt_source_write_errors_total", "Tuples the topology failed to accept.",
+			s.name, atomic.LoadInt64(&s.writeErrors)),
+		counterMetric("mqtt_source_reconnects_total", "Connections to the broker after the first one.",
+			s.name, reconnects),
+		gaugeMetric("mqtt_source_connected", "1 when the source is connected to the broker.",
+			s.name, boolGauge(connected)),
+	}
+}
+
+func (s *sink) metrics() []Metric {
+	connected, reconnects := s.connection.state()
+	ms := []Metric{
+		counterMetric("mqtt_sink_published_messages_total", "Messages published to the broker.",
+			s.name, atomic.LoadInt64(&s.published)),
+		counterMetric("mqtt_sink_publish_errors_total", "Publishes which failed.",
+			s.name, atomic.LoadInt64(&s.publishErrors)),
+		s.latency.metric("mqtt_sink_publish_latency_seconds", "Time to complete publishes.", s.name),
+		counterMetric("mqtt_sink_reconnects_total", "Connections to the broker after the first one.",
+			s.name, reconnects),
+		gaugeMetric("mqtt_sink_connected", "1 when the sink is connected to the broker.",
+			s.name, boolGauge(connected)),
+	}
+	if s.outbox != nil {
+		buffered, dropped := s.outbox.stats()
+		ms = append(ms,
+			gaugeMetric("mqtt_sink_queue_depth", "Messages waiting in the buffer of the sink.",
+				s.name, float64(buffered)),
+			counterMetric("mqtt_sink_dropped_messages_total", "Messages dropped because the buffer was full.",
+				s.name, dropped))
+	}
+	return ms
+}
+
+// escapeMetricHelp escapes a help text of the text exposition format.
+func escapeMetricHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := &latencyHistogram{}
+	for _, d := range []time.Duration{time.Millisecond, 20 * time.Millisecond, time.Second, time.Minute} {
+		h.observe(d)
+	}
+	m := h.metric("latency", "", "a")
+	if m.Count != 4 {
+		t.Errorf("wrong count: %v", m.Count)
+	}
+	expected := map[float64]uint64{.005: 1, .025: 2, .5: 2, 1: 3, 10: 3}
+	for i, b := range m.UpperBounds {
+		if n, ok := expected[b]; ok && m.Buckets[i] != n {
+			t.Errorf("bucket %v: expected %v, actual %v", b, n, m.Buckets[i])
+		}
+	}
+	if m.Sum < 61 || m.Sum > 61.1 {
+		t.Errorf("wrong sum: %v", m.Sum)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	src := &source{name: "src", received: 3, receivedBytes: 42}
+	src.connection.connected()
+	snk := &sink{name: "snk", published: 2}
+	snk.latency.observe(time.Millisecond)
+	for _, n := range []Node{src, snk} {
+		registerNode(n)
+		defer unregisterNode(n)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteMetrics(buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, l := range []string{
+		"# TYPE mqtt_source_received_messages_total counter\n",
+		`mqtt_source_received_messages_total{node="src"} 3` + "\n",
+		`mqtt_source_received_bytes_total{node="src"} 42` + "\n",
+		`mqtt_source_connected{node="src"} 1` + "\n",
+		`mqtt_sink_published_messages_total{node="snk"} 2` + "\n",
+		"# TYPE mqtt_sink_publish_latency_seconds histogram\n",
+		`mqtt_sink_publish_latency_seconds_bucket{node="snk",le="0.005"} 1` + "\n",
+		`mqtt_sink_publish_latency_seconds_bucket{node="snk",le="+Inf"} 1` + "\n",
+		`mqtt_sink_publish_latency_seconds_count{node="snk"} 1` + "\n",
+	} {
+		if !strings.Contains(out, l) {
+			t.Errorf("the output doesn't have %q:\n%v", l, out)
+		}
+	}
+	if strings.Contains(out, "mqtt_sink_queue_depth") {
+		t.Error("the queue depth shouldn't be reported without the buffer")
+	}
+
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Body.String() != out {
+		t.Errorf("the handler should serve the same metrics:\n%v", rec.Body.String())
+	}
+}
@@ -0,0 +1,423 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Message types of MQTT-SN 1.2 used by the client.
+const (
+	snConnect    byte = 0x04
+	snConnack    byte = 0x05
+	snRegister   byte = 0x0a
+	snRegack     byte = 0x0b
+	snPublish    byte = 0x0c
+	snPuback     byte = 0x0d
+	snSubscribe  byte = 0x12
+	snSuback     byte = 0x13
+	snPingreq    byte = 0x16
+	snPingresp   byte = 0x17
+	snDisconnect byte = 0x18
+)
+
+// Flags of MQTT-SN packets.
+const (
+	snFlagRetain       byte = 0x10
+	snFlagCleanSession byte = 0x04
+
+	snTopicNormal     byte = 0x00
+	snTopicPredefined byte = 0x01
+	snTopicShort      byte = 0x02
+)
+
+// snQoSFlags returns the QoS bits of flags. QoS -1 is encoded as 3.
+func snQoSFlags(qos int) byte {
+	if qos < 0 {
+		return 0x60
+	}
+	return byte(qos) << 5
+}
+
+// snQoS returns the QoS of flags.
+func snQoS(flags byte) int {
+	q := int(flags>>5) & 0x03
+	if q == 3 {
+		return -1
+	}
+	return q
+}
+
+// snPacket is an MQTT-SN packet without the length field.
+type snPacket struct {
+	typ  byte
+	body []byte
+}
+
+func (p *snPacket) encode() []byte {
+	n := len(p.body) + 2
+	if n < 256 {
+		return append([]byte{byte(n), p.typ}, p.body...)
+	}
+	n += 2
+	b := []byte{0x01, byte(n >> 8), byte(n), p.typ}
+	return append(b, p.body...)
+}
+
+func decodeSNPacket(b []byte) (*snPacket, error) {
+	if len(b) < 2 {
+		return nil, errors.New("an MQTT-SN packet is too short")
+	}
+	n, h := int(b[0]), 1
+	if b[0] == 0x01 {
+		if len(b) < 4 {
+			return nil, errors.New("an MQTT-SN packet is too short")
+		}
+		n, h = int(binary.BigEndian.Uint16(b[1:3])), 3
+	}
+	if n != len(b) || n <= h {
+		return nil, fmt.Errorf("wrong length of an MQTT-SN packet: %v", n)
+	}
+	return &snPacket{typ: b[h], body: b[h+1:]}, nil
+}
+
+// snMessage is a message published to the client.
+type snMessage struct {
+	topic   string
+	payload []byte
+	qos     int
+	retain  bool
+}
+
+// snClient is a minimal client of MQTT-SN 1.2 gateways over UDP. It supports
+// QoS -1, 0, and 1, registrations of topic names, and predefined topic IDs.
+// Requests are sent one at a time.
+type snClient struct {
+	conn    net.Conn
+	timeout time.Duration
+
+	// handler is called with messages published to the client by the
+	// goroutine reading packets.
+	handler func(*snMessage)
+
+	// reqM serializes requests waiting for their responses.
+	reqM sync.Mutex
+
+	m      sync.Mutex
+	msgID  uint16
+	topics map[uint16]string
+	ids    map[string]uint16
+
+	responses chan *snPacket
+	done      chan struct{}
+	err       error
+}
+
+// dialSN opens a UDP socket to the gateway and starts reading packets.
+// Predefined topic IDs are mapped to topic names by predefined.
+func dialSN(gateway string, predefined map[uint16]string, timeout time.Duration, handler func(*snMessage)) (*snClient, error) {
+	conn, err := net.Dial("udp", gateway)
+	if err != nil {
+		return nil, err
+	}
+	c := &snClient{
+		conn:      conn,
+		timeout:   timeout,
+		handler:   handler,
+		topics:    map[uint16]string{},
+		ids:       map[string]uint16{},
+		responses: make(chan *snPacket, 1),
+		done:      make(chan struct{}),
+	}
+	for id, t := range predefined {
+		c.topics[id] = t
+		c.ids[t] = id
+	}
+	go c.read()
+	return c, nil
+}
+
+func (c *snClient) read() {
+	defer close(c.done)
+	buf := make([]byte, 65536)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			c.err = err
+			return
+		}
+		p, err := decodeSNPacket(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			// UDP can deliver garbage, which is just ignored
+			continue
+		}
+		switch p.typ {
+		case snPublish:
+			c.handlePublish(p)
+		case snRegister:
+			c.handleRegister(p)
+		case snDisconnect:
+			c.err = errors.New("the gateway disconnected the client")
+			c.conn.Close()
+			return
+		default:
+			select {
+			case c.responses <- p:
+			default:
+				// responses nobody waits for
+			}
+		}
+	}
+}
+
+func (c *snClient) handlePublish(p *snPacket) {
+	if len(p.body) < 5 {
+		return
+	}
+	flags := p.body[0]
+	topicID := binary.BigEndian.Uint16(p.body[1:3])
+	var topic string
+	if flags&0x03 == snTopicShort {
+		topic = string(p.body[1:3])
+	} else {
+		c.m.Lock()
+		topic = c.topics[topicID]
+		c.m.Unlock()
+	}
+
+	qos := snQoS(flags)
+	if qos == 1 {
+		c.send(&snPacket{snPuback, snPubackBody(p.body[1:5], 0)})
+	}
+	if topic == "" {
+		// the topic ID isn't registered
+		return
+	}
+	c.handler(&snMessage{
+		topic:   topic,
+		payload: p.body[5:],
+		qos:     qos,
+		retain:  flags&snFlagRetain != 0,
+	})
+}
+
+func snPubackBody(topicAndMsgID []byte, code byte) []byte {
+	return append(append([]byte(nil), topicAndMsgID...), code)
+}
+
+// handleRegister stores a topic ID which the gateway assigned to a topic
+// matching a wildcard subscription.
+func (c *snClient) handleRegister(p *snPacket) {
+	if len(p.body) < 5 {
+		return
+	}
+	topicID := binary.BigEndian.Uint16(p.body[0:2])
+	c.setTopic(topicID, string(p.body[4:]))
+	c.send(&snPacket{snRegack, snPubackBody(p.body[0:4], 0)})
+}
+
+func (c *snClient) setTopic(id uint16, topic string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.topics[id] = topic
+	c.ids[topic] = id
+}
+
+func (c *snClient) nextMsgID() uint16 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.msgID++
+	if c.msgID == 0 {
+		c.msgID = 1
+	}
+	return c.msgID
+}
+
+func (c *snClient) send(p *snPacket) error {
+	_, err := c.conn.Write(p.encode())
+	return err
+}
+
+// request sends a packet and waits for the response of the type.
+func (c *snClient) request(p *snPacket, typ byte, msgID func(*snPacket) bool) (*snPacket, error) {
+	c.reqM.Lock()
+	defer c.reqM.Unlock()
+	if err := c.send(p); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case r := <-c.responses:
+			if r.typ == typ && (msgID == nil || msgID(r)) {
+				return r, nil
+			}
+		case <-c.done:
+			if c.err != nil {
+				return nil, c.err
+			}
+			return nil, errors.New("the client is closed")
+		case <-timer.C:
+			return nil, fmt.Errorf("the gateway didn't respond within %v", c.timeout)
+		}
+	}
+}
+
+// connect sends CONNECT and waits for CONNACK.
+func (c *snClient) connect(clientID string, keepAlive time.Duration, cleanSession bool) error {
+	var flags byte
+	if cleanSession {
+		flags |= snFlagCleanSession
+	}
+	body := []byte{flags, 0x01, 0, 0}
+	binary.BigEndian.PutUint16(body[2:], uint16(keepAlive/time.Second))
+	body = append(body, clientID...)
+	r, err := c.request(&snPacket{snConnect, body}, snConnack, nil)
+	if err != nil {
+		return err
+	}
+	if len(r.body) < 1 || r.body[0] != 0 {
+		return fmt.Errorf("the gateway rejected the connection: %v", snReturnCode(r.body))
+	}
+	return nil
+}
+
+// subscribe subscribes to a topic name or a predefined topic.
+func (c *snClient) subscribe(topic string, qos int) error {
+	id := c.nextMsgID()
+	flags := snQoSFlags(qos)
+	var name []byte
+	c.m.Lock()
+	predefined, ok := c.ids[topic]
+	c.m.Unlock()
+	if ok {
+		flags |= snTopicPredefined
+		name = []byte{byte(predefined >> 8), byte(predefined)}
+	} else {
+		name = []byte(topic)
+	}
+	body := append([]byte{flags, byte(id >> 8), byte(id)}, name...)
+	r, err := c.request(&snPacket{snSubscribe, body}, snSuback, func(r *snPacket) bool {
+		return len(r.body) >= 6 && binary.BigEndian.Uint16(r.body[3:5]) == id
+	})
+	if err != nil {
+		return err
+	}
+	if r.body[5] != 0 {
+		return fmt.Errorf("the gateway rejected the subscription: %v", snReturnCode(r.body[5:]))
+	}
+	if topicID := binary.BigEndian.Uint16(r.body[1:3]); topicID != 0 && !ok {
+		// topics without wildcards have IDs assigned by the gateway
+		c.setTopic(topicID, topic)
+	}
+	return nil
+}
+
+// register returns the ID of a topic, registering it unless it's known.
+func (c *snClient) register(topic string) (uint16, error) {
+	c.m.Lock()
+	topicID, ok := c.ids[topic]
+	c.m.Unlock()
+	if ok {
+		return topicID, nil
+	}
+
+	id := c.nextMsgID()
+	body := append([]byte{0, 0, byte(id >> 8), byte(id)}, topic...)
+	r, err := c.request(&snPacket{snRegister, body}, snRegack, func(r *snPacket) bool {
+		return len(r.body) >= 5 && binary.BigEndian.Uint16(r.body[2:4]) == id
+	})
+	if err != nil {
+		return 0, err
+	}
+	if r.body[4] != 0 {
+		return 0, fmt.Errorf("the gateway rejected the registration of %v: %v", topic, snReturnCode(r.body[4:]))
+	}
+	topicID = binary.BigEndian.Uint16(r.body[0:2])
+	c.setTopic(topicID, topic)
+	return topicID, nil
+}
+
+// publish publishes a message. QoS -1 messages can only be published to
+// predefined topics and don't require connections. QoS 1 messages wait for
+// PUBACK.
+func (c *snClient) publish(topic string, qos int, retain bool, payload []byte) error {
+	flags := snQoSFlags(qos)
+	if retain {
+		flags |= snFlagRetain
+	}
+	var topicID uint16
+	if qos < 0 {
+		c.m.Lock()
+		id, ok := c.ids[topic]
+		c.m.Unlock()
+		if !ok {
+			return fmt.Errorf("QoS -1 messages require a predefined topic: %v", topic)
+		}
+		topicID = id
+		flags |= snTopicPredefined
+	} else {
+		id, err := c.register(topic)
+		if err != nil {
+			return err
+		}
+		topicID = id
+	}
+
+	var msgID uint16
+	if qos == 1 {
+		msgID = c.nextMsgID()
+	}
+	body := []byte{flags, byte(topicID >> 8), byte(topicID), byte(msgID >> 8), byte(msgID)}
+	p := &snPacket{snPublish, append(body, payload...)}
+	if qos != 1 {
+		return c.send(p)
+	}
+	r, err := c.request(p, snPuback, func(r *snPacket) bool {
+		return len(r.body) >= 5 && binary.BigEndian.Uint16(r.body[2:4]) == msgID
+	})
+	if err != nil {
+		return err
+	}
+	if r.body[4] != 0 {
+		return fmt.Errorf("the gateway rejected the message: %v", snReturnCode(r.body[4:]))
+	}
+	return nil
+}
+
+// ping sends PINGREQ and waits for PINGRESP.
+func (c *snClient) ping() error {
+	_, err := c.request(&snPacket{snPingreq, nil}, snPingresp, nil)
+	return err
+}
+
+// close sends DISCONNECT when connected and closes the socket.
+func (c *snClient) close(connected bool) error {
+	if connected {
+		c.send(&snPacket{snDisconnect, nil})
+	}
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+// snReturnCode describes the return code in the first byte of b.
+func snReturnCode(b []byte) string {
+	if len(b) == 0 {
+		return "no return code"
+	}
+	switch b[0] {
+	case 0x01:
+		return "congestion"
+	case 0x02:
+		return "invalid topic ID"
+	case 0x03:
+		return "not supported"
+	default:
+		return fmt.Sprintf("return code %v", b[0])
+	}
+}
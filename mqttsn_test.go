@@ -0,0 +1,240 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// fakeSNGateway is a gateway responding to requests of clients. When a
+// client subscribes, it registers sensors/a and publishes a message to it.
+type fakeSNGateway struct {
+	conn    net.PacketConn
+	packets chan *snPacket
+}
+
+func newFakeSNGateway(t *testing.T) *fakeSNGateway {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &fakeSNGateway{
+		conn:    conn,
+		packets: make(chan *snPacket, 100),
+	}
+	go g.run()
+	return g
+}
+
+func (g *fakeSNGateway) addr() string {
+	return g.conn.LocalAddr().String()
+}
+
+func (g *fakeSNGateway) run() {
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := g.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		p, err := decodeSNPacket(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			continue
+		}
+		g.packets <- p
+		send := func(typ byte, body ...byte) {
+			g.conn.WriteTo((&snPacket{typ, body}).encode(), addr)
+		}
+		switch p.typ {
+		case snConnect:
+			send(snConnack, 0)
+		case snSubscribe:
+			send(snSuback, p.body[0], 0, 0, p.body[1], p.body[2], 0)
+			send(snRegister, append([]byte{0, 7, 0, 1}, "sensors/a"...)...)
+			send(snPublish, append([]byte{snQoSFlags(1), 0, 7, 0, 2}, `{"v":1}`...)...)
+		case snRegister:
+			send(snRegack, 0, 9, p.body[2], p.body[3], 0)
+		case snPublish:
+			if snQoS(p.body[0]) == 1 {
+				send(snPuback, p.body[1], p.body[2], p.body[3], p.body[4], 0)
+			}
+		case snPingreq:
+			send(snPingresp)
+		}
+	}
+}
+
+// next returns the next packet of the type received by the gateway.
+func (g *fakeSNGateway) next(t *testing.T, typ byte) *snPacket {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case p := <-g.packets:
+			if p.typ == typ {
+				return p
+			}
+		case <-timeout:
+			t.Fatalf("the gateway didn't receive a packet of type %v", typ)
+		}
+	}
+}
+
+func TestSNPacket(t *testing.T) {
+	for _, size := range []int{0, 10, 253, 254, 1000} {
+		p := &snPacket{snPublish, bytes.Repeat([]byte{1}, size)}
+		b := p.encode()
+		d, err := decodeSNPacket(b)
+		if err != nil {
+			t.Fatalf("%v: %v", size, err)
+		}
+		if d.typ != p.typ || !bytes.Equal(d.body, p.body) {
+			t.Errorf("%v: wrong packet: %v", size, d)
+		}
+	}
+	for _, b := range [][]byte{{}, {2}, {5, snPublish}, {0x01, 0, 3, snPublish}} {
+		if _, err := decodeSNPacket(b); err == nil {
+			t.Errorf("%v should be rejected", b)
+		}
+	}
+	if snQoS(snQoSFlags(-1)) != -1 || snQoS(snQoSFlags(1)) != 1 {
+		t.Error("QoS flags are wrong")
+	}
+}
+
+func TestSNSource(t *testing.T) {
+	g := newFakeSNGateway(t)
+	defer g.conn.Close()
+
+	ctx := core.NewContext(nil)
+	src, err := NewSNSource(ctx, &bql.IOParams{}, data.Map{
+		"gateway":   data.String(g.addr()),
+		"topic":     data.String("sensors/#"),
+		"qos":       data.Int(1),
+		"format":    data.String("json"),
+		"client_id": data.String("test"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuples := make(chan *core.Tuple, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- src.GenerateStream(ctx, core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+			tuples <- t
+			return nil
+		}))
+	}()
+
+	connect := g.next(t, snConnect)
+	if string(connect.body[4:]) != "test" {
+		t.Errorf("wrong client ID: %s", connect.body[4:])
+	}
+	sub := g.next(t, snSubscribe)
+	if snQoS(sub.body[0]) != 1 || string(sub.body[3:]) != "sensors/#" {
+		t.Errorf("wrong subscription: %v", sub.body)
+	}
+	select {
+	case tu := <-tuples:
+		expected := data.Map{
+			"topic":   data.String("sensors/a"),
+			"payload": data.Map{"v": data.Int(1)},
+		}
+		if !data.Equal(expected, tu.Data) {
+			t.Errorf("expected %v, actual %v", expected, tu.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message wasn't emitted")
+	}
+	g.next(t, snRegack)
+	if ack := g.next(t, snPuback); binary.BigEndian.Uint16(ack.body[2:4]) != 2 {
+		t.Errorf("wrong PUBACK: %v", ack.body)
+	}
+
+	if err := src.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	g.next(t, snDisconnect)
+}
+
+func TestSNSink(t *testing.T) {
+	g := newFakeSNGateway(t)
+	defer g.conn.Close()
+
+	ctx := core.NewContext(nil)
+	snk, err := NewSNSink(ctx, &bql.IOParams{}, data.Map{
+		"gateway": data.String(g.addr()),
+		"qos":     data.Int(1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tu := core.NewTuple(data.Map{"topic": data.String("a/b"), "payload": data.String("on")})
+	if err := snk.Write(ctx, tu); err != nil {
+		t.Fatal(err)
+	}
+	g.next(t, snConnect)
+	if reg := g.next(t, snRegister); string(reg.body[4:]) != "a/b" {
+		t.Errorf("wrong registration: %v", reg.body)
+	}
+	pub := g.next(t, snPublish)
+	if binary.BigEndian.Uint16(pub.body[1:3]) != 9 || string(pub.body[5:]) != "on" {
+		t.Errorf("wrong message: %v", pub.body)
+	}
+	if err := snk.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	snk, err = NewSNSink(ctx, &bql.IOParams{}, data.Map{
+		"gateway":           data.String(g.addr()),
+		"qos":               data.Int(-1),
+		"predefined_topics": data.Map{"3": data.String("valve")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snk.Close(ctx)
+	if err := snk.Write(ctx, core.NewTuple(data.Map{"topic": data.String("a/b"), "payload": data.String("on")})); err == nil {
+		t.Error("QoS -1 messages to topics which aren't predefined should be rejected")
+	}
+	if err := snk.Write(ctx, core.NewTuple(data.Map{"topic": data.String("valve"), "payload": data.String("open")})); err != nil {
+		t.Fatal(err)
+	}
+	pub = g.next(t, snPublish)
+	if snQoS(pub.body[0]) != -1 || pub.body[0]&0x03 != snTopicPredefined || binary.BigEndian.Uint16(pub.body[1:3]) != 3 {
+		t.Errorf("wrong QoS -1 message: %v", pub.body)
+	}
+}
+
+func TestNewSNNodes(t *testing.T) {
+	ctx := core.NewContext(nil)
+	for _, params := range []data.Map{
+		{"topic": data.String("a")},
+		{"gateway": data.String("localhost:10000")},
+		{"gateway": data.String("localhost:10000"), "topic": data.String("a"), "qos": data.Int(-1)},
+		{"gateway": data.String("localhost:10000"), "topic": data.String("a"), "format": data.String("csv")},
+		{"gateway": data.String("localhost:10000"), "topic": data.String("a"), "client_id": data.String("")},
+		{"gateway": data.String("localhost:10000"), "topic": data.String("a"), "keep_alive": data.String("0s")},
+		{"gateway": data.String("localhost:10000"), "topic": data.String("a"), "predefined_topics": data.Map{"x": data.String("a")}},
+	} {
+		if _, err := NewSNSource(ctx, &bql.IOParams{}, params); err == nil {
+			t.Errorf("%v should be rejected by the source", params)
+		}
+	}
+	for _, params := range []data.Map{
+		{"gateway": data.String("localhost:10000"), "qos": data.Int(2)},
+		{"gateway": data.String("localhost:10000"), "default_qos": data.Int(1)},
+	} {
+		if _, err := NewSNSink(ctx, &bql.IOParams{}, params); err == nil {
+			t.Errorf("%v should be rejected by the sink", params)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// ngsi decodes entities of FIWARE NGSI-v2 and NGSI-LD. A payload can be an
+// entity, an array of entities, or a notification having entities in its
+// data field. Measures published to /<apikey>/<device>/attrs by devices
+// following the JSON protocol of IoT Agents are also decoded as entities
+// whose IDs are the device IDs.
+type ngsi struct{}
+
+func (ngsi) String() string {
+	return "ngsi"
+}
+
+func (ngsi) decode(topic string, payload []byte) ([]data.Map, error) {
+	if len(payload) == 0 {
+		return nil, nil
+	}
+	v, err := decodeJSON(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var entities data.Array
+	switch v := v.(type) {
+	case data.Array:
+		entities = v
+	case data.Map:
+		if d, ok := v["data"].(data.Array); ok {
+			// notifications of subscriptions
+			entities = d
+		} else {
+			entities = data.Array{v}
+		}
+	default:
+		return nil, fmt.Errorf("the payload must be an entity or an array of entities: %v", v)
+	}
+
+	deviceID := iotAgentDevice(topic)
+	ds := make([]data.Map, 0, len(entities))
+	for _, e := range entities {
+		m, ok := e.(data.Map)
+		if !ok {
+			return nil, fmt.Errorf("an entity must be a JSON object: %v", e)
+		}
+		d, err := ngsiEntity(m, deviceID)
+		if err != nil {
+			return nil, err
+		}
+		d["topic"] = data.String(topic)
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// iotAgentDevice returns the device ID of a topic of IoT Agents like
+// /<apikey>/<device>/attrs. It returns "" when the topic isn't such a topic.
+func iotAgentDevice(topic string) string {
+	levels := strings.Split(topic, "/")
+	if len(levels) == 4 && levels[0] == "" && levels[3] == "attrs" {
+		return levels[2]
+	}
+	return ""
+}
+
+// ngsiEntity converts an entity into entity_id, entity_type, and attributes
+// having values of attributes. Values are taken from value of properties and
+// object of relationships, and attributes in the simplified (keyValues)
+// representation are used as they are.
+func ngsiEntity(e data.Map, deviceID string) (data.Map, error) {
+	id, _ := e["id"].(data.String)
+	if id == "" {
+		id = data.String(deviceID)
+	}
+	if id == "" {
+		return nil, errors.New("an entity doesn't have id")
+	}
+	d := data.Map{"entity_id": id}
+	if t, ok := e["type"].(data.String); ok {
+		d["entity_type"] = t
+	}
+
+	attrs := data.Map{}
+	for name, a := range e {
+		switch name {
+		case "id", "type", "@context":
+			continue
+		}
+		attrs[name] = a
+		if m, ok := a.(data.Map); ok {
+			if v, ok := m["value"]; ok {
+				attrs[name] = v
+			} else if v, ok := m["object"]; ok {
+				attrs[name] = v
+			}
+		}
+	}
+	d["attributes"] = attrs
+	return d, nil
+}
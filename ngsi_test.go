@@ -0,0 +1,79 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestNGSIDecode(t *testing.T) {
+	cases := []struct {
+		topic    string
+		payload  string
+		expected []data.Map
+	}{
+		{
+			"fiware/rooms",
+			`{"id":"urn:ngsi-ld:Room:1","type":"Room","@context":"https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld",
+			  "temperature":{"type":"Property","value":21.5,"unitCode":"CEL"},
+			  "locatedIn":{"type":"Relationship","object":"urn:ngsi-ld:Building:1"}}`,
+			[]data.Map{{
+				"topic":       data.String("fiware/rooms"),
+				"entity_id":   data.String("urn:ngsi-ld:Room:1"),
+				"entity_type": data.String("Room"),
+				"attributes": data.Map{
+					"temperature": data.Float(21.5),
+					"locatedIn":   data.String("urn:ngsi-ld:Building:1"),
+				},
+			}},
+		},
+		{
+			"fiware/notify",
+			`{"subscriptionId":"s1","data":[{"id":"Room1","type":"Room","temperature":{"value":23,"type":"Float","metadata":{}}},{"id":"Room2","pressure":720}]}`,
+			[]data.Map{
+				{
+					"topic":       data.String("fiware/notify"),
+					"entity_id":   data.String("Room1"),
+					"entity_type": data.String("Room"),
+					"attributes":  data.Map{"temperature": data.Int(23)},
+				},
+				{
+					"topic":      data.String("fiware/notify"),
+					"entity_id":  data.String("Room2"),
+					"attributes": data.Map{"pressure": data.Int(720)},
+				},
+			},
+		},
+		{
+			"/key/sensor01/attrs",
+			`{"t":21,"h":40}`,
+			[]data.Map{{
+				"topic":      data.String("/key/sensor01/attrs"),
+				"entity_id":  data.String("sensor01"),
+				"attributes": data.Map{"t": data.Int(21), "h": data.Int(40)},
+			}},
+		},
+	}
+	for _, c := range cases {
+		ds, err := ngsi{}.decode(c.topic, []byte(c.payload))
+		if err != nil {
+			t.Errorf("%v: %v", c.topic, err)
+			continue
+		}
+		if len(ds) != len(c.expected) {
+			t.Errorf("%v: expected %v, actual %v", c.topic, c.expected, ds)
+			continue
+		}
+		for i, d := range ds {
+			if !data.Equal(c.expected[i], d) {
+				t.Errorf("%v: expected %v, actual %v", c.topic, c.expected[i], d)
+			}
+		}
+	}
+
+	for _, payload := range []string{`{"t":21}`, `1`, `[1]`, `{`} {
+		if _, err := (ngsi{}).decode("fiware/rooms", []byte(payload)); err == nil {
+			t.Errorf("%v should be rejected", payload)
+		}
+	}
+}
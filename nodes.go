@@ -0,0 +1,129 @@
+package mqtt
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// Node is an active MQTT source or sink. Host applications can list nodes by
+// Nodes to build their own administration tools on top of the package.
+type Node interface {
+	// Kind returns "source" or "sink".
+	Kind() string
+
+	// Name returns the name of the source or the sink in the topology.
+	Name() string
+
+	// Status returns a snapshot of the status, which is the same as the one
+	// returned to SensorBee.
+	Status() data.Map
+
+	// Pause makes the node discard messages until Resume is called. A paused
+	// source keeps receiving messages from the broker but doesn't emit them,
+	// and a paused sink doesn't publish tuples written to it. Discarded
+	// messages are reported to the discard monitor as "paused".
+	Pause()
+
+	// Resume resumes the node paused by Pause.
+	Resume()
+
+	// Reconnect closes the connection to the broker and connects again.
+	// The current credentials of the credentials state and an access token
+	// from oauth2_token_url are used when the client reconnects.
+	Reconnect() error
+}
+
+// TopicSubscriber is implemented by MQTT sources. Host applications can
+// change topics of a running source by asserting a Node returned from Nodes
+// to it, for example, to subscribe to topics of newly discovered devices
+// without recreating the source.
+type TopicSubscriber interface {
+	Node
+
+	// Topics returns topics which the source subscribes to, starting with
+	// the topic parameter.
+	Topics() []string
+
+	// AddTopic makes the source subscribe to the topic filter. It's
+	// subscribed immediately when the source is connected and on every
+	// reconnect. Adding a topic which is already subscribed does nothing.
+	AddTopic(topic string) error
+
+	// RemoveTopic makes the source unsubscribe from the topic filter. The
+	// last topic cannot be removed.
+	RemoveTopic(topic string) error
+}
+
+var (
+	nodesMutex sync.RWMutex
+	nodes      = map[Node]struct{}{}
+)
+
+// Nodes returns MQTT sources and sinks which are currently active, sorted by
+// their kinds and names. A source is active while it's generating a stream,
+// and a sink is active until it's closed.
+func Nodes() []Node {
+	nodesMutex.RLock()
+	res := make([]Node, 0, len(nodes))
+	for n := range nodes {
+		res = append(res, n)
+	}
+	nodesMutex.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Kind() != res[j].Kind() {
+			return res[i].Kind() < res[j].Kind()
+		}
+		return res[i].Name() < res[j].Name()
+	})
+	return res
+}
+
+func registerNode(n Node) {
+	nodesMutex.Lock()
+	defer nodesMutex.Unlock()
+	nodes[n] = struct{}{}
+}
+
+func unregisterNode(n Node) {
+	nodesMutex.Lock()
+	defer nodesMutex.Unlock()
+	delete(nodes, n)
+}
+
+// pauseState is the state of Node.Pause shared by sources and sinks.
+type pauseState struct {
+	// paused is 1 while the node is paused, and discarded is the number of
+	// messages discarded while paused. They must be accessed atomically.
+	paused    int32
+	discarded int64
+}
+
+func (p *pauseState) set(paused bool) {
+	v := int32(0)
+	if paused {
+		v = 1
+	}
+	atomic.StoreInt32(&p.paused, v)
+}
+
+// discard returns true and counts the message as discarded when the node is
+// paused.
+func (p *pauseState) discard() bool {
+	if atomic.LoadInt32(&p.paused) == 0 {
+		return false
+	}
+	atomic.AddInt64(&p.discarded, 1)
+	return true
+}
+
+func (p *pauseState) isPaused() bool {
+	return atomic.LoadInt32(&p.paused) != 0
+}
+
+func (p *pauseState) discards() int64 {
+	return atomic.LoadInt64(&p.discarded)
+}
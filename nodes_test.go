@@ -0,0 +1,99 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// findNode returns the active node of the kind and the name.
+func findNode(t *testing.T, kind, name string) Node {
+	for _, n := range Nodes() {
+		if n.Kind() == kind && n.Name() == name {
+			return n
+		}
+	}
+	t.Fatalf("%v %v isn't active", kind, name)
+	return nil
+}
+
+func TestNodes(t *testing.T) {
+	src1 := &source{name: "b"}
+	src2 := &source{name: "a"}
+	snk := &sink{name: "a"}
+	for _, n := range []Node{src1, snk, src2} {
+		registerNode(n)
+		defer unregisterNode(n)
+	}
+
+	ns := Nodes()
+	expected := []Node{snk, src2, src1}
+	if len(ns) != len(expected) {
+		t.Fatalf("expected %v nodes, actual %v", len(expected), len(ns))
+	}
+	for i, n := range ns {
+		if n != expected[i] {
+			t.Errorf("%v: expected %v %v, actual %v %v", i,
+				expected[i].Kind(), expected[i].Name(), n.Kind(), n.Name())
+		}
+	}
+
+	unregisterNode(src1)
+	if len(Nodes()) != 2 {
+		t.Error("an unregistered node shouldn't be listed")
+	}
+}
+
+func TestSourcePause(t *testing.T) {
+	s := &source{}
+	s.Pause()
+	if !s.pause.discard() {
+		t.Error("messages should be discarded while the source is paused")
+	}
+	if !s.pause.isPaused() {
+		t.Error("the source should be paused")
+	}
+
+	s.Resume()
+	if s.pause.discard() {
+		t.Error("messages shouldn't be discarded after the source is resumed")
+	}
+	if n := s.pause.discards(); n != 1 {
+		t.Errorf("wrong number of discarded messages: %v", n)
+	}
+}
+
+func TestSinkPause(t *testing.T) {
+	s := &sink{}
+	s.Pause()
+	// the sink doesn't touch the client while it's paused
+	if err := s.Write(core.NewContext(nil), core.NewTuple(data.Map{"payload": data.String("a")})); err != nil {
+		t.Fatal(err)
+	}
+	if d := s.discards(); d[discardPaused] != 1 {
+		t.Errorf("the tuple should be discarded while the sink is paused: %v", d)
+	}
+}
+
+func TestSourceReconnect(t *testing.T) {
+	s := &source{reconnect: make(chan struct{}, 1)}
+	if err := s.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.reconnect:
+	default:
+		t.Error("the source should be requested to reconnect")
+	}
+
+	s = &source{reconnect: make(chan struct{})}
+	if err := s.Reconnect(); err == nil {
+		t.Error("reconnecting should fail while the source isn't subscribing")
+	}
+
+	s = &source{autoReconnect: true}
+	if err := s.Reconnect(); err == nil {
+		t.Error("reconnecting should fail with automatic reconnect")
+	}
+}
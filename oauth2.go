@@ -0,0 +1,104 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net/url"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// newOAuth2TokenSource creates a token source using the OAuth2 client
+// credentials flow from oauth2_* parameters. It returns nil when the
+// oauth2_token_url parameter isn't given. The token source caches a token
+// and automatically fetches a new one when it expires.
+func newOAuth2TokenSource(params data.Map) (oauth2.TokenSource, error) {
+	v, ok := params["oauth2_token_url"]
+	if !ok {
+		for _, k := range []string{"oauth2_client_id", "oauth2_client_secret", "oauth2_scopes", "oauth2_audience"} {
+			if _, ok := params[k]; ok {
+				return nil, errors.New(k + " requires oauth2_token_url")
+			}
+		}
+		return nil, nil
+	}
+	tokenURL, err := data.AsString(v)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &clientcredentials.Config{
+		TokenURL: tokenURL,
+	}
+
+	{ // This block is to suppress a golint warning.
+		v, ok := params["oauth2_client_id"]
+		if !ok {
+			return nil, errors.New("oauth2_client_id parameter is missing")
+		}
+		id, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientID, err = expandEnv(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if v, ok := params["oauth2_client_secret"]; ok {
+		secret, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientSecret, err = expandEnv(secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if v, ok := params["oauth2_scopes"]; ok {
+		if v.Type() == data.TypeArray {
+			a, _ := data.AsArray(v)
+			for _, e := range a {
+				s, err := data.AsString(e)
+				if err != nil {
+					return nil, err
+				}
+				cfg.Scopes = append(cfg.Scopes, s)
+			}
+		} else {
+			s, err := data.AsString(v)
+			if err != nil {
+				return nil, err
+			}
+			cfg.Scopes = []string{s}
+		}
+	}
+
+	if v, ok := params["oauth2_audience"]; ok {
+		aud, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		cfg.EndpointParams = url.Values{"audience": []string{aud}}
+	}
+	return cfg.TokenSource(context.Background()), nil
+}
+
+// oauth2CredentialsProvider returns a mqtt.CredentialsProvider passing an
+// access token as the password.
+func oauth2CredentialsProvider(ctx *core.Context, user string, ts oauth2.TokenSource) func() (string, string) {
+	return func() (string, string) {
+		tok, err := ts.Token()
+		if err != nil {
+			// The broker will reject the connection and the client will
+			// retry it with a new token later.
+			ctx.ErrLog(err).Error("Cannot get an OAuth2 access token")
+			return user, ""
+		}
+		return user, tok.AccessToken
+	}
+}
@@ -0,0 +1,57 @@
+package mqtt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestOAuth2CredentialsProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		if g := r.PostForm.Get("grant_type"); g != "client_credentials" {
+			t.Errorf("wrong grant type: %v", g)
+		}
+		if s := r.PostForm.Get("scope"); s != "read write" {
+			t.Errorf("wrong scope: %v", s)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","token_type":"bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	ts, err := newOAuth2TokenSource(data.Map{
+		"oauth2_token_url":     data.String(server.URL),
+		"oauth2_client_id":     data.String("id"),
+		"oauth2_client_secret": data.String("secret"),
+		"oauth2_scopes":        data.Array{data.String("read"), data.String("write")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, p := oauth2CredentialsProvider(nil, "user", ts)(); u != "user" || p != "token" {
+		t.Errorf("wrong credentials: %v, %v", u, p)
+	}
+}
+
+func TestNewOAuth2TokenSource(t *testing.T) {
+	if ts, err := newOAuth2TokenSource(data.Map{}); err != nil || ts != nil {
+		t.Errorf("token source shouldn't be created without the parameter: %v, %v", ts, err)
+	}
+
+	for _, params := range []data.Map{
+		{"oauth2_client_id": data.String("id")},
+		{"oauth2_token_url": data.String("http://localhost/token")},
+		{"oauth2_token_url": data.String("http://localhost/token"), "oauth2_client_id": data.Int(1)},
+		{"oauth2_token_url": data.String("http://localhost/token"), "oauth2_client_id": data.String("id"),
+			"oauth2_scopes": data.Array{data.Int(1)}},
+	} {
+		if _, err := newOAuth2TokenSource(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// onErrorPolicy decides what the sink does with tuples written while it isn't
+// connected to the broker.
+type onErrorPolicy int
+
+const (
+	// dropOnError drops the tuple and counts it.
+	dropOnError onErrorPolicy = iota
+
+	// retryOnError blocks the writer until the sink is reconnected or the
+	// timeout expires.
+	retryOnError
+
+	// failOnError returns an error from Write.
+	failOnError
+)
+
+func parseOnErrorPolicy(s string) (onErrorPolicy, error) {
+	switch s {
+	case "drop":
+		return dropOnError, nil
+	case "retry":
+		return retryOnError, nil
+	case "fail":
+		return failOnError, nil
+	default:
+		return 0, fmt.Errorf("unknown on_error: %v", s)
+	}
+}
+
+func (p onErrorPolicy) String() string {
+	switch p {
+	case retryOnError:
+		return "retry"
+	case failOnError:
+		return "fail"
+	default:
+		return "drop"
+	}
+}
+
+// errNotConnected is returned from Write when the sink isn't connected to the
+// broker.
+var errNotConnected = errors.New("the sink isn't connected to the broker")
+
+// connectionChecker is a client whose connection can be checked.
+type connectionChecker interface {
+	IsConnected() bool
+}
+
+// onError handles tuples written while the sink isn't connected.
+type onError struct {
+	policy  onErrorPolicy
+	timeout time.Duration
+
+	// dropped is the number of tuples dropped by dropOnError. It must be
+	// accessed atomically.
+	dropped int64
+}
+
+// parseOnError parses on_error and on_error_timeout parameters.
+func parseOnError(params data.Map) (*onError, error) {
+	e := &onError{
+		timeout: 30 * time.Second,
+	}
+	if v, ok := params["on_error"]; ok {
+		s, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		p, err := parseOnErrorPolicy(s)
+		if err != nil {
+			return nil, err
+		}
+		e.policy = p
+	}
+
+	if v, ok := params["on_error_timeout"]; ok {
+		if e.policy != retryOnError {
+			return nil, errors.New("on_error_timeout requires on_error to be \"retry\"")
+		}
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, errors.New("on_error_timeout must be positive")
+		}
+		e.timeout = d
+	}
+	return e, nil
+}
+
+// disconnected is called when a tuple is written while c isn't connected. It
+// returns true when c has been reconnected and the tuple can be published.
+// Otherwise, it returns the error to be returned from Write. It gives up
+// waiting when closing is closed.
+func (e *onError) disconnected(c connectionChecker, closing <-chan struct{}) (bool, error) {
+	switch e.policy {
+	case retryOnError:
+		deadline := time.Now().Add(e.timeout)
+		b := &backoff{
+			min: connectionPollInterval,
+			max: time.Second,
+		}
+		for {
+			wait := b.next()
+			if rest := deadline.Sub(time.Now()); wait > rest {
+				wait = rest
+			}
+			if wait <= 0 {
+				return false, fmt.Errorf("%v for %v", errNotConnected, e.timeout)
+			}
+			select {
+			case <-closing:
+				return false, errNotConnected
+			case <-time.After(wait):
+			}
+			if c.IsConnected() {
+				return true, nil
+			}
+		}
+	case failOnError:
+		return false, errNotConnected
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+		return false, nil
+	}
+}
+
+// config reports the policy, and the timeout when tuples are retried.
+func (e *onError) config(c data.Map) {
+	c["on_error"] = data.String(e.policy.String())
+	if e.policy == retryOnError {
+		c["on_error_timeout"] = data.String(e.timeout.String())
+	}
+}
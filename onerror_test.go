@@ -0,0 +1,89 @@
+package mqtt
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// testConnection becomes connected after the given number of checks.
+type testConnection struct {
+	checks int32
+	after  int32
+}
+
+func (c *testConnection) IsConnected() bool {
+	return atomic.AddInt32(&c.checks, 1) > c.after
+}
+
+func TestParseOnError(t *testing.T) {
+	e, err := parseOnError(data.Map{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.policy != dropOnError {
+		t.Errorf("wrong default policy: %v", e.policy)
+	}
+
+	e, err = parseOnError(data.Map{"on_error": data.String("retry"), "on_error_timeout": data.String("5s")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.policy != retryOnError || e.timeout != 5*time.Second {
+		t.Errorf("wrong parameters: %v, %v", e.policy, e.timeout)
+	}
+
+	for _, params := range []data.Map{
+		{"on_error": data.String("ignore")},
+		{"on_error": data.Int(1)},
+		{"on_error_timeout": data.String("5s")},
+		{"on_error": data.String("retry"), "on_error_timeout": data.String("0s")},
+	} {
+		if _, err := parseOnError(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
+
+func TestOnErrorDisconnected(t *testing.T) {
+	closing := make(chan struct{})
+	never := &testConnection{after: 1 << 30}
+
+	e := &onError{policy: dropOnError}
+	if ok, err := e.disconnected(never, closing); ok || err != nil {
+		t.Errorf("the tuple should be dropped: %v, %v", ok, err)
+	}
+	if e.dropped != 1 {
+		t.Errorf("the dropped tuple should be counted: %v", e.dropped)
+	}
+
+	e = &onError{policy: failOnError}
+	if ok, err := e.disconnected(never, closing); ok || err != errNotConnected {
+		t.Errorf("the error should be returned: %v, %v", ok, err)
+	}
+
+	e = &onError{policy: retryOnError, timeout: time.Second}
+	if ok, err := e.disconnected(&testConnection{after: 1}, closing); !ok || err != nil {
+		t.Errorf("the tuple should be published after reconnection: %v, %v", ok, err)
+	}
+
+	e = &onError{policy: retryOnError, timeout: 50 * time.Millisecond}
+	start := time.Now()
+	if ok, err := e.disconnected(never, closing); ok || err == nil {
+		t.Errorf("waiting should time out: %v, %v", ok, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("waiting should be limited by the timeout: %v", d)
+	}
+
+	e = &onError{policy: retryOnError, timeout: time.Hour}
+	close(closing)
+	if ok, err := e.disconnected(never, closing); ok || err == nil {
+		t.Errorf("waiting should stop when the sink is closed: %v, %v", ok, err)
+	}
+	if e.dropped != 0 {
+		t.Errorf("only dropped tuples should be counted: %v", e.dropped)
+	}
+}
@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"fmt"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// messageOrder is how a source handles messages delivered by the client.
+type messageOrder int
+
+const (
+	// orderedMessages handles messages one at a time in the order the client
+	// receives them within each QoS level. A slow handler blocks the client.
+	orderedMessages messageOrder = iota
+
+	// parallelMessages handles each message in its own goroutine. Tuples can
+	// be emitted out of order.
+	parallelMessages
+
+	// serializedMessages receives messages in order and writes them in the
+	// same order from a single writer goroutine so that writing tuples doesn't
+	// block the client.
+	serializedMessages
+)
+
+func parseMessageOrder(s string) (messageOrder, error) {
+	switch s {
+	case "ordered":
+		return orderedMessages, nil
+	case "parallel":
+		return parallelMessages, nil
+	case "serialized":
+		return serializedMessages, nil
+	default:
+		return 0, fmt.Errorf("unknown message order: %v", s)
+	}
+}
+
+func (o messageOrder) String() string {
+	switch o {
+	case parallelMessages:
+		return "parallel"
+	case serializedMessages:
+		return "serialized"
+	default:
+		return "ordered"
+	}
+}
+
+// serializedBufferSize is the size of the queue used by the serialized order
+// when buffer_size isn't given.
+const serializedBufferSize = 1024
+
+// limitInflight returns a handler running h in its own goroutine while at
+// most n messages are being handled. It blocks when n messages are in
+// progress, so it must be used with a client delivering messages in order,
+// which then stops reading messages from the broker until a handler finishes.
+func limitInflight(h mqtt.MessageHandler, n int) mqtt.MessageHandler {
+	sem := make(chan struct{}, n)
+	return func(c mqtt.Client, m mqtt.Message) {
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+			}()
+			h(c, m)
+		}()
+	}
+}
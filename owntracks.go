@@ -0,0 +1,71 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// ownTracks decodes location messages of OwnTracks published to
+// owntracks/<user>/<device>. Messages whose _type isn't "location", such as
+// transitions and waypoints, aren't emitted.
+type ownTracks struct{}
+
+// ownTracksFields has fields of location messages emitted as tuple fields.
+// tst is renamed to timestamp.
+var ownTracksFields = []struct {
+	name     string
+	field    string
+	coercion *coercion
+	required bool
+}{
+	{"lat", "lat", &coercion{typ: data.TypeFloat}, true},
+	{"lon", "lon", &coercion{typ: data.TypeFloat}, true},
+	{"acc", "acc", &coercion{typ: data.TypeInt}, false},
+	{"batt", "batt", &coercion{typ: data.TypeInt}, false},
+	{"tid", "tid", &coercion{typ: data.TypeString}, false},
+	{"tst", "timestamp", &coercion{typ: data.TypeTimestamp, format: "unix"}, false},
+}
+
+func (ownTracks) String() string {
+	return "owntracks"
+}
+
+func (ownTracks) decode(topic string, payload []byte) ([]data.Map, error) {
+	if len(payload) == 0 {
+		return nil, nil
+	}
+	v, err := decodeJSON(payload)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(data.Map)
+	if !ok {
+		return nil, fmt.Errorf("the payload must be a JSON object: %v", v)
+	}
+	if t, _ := m["_type"].(data.String); t != "location" {
+		return nil, nil
+	}
+
+	d := data.Map{"topic": data.String(topic)}
+	if levels := strings.Split(topic, "/"); len(levels) == 3 {
+		d["user"] = data.String(levels[1])
+		d["device"] = data.String(levels[2])
+	}
+	for _, f := range ownTracksFields {
+		v, ok := m[f.name]
+		if !ok {
+			if f.required {
+				return nil, fmt.Errorf("the location doesn't have %v", f.name)
+			}
+			continue
+		}
+		x, err := f.coercion.coerce(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v: %v", f.name, err)
+		}
+		d[f.field] = x
+	}
+	return []data.Map{d}, nil
+}
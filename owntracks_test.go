@@ -0,0 +1,40 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestOwnTracksDecode(t *testing.T) {
+	ds, err := ownTracks{}.decode("owntracks/alice/phone", []byte(`{"_type":"location","lat":35.5,"lon":139,"acc":"12","batt":80,"tid":"ap","tst":1704164645,"vel":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := data.Map{
+		"topic":     data.String("owntracks/alice/phone"),
+		"user":      data.String("alice"),
+		"device":    data.String("phone"),
+		"lat":       data.Float(35.5),
+		"lon":       data.Float(139),
+		"acc":       data.Int(12),
+		"batt":      data.Int(80),
+		"tid":       data.String("ap"),
+		"timestamp": data.Timestamp(time.Unix(1704164645, 0)),
+	}
+	if len(ds) != 1 || !data.Equal(expected, ds[0]) {
+		t.Errorf("expected %v, actual %v", expected, ds)
+	}
+
+	for _, payload := range []string{`{"_type":"transition","lat":1,"lon":2}`, `{"lat":1,"lon":2}`, ``} {
+		if ds, err := (ownTracks{}).decode("owntracks/alice/phone", []byte(payload)); err != nil || ds != nil {
+			t.Errorf("%v shouldn't be emitted: %v, %v", payload, ds, err)
+		}
+	}
+	for _, payload := range []string{`{"_type":"location","lat":1}`, `{"_type":"location","lat":"north","lon":2}`, `[]`} {
+		if _, err := (ownTracks{}).decode("owntracks/alice/phone", []byte(payload)); err == nil {
+			t.Errorf("%v should be rejected", payload)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+)
+
+// pahoLogLevel is the verbosity of internal logs of the MQTT client libraries
+// written to the SensorBee log.
+type pahoLogLevel int
+
+const (
+	pahoLogNone pahoLogLevel = iota
+	pahoLogError
+	pahoLogWarn
+	pahoLogDebug
+)
+
+func parsePahoLogLevel(s string) (pahoLogLevel, error) {
+	switch s {
+	case "none":
+		return pahoLogNone, nil
+	case "error":
+		return pahoLogError, nil
+	case "warn":
+		return pahoLogWarn, nil
+	case "debug":
+		return pahoLogDebug, nil
+	default:
+		return 0, fmt.Errorf("unknown paho_log_level: %v", s)
+	}
+}
+
+func (l pahoLogLevel) String() string {
+	switch l {
+	case pahoLogError:
+		return "error"
+	case pahoLogWarn:
+		return "warn"
+	case pahoLogDebug:
+		return "debug"
+	default:
+		return "none"
+	}
+}
+
+// pahoLogger implements Logger of paho.mqtt.golang and paho.golang, which
+// have the same methods. It writes messages at the level.
+type pahoLogger struct {
+	level pahoLogLevel
+	write func(level pahoLogLevel, msg string)
+}
+
+func (l pahoLogger) Println(v ...interface{}) {
+	l.write(l.level, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+func (l pahoLogger) Printf(format string, v ...interface{}) {
+	l.write(l.level, fmt.Sprintf(format, v...))
+}
+
+// pahoLogTarget is a node writing internal logs of its clients to the context.
+type pahoLogTarget struct {
+	ctx   *core.Context
+	level pahoLogLevel
+}
+
+// write writes the message if the target's verbosity allows it.
+func (t *pahoLogTarget) write(level pahoLogLevel, msg string) {
+	if level > t.level {
+		return
+	}
+	l := t.ctx.Log().WithField("component", "paho")
+	switch level {
+	case pahoLogError:
+		l.Error(msg)
+	case pahoLogWarn:
+		l.Warn(msg)
+	default:
+		l.Debug(msg)
+	}
+}
+
+// logger returns a logger writing messages at the level to the target. It
+// returns nil when the target doesn't write them.
+func (t *pahoLogTarget) logger(level pahoLogLevel) *pahoLogger {
+	if t == nil || level > t.level {
+		return nil
+	}
+	return &pahoLogger{level: level, write: t.write}
+}
+
+var pahoLogs struct {
+	m       sync.RWMutex
+	targets []*pahoLogTarget
+	install sync.Once
+}
+
+// registerPahoLogs starts writing internal logs of the clients of a node to
+// the context. It returns nil when level is pahoLogNone. Loggers of
+// paho.mqtt.golang are global, so its logs are written to the context of one
+// of the nodes having the level. They're installed on the first registration
+// and replace the loggers set by the program.
+func registerPahoLogs(ctx *core.Context, level pahoLogLevel) *pahoLogTarget {
+	if level == pahoLogNone {
+		return nil
+	}
+	t := &pahoLogTarget{ctx: ctx, level: level}
+
+	pahoLogs.m.Lock()
+	defer pahoLogs.m.Unlock()
+	pahoLogs.targets = append(pahoLogs.targets, t)
+	pahoLogs.install.Do(func() {
+		mqtt.CRITICAL = pahoLogger{level: pahoLogError, write: writePahoLog}
+		mqtt.ERROR = pahoLogger{level: pahoLogError, write: writePahoLog}
+		mqtt.WARN = pahoLogger{level: pahoLogWarn, write: writePahoLog}
+		mqtt.DEBUG = pahoLogger{level: pahoLogDebug, write: writePahoLog}
+	})
+	return t
+}
+
+// unregisterPahoLogs stops writing logs to the target. It does nothing when
+// t is nil.
+func unregisterPahoLogs(t *pahoLogTarget) {
+	if t == nil {
+		return
+	}
+	pahoLogs.m.Lock()
+	defer pahoLogs.m.Unlock()
+	for i, u := range pahoLogs.targets {
+		if u == t {
+			pahoLogs.targets = append(pahoLogs.targets[:i], pahoLogs.targets[i+1:]...)
+			return
+		}
+	}
+}
+
+// writePahoLog writes a log of paho.mqtt.golang to the first target whose
+// verbosity allows it.
+func writePahoLog(level pahoLogLevel, msg string) {
+	pahoLogs.m.RLock()
+	defer pahoLogs.m.RUnlock()
+	for _, t := range pahoLogs.targets {
+		if level <= t.level {
+			t.write(level, msg)
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+)
+
+func TestParsePahoLogLevel(t *testing.T) {
+	for _, l := range []pahoLogLevel{pahoLogNone, pahoLogError, pahoLogWarn, pahoLogDebug} {
+		actual, err := parsePahoLogLevel(l.String())
+		if err != nil {
+			t.Error(err)
+		} else if actual != l {
+			t.Errorf("expected %v, actual %v", l, actual)
+		}
+	}
+	if _, err := parsePahoLogLevel("critical"); err == nil {
+		t.Error("an unknown level should be rejected")
+	}
+}
+
+func TestPahoLogger(t *testing.T) {
+	var msgs []string
+	l := pahoLogger{level: pahoLogWarn, write: func(level pahoLogLevel, msg string) {
+		if level != pahoLogWarn {
+			t.Errorf("wrong level: %v", level)
+		}
+		msgs = append(msgs, msg)
+	}}
+	l.Println("[client]", "connection lost")
+	l.Printf("%v packets", 3)
+	if len(msgs) != 2 || msgs[0] != "[client] connection lost" || msgs[1] != "3 packets" {
+		t.Errorf("wrong messages: %q", msgs)
+	}
+}
+
+func TestRegisterPahoLogs(t *testing.T) {
+	ctx := core.NewContext(nil)
+	if registerPahoLogs(ctx, pahoLogNone) != nil {
+		t.Error("logs shouldn't be written when the level is none")
+	}
+
+	tg := registerPahoLogs(ctx, pahoLogWarn)
+	if tg.logger(pahoLogError) == nil || tg.logger(pahoLogDebug) != nil {
+		t.Error("loggers should be created only for levels the target writes")
+	}
+	var nilTarget *pahoLogTarget
+	if nilTarget.logger(pahoLogError) != nil {
+		t.Error("a nil target shouldn't create loggers")
+	}
+
+	found := func() bool {
+		pahoLogs.m.RLock()
+		defer pahoLogs.m.RUnlock()
+		for _, u := range pahoLogs.targets {
+			if u == tg {
+				return true
+			}
+		}
+		return false
+	}
+	if !found() {
+		t.Error("the target should be registered")
+	}
+	unregisterPahoLogs(tg)
+	if found() {
+		t.Error("the target should be unregistered")
+	}
+	unregisterPahoLogs(nil)
+}
@@ -3,9 +3,26 @@ package plugin
 import (
 	"gopkg.in/sensorbee/mqtt.v1"
 	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/bql/udf"
 )
 
 func init() {
 	bql.MustRegisterGlobalSourceCreator("mqtt", bql.SourceCreatorFunc(mqtt.NewSource))
 	bql.MustRegisterGlobalSinkCreator("mqtt", bql.SinkCreatorFunc(mqtt.NewSink))
+	bql.MustRegisterGlobalSourceCreator("mqtt_sn", bql.SourceCreatorFunc(mqtt.NewSNSource))
+	bql.MustRegisterGlobalSinkCreator("mqtt_sn", bql.SinkCreatorFunc(mqtt.NewSNSink))
+	udf.MustRegisterGlobalUDSCreator("mqtt_credentials", udf.UDSCreatorFunc(mqtt.NewCredentials))
+	udf.MustRegisterGlobalUDSCreator("mqtt_memory_budget", udf.UDSCreatorFunc(mqtt.NewMemoryBudget))
+	udf.MustRegisterGlobalUDSCreator("mqtt_router", udf.UDSCreatorFunc(mqtt.NewRouter))
+	bql.MustRegisterGlobalSourceCreator("mqtt_route", bql.SourceCreatorFunc(mqtt.NewRouteSource))
+	udf.MustRegisterGlobalUDSCreator("mqtt_discard_monitor", udf.UDSCreatorFunc(mqtt.NewDiscardMonitor))
+	bql.MustRegisterGlobalSourceCreator("mqtt_discards", bql.SourceCreatorFunc(mqtt.NewDiscardSource))
+	udf.MustRegisterGlobalUDSCreator("mqtt_leader", udf.UDSCreatorFunc(mqtt.NewLeader))
+	udf.MustRegisterGlobalUDF("mqtt_is_leader", udf.MustConvertGeneric(mqtt.IsLeader))
+	udf.MustRegisterGlobalUDSFCreator("mqtt_subscribe", mqtt.NewSubscribeUDSFCreator())
+	udf.MustRegisterGlobalUDF("mqtt_topic_stats", udf.MustConvertGeneric(mqtt.TopicStats))
+
+	bql.MustRegisterGlobalSinkCreator("mqtt_recorder", bql.SinkCreatorFunc(mqtt.NewRecorderSink))
+	udf.MustRegisterGlobalUDSCreator("mqtt_recorder", udf.UDSCreatorFunc(mqtt.NewRecorder))
+	udf.MustRegisterGlobalUDF("mqtt_recorded_messages", udf.MustConvertGeneric(mqtt.RecordedMessages))
 }
@@ -0,0 +1,137 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// parseProtocolVersion parses the protocol_version parameter and returns the
+// version numbered like paho, that is, 3 is MQTT 3.1, 4 is MQTT 3.1.1, and 5
+// is MQTT 5.
+func parseProtocolVersion(v data.Value) (uint, error) {
+	str, err := data.ToString(v)
+	if err != nil {
+		return 0, err
+	}
+	switch str {
+	case "3.1", "3":
+		return 3, nil
+	case "3.1.1", "4":
+		return 4, nil
+	case "5", "5.0":
+		return 5, nil
+	default:
+		return 0, fmt.Errorf("unsupported protocol_version: %v", str)
+	}
+}
+
+// protocolVersionName returns the name of the version numbered like paho.
+func protocolVersionName(v uint) string {
+	switch v {
+	case 3:
+		return "3.1"
+	case 5:
+		return "5"
+	default:
+		return "3.1.1"
+	}
+}
+
+// fallbackClient connects to the broker with MQTT 5 and falls back to MQTT
+// 3.1.1 and 3.1 when the broker rejects MQTT 5. Methods other than Connect
+// are called on the client which has connected.
+type fallbackClient struct {
+	v5 *v5Client
+
+	m      sync.Mutex
+	client mqtt.Client
+}
+
+func newFallbackClient(v5 *v5Client) *fallbackClient {
+	return &fallbackClient{v5: v5}
+}
+
+// current returns the client which has connected, or the MQTT 5 client
+// before connecting.
+func (c *fallbackClient) current() mqtt.Client {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.client == nil {
+		return c.v5
+	}
+	return c.client
+}
+
+func (c *fallbackClient) Connect() mqtt.Token {
+	return runV5Token(func() error {
+		err := c.v5.connect()
+		if !errors.Is(err, errV5Unsupported) {
+			c.m.Lock()
+			c.client = c.v5
+			c.m.Unlock()
+			return err
+		}
+
+		// paho tries MQTT 3.1 when MQTT 3.1.1 is rejected unless the version
+		// is set explicitly
+		opts := *c.v5.opts
+		opts.ProtocolVersion = 0
+		client := mqtt.NewClient(&opts)
+		c.m.Lock()
+		c.client = client
+		c.m.Unlock()
+		tok := client.Connect()
+		tok.Wait()
+		return tok.Error()
+	})
+}
+
+func (c *fallbackClient) IsConnected() bool {
+	return c.current().IsConnected()
+}
+
+func (c *fallbackClient) IsConnectionOpen() bool {
+	return c.current().IsConnectionOpen()
+}
+
+func (c *fallbackClient) Disconnect(quiesce uint) {
+	c.current().Disconnect(quiesce)
+}
+
+func (c *fallbackClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return c.current().Publish(topic, qos, retained, payload)
+}
+
+// publishWithProperties publishes a message having the user properties when
+// the client has connected with MQTT 5. The properties are dropped
+// otherwise.
+func (c *fallbackClient) publishWithProperties(topic string, qos byte, retained bool, payload []byte, user map[string]string) mqtt.Token {
+	if p, ok := c.current().(propertiesPublisher); ok {
+		return p.publishWithProperties(topic, qos, retained, payload, user)
+	}
+	return c.current().Publish(topic, qos, retained, payload)
+}
+
+func (c *fallbackClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.current().Subscribe(topic, qos, callback)
+}
+
+func (c *fallbackClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.current().SubscribeMultiple(filters, callback)
+}
+
+func (c *fallbackClient) Unsubscribe(topics ...string) mqtt.Token {
+	return c.current().Unsubscribe(topics...)
+}
+
+func (c *fallbackClient) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.current().AddRoute(topic, callback)
+}
+
+func (c *fallbackClient) OptionsReader() mqtt.ClientOptionsReader {
+	return c.current().OptionsReader()
+}
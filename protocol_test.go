@@ -0,0 +1,151 @@
+package mqtt
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// fakeV3Broker is a broker only accepting MQTT 3.1.1. It sends the protocol
+// level of each CONNECT to levels.
+type fakeV3Broker struct {
+	l      net.Listener
+	levels chan byte
+}
+
+func newFakeV3Broker(t *testing.T) *fakeV3Broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeV3Broker{l: l, levels: make(chan byte, 10)}
+	go b.run()
+	return b
+}
+
+func (b *fakeV3Broker) run() {
+	for {
+		conn, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(conn)
+	}
+}
+
+func (b *fakeV3Broker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if _, err := r.ReadByte(); err != nil {
+		return
+	}
+	n, shift := 0, uint(0)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		n |= int(c&0x7f) << shift
+		if c&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil || n < 7 {
+		return
+	}
+	level := body[6]
+	b.levels <- level
+	if level != 4 {
+		conn.Write([]byte{0x20, 0x02, 0x00, 0x01})
+		return
+	}
+	conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+	io.Copy(io.Discard, r)
+}
+
+func TestFallbackClient(t *testing.T) {
+	b := newFakeV3Broker(t)
+	defer b.l.Close()
+
+	c := newFallbackClient(newV5Client(mqtt.NewClientOptions().AddBroker("tcp://" + b.l.Addr().String())))
+	if err := waitToken(c.Connect(), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect(0)
+	for _, expected := range []byte{5, 4} {
+		select {
+		case l := <-b.levels:
+			if l != expected {
+				t.Errorf("expected protocol level %v, actual %v", expected, l)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the client didn't connect")
+		}
+	}
+	r := c.OptionsReader()
+	if v := r.ProtocolVersion(); v != 4 {
+		t.Errorf("the client should have downgraded to MQTT 3.1.1: %v", v)
+	}
+	if !c.IsConnected() {
+		t.Error("the client should be connected")
+	}
+}
+
+func TestV5ClientRejectedVersion(t *testing.T) {
+	b := newFakeV3Broker(t)
+	defer b.l.Close()
+
+	c := newV5Client(mqtt.NewClientOptions().AddBroker("tcp://" + b.l.Addr().String()))
+	if err := waitToken(c.Connect(), 5*time.Second); err != errV5Unsupported {
+		t.Errorf("the rejected version should be detected: %v", err)
+	}
+}
+
+func TestParseProtocolVersion(t *testing.T) {
+	cases := map[string]uint{
+		"3.1":   3,
+		"3.1.1": 4,
+		"5":     5,
+	}
+	for str, expected := range cases {
+		v, err := parseProtocolVersion(data.String(str))
+		if err != nil {
+			t.Errorf("%v: %v", str, err)
+			continue
+		}
+		if v != expected {
+			t.Errorf("%v: expected %v, actual %v", str, expected, v)
+		}
+		if name := protocolVersionName(v); name != str {
+			t.Errorf("%v: wrong name %v", str, name)
+		}
+	}
+	if _, err := parseProtocolVersion(data.String("3.2")); err == nil {
+		t.Error("an unknown version should be rejected")
+	}
+}
+
+func TestSourceApplyProtocolVersion(t *testing.T) {
+	cases := []struct {
+		s        *source
+		expected uint
+	}{
+		{&source{protocolVersion: 4, downgrade: true}, 0},
+		{&source{protocolVersion: 3, downgrade: true}, 3},
+		{&source{protocolVersion: 4, downgrade: false}, 4},
+	}
+	for _, c := range cases {
+		opts := mqtt.NewClientOptions()
+		c.s.applyProtocolVersion(opts)
+		if opts.ProtocolVersion != c.expected {
+			t.Errorf("%v, %v: expected %v, actual %v", c.s.protocolVersion, c.s.downgrade, c.expected, opts.ProtocolVersion)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting the number of messages per second.
+// It allows a burst of up to a second worth of messages.
+type rateLimiter struct {
+	m      sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+	}
+}
+
+// allow returns true when a message arriving at now is within the rate.
+func (r *rateLimiter) allow(now time.Time) bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if !r.last.IsZero() {
+		r.tokens += now.Sub(r.last).Seconds() * r.rate
+		if r.tokens > r.burst {
+			r.tokens = r.burst
+		}
+	}
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
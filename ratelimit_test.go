@@ -0,0 +1,46 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	r := newRateLimiter(2)
+
+	// The burst of a second worth of messages is allowed.
+	for i := 0; i < 2; i++ {
+		if !r.allow(now) {
+			t.Errorf("message %v should be allowed", i)
+		}
+	}
+	if r.allow(now) {
+		t.Error("a message exceeding the burst should be dropped")
+	}
+
+	if !r.allow(now.Add(500 * time.Millisecond)) {
+		t.Error("a message should be allowed after the token is refilled")
+	}
+	if r.allow(now.Add(600 * time.Millisecond)) {
+		t.Error("a message should be dropped before the token is refilled")
+	}
+
+	// Tokens don't exceed the burst after an idle period.
+	later := now.Add(time.Minute)
+	n := 0
+	for i := 0; i < 10; i++ {
+		if r.allow(later) {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Errorf("only the burst should be allowed: %v", n)
+	}
+
+	// A rate lower than 1 still allows a message.
+	r = newRateLimiter(0.5)
+	if !r.allow(now) || r.allow(now.Add(time.Second)) || !r.allow(now.Add(2*time.Second)) {
+		t.Error("a message should be allowed every two seconds")
+	}
+}
@@ -0,0 +1,176 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// RecordedMessage is a message recorded by a Recorder instead of being
+// published to a broker.
+type RecordedMessage struct {
+	Topic     string
+	QoS       byte
+	Retained  bool
+	Payload   []byte
+	Timestamp time.Time
+}
+
+// Recorder is a shared state storing messages written to mqtt_recorder sinks.
+// It's designed for testing topologies: a test can inspect exactly which
+// messages would have been published to a broker without running one.
+type Recorder struct {
+	m    sync.RWMutex
+	msgs []*RecordedMessage
+}
+
+// NewRecorder creates a new Recorder. It doesn't have any parameter.
+//
+//	CREATE STATE published TYPE mqtt_recorder;
+func NewRecorder(ctx *core.Context, params data.Map) (core.SharedState, error) {
+	return &Recorder{}, nil
+}
+
+func (r *Recorder) record(m *message) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.msgs = append(r.msgs, &RecordedMessage{
+		Topic:     m.topic,
+		QoS:       m.qos,
+		Retained:  m.retained,
+		Payload:   m.payload,
+		Timestamp: time.Now(),
+	})
+}
+
+// Messages returns all messages recorded so far in the order in which they
+// were written.
+func (r *Recorder) Messages() []*RecordedMessage {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	msgs := make([]*RecordedMessage, len(r.msgs))
+	copy(msgs, r.msgs)
+	return msgs
+}
+
+// Reset removes all recorded messages.
+func (r *Recorder) Reset() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.msgs = nil
+}
+
+// Terminate terminates the state.
+func (r *Recorder) Terminate(ctx *core.Context) error {
+	return nil
+}
+
+func lookupRecorder(ctx *core.Context, name string) (*Recorder, error) {
+	st, err := ctx.SharedStates.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := st.(*Recorder)
+	if !ok {
+		return nil, fmt.Errorf("state '%v' isn't a mqtt_recorder", name)
+	}
+	return r, nil
+}
+
+// RecordedMessages is a UDF returning messages recorded by the Recorder
+// having the given name. Each message is a map like:
+//
+//	{
+//		"topic": "foo/bar",
+//		"payload": <blob>,
+//		"qos": 0,
+//		"retained": false,
+//		"timestamp": <timestamp>
+//	}
+func RecordedMessages(ctx *core.Context, name string) (data.Value, error) {
+	r, err := lookupRecorder(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := r.Messages()
+	res := make(data.Array, len(msgs))
+	for i, m := range msgs {
+		res[i] = data.Map{
+			"topic":     data.String(m.Topic),
+			"payload":   data.Blob(m.Payload),
+			"qos":       data.Int(m.QoS),
+			"retained":  data.Bool(m.Retained),
+			"timestamp": data.Timestamp(m.Timestamp),
+		}
+	}
+	return res, nil
+}
+
+type recorderSink struct {
+	messageConverter
+	recorder *Recorder
+}
+
+func (s *recorderSink) Write(ctx *core.Context, t *core.Tuple) error {
+	m, err := s.convert(t)
+	if err != nil {
+		return err
+	}
+	s.recorder.record(m)
+	return nil
+}
+
+func (s *recorderSink) Close(ctx *core.Context) error {
+	s.messageConverter.close()
+	return nil
+}
+
+// NewRecorderSink returns a sink which converts tuples into messages in the
+// same way as the MQTT sink but records them in a Recorder instead of
+// publishing them to a broker:
+//
+//	CREATE STATE published TYPE mqtt_recorder;
+//	CREATE SINK mqtt_sink TYPE mqtt_recorder WITH state = "published";
+//
+// Recorded messages can be inspected by the mqtt_recorded_messages UDF or
+// Recorder.Messages.
+//
+// The sink has following required parameters:
+//
+//	* state: the name of the mqtt_recorder state recording messages
+//
+// The sink accepts parameters of the MQTT sink which are related to the
+// conversion from tuples to messages, such as payload_field or compression.
+// Parameters related to connections are ignored.
+func NewRecorderSink(ctx *core.Context, ioParams *bql.IOParams, params data.Map) (core.Sink, error) {
+	s := &recorderSink{
+		messageConverter: newMessageConverter(),
+	}
+
+	{ // This block is to suppress a golint warning.
+		v, ok := params["state"]
+		if !ok {
+			return nil, errors.New("state parameter is missing")
+		}
+		name, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		r, err := lookupRecorder(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		s.recorder = r
+	}
+
+	if err := s.messageConverter.parseParams(params); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,107 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestRecorderSink(t *testing.T) {
+	r := &Recorder{}
+	s := &recorderSink{
+		messageConverter: newMessageConverter(),
+		recorder:         r,
+	}
+	s.defaultTopic = "default/topic"
+
+	tuples := []data.Map{
+		{"topic": data.String("foo/bar"), "payload": data.String("hoge")},
+		{"payload": data.Blob("fuga"), "qos": data.Int(2)},
+		{"topic": data.String("foo/baz"), "payload": data.Map{"a": data.Int(1)}},
+	}
+	for _, d := range tuples {
+		if err := s.Write(nil, core.NewTuple(d)); err != nil {
+			t.Fatalf("cannot write %v: %v", d, err)
+		}
+	}
+	if err := s.Write(nil, core.NewTuple(data.Map{"payload": data.Int(1)})); err == nil {
+		t.Error("an integer payload should be rejected")
+	}
+
+	expected := []struct {
+		topic   string
+		qos     byte
+		payload string
+	}{
+		{"foo/bar", 0, "hoge"},
+		{"default/topic", 2, "fuga"},
+		{"foo/baz", 0, data.Map{"a": data.Int(1)}.String()},
+	}
+	msgs := r.Messages()
+	if len(msgs) != len(expected) {
+		t.Fatalf("%v messages should be recorded but %v were", len(expected), len(msgs))
+	}
+	for i, e := range expected {
+		m := msgs[i]
+		if m.Topic != e.topic || m.QoS != e.qos || string(m.Payload) != e.payload {
+			t.Errorf("message %v: expected %+v, actual %+v", i, e, m)
+		}
+	}
+
+	r.Reset()
+	if n := len(r.Messages()); n != 0 {
+		t.Errorf("Reset should remove all messages but %v remain", n)
+	}
+}
+
+func TestRecorderSinkRetained(t *testing.T) {
+	r := &Recorder{}
+	s := &recorderSink{
+		messageConverter: newMessageConverter(),
+		recorder:         r,
+	}
+	if err := s.parseParams(data.Map{"retained": data.Bool(true)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(nil, core.NewTuple(data.Map{"topic": data.String("state"), "payload": data.String("on")})); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := r.Messages(); len(msgs) != 1 || !msgs[0].Retained {
+		t.Errorf("the message should be retained: %+v", msgs)
+	}
+
+	if err := s.parseParams(data.Map{"retained": data.String("yes")}); err == nil {
+		t.Error("a non-boolean value should be rejected")
+	}
+}
+
+func TestRecorderSinkRetainedField(t *testing.T) {
+	r := &Recorder{}
+	s := &recorderSink{
+		messageConverter: newMessageConverter(),
+		recorder:         r,
+	}
+	if err := s.parseParams(data.Map{"retained_field": data.String("retain")}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []data.Map{
+		{"topic": data.String("devices/1/state"), "payload": data.String("on"), "retain": data.Bool(true)},
+		{"topic": data.String("devices/1/events"), "payload": data.String("pressed"), "retain": data.Bool(false)},
+		{"topic": data.String("devices/1/events"), "payload": data.String("pressed")},
+	} {
+		if err := s.Write(nil, core.NewTuple(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs := r.Messages()
+	if len(msgs) != 3 || !msgs[0].Retained || msgs[1].Retained || msgs[2].Retained {
+		t.Errorf("wrong retained flags: %+v", msgs)
+	}
+
+	tu := core.NewTuple(data.Map{"topic": data.String("a"), "payload": data.String("b"), "retain": data.Int(1)})
+	if err := s.Write(nil, tu); err == nil {
+		t.Error("a non-boolean retained field should be rejected")
+	}
+}
@@ -0,0 +1,270 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// Router is a shared state dispatching tuples emitted by a MQTT source to
+// mqtt_route sources by topic filters. It allows a single wildcard
+// subscription to be split into multiple streams without filtering the same
+// stream repeatedly in BQL.
+type Router struct {
+	routes map[string][]string
+
+	m       sync.RWMutex
+	writers map[string]core.Writer
+}
+
+// NewRouter creates a new Router:
+//
+//	CREATE STATE sensor_router TYPE mqtt_router WITH routes = {
+//	  "temperature": "sensors/+/temperature",
+//	  "humidity": ["sensors/+/humidity", "legacy/humidity/#"]
+//	};
+//
+// The state has following required parameters:
+//
+//	* routes: a map from route names to a topic filter or an array of topic filters
+//
+// Topic filters can have MQTT wildcards, "+" and "#".
+func NewRouter(ctx *core.Context, params data.Map) (core.SharedState, error) {
+	v, ok := params["routes"]
+	if !ok {
+		return nil, errors.New("routes parameter is missing")
+	}
+	m, err := data.AsMap(v)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Router{
+		routes:  map[string][]string{},
+		writers: map[string]core.Writer{},
+	}
+	for name, v := range m {
+		var filters []string
+		if v.Type() == data.TypeArray {
+			a, _ := data.AsArray(v)
+			for _, e := range a {
+				f, err := data.AsString(e)
+				if err != nil {
+					return nil, err
+				}
+				filters = append(filters, f)
+			}
+		} else {
+			f, err := data.AsString(v)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, f)
+		}
+		if len(filters) == 0 {
+			return nil, fmt.Errorf("route '%v' doesn't have a topic filter", name)
+		}
+		for _, f := range filters {
+			if err := validateTopicFilter(f); err != nil {
+				return nil, fmt.Errorf("route '%v' has an invalid topic filter: %v", name, err)
+			}
+		}
+		r.routes[name] = filters
+	}
+	return r, nil
+}
+
+// route writes the tuple to mqtt_route sources having a topic filter matching
+// the topic. It returns false when no route matches the topic. Tuples
+// matching a route without a source are dropped.
+func (r *Router) route(ctx *core.Context, topic string, t *core.Tuple) bool {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	matched := false
+	for name, filters := range r.routes {
+		for _, f := range filters {
+			if !topicMatches(f, topic) {
+				continue
+			}
+			if w, ok := r.writers[name]; ok {
+				// Each stream must have its own tuple.
+				w.Write(ctx, t.Copy())
+			}
+			matched = true
+			break
+		}
+	}
+	return matched
+}
+
+// write writes the tuple to the mqtt_route source of the route regardless of
+// its topic filters. It returns false when the route doesn't have a source.
+func (r *Router) write(ctx *core.Context, name string, t *core.Tuple) bool {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	w, ok := r.writers[name]
+	if !ok {
+		return false
+	}
+	w.Write(ctx, t)
+	return true
+}
+
+// has returns true when the route is defined.
+func (r *Router) has(name string) bool {
+	_, ok := r.routes[name]
+	return ok
+}
+
+func (r *Router) attach(name string, w core.Writer) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if _, ok := r.routes[name]; !ok {
+		return fmt.Errorf("route '%v' isn't defined", name)
+	}
+	if _, ok := r.writers[name]; ok {
+		return fmt.Errorf("route '%v' already has a source", name)
+	}
+	r.writers[name] = w
+	return nil
+}
+
+func (r *Router) detach(name string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	delete(r.writers, name)
+}
+
+// Terminate terminates the state.
+func (r *Router) Terminate(ctx *core.Context) error {
+	return nil
+}
+
+func lookupRouter(ctx *core.Context, name string) (*Router, error) {
+	st, err := ctx.SharedStates.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := st.(*Router)
+	if !ok {
+		return nil, fmt.Errorf("state '%v' isn't a mqtt_router", name)
+	}
+	return r, nil
+}
+
+// validateTopicFilter returns an error when the topic filter is invalid.
+func validateTopicFilter(filter string) error {
+	if filter == "" {
+		return errors.New("a topic filter must not be empty")
+	}
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		if strings.Contains(l, "#") && (l != "#" || i != len(levels)-1) {
+			return fmt.Errorf("'#' must be the last level: %v", filter)
+		}
+		if strings.Contains(l, "+") && l != "+" {
+			return fmt.Errorf("'+' must occupy an entire level: %v", filter)
+		}
+	}
+	return nil
+}
+
+// topicMatches returns true when the topic matches the topic filter. Topics
+// starting with "$" don't match filters starting with a wildcard.
+func topicMatches(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			// "a/#" also matches "a".
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+type routeSource struct {
+	router *Router
+	name   string
+	stop   chan struct{}
+}
+
+func (s *routeSource) GenerateStream(ctx *core.Context, w core.Writer) error {
+	if err := s.router.attach(s.name, w); err != nil {
+		return err
+	}
+	defer s.router.detach(s.name)
+	<-s.stop
+	return nil
+}
+
+func (s *routeSource) Stop(ctx *core.Context) error {
+	close(s.stop)
+	return nil
+}
+
+// NewRouteSource creates a source emitting tuples dispatched by a Router. The
+// tuples are the same as ones emitted by the MQTT source having the router
+// parameter:
+//
+//	CREATE SOURCE sensors TYPE mqtt WITH topic = "sensors/#",
+//	  router = "sensor_router";
+//	CREATE SOURCE temperature TYPE mqtt_route WITH
+//	  router = "sensor_router", route = "temperature";
+//
+// The source has following required parameters:
+//
+//	* router: the name of the mqtt_router state
+//	* route: the name of the route defined in the router
+func NewRouteSource(ctx *core.Context, ioParams *bql.IOParams, params data.Map) (core.Source, error) {
+	s := &routeSource{
+		stop: make(chan struct{}),
+	}
+
+	{ // This block is to suppress a golint warning.
+		v, ok := params["router"]
+		if !ok {
+			return nil, errors.New("router parameter is missing")
+		}
+		name, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		r, err := lookupRouter(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		s.router = r
+	}
+
+	{ // This block is to suppress a golint warning.
+		v, ok := params["route"]
+		if !ok {
+			return nil, errors.New("route parameter is missing")
+		}
+		name, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := s.router.routes[name]; !ok {
+			return nil, fmt.Errorf("route '%v' isn't defined", name)
+		}
+		s.name = name
+	}
+	return core.ImplementSourceStop(s), nil
+}
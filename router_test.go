@@ -0,0 +1,96 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestTopicMatches(t *testing.T) {
+	cases := []struct {
+		filter  string
+		topic   string
+		matches bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"+/+", "/b", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "b/c", false},
+		{"#", "a/b", true},
+		{"#", "$SYS/broker", false},
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+	}
+	for _, c := range cases {
+		if res := topicMatches(c.filter, c.topic); res != c.matches {
+			t.Errorf("%v with %v: expected %v, actual %v", c.filter, c.topic, c.matches, res)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	st, err := NewRouter(nil, data.Map{
+		"routes": data.Map{
+			"temperature": data.String("sensors/+/temperature"),
+			"all":         data.Array{data.String("sensors/#"), data.String("legacy/#")},
+			"unused":      data.String("unused/#"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := st.(*Router)
+
+	received := map[string][]string{}
+	for _, name := range []string{"temperature", "all"} {
+		name := name
+		if err := r.attach(name, core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+			topic, _ := data.AsString(t.Data["topic"])
+			received[name] = append(received[name], topic)
+			return nil
+		})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.attach("all", core.WriterFunc(func(*core.Context, *core.Tuple) error { return nil })); err == nil {
+		t.Error("a route cannot have two sources")
+	}
+	if err := r.attach("undefined", core.WriterFunc(func(*core.Context, *core.Tuple) error { return nil })); err == nil {
+		t.Error("an undefined route cannot be attached")
+	}
+
+	for _, c := range []struct {
+		topic   string
+		matched bool
+	}{
+		{"sensors/1/temperature", true},
+		{"legacy/humidity", true},
+		{"unused/a", true},
+		{"other", false},
+	} {
+		tu := core.NewTuple(data.Map{"topic": data.String(c.topic)})
+		if res := r.route(nil, c.topic, tu); res != c.matched {
+			t.Errorf("%v: expected %v, actual %v", c.topic, c.matched, res)
+		}
+	}
+	if len(received["temperature"]) != 1 || len(received["all"]) != 2 {
+		t.Errorf("wrong tuples were routed: %v", received)
+	}
+
+	for _, routes := range []data.Value{
+		data.Map{"bad": data.String("a/#/b")},
+		data.Map{"bad": data.String("a/b+")},
+		data.Map{"bad": data.Array{}},
+		data.String("a/#"),
+	} {
+		if _, err := NewRouter(nil, data.Map{"routes": routes}); err == nil {
+			t.Errorf("%v should be rejected", routes)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package mqtt
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// shutdownState publishes the final state of a sink as retained messages when
+// the sink is closed, so that consumers subscribing later don't see stale
+// values published while the topology was running.
+type shutdownState struct {
+	// status is the message published when the sink is closed if it isn't
+	// nil.
+	status *message
+
+	// retainLast is true when the last message of each topic is published
+	// again as a retained message when the sink is closed.
+	retainLast bool
+
+	m sync.Mutex
+
+	// last has the last message published to each topic which isn't
+	// retained by the broker.
+	last map[string]*message
+}
+
+// parseShutdownState parses shutdown_* and retain_last_on_close parameters.
+// It returns nil when neither shutdown_topic nor retain_last_on_close is
+// given.
+func parseShutdownState(params data.Map) (*shutdownState, error) {
+	status, err := parsePresenceMessage(params, "shutdown", nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != nil {
+		if _, ok := params["shutdown_retained"]; !ok {
+			// the final status is retained unless it's configured
+			status.retained = true
+		}
+	}
+
+	retainLast := false
+	if v, ok := params["retain_last_on_close"]; ok {
+		b, err := data.AsBool(v)
+		if err != nil {
+			return nil, err
+		}
+		retainLast = b
+	}
+
+	if status == nil && !retainLast {
+		return nil, nil
+	}
+	return &shutdownState{
+		status:     status,
+		retainLast: retainLast,
+		last:       map[string]*message{},
+	}, nil
+}
+
+// record records a message published by the sink.
+func (s *shutdownState) record(m *message) {
+	if !s.retainLast {
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if m.retained {
+		// the broker already has it
+		delete(s.last, m.topic)
+		return
+	}
+	s.last[m.topic] = m
+}
+
+// flush publishes the last messages as retained messages and then the status
+// message.
+func (s *shutdownState) flush(ctx *core.Context, c publisher) {
+	s.m.Lock()
+	topics := make([]string, 0, len(s.last))
+	for t := range s.last {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	msgs := make([]*message, len(topics))
+	for i, t := range topics {
+		msgs[i] = s.last[t]
+	}
+	s.last = map[string]*message{}
+	s.m.Unlock()
+
+	for _, m := range msgs {
+		if err := waitToken(c.Publish(m.topic, m.qos, true, m.payload), 10*time.Second); err != nil {
+			ctx.ErrLog(err).WithField("topic", m.topic).Error("Cannot retain the last message")
+		}
+	}
+	if s.status != nil {
+		m := s.status
+		if err := waitToken(c.Publish(m.topic, m.qos, m.retained, m.payload), 10*time.Second); err != nil {
+			ctx.ErrLog(err).WithField("topic", m.topic).Error("Cannot publish the shutdown message")
+		}
+	}
+}
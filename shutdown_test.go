@@ -0,0 +1,67 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// publishRecorder records messages published to it.
+type publishRecorder struct {
+	msgs []*message
+}
+
+func (p *publishRecorder) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	p.msgs = append(p.msgs, &message{
+		topic:    topic,
+		qos:      qos,
+		retained: retained,
+		payload:  payload.([]byte),
+	})
+	return &testToken{}
+}
+
+func TestShutdownState(t *testing.T) {
+	s, err := parseShutdownState(data.Map{
+		"shutdown_topic":       data.String("status/sink"),
+		"shutdown_payload":     data.String("shutting down"),
+		"retain_last_on_close": data.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.record(&message{topic: "b", payload: []byte("1")})
+	s.record(&message{topic: "a", payload: []byte("1")})
+	s.record(&message{topic: "a", payload: []byte("2")})
+	s.record(&message{topic: "c", payload: []byte("1")})
+	s.record(&message{topic: "c", payload: []byte("2"), retained: true})
+
+	p := &publishRecorder{}
+	s.flush(core.NewContext(nil), p)
+
+	expected := []struct {
+		topic   string
+		payload string
+	}{
+		{"a", "2"},
+		{"b", "1"},
+		{"status/sink", "shutting down"},
+	}
+	if len(p.msgs) != len(expected) {
+		t.Fatalf("wrong number of messages: %v", len(p.msgs))
+	}
+	for i, e := range expected {
+		m := p.msgs[i]
+		if m.topic != e.topic || string(m.payload) != e.payload || !m.retained {
+			t.Errorf("expected retained %v: %v, actual %v: %v (retained: %v)",
+				e.topic, e.payload, m.topic, string(m.payload), m.retained)
+		}
+	}
+
+	if s, err := parseShutdownState(data.Map{}); err != nil || s != nil {
+		t.Error("the shutdown state should be disabled by default")
+	}
+}
@@ -1,7 +1,10 @@
 package mqtt
 
 import (
+	"errors"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/eclipse/paho.mqtt.golang"
 	"gopkg.in/sensorbee/sensorbee.v0/bql"
@@ -10,75 +13,707 @@ import (
 )
 
 type sink struct {
+	ctx *core.Context
+	messageConverter
+	clientConfig
+
 	opts   *mqtt.ClientOptions
 	client mqtt.Client
 
+	// pahoLogs writes internal logs of the client if it isn't nil.
+	pahoLogs *pahoLogTarget
+
+	// outbox buffers messages published in background if it isn't nil.
+	outbox *messageQueue
+
+	// maxLatency is the maximum time a message can wait in the outbox.
+	// Messages waiting longer are dropped instead of being published. It's
+	// disabled when it's 0.
+	maxLatency time.Duration
+
+	// expired is the number of messages dropped due to maxLatency. It must
+	// be accessed atomically.
+	expired int64
+
+	// leader makes the sink discard tuples while this instance isn't the
+	// leader if it isn't nil.
+	leader *Leader
+
+	// guard checks messages published to command topics if it isn't nil.
+	guard *commandGuard
+
+	// throttle limits the publish rate if it isn't nil.
+	throttle *throttle
+
+	// acl skips messages to topics the broker has recently denied if it
+	// isn't nil.
+	acl *aclCache
+
+	// inflight limits the number of messages published at once to each topic
+	// if it isn't nil.
+	inflight *topicInflight
+
+	// reporter publishes the status of the sink if it isn't nil.
+	reporter *statusReporter
+
+	// session has parameters of the session with the broker.
+	session *sinkSession
+
+	// pause discards tuples while the sink is paused by Pause.
+	pause pauseState
+
+	// shutdown publishes the final state when the sink is closed if it
+	// isn't nil.
+	shutdown *shutdownState
+
+	// presence has will and birth messages if it isn't nil.
+	presence *presence
+
+	// connector connects the sink to the broker in the background.
+	connector *sinkConnector
+
+	// onError handles tuples written while the sink isn't connected.
+	onError *onError
+
+	// published and publishErrors are the number of messages published and
+	// failed to be published. They must be accessed atomically.
+	published     int64
+	publishErrors int64
+
+	// latency has durations of publishes.
+	latency latencyHistogram
+
+	// connection tracks connections of the client.
+	connection connectionInfo
+
+	// protocolVersion is the version of MQTT numbered like paho, and
+	// downgrade is true when lower versions are tried when the broker
+	// rejects it.
+	protocolVersion uint
+	downgrade       bool
+
+	// publishTimeout is the maximum time to wait for a publish to complete.
+	// It waits forever when it's 0.
+	publishTimeout time.Duration
+
+	// name is the name of the sink in the topology.
+	name string
+
+	// discardMonitor summarizes discarded messages if it isn't nil.
+	discardMonitor *DiscardMonitor
+
+	// closing is closed when Close is called.
+	closing chan struct{}
+
+	// publisherDone is closed when the goroutine publishing buffered
+	// messages exits.
+	publisherDone chan struct{}
+}
+
+func (s *sink) Write(ctx *core.Context, t *core.Tuple) error {
+	if s.leader != nil && !s.leader.IsLeader() {
+		// stand by until this instance is elected
+		return nil
+	}
+	if s.pause.discard() {
+		return nil
+	}
+	if s.outbox == nil && !s.client.IsConnected() {
+		if ok, err := s.onError.disconnected(s.client, s.connector.stop); !ok {
+			return err
+		}
+	}
+
+	m, err := s.convert(t)
+	if err != nil {
+		return err
+	}
+	if s.tracer != nil {
+		m.traceContext = traceContextFromTuple(t)
+	}
+	if err := authorize(ctx, s.authorizer, ActionPublish, m.topic); err != nil {
+		return err
+	}
+
+	if s.guard != nil {
+		if ok, err := s.guard.check(t, m); err != nil {
+			return err
+		} else if !ok {
+			return nil
+		}
+	}
+
+	if s.outbox != nil {
+		return s.outbox.push(m)
+	}
+	return s.publish(ctx, m)
+}
+
+func (s *sink) publish(ctx *core.Context, m *message) error {
+	if s.acl != nil && !s.acl.allowed(m.topic, time.Now()) {
+		// the broker denied the topic recently
+		return nil
+	}
+	if s.inflight != nil {
+		release := s.inflight.acquire(m.topic)
+		defer release()
+	}
+	if s.throttle != nil && !s.throttle.wait(s.closing) {
+		return errors.New("the sink is closed")
+	}
+	start := time.Now()
+	if err := s.send(ctx, m); err != nil {
+		atomic.AddInt64(&s.publishErrors, 1)
+		if s.throttle != nil && throttled(err) {
+			s.throttle.penalize(time.Now())
+		}
+		if s.acl != nil && unauthorized(err) && s.acl.deny(m.topic, time.Now()) && s.logLevel.enabled(warnLevel) {
+			ctx.ErrLog(err).WithField("topic", m.topic).WithField("ttl", s.acl.ttl).
+				Warn("Skipping the topic since the broker doesn't authorize publishing to it")
+		}
+		return err
+	}
+	s.latency.observe(time.Since(start))
+	atomic.AddInt64(&s.published, 1)
+	if s.throttle != nil {
+		s.throttle.succeed(time.Now())
+	}
+	if s.shutdown != nil {
+		s.shutdown.record(m)
+	}
+	return nil
+}
+
+// send publishes the message and waits for it. When the sink has a tracer,
+// the message is published in a span, whose trace context is injected into
+// user properties if the client is connected with MQTT 5.
+func (s *sink) send(ctx *core.Context, m *message) error {
+	if s.tracer == nil {
+		return s.waitPublished(m.topic, s.client.Publish(m.topic, m.qos, m.retained, m.payload))
+	}
+	carrier, end := s.tracer.StartPublish(ctx, m.topic, m.traceContext)
+	var token mqtt.Token
+	if p, ok := s.client.(propertiesPublisher); ok && len(carrier) > 0 {
+		token = p.publishWithProperties(m.topic, m.qos, m.retained, m.payload, carrier)
+	} else {
+		token = s.client.Publish(m.topic, m.qos, m.retained, m.payload)
+	}
+	err := s.waitPublished(m.topic, token)
+	end(err)
+	return err
+}
+
+// waitPublished waits until the token of a message to the topic completes or
+// the publish timeout passes.
+func (s *sink) waitPublished(topic string, token mqtt.Token) error {
+	if s.publishTimeout == 0 {
+		token.Wait()
+		return token.Error()
+	}
+	if !token.WaitTimeout(s.publishTimeout) {
+		return fmt.Errorf("publishing a message to '%v' timed out after %v", topic, s.publishTimeout)
+	}
+	return token.Error()
+}
+
+// publishBuffered publishes messages in the outbox until it's closed. When
+// the sink is closed while it isn't connected to the broker, remaining
+// messages are discarded.
+func (s *sink) publishBuffered(ctx *core.Context) {
+	defer close(s.publisherDone)
+	for {
+		m, ok, err := s.outbox.pop()
+		if err != nil {
+			ctx.ErrLog(err).Error("Cannot read spilled messages")
+			continue
+		}
+		if !ok {
+			return
+		}
+
+		if !s.waitConnected() {
+			n, err := s.outbox.discard()
+			if err != nil {
+				ctx.ErrLog(err).Error("Cannot remove the spill file")
+			}
+			if s.logLevel.enabled(infoLevel) {
+				ctx.Log().WithField("discarded", n+1).
+					Info("Discarded buffered messages because the sink was closed while disconnected")
+			}
+			return
+		}
+		if s.maxLatency > 0 && time.Since(m.queuedAt) > s.maxLatency {
+			atomic.AddInt64(&s.expired, 1)
+			continue
+		}
+		if err := s.publish(ctx, m); err != nil {
+			ctx.ErrLog(err).WithField("topic", m.topic).Error("Cannot publish a message")
+		}
+	}
+}
+
+// connectionPollInterval is the interval at which a sink checks if the
+// client has been reconnected.
+const connectionPollInterval = 100 * time.Millisecond
+
+// waitConnected blocks until the client is connected to the broker. It returns
+// false when the sink is closed before that.
+func (s *sink) waitConnected() bool {
+	for !s.client.IsConnected() {
+		select {
+		case <-s.closing:
+			return false
+		case <-time.After(connectionPollInterval):
+		}
+	}
+	return true
+}
+
+// Status returns the status of the outbox, the current publish rate, topics
+// denied by the broker, and the effective configuration.
+func (s *sink) Status() data.Map {
+	st := data.Map{}
+	if s.outbox != nil {
+		buffered, dropped := s.outbox.stats()
+		st["buffered"] = data.Int(buffered)
+		st["dropped"] = data.Int(dropped)
+		st["expired"] = data.Int(atomic.LoadInt64(&s.expired))
+	}
+	if s.throttle != nil {
+		st["publish_rate"] = data.Float(s.throttle.currentRate())
+	}
+	if s.acl != nil {
+		denied, skipped := s.acl.stats()
+		st["denied_topics"] = data.Int(denied)
+		st["unauthorized"] = data.Int(skipped)
+	}
+	st["paused"] = data.Bool(s.pause.isPaused())
+	if d := s.connection.effectiveKeepAlive(); d > 0 {
+		st["keep_alive"] = data.String(d.String())
+	}
+	if s.onError != nil {
+		st["disconnected"] = data.Int(atomic.LoadInt64(&s.onError.dropped))
+	}
+	st["config"] = s.Config()
+	return st
+}
+
+// Kind returns "sink".
+func (s *sink) Kind() string {
+	return "sink"
+}
+
+// Name returns the name of the sink.
+func (s *sink) Name() string {
+	return s.name
+}
+
+// Pause makes the sink discard tuples until Resume is called.
+func (s *sink) Pause() {
+	s.pause.set(true)
+}
+
+// Resume resumes the sink.
+func (s *sink) Resume() {
+	s.pause.set(false)
+}
+
+// Reconnect disconnects the client from the broker and makes the connector
+// connect it again in the background. When the connector is waiting to retry
+// connecting, it retries right away. Tuples written while reconnecting are
+// discarded unless the sink has the buffer.
+func (s *sink) Reconnect() error {
+	s.client.Disconnect(250)
+	s.connection.disconnected()
+	if !s.connector.reconnect(s.ctx, s.client, s.logLevel, s.onConnected) {
+		return errors.New("the sink is closed")
+	}
+	return nil
+}
+
+// Config returns the effective configuration of the sink after defaults are
+// applied and the broker URL is normalized. Secrets are masked.
+func (s *sink) Config() data.Map {
+	c := s.clientConfig.config()
+	c["default_topic"] = data.String(s.defaultTopic)
+	c["default_qos"] = data.Int(s.qos)
+	c["retained"] = data.Bool(s.retained)
+	c["envelope_schema"] = data.String(s.envelopeSchema)
+	if s.envelopeSchema != "" {
+		c["envelope_version"] = data.Int(s.envelopeVersion)
+	}
+	c["compression"] = data.Bool(s.compression != nil)
+	if s.json != nil {
+		c["json_timestamp_format"] = data.String(s.json.timestamp)
+		c["json_blob_encoding"] = data.String(s.json.blob)
+	}
+	if s.outbox != nil {
+		c["buffer_size"] = data.Int(s.outbox.maxSize)
+		c["buffer_policy"] = data.String(s.outbox.policy.String())
+		c["max_queue_latency"] = data.String(s.maxLatency.String())
+	} else {
+		c["buffer_size"] = data.Int(0)
+	}
+	if s.throttle != nil {
+		c["max_publish_rate"] = data.Float(s.throttle.max)
+		c["min_publish_rate"] = data.Float(s.throttle.min)
+	}
+	c["publish_timeout"] = data.String(s.publishTimeout.String())
+	c["protocol_version"] = data.String(protocolVersionName(s.protocolVersion))
+	c["protocol_downgrade"] = data.Bool(s.downgrade)
+	if s.session != nil {
+		s.session.config(c)
+	}
+	if s.acl != nil {
+		c["acl_cache_ttl"] = data.String(s.acl.ttl.String())
+	}
+	if s.inflight != nil {
+		c["topic_inflight"] = s.inflight.config()
+	}
+	c["leader"] = data.Bool(s.leader != nil)
+	if s.reporter != nil {
+		c["status_topic"] = data.String(s.reporter.topic)
+		c["status_interval"] = data.String(s.reporter.interval.String())
+	}
+	if s.presence != nil {
+		s.presence.config(c)
+	}
+	if s.connector != nil {
+		s.connector.config(c)
+	}
+	if s.onError != nil {
+		s.onError.config(c)
+	}
+	return c
+}
+
+func (s *sink) Close(ctx *core.Context) error {
+	unregisterNode(s)
+	if s.connector != nil {
+		s.connector.close()
+	}
+	if s.discardMonitor != nil {
+		s.discardMonitor.unregister("sink", s.name)
+	}
+	if s.outbox != nil {
+		s.outbox.close()
+		close(s.closing)
+		<-s.publisherDone
+		if _, err := s.outbox.discard(); err != nil {
+			ctx.ErrLog(err).Error("Cannot remove the spill file")
+		}
+	}
+	if s.reporter != nil {
+		s.reporter.close()
+	}
+	if s.shutdown != nil {
+		if s.client.IsConnected() {
+			s.shutdown.flush(ctx, s.client)
+		} else if s.logLevel.enabled(warnLevel) {
+			ctx.Log().Warn("Cannot publish the final state because the sink isn't connected")
+		}
+	}
+	if s.presence != nil && s.client.IsConnected() {
+		s.presence.announceOffline(ctx, s.client)
+	}
+	s.client.Disconnect(250)
+	s.session.close()
+	unregisterPahoLogs(s.pahoLogs)
+	s.messageConverter.close()
+	return nil
+}
+
+// message is a message to be published to a broker or received from a
+// broker.
+type message struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  []byte
+
+	// queuedAt is the time when the message was added to a messageQueue.
+	queuedAt time.Time
+
+	// broker is the URL of the broker from which the source received the
+	// message, and generation is the number of connections the source had
+	// made when it received the message. They're only used by the source.
+	broker     string
+	generation int64
+
+	// id and duplicate are the packet identifier and the DUP flag of the
+	// message received by the source. They aren't buffered.
+	id        uint16
+	duplicate bool
+
+	// properties has MQTT 5 properties of the message received by the
+	// source, which are added to its tuples. They aren't spilled.
+	properties data.Map
+
+	// traceContext is the trace context of the tuple published by the sink
+	// having a tracer. It isn't spilled.
+	traceContext map[string]string
+
+	// ack acknowledges the message received by the source if it isn't nil.
+	// It's only set when the source acknowledges messages after writing
+	// them.
+	ack func()
+}
+
+// acknowledge acknowledges the message to the broker if the source
+// acknowledges messages by itself.
+func (m *message) acknowledge() {
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+// messageConverter converts a tuple into a message. It's shared by sinks
+// which publish messages built from tuples.
+type messageConverter struct {
 	qos          byte
 	retained     bool
-	broker       string
-	user         string
-	password     string
 	payloadPath  data.Path
 	topicPath    data.Path
 	qosPath      data.Path
 	defaultTopic string
+
+	// retainedPath is the field having the retained flag of each tuple. The
+	// retained parameter is used for all tuples when it's nil.
+	retainedPath data.Path
+
+	// envelopeSchema is the name of the schema of payloads. When it isn't
+	// empty, payloads are wrapped in an envelope with envelopeVersion.
+	envelopeSchema  string
+	envelopeVersion int64
+
+	// compression compresses payloads if it isn't nil.
+	compression compression
+
+	// json encodes arrays and maps in payloads. It's nil when the default
+	// encoding is used.
+	json *jsonEncoding
 }
 
-func (s *sink) Write(ctx *core.Context, t *core.Tuple) error {
-	if !s.client.IsConnected() {
-		return nil
+func newMessageConverter() messageConverter {
+	return messageConverter{
+		qos:          0,
+		retained:     false,
+		payloadPath:  data.MustCompilePath("payload"),
+		topicPath:    data.MustCompilePath("topic"),
+		qosPath:      data.MustCompilePath("qos"),
+		defaultTopic: "",
+
+		envelopeSchema:  "",
+		envelopeVersion: 1,
 	}
+}
 
-	p, err := t.Data.Get(s.payloadPath)
+func (c *messageConverter) convert(t *core.Tuple) (*message, error) {
+	p, err := t.Data.Get(c.payloadPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	// null is published as an empty payload without being wrapped or
+	// compressed so that it can be used as a signal such as clearing a
+	// retained message
 	var b []byte
-	switch p.Type() {
-	case data.TypeString:
-		str, _ := data.AsString(p)
-		b = []byte(str) // TODO: reduce this data copy
-	case data.TypeBlob:
-		b, _ = data.AsBlob(p)
-	case data.TypeArray, data.TypeMap:
-		b = []byte(p.String()) // TODO: reduce this data copy
-	default:
-		return fmt.Errorf("data type '%v' cannot be used as payload", p.Type())
+	if p.Type() == data.TypeNull {
+		b = []byte{}
+	} else if c.envelopeSchema != "" {
+		b, err = wrapEnvelope(c.envelopeSchema, c.envelopeVersion, p, c.json)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		switch p.Type() {
+		case data.TypeString:
+			str, _ := data.AsString(p)
+			b = []byte(str) // TODO: reduce this data copy
+		case data.TypeBlob:
+			b, _ = data.AsBlob(p)
+		case data.TypeArray, data.TypeMap:
+			b, err = c.json.marshal(p)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("data type '%v' cannot be used as payload", p.Type())
+		}
+	}
+
+	// empty payloads are signals, so they're published as they are
+	if c.compression != nil && len(b) > 0 {
+		b, err = c.compression.compress(b)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	topic := ""
-	if to, err := t.Data.Get(s.topicPath); err != nil {
-		if s.defaultTopic == "" {
-			return fmt.Errorf("topic field '%v' is missing", s.topicPath)
+	if to, err := t.Data.Get(c.topicPath); err != nil {
+		if c.defaultTopic == "" {
+			return nil, fmt.Errorf("topic field '%v' is missing", c.topicPath)
 		}
-		topic = s.defaultTopic
+		topic = c.defaultTopic
 	} else if topic, err = data.AsString(to); err != nil {
-		return err
+		return nil, err
 	}
 
-	qos := s.qos
-	if q, err := t.Data.Get(s.qosPath); err == nil {
+	qos := c.qos
+	if q, err := t.Data.Get(c.qosPath); err == nil {
 		qq, err := data.AsInt(q)
 		if err != nil {
-			return err
+			return nil, err
 		} else if qq < 0 || qq > 2 {
-			return fmt.Errorf("wrong QoS: %d", qq)
+			return nil, fmt.Errorf("wrong QoS: %d", qq)
 		}
 		qos = byte(qq)
 	}
 
-	if token := s.client.Publish(topic, qos, s.retained, b); token.Wait() && token.Error() != nil {
-		return token.Error()
+	retained := c.retained
+	if c.retainedPath != nil {
+		if r, err := t.Data.Get(c.retainedPath); err == nil {
+			retained, err = data.AsBool(r)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
-	return nil
+
+	return &message{
+		topic:    topic,
+		qos:      qos,
+		retained: retained,
+		payload:  b,
+	}, nil
 }
 
-func (s *sink) Close(ctx *core.Context) error {
-	s.client.Disconnect(250)
+// parseParams parses parameters related to the conversion: payload_field,
+// topic_field, default_topic, qos_field, default_qos, retained_field,
+// retained, envelope_schema, envelope_version, compression, and
+// compression_dictionary.
+func (c *messageConverter) parseParams(params data.Map) error {
+	if v, ok := params["payload_field"]; ok {
+		name, err := data.AsString(v)
+		if err != nil {
+			return err
+		}
+		path, err := data.CompilePath(name)
+		if err != nil {
+			return err
+		}
+		c.payloadPath = path
+	}
+
+	if v, ok := params["topic_field"]; ok {
+		name, err := data.AsString(v)
+		if err != nil {
+			return err
+		}
+		path, err := data.CompilePath(name)
+		if err != nil {
+			return err
+		}
+		c.topicPath = path
+	}
+
+	if v, ok := params["default_topic"]; ok {
+		t, err := data.AsString(v)
+		if err != nil {
+			return err
+		}
+		if t == "" {
+			return fmt.Errorf("empty default topic is not supported")
+		}
+		c.defaultTopic = t
+	}
+
+	if v, ok := params["qos_field"]; ok {
+		name, err := data.AsString(v)
+		if err != nil {
+			return err
+		}
+		path, err := data.CompilePath(name)
+		if err != nil {
+			return err
+		}
+		c.qosPath = path
+	}
+	if v, ok := params["default_qos"]; ok {
+		q, err := data.AsInt(v)
+		if err != nil {
+			return err
+		}
+		if q < 0 || q > 2 {
+			return fmt.Errorf("unknown QoS. Qos can only be between 0 and 2")
+		}
+		c.qos = byte(q)
+	}
+
+	if v, ok := params["retained_field"]; ok {
+		name, err := data.AsString(v)
+		if err != nil {
+			return err
+		}
+		path, err := data.CompilePath(name)
+		if err != nil {
+			return err
+		}
+		c.retainedPath = path
+	}
+	if v, ok := params["retained"]; ok {
+		b, err := data.AsBool(v)
+		if err != nil {
+			return err
+		}
+		c.retained = b
+	}
+
+	if v, ok := params["envelope_schema"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return err
+		}
+		c.envelopeSchema = str
+	}
+	if v, ok := params["envelope_version"]; ok {
+		if c.envelopeSchema == "" {
+			return fmt.Errorf("envelope_version requires envelope_schema")
+		}
+		ver, err := data.AsInt(v)
+		if err != nil {
+			return err
+		}
+		c.envelopeVersion = ver
+	}
+
+	enc, err := parseJSONEncoding(params)
+	if err != nil {
+		return err
+	}
+	c.json = enc
+
+	// compression is created at last because it needs to be closed on errors
+	comp, err := newCompression(params)
+	if err != nil {
+		return err
+	}
+	if _, ok := comp.(*autoCompression); ok {
+		comp.close()
+		return errors.New("compression \"auto\" is only supported by the source")
+	}
+	c.compression = comp
 	return nil
 }
 
+// close releases resources used by the converter.
+func (c *messageConverter) close() {
+	if c.compression != nil {
+		c.compression.close()
+	}
+}
+
 // NewSink returns a sink as MQTT publisher. To publish a message, a tuple
 // inserted into the sink needs to have two fields: "topic" and "payload".
 // There is also one optional field: "qos", that should contain MQTT qos to
@@ -102,119 +737,409 @@ func (s *sink) Close(ctx *core.Context) error {
 //	* broker: the address of the broker in URI "scheme://host:port" format (default: "tcp://127.0.0.1:1883")
 //	* user: the user name to be connected (default: "")
 //	* password: the password of the user (default: "")
+//	* password_file: the path to a file containing the password (default: "")
+//	* credentials: the name of a mqtt_credentials state used instead of user and password (default: "")
+//	* tls_pinned_sha256: SHA-256 fingerprints of the broker's certificate or public key in hex (default: none)
+//	* tls_verify_ca: false to verify the broker's certificate only by tls_pinned_sha256 (default: true)
+//	* oauth2_token_url: the token endpoint of the OAuth2 client credentials flow (default: "")
+//	* oauth2_client_id: the client ID of the OAuth2 client credentials flow (default: "")
+//	* oauth2_client_secret: the client secret of the OAuth2 client credentials flow (default: "")
+//	* oauth2_scopes: the scopes requested by the OAuth2 client credentials flow (default: none)
+//	* oauth2_audience: the audience requested by the OAuth2 client credentials flow (default: "")
+//	* vault_addr: the address of HashiCorp Vault issuing client certificates (default: "")
+//	* vault_token: the token used to access Vault (default: "")
+//	* vault_pki_path: the path of the PKI issue endpoint such as "pki/issue/sensorbee" (default: "")
+//	* vault_common_name: the common name of client certificates (default: "")
+//	* vault_ttl: the TTL of client certificates (default: the default TTL of the role)
+//	* vault_ca_file: the path to a PEM file having CA certificates to verify Vault (default: "")
+//	* greengrass_thing_name: the thing name used to discover a local AWS IoT Greengrass core (default: "")
+//	* greengrass_discovery_endpoint: the host of the Greengrass discovery API (default: "")
+//	* store_dir: the directory where in-flight QoS 1 and 2 messages are stored in the subdirectory named after client_id, requires clean_session false (default: "", which means memory)
+//	* dialer: the name of a Dialer registered by RegisterDialer to connect to the broker (default: "")
+//	* authorizer: the name of an Authorizer registered by RegisterAuthorizer to veto publishes (default: "")
+//	* auth_method: the authentication method of MQTT 5 enhanced authentication performed by an Authenticator registered by RegisterAuthenticator (default: "")
+//	* tracer: the name of a Tracer registered by RegisterTracer to create spans around publishes (default: "")
+//	* log_level: the minimum level of logs, "debug", "info", "warn", or "error" (default: "info")
+//	* paho_log_level: the verbosity of internal logs of the MQTT client, "none", "error", "warn", or "debug" (default: "none")
+//	* protocol_version: the version of MQTT, "3.1", "3.1.1", or "5" (default: "3.1.1")
+//	* protocol_downgrade: true to try lower versions when the broker rejects protocol_version (default: true)
+//	* client_id: the client ID of the sink (default: "", which means the broker assigns one)
+//	* clean_session: false to keep the session on the broker so that in-flight QoS 1 and 2 messages are resumed on reconnect (default: true)
+//	* session_expiry: how long MQTT 5 brokers keep the session after disconnection in Go duration format (default: never expires)
+//	* keep_alive: the keep alive interval in Go duration format (default: 30s)
+//	* ping_timeout: how long the sink waits for the response of a ping before the connection is considered lost in Go duration format (default: 10s)
+//	* connect_timeout: how long the sink waits for connecting to the broker in Go duration format (default: 30s)
+//	* status_topic: the topic to which the status is published periodically as a retained message (default: "")
+//	* status_interval: the interval at which the status is published in Go duration format (default: 1m)
+//	* status_qos: the QoS of status messages (default: 0)
 //	* payload_field: the field name in tuples having a payload (default: "payload")
 //	* topic_field: the field name in tuples having a topic (default: "")
 //	* default_topic: the default topic used when a tuple doesn't have topic_field (default: "")
 //	* default_qos: the default to publish tuples with, can be 0, 1 or 2 (default: 0)
+//	* retained_field: the field name in tuples having a boolean which is true when the message is retained (default: "")
+//	* retained: true to publish messages as retained messages when tuples don't have retained_field (default: false)
+//	* envelope_schema: the schema name of payloads, which makes the sink wrap payloads in an envelope (default: "")
+//	* envelope_version: the schema version of payloads in envelopes (default: 1)
+//	* compression: the compression algorithm of payloads, "gzip", "zlib", "zstd", or "snappy" (default: "")
+//	* compression_dictionary: the path to a dictionary file used by the compression (default: "")
+//	* json_timestamp_format: how timestamps in JSON payloads are encoded, "rfc3339", "unix", or "unix_ms" (default: "rfc3339")
+//	* json_blob_encoding: how blobs in JSON payloads are encoded, "base64" or "hex" (default: "base64")
+//	* buffer_size: the maximum number of messages buffered to be published in background, 0 disables buffering (default: 0)
+//	* buffer_policy: what to do when the buffer is full, "drop_newest", "drop_oldest", "spill", or "block" (default: "drop_newest")
+//	* spill_dir: the directory where the spill policy writes messages (default: the system's temporary directory)
+//	* memory_budget: the name of a mqtt_memory_budget state limiting the size of buffered messages (default: "")
+//	* max_queue_latency: the maximum time a message can wait in the buffer before it's dropped, 0 disables it (default: 0)
+//	* max_publish_rate: the maximum number of messages published per second, which enables adaptive throttling (default: none)
+//	* min_publish_rate: the minimum publish rate the throttling slows down to (default: 1% of max_publish_rate)
+//	* publish_rate_probe_interval: the time to keep a publish rate before raising it in Go duration format (default: 10s)
+//	* discard_monitor: the name of a mqtt_discard_monitor state summarizing discarded messages (default: "")
+//	* topic_allowlist: an array of topic filters to which the sink can publish (default: none, which allows all topics)
+//	* require_confirm: true to publish only tuples having the confirm field being true (default: false)
+//	* confirm_window: the time within which the same message must be written twice before it's published, 0 disables it (default: 0)
+//	* leader: the name of a mqtt_leader state, which makes the sink discard tuples unless this instance is the leader (default: "")
+//	* shutdown_topic: the topic of the message published when the sink is closed (default: "")
+//	* shutdown_payload: the payload of the shutdown message (default: "")
+//	* shutdown_qos: the QoS of the shutdown message (default: 0)
+//	* shutdown_retained: true to retain the shutdown message (default: true)
+//	* retain_last_on_close: true to publish the last message of each topic as a retained message when the sink is closed (default: false)
+//	* will_topic: the topic of the will message published by the broker when the sink is disconnected unexpectedly (default: "")
+//	* will_payload: the payload of the will message (default: "")
+//	* will_qos: the QoS of the will message (default: 0)
+//	* will_retained: true to retain the will message (default: false)
+//	* will_delay_interval: the time the broker waits before publishing the will message in Go duration format, only used with MQTT 5 (default: 0s)
+//	* will_user_properties: a map of user properties of the will message, only used with MQTT 5 (default: none)
+//	* birth_topic: the topic of the birth message published when the sink connects (default: will_topic)
+//	* birth_payload: the payload of the birth message (default: will_payload)
+//	* birth_qos: the QoS of the birth message (default: will_qos)
+//	* birth_retained: true to retain the birth message (default: will_retained)
+//	* lazy_connect: true to connect to the broker in the background so that the sink can be created while the broker is down (default: false)
+//	* reconnect_min_time: minimal time to wait before reconnecting in Go duration format (default: 1s)
+//	* reconnect_max_time: maximal time to wait before reconnecting in Go duration format (default: 30s)
+//	* reconnect_jitter: how to randomize the time to wait before reconnecting, "none", "full", or "equal" (default: "none")
+//	* reconnect_log_interval: the minimum interval between logs of failures to reconnect in Go duration format (default: 1m)
+//	* on_error: what to do with tuples written while the sink isn't connected, "drop", "retry", or "fail" (default: "drop")
+//	* on_error_timeout: the maximum time to wait for the sink to be reconnected when on_error is "retry" in Go duration format (default: 30s)
+//	* publish_timeout: the maximum time to wait for a publish to complete in Go duration format, 0 waits forever (default: 30s)
+//	* acl_cache_ttl: the time during which messages to a topic are skipped after the broker denied publishing to it, 0 disables it (default: 0)
+//	* topic_inflight: a map from topic filters to the maximum numbers of messages published at once to each topic matching them (default: none)
+//
+// ${NAME} in user, password, oauth2_client_id, oauth2_client_secret,
+// vault_token, and client_id is replaced with the value of the environment
+// variable NAME. When oauth2_token_url is given, an access token is passed as
+// the password.
 func NewSink(ctx *core.Context, ioParams *bql.IOParams, params data.Map) (core.Sink, error) {
 	s := &sink{
-		qos:          0,
-		retained:     false,
-		broker:       "tcp://127.0.0.1:1883",
-		user:         "",
-		password:     "",
-		payloadPath:  data.MustCompilePath("payload"),
-		topicPath:    data.MustCompilePath("topic"),
-		qosPath:      data.MustCompilePath("qos"),
-		defaultTopic: "",
+		ctx:              ctx,
+		messageConverter: newMessageConverter(),
+		clientConfig:     newClientConfig(),
+		protocolVersion:  4,
+		downgrade:        true,
+		publishTimeout:   30 * time.Second,
+		name:             ioParams.Name,
 	}
 
-	if v, ok := params["broker"]; ok {
-		b, err := data.AsString(v)
-		if err != nil {
-			return nil, err
-		}
-		s.broker, err = adjustOldBrokerURL(b)
-		if err != nil {
-			return nil, err
-		}
+	if err := s.clientConfig.parseParams(ctx, params); err != nil {
+		return nil, err
 	}
 
-	if v, ok := params["user"]; ok {
-		u, err := data.AsString(v)
-		if err != nil {
-			return nil, err
-		}
-		s.user = u
+	if err := s.messageConverter.parseParams(params); err != nil {
+		return nil, err
+	}
+
+	buf, err := parseBufferParams(ctx, params)
+	if err != nil {
+		s.messageConverter.close()
+		return nil, err
 	}
 
-	if v, ok := params["password"]; ok {
-		p, err := data.AsString(v)
+	if v, ok := params["max_queue_latency"]; ok {
+		if buf.size == 0 {
+			s.messageConverter.close()
+			return nil, errors.New("max_queue_latency requires buffer_size")
+		}
+		d, err := data.ToDuration(v)
 		if err != nil {
+			s.messageConverter.close()
 			return nil, err
 		}
-		s.password = p
+		s.maxLatency = d
 	}
 
-	if v, ok := params["payload_field"]; ok {
+	guard, err := parseCommandGuard(params)
+	if err != nil {
+		s.messageConverter.close()
+		return nil, err
+	}
+	s.guard = guard
+
+	if v, ok := params["leader"]; ok {
 		name, err := data.AsString(v)
 		if err != nil {
+			s.messageConverter.close()
 			return nil, err
 		}
-		path, err := data.CompilePath(name)
+		l, err := lookupLeader(ctx, name)
 		if err != nil {
+			s.messageConverter.close()
 			return nil, err
 		}
-		s.payloadPath = path
+		s.leader = l
 	}
 
-	if v, ok := params["topic_field"]; ok {
-		name, err := data.AsString(v)
+	dm, err := parseDiscardMonitor(ctx, params)
+	if err != nil {
+		s.messageConverter.close()
+		return nil, err
+	}
+
+	th, err := parseThrottle(params)
+	if err != nil {
+		s.messageConverter.close()
+		return nil, err
+	}
+	s.throttle = th
+
+	if v, ok := params["publish_timeout"]; ok {
+		d, err := data.ToDuration(v)
 		if err != nil {
+			s.messageConverter.close()
 			return nil, err
 		}
-		path, err := data.CompilePath(name)
-		if err != nil {
-			return nil, err
+		if d < 0 {
+			s.messageConverter.close()
+			return nil, errors.New("publish_timeout must not be negative")
 		}
-		s.topicPath = path
+		s.publishTimeout = d
 	}
 
-	if v, ok := params["default_topic"]; ok {
-		t, err := data.AsString(v)
+	if v, ok := params["protocol_version"]; ok {
+		pv, err := parseProtocolVersion(v)
 		if err != nil {
+			s.messageConverter.close()
 			return nil, err
 		}
-		if t == "" {
-			return nil, fmt.Errorf("empty default topic is not supported")
+		if pv == 5 && s.storeDir != "" {
+			s.messageConverter.close()
+			return nil, errors.New("protocol_version 5 cannot be used with store_dir")
 		}
-		s.defaultTopic = t
+		s.protocolVersion = pv
+	}
+	if s.authenticator != nil && s.protocolVersion != 5 {
+		s.messageConverter.close()
+		return nil, errors.New("auth_method requires protocol_version 5")
 	}
 
-	if v, ok := params["qos_field"]; ok {
-		name, err := data.AsString(v)
+	if v, ok := params["protocol_downgrade"]; ok {
+		b, err := data.AsBool(v)
 		if err != nil {
+			s.messageConverter.close()
 			return nil, err
 		}
-		path, err := data.CompilePath(name)
+		s.downgrade = b
+	}
+
+	sd, err := parseShutdownState(params)
+	if err != nil {
+		s.messageConverter.close()
+		return nil, err
+	}
+	s.shutdown = sd
+
+	p, err := parsePresence(params)
+	if err != nil {
+		s.messageConverter.close()
+		return nil, err
+	}
+	if p != nil && p.willProperties != nil && s.protocolVersion != 5 {
+		s.messageConverter.close()
+		return nil, errors.New("will_delay_interval and will_user_properties require protocol_version 5")
+	}
+	s.presence = p
+
+	connector, err := parseSinkConnector(params)
+	if err != nil {
+		s.messageConverter.close()
+		return nil, err
+	}
+	s.connector = connector
+
+	oe, err := parseOnError(params)
+	if err != nil {
+		s.messageConverter.close()
+		return nil, err
+	}
+	s.onError = oe
+
+	acl, err := parseACLCache(params)
+	if err != nil {
+		s.messageConverter.close()
+		return nil, err
+	}
+	if acl != nil && s.protocolVersion != 5 {
+		// only MQTT 5 brokers report unauthorized publishes
+		s.messageConverter.close()
+		return nil, errors.New("acl_cache_ttl requires protocol_version to be \"5\"")
+	}
+	s.acl = acl
+
+	inflight, err := parseTopicInflight(params)
+	if err != nil {
+		s.messageConverter.close()
+		return nil, err
+	}
+	s.inflight = inflight
+
+	reporter, err := parseStatusReporter(params)
+	if err != nil {
+		s.messageConverter.close()
+		return nil, err
+	}
+	s.reporter = reporter
+
+	session, err := parseSinkSession(params)
+	if err != nil {
+		s.messageConverter.close()
+		return nil, err
+	}
+	s.session = session
+
+	storePath, err := s.session.storePath(s.storeDir)
+	if err != nil {
+		s.messageConverter.close()
+		return nil, err
+	}
+	opts, err := s.clientOptions(ctx)
+	if err != nil {
+		s.messageConverter.close()
+		return nil, err
+	}
+	s.opts = opts
+	s.session.apply(s.opts)
+	if storePath != "" {
+		s.opts.SetStore(mqtt.NewFileStore(storePath))
+	}
+	if s.presence != nil {
+		s.presence.apply(s.opts)
+	}
+	s.opts.SetOnConnectHandler(func(c mqtt.Client) {
+		s.connection.connected()
+		s.connection.setKeepAlive(keepAliveOf(c))
+		if s.presence != nil {
+			s.presence.announceOnline(ctx, c)
+		}
+	})
+	s.opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		s.connection.disconnected()
+		if s.throttle != nil && throttled(err) {
+			// the broker disconnected the client exceeding its quota
+			s.throttle.penalize(time.Now())
+			if s.logLevel.enabled(infoLevel) {
+				ctx.ErrLog(err).WithField("publishRate", s.throttle.currentRate()).
+					Info("Lost connection to MQTT broker, slowing down publishing")
+			}
+		} else if s.logLevel.enabled(infoLevel) {
+			ctx.ErrLog(err).Info("Lost connection to MQTT broker")
+		}
+		s.connectInBackground(ctx)
+	})
+	// the sink reconnects by itself with reconnect_* parameters
+	s.opts.SetAutoReconnect(false)
+
+	s.pahoLogs = registerPahoLogs(ctx, s.pahoLogLevel)
+	s.client = s.newClient()
+	if !s.connector.lazy {
+		if token := s.client.Connect(); token.Wait() && token.Error() != nil {
+			// TODO: error log
+			s.session.close()
+			unregisterPahoLogs(s.pahoLogs)
+			s.messageConverter.close()
+			return nil, token.Error()
+		}
+	}
+
+	if buf.size > 0 {
+		q, err := buf.newQueue()
 		if err != nil {
+			s.client.Disconnect(0)
+			s.session.close()
+			unregisterPahoLogs(s.pahoLogs)
+			s.messageConverter.close()
 			return nil, err
 		}
-		s.qosPath = path
+		s.outbox = q
+		s.closing = make(chan struct{})
+		s.publisherDone = make(chan struct{})
+		go s.publishBuffered(ctx)
 	}
-	if v, ok := params["default_qos"]; ok {
-		q, err := data.AsInt(v)
-		if err != nil {
+
+	if dm != nil {
+		if err := dm.register("sink", s.name, s.discards); err != nil {
+			s.Close(ctx)
 			return nil, err
 		}
-		if q < 0 || q > 2 {
-			return nil, fmt.Errorf("unknown QoS. Qos can only be between 0 and 2")
+		s.discardMonitor = dm
+	}
+
+	if s.reporter != nil {
+		s.reporter.start(ctx, "sink", s.name, s.Status)
+		if !s.connector.lazy {
+			s.reporter.attach(ctx, s.client)
 		}
-		s.qos = byte(q)
 	}
+	if s.connector.lazy {
+		s.connectInBackground(ctx)
+	}
+	registerNode(s)
+	return s, nil
+}
 
-	s.opts = mqtt.NewClientOptions()
-	s.opts.AddBroker(s.broker)
-	if s.user != "" {
-		s.opts.Username = s.user
-		s.opts.Password = s.password
+// connectInBackground connects the client to the broker with the connector
+// unless it's already being connected.
+func (s *sink) connectInBackground(ctx *core.Context) {
+	s.connector.connect(ctx, s.client, s.logLevel, s.onConnected)
+}
+
+// onConnected is called when the connector has connected the client.
+func (s *sink) onConnected() {
+	if s.reporter != nil {
+		s.reporter.attach(s.ctx, s.client)
 	}
+}
 
-	s.client = mqtt.NewClient(s.opts)
-	if token := s.client.Connect(); token.Wait() && token.Error() != nil {
-		// TODO: error log
-		return nil, token.Error()
+// newClient creates a client of the protocol version.
+func (s *sink) newClient() mqtt.Client {
+	if s.protocolVersion == 5 {
+		c := newV5Client(s.opts)
+		c.logs = s.pahoLogs
+		c.authMethod, c.authenticator = s.authMethod, s.authenticator
+		s.session.applyV5(c)
+		if s.presence != nil {
+			s.presence.applyV5(c)
+		}
+		if s.downgrade {
+			return newFallbackClient(c)
+		}
+		return c
+	}
+	if s.protocolVersion == 3 || !s.downgrade {
+		s.opts.SetProtocolVersion(s.protocolVersion)
 	}
+	return mqtt.NewClient(s.opts)
+}
 
-	return s, nil
+// discards returns the number of messages discarded so far by reason.
+func (s *sink) discards() map[string]int64 {
+	d := map[string]int64{}
+	if s.outbox != nil {
+		_, d[discardBufferFull] = s.outbox.stats()
+		d[discardAgeLimit] = atomic.LoadInt64(&s.expired)
+	}
+	if s.acl != nil {
+		_, d[discardUnauthorized] = s.acl.stats()
+	}
+	d[discardPaused] = s.pause.discards()
+	if s.onError != nil {
+		d[discardDisconnected] = atomic.LoadInt64(&s.onError.dropped)
+	}
+	return d
 }
@@ -0,0 +1,31 @@
+package mqtt
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestSinkWaitPublished(t *testing.T) {
+	s := &sink{publishTimeout: time.Second}
+	if err := s.waitPublished("a", &testToken{}); err != nil {
+		t.Error(err)
+	}
+	err := s.waitPublished("devices/1", &testToken{timeout: true})
+	if err == nil || !strings.Contains(err.Error(), "'devices/1'") || !strings.Contains(err.Error(), "1s") {
+		t.Errorf("the error should have the topic and the timeout: %v", err)
+	}
+}
+
+func TestNewSinkPublishTimeout(t *testing.T) {
+	_, err := NewSink(core.NewContext(nil), &bql.IOParams{}, data.Map{
+		"publish_timeout": data.String("-1s"),
+	})
+	if err == nil || !strings.Contains(err.Error(), "publish_timeout") {
+		t.Errorf("a negative publish_timeout should be rejected: %v", err)
+	}
+}
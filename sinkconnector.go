@@ -0,0 +1,205 @@
+package mqtt
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// sinkConnector connects a sink to the broker in the background. It connects
+// the sink lazily when it's created and reconnects it after the connection is
+// lost. Connecting is retried with exponential backoff until it succeeds or
+// the sink is closed.
+type sinkConnector struct {
+	// lazy is true when NewSink doesn't wait for the connection to the
+	// broker.
+	lazy bool
+
+	backoff     *backoff
+	logThrottle *logThrottle
+
+	m       sync.Mutex
+	running bool
+	closed  bool
+	stop    chan struct{}
+	wg      sync.WaitGroup
+
+	// retry makes the running goroutine retry connecting without waiting
+	// for the backoff.
+	retry chan struct{}
+}
+
+// parseSinkConnector parses lazy_connect and reconnect_* parameters.
+func parseSinkConnector(params data.Map) (*sinkConnector, error) {
+	c := &sinkConnector{
+		backoff: &backoff{
+			min: time.Second,
+			max: 30 * time.Second,
+		},
+		stop:  make(chan struct{}),
+		retry: make(chan struct{}, 1),
+	}
+
+	if v, ok := params["lazy_connect"]; ok {
+		b, err := data.AsBool(v)
+		if err != nil {
+			return nil, err
+		}
+		c.lazy = b
+	}
+
+	if v, ok := params["reconnect_min_time"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		c.backoff.min = d
+	}
+
+	if v, ok := params["reconnect_max_time"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		c.backoff.max = d
+	}
+	if c.backoff.min <= 0 {
+		return nil, errors.New("reconnect_min_time must be positive")
+	}
+	if c.backoff.max < c.backoff.min {
+		return nil, errors.New("reconnect_max_time must not be less than reconnect_min_time")
+	}
+
+	if v, ok := params["reconnect_jitter"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		j, err := parseJitter(str)
+		if err != nil {
+			return nil, err
+		}
+		c.backoff.jitter = j
+	}
+
+	lt, err := parseLogThrottle(params)
+	if err != nil {
+		return nil, err
+	}
+	c.logThrottle = lt
+	return c, nil
+}
+
+// connect starts connecting cli in the background unless it's already being
+// connected or the connector is closed. connected is called once cli is
+// connected.
+func (c *sinkConnector) connect(ctx *core.Context, cli supervisedClient, level logLevel, connected func()) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.running || c.closed {
+		return
+	}
+	c.start(ctx, cli, level, connected)
+}
+
+// reconnect connects cli again right away. When cli is already being
+// connected, the running goroutine retries without waiting for the backoff.
+// It returns false when the connector is closed.
+func (c *sinkConnector) reconnect(ctx *core.Context, cli supervisedClient, level logLevel, connected func()) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.closed {
+		return false
+	}
+	if c.running {
+		select {
+		case c.retry <- struct{}{}:
+		default:
+		}
+		return true
+	}
+	c.start(ctx, cli, level, connected)
+	return true
+}
+
+// start starts the goroutine connecting cli. c.m must be locked.
+func (c *sinkConnector) start(ctx *core.Context, cli supervisedClient, level logLevel, connected func()) {
+	c.running = true
+	c.wg.Add(1)
+	go c.run(ctx, cli, level, connected)
+}
+
+func (c *sinkConnector) run(ctx *core.Context, cli supervisedClient, level logLevel, connected func()) {
+	defer c.wg.Done()
+	for {
+		token := cli.Connect()
+		select {
+		case <-token.Done():
+		case <-c.stop:
+			c.finish()
+			return
+		}
+		err := token.Error()
+		if err == nil {
+			c.backoff.reset()
+			c.logThrottle.reset()
+			// the connection can be lost again while connected is called
+			c.finish()
+			if level.enabled(infoLevel) {
+				ctx.Log().Info("Connected to MQTT broker")
+			}
+			connected()
+			return
+		}
+
+		wait := c.backoff.next()
+		if ok, suppressed := c.logThrottle.allow(time.Now()); ok && level.enabled(warnLevel) {
+			l := ctx.ErrLog(err).WithField("wait", wait)
+			if suppressed > 0 {
+				l = l.WithField("suppressed", suppressed)
+			}
+			l.Warn("Cannot connect to MQTT broker, retrying")
+		}
+		select {
+		case <-time.After(wait):
+		case <-c.retry:
+			c.backoff.reset()
+		case <-c.stop:
+			c.finish()
+			return
+		}
+	}
+}
+
+func (c *sinkConnector) finish() {
+	c.m.Lock()
+	c.running = false
+	// a retry requested while connecting isn't carried over to the next run
+	select {
+	case <-c.retry:
+	default:
+	}
+	c.m.Unlock()
+}
+
+// close stops connecting and waits until the background goroutine stops.
+func (c *sinkConnector) close() {
+	c.m.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.stop)
+	}
+	c.m.Unlock()
+	c.wg.Wait()
+}
+
+// config reports lazy_connect and the reconnect parameters in effect.
+func (c *sinkConnector) config(m data.Map) {
+	m["lazy_connect"] = data.Bool(c.lazy)
+	m["reconnect_min_time"] = data.String(c.backoff.min.String())
+	m["reconnect_max_time"] = data.String(c.backoff.max.String())
+	m["reconnect_log_interval"] = data.String(c.logThrottle.interval.String())
+}
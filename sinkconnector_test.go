@@ -0,0 +1,137 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseSinkConnector(t *testing.T) {
+	c, err := parseSinkConnector(data.Map{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.lazy || c.backoff.min != time.Second || c.backoff.max != 30*time.Second || c.backoff.jitter != noJitter {
+		t.Errorf("wrong defaults: %v, %+v", c.lazy, c.backoff)
+	}
+
+	c, err = parseSinkConnector(data.Map{
+		"lazy_connect":       data.Bool(true),
+		"reconnect_min_time": data.String("2s"),
+		"reconnect_max_time": data.Int(60),
+		"reconnect_jitter":   data.String("full"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.lazy || c.backoff.min != 2*time.Second || c.backoff.max != time.Minute || c.backoff.jitter != fullJitter {
+		t.Errorf("wrong parameters: %v, %+v", c.lazy, c.backoff)
+	}
+
+	for _, params := range []data.Map{
+		{"lazy_connect": data.String("yes")},
+		{"reconnect_min_time": data.String("0s")},
+		{"reconnect_min_time": data.String("1m")},
+		{"reconnect_jitter": data.String("random")},
+		{"reconnect_log_interval": data.String("-1s")},
+	} {
+		if _, err := parseSinkConnector(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
+
+func TestSinkConnectorRetries(t *testing.T) {
+	cli := &testClient{
+		connect: []*testToken{{err: errors.New("refused")}, {err: errors.New("refused")}, {}},
+	}
+	c, err := parseSinkConnector(data.Map{"reconnect_min_time": data.String("1ms"), "reconnect_max_time": data.String("1ms")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connected := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		// the second call is ignored while the first one is connecting
+		c.connect(core.NewContext(nil), cli, infoLevel, func() {
+			connected <- struct{}{}
+		})
+	}
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("the client should be connected after retries")
+	}
+	c.close() // waits for the goroutine
+	if len(connected) != 0 {
+		t.Error("the client should be connected only once")
+	}
+}
+
+func TestSinkConnectorClose(t *testing.T) {
+	cli := &testClient{
+		connect: []*testToken{{err: errors.New("refused")}},
+	}
+	c, err := parseSinkConnector(data.Map{"reconnect_min_time": data.String("1h"), "reconnect_max_time": data.String("1h")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.connect(core.NewContext(nil), cli, infoLevel, func() {
+		t.Error("the client shouldn't be connected")
+	})
+
+	done := make(chan struct{})
+	go func() {
+		c.close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("close should stop retrying")
+	}
+
+	c.connect(core.NewContext(nil), cli, infoLevel, func() {
+		t.Error("a closed connector shouldn't connect the client")
+	})
+	c.close()
+}
+
+func TestSinkConnectorReconnect(t *testing.T) {
+	cli := &testClient{
+		connect: []*testToken{{err: errors.New("refused")}, {}},
+	}
+	c, err := parseSinkConnector(data.Map{"reconnect_min_time": data.String("1h"), "reconnect_max_time": data.String("1h")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan struct{}, 1)
+	c.connect(core.NewContext(nil), cli, infoLevel, func() {
+		connected <- struct{}{}
+	})
+
+	// the first attempt fails and the connector waits for an hour
+	select {
+	case <-connected:
+		t.Fatal("the first attempt should fail")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if !c.reconnect(core.NewContext(nil), cli, infoLevel, func() {
+		t.Error("the running goroutine should connect the client")
+	}) {
+		t.Fatal("reconnect should succeed while the connector isn't closed")
+	}
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("reconnect should skip the backoff")
+	}
+
+	c.close()
+	if c.reconnect(core.NewContext(nil), cli, infoLevel, func() {}) {
+		t.Error("a closed connector shouldn't reconnect the client")
+	}
+}
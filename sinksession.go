@@ -0,0 +1,220 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho/session/state"
+	"github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// session has parameters of the session between a client and the broker.
+type session struct {
+	// clientID is the client ID of the client. The broker assigns one when
+	// it's empty.
+	clientID string
+
+	// cleanSession is false when the broker keeps the session after the
+	// connection is lost so that in-flight QoS 1 and 2 messages are resumed
+	// on reconnect. expiry is how long MQTT 5 brokers keep the session, and
+	// it never expires when it's negative.
+	cleanSession bool
+	expiry       time.Duration
+
+	// state is the state of the persistent session of MQTT 5 clients. It's
+	// created by applyV5.
+	state *state.State
+}
+
+// parseSession parses client_id, clean_session, and session_expiry
+// parameters.
+func parseSession(params data.Map) (*session, error) {
+	s := &session{
+		cleanSession: true,
+		expiry:       -1,
+	}
+	if v, ok := params["client_id"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		id, err := expandEnv(str)
+		if err != nil {
+			return nil, err
+		}
+		if id == "" {
+			return nil, errors.New("client_id must not be empty")
+		}
+		s.clientID = id
+	}
+
+	if v, ok := params["clean_session"]; ok {
+		b, err := data.AsBool(v)
+		if err != nil {
+			return nil, err
+		}
+		if !b && s.clientID == "" {
+			// the broker identifies the session by the client ID
+			return nil, errors.New("clean_session false requires client_id")
+		}
+		s.cleanSession = b
+	}
+
+	if v, ok := params["session_expiry"]; ok {
+		if s.cleanSession {
+			return nil, errors.New("session_expiry requires clean_session to be false")
+		}
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d < 0 || d >= math.MaxUint32*time.Second {
+			return nil, errors.New("session_expiry must be between 0s and 4294967294s")
+		}
+		s.expiry = d
+	}
+	return s, nil
+}
+
+// apply sets the client ID and the session to opts.
+func (s *session) apply(opts *mqtt.ClientOptions) {
+	if s.clientID != "" {
+		opts.SetClientID(s.clientID)
+	}
+	opts.SetCleanSession(s.cleanSession)
+}
+
+// applyV5 sets the persistent session to the MQTT 5 client. The state is
+// shared by all clients of the node.
+func (s *session) applyV5(c *v5Client) {
+	if s.cleanSession {
+		return
+	}
+	if s.state == nil {
+		s.state = state.NewInMemory()
+	}
+	c.session = s.state
+	c.sessionExpiry = math.MaxUint32
+	if s.expiry >= 0 {
+		c.sessionExpiry = uint32(s.expiry / time.Second)
+	}
+}
+
+// close releases the state of the persistent session. A new state is
+// created when a client is applied again.
+func (s *session) close() {
+	if s.state != nil {
+		s.state.Close()
+		s.state = nil
+	}
+}
+
+// config reports the client ID and the session.
+func (s *session) config(c data.Map) {
+	c["client_id"] = data.String(s.clientID)
+	c["clean_session"] = data.Bool(s.cleanSession)
+	if !s.cleanSession && s.expiry >= 0 {
+		c["session_expiry"] = data.String(s.expiry.String())
+	}
+}
+
+// sinkSession has parameters of the session between the sink and the broker.
+type sinkSession struct {
+	session
+
+	// keepAlive is the interval of pings, and the connection is considered
+	// lost when the response doesn't arrive within pingTimeout.
+	// connectTimeout limits how long connecting to the broker takes.
+	keepAlive      time.Duration
+	pingTimeout    time.Duration
+	connectTimeout time.Duration
+}
+
+// parseSinkSession parses client_id, clean_session, session_expiry,
+// keep_alive, ping_timeout, and connect_timeout parameters.
+func parseSinkSession(params data.Map) (*sinkSession, error) {
+	ss, err := parseSession(params)
+	if err != nil {
+		return nil, err
+	}
+	s := &sinkSession{
+		session:        *ss,
+		keepAlive:      30 * time.Second,
+		pingTimeout:    10 * time.Second,
+		connectTimeout: 30 * time.Second,
+	}
+
+	if v, ok := params["keep_alive"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d < time.Second || d > 65535*time.Second {
+			return nil, errors.New("keep_alive must be between 1s and 65535s")
+		}
+		s.keepAlive = d
+	}
+
+	if v, ok := params["ping_timeout"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, errors.New("ping_timeout must be positive")
+		}
+		s.pingTimeout = d
+	}
+
+	if v, ok := params["connect_timeout"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, errors.New("connect_timeout must be positive")
+		}
+		s.connectTimeout = d
+	}
+	return s, nil
+}
+
+// apply sets the parameters to opts.
+func (s *sinkSession) apply(opts *mqtt.ClientOptions) {
+	s.session.apply(opts)
+	opts.SetKeepAlive(s.keepAlive)
+	opts.SetPingTimeout(s.pingTimeout)
+	opts.SetConnectTimeout(s.connectTimeout)
+}
+
+// storePath returns the subdirectory of dir named after the client ID where
+// in-flight messages are stored, so that sinks sharing dir don't share files.
+// It returns an empty string when dir is empty.
+func (s *sinkSession) storePath(dir string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	if s.cleanSession {
+		// paho resets the store on every clean connection
+		return "", errors.New("store_dir requires clean_session to be false")
+	}
+	name := url.PathEscape(s.clientID)
+	if name == "." || name == ".." {
+		return "", fmt.Errorf("client_id '%v' cannot be used as a directory name of store_dir", s.clientID)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// config reports the client ID, the session, and the keepalive and timeouts
+// with which the sink connects.
+func (s *sinkSession) config(c data.Map) {
+	s.session.config(c)
+	c["keep_alive"] = data.String(s.keepAlive.String())
+	c["ping_timeout"] = data.String(s.pingTimeout.String())
+	c["connect_timeout"] = data.String(s.connectTimeout.String())
+}
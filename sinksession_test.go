@@ -0,0 +1,161 @@
+package mqtt
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseSinkSession(t *testing.T) {
+	os.Setenv("MQTT_TEST_HOST", "node1")
+	defer os.Unsetenv("MQTT_TEST_HOST")
+
+	s, err := parseSinkSession(data.Map{"client_id": data.String("sensorbee-${MQTT_TEST_HOST}")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := mqtt.NewClientOptions()
+	s.apply(opts)
+	if opts.ClientID != "sensorbee-node1" {
+		t.Errorf("wrong client ID: %v", opts.ClientID)
+	}
+
+	s, err = parseSinkSession(data.Map{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = mqtt.NewClientOptions()
+	s.apply(opts)
+	if opts.ClientID != "" {
+		t.Errorf("the broker should assign the client ID: %v", opts.ClientID)
+	}
+
+	for _, params := range []data.Map{
+		{"client_id": data.String("")},
+		{"client_id": data.Int(1)},
+		{"client_id": data.String("${MQTT_TEST_UNDEFINED}")},
+	} {
+		if _, err := parseSinkSession(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
+
+func TestParseSinkSessionCleanSession(t *testing.T) {
+	s, err := parseSinkSession(data.Map{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := mqtt.NewClientOptions()
+	opts.SetCleanSession(false)
+	s.apply(opts)
+	if !opts.CleanSession {
+		t.Error("the session should be clean by default")
+	}
+	c := newV5Client(opts)
+	s.applyV5(c)
+	if c.session != nil {
+		t.Error("a clean session shouldn't have the state")
+	}
+
+	s, err = parseSinkSession(data.Map{
+		"client_id":      data.String("sink"),
+		"clean_session":  data.Bool(false),
+		"session_expiry": data.String("1h"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	opts = mqtt.NewClientOptions()
+	s.apply(opts)
+	if opts.CleanSession {
+		t.Error("the session should be persistent")
+	}
+	c1, c2 := newV5Client(opts), newV5Client(opts)
+	s.applyV5(c1)
+	s.applyV5(c2)
+	if c1.session == nil || c1.session != c2.session {
+		t.Error("clients should share the state")
+	}
+	if c1.sessionExpiry != 3600 {
+		t.Errorf("wrong session expiry: %v", c1.sessionExpiry)
+	}
+
+	for _, params := range []data.Map{
+		{"clean_session": data.Bool(false)},
+		{"client_id": data.String("sink"), "clean_session": data.Int(0)},
+		{"client_id": data.String("sink"), "session_expiry": data.String("1h")},
+		{"client_id": data.String("sink"), "clean_session": data.Bool(false), "session_expiry": data.String("-1s")},
+	} {
+		if _, err := parseSinkSession(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
+
+func TestParseSinkSessionKeepAlive(t *testing.T) {
+	s, err := parseSinkSession(data.Map{
+		"keep_alive":      data.String("2m"),
+		"ping_timeout":    data.String("30s"),
+		"connect_timeout": data.Int(5),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := mqtt.NewClientOptions()
+	s.apply(opts)
+	if opts.KeepAlive != 120 || opts.PingTimeout != 30*time.Second || opts.ConnectTimeout != 5*time.Second {
+		t.Errorf("wrong options: %v, %v, %v", opts.KeepAlive, opts.PingTimeout, opts.ConnectTimeout)
+	}
+
+	for _, params := range []data.Map{
+		{"keep_alive": data.String("0s")},
+		{"keep_alive": data.String("65536s")},
+		{"ping_timeout": data.String("0s")},
+		{"connect_timeout": data.String("-1s")},
+		{"connect_timeout": data.String("soon")},
+	} {
+		if _, err := parseSinkSession(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
+
+func TestSinkSessionStorePath(t *testing.T) {
+	s, err := parseSinkSession(data.Map{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := s.storePath(""); err != nil || p != "" {
+		t.Errorf("messages should be stored in memory: %v, %v", p, err)
+	}
+	if _, err := s.storePath("/tmp/mqtt"); err == nil {
+		t.Error("store_dir should require a persistent session")
+	}
+
+	for id, path := range map[string]string{
+		"sink-1":    "/tmp/mqtt/sink-1",
+		"sink/2":    "/tmp/mqtt/sink%2F2",
+		"sensorbee": "/tmp/mqtt/sensorbee",
+	} {
+		s, err := parseSinkSession(data.Map{"client_id": data.String(id), "clean_session": data.Bool(false)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, err := s.storePath("/tmp/mqtt"); err != nil || p != path {
+			t.Errorf("wrong directory of %v: %v, %v", id, p, err)
+		}
+	}
+
+	s, err = parseSinkSession(data.Map{"client_id": data.String(".."), "clean_session": data.Bool(false)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.storePath("/tmp/mqtt"); err == nil {
+		t.Error("the store shouldn't be created outside of store_dir")
+	}
+}
@@ -0,0 +1,32 @@
+package mqtt
+
+import "fmt"
+
+// sizePolicy is what a source does with a message whose payload exceeds
+// max_payload_bytes.
+type sizePolicy int
+
+const (
+	// dropOversized drops the message.
+	dropOversized sizePolicy = iota
+
+	// truncateOversized truncates the payload to max_payload_bytes.
+	truncateOversized
+
+	// reportOversized emits an error tuple having the size of the payload
+	// instead of the message.
+	reportOversized
+)
+
+func parseSizePolicy(s string) (sizePolicy, error) {
+	switch s {
+	case "drop":
+		return dropOversized, nil
+	case "truncate":
+		return truncateOversized, nil
+	case "error":
+		return reportOversized, nil
+	default:
+		return 0, fmt.Errorf("unknown payload_size_policy: %v", s)
+	}
+}
@@ -0,0 +1,47 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestLimitPayload(t *testing.T) {
+	ctx := core.NewContext(nil)
+	large := []byte("0123456789")
+
+	s := &source{maxPayloadBytes: 4}
+	w := &testWriter{}
+	if p, ok := s.limitPayload(ctx, w, "a", []byte("0123")); !ok || string(p) != "0123" {
+		t.Errorf("a payload within the limit should be kept: %v, %v", string(p), ok)
+	}
+	if _, ok := s.limitPayload(ctx, w, "a", large); ok {
+		t.Error("a large payload should be dropped")
+	}
+	if s.oversized != 1 {
+		t.Errorf("the dropped message should be counted: %v", s.oversized)
+	}
+
+	s.sizePolicy = truncateOversized
+	if p, ok := s.limitPayload(ctx, w, "a", large); !ok || string(p) != "0123" {
+		t.Errorf("a large payload should be truncated: %v, %v", string(p), ok)
+	}
+
+	s.sizePolicy = reportOversized
+	if _, ok := s.limitPayload(ctx, w, "a", large); ok {
+		t.Error("a large payload shouldn't be emitted")
+	}
+	expected := data.Map{
+		"topic":        data.String("a"),
+		"error":        data.String("payload_too_large"),
+		"payload_size": data.Int(10),
+	}
+	if len(w.tuples) != 1 || !data.Equal(expected, w.tuples[0].Data) {
+		t.Errorf("an error tuple should be written: %v", w.tuples)
+	}
+
+	if _, err := parseSizePolicy("split"); err == nil {
+		t.Error("an unknown policy should be rejected")
+	}
+}
@@ -0,0 +1,169 @@
+package mqtt
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// snSink is a sink publishing messages to an MQTT-SN gateway.
+type snSink struct {
+	messageConverter
+	*snConfig
+	qos int
+
+	m sync.Mutex
+
+	// client is the client publishing messages. It's connected lazily and
+	// recreated after errors.
+	client    *snClient
+	connected bool
+}
+
+func (s *snSink) Write(ctx *core.Context, t *core.Tuple) error {
+	m, err := s.convert(t)
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	c, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if err := c.publish(m.topic, s.qos, m.retained, m.payload); err != nil {
+		s.disconnect()
+		return err
+	}
+	return nil
+}
+
+// connect returns the client, creating it unless it exists. Clients only
+// publishing QoS -1 messages don't connect to the gateway.
+func (s *snSink) connect(ctx *core.Context) (*snClient, error) {
+	if s.client != nil {
+		select {
+		case <-s.client.done:
+			s.disconnect()
+		default:
+			return s.client, nil
+		}
+	}
+
+	c, err := s.dial(func(*snMessage) {})
+	if err != nil {
+		return nil, err
+	}
+	if s.qos >= 0 {
+		if err := c.connect(s.clientID, s.keepAlive, true); err != nil {
+			c.close(false)
+			return nil, err
+		}
+		s.connected = true
+		go s.keepAliveLoop(ctx, c)
+		ctx.Log().WithField("gateway", s.gateway).Info("Connected to MQTT-SN gateway")
+	}
+	s.client = c
+	return c, nil
+}
+
+// keepAliveLoop pings the gateway until the client is closed.
+func (s *snSink) keepAliveLoop(ctx *core.Context, c *snClient) {
+	ticker := time.NewTicker(s.keepAlive * 3 / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.ping(); err != nil {
+				ctx.ErrLog(err).WithField("gateway", s.gateway).Warn("Failed to ping MQTT-SN gateway")
+			}
+		}
+	}
+}
+
+func (s *snSink) disconnect() {
+	if s.client == nil {
+		return
+	}
+	s.client.close(s.connected)
+	s.client = nil
+	s.connected = false
+}
+
+func (s *snSink) Close(ctx *core.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.disconnect()
+	s.messageConverter.close()
+	return nil
+}
+
+// Config returns the effective configuration of the sink.
+func (s *snSink) Config() data.Map {
+	c := s.snConfig.config()
+	c["qos"] = data.Int(s.qos)
+	return c
+}
+
+// NewSNSink creates a sink publishing messages to an MQTT-SN gateway over
+// UDP. Tuples are converted into messages like the mqtt sink. QoS -1
+// messages are published without connecting to the gateway, and they can
+// only be published to predefined topics. Other topics are registered to the
+// gateway before messages are published to them.
+//
+// The sink has following required parameters:
+//
+//	* gateway: the address of the gateway like "localhost:10000"
+//
+// The sink has following optional parameters:
+//
+//	* qos: the QoS of messages, -1, 0, or 1 (default: 0)
+//	* client_id: the client ID of 1 to 23 bytes (default: "sensorbee-" and a random ID)
+//	* keep_alive: the keep alive interval in Go duration format (default: 60s)
+//	* timeout: the time to wait for responses from the gateway in Go duration format (default: 10s)
+//	* predefined_topics: a map from predefined topic IDs to topic names (default: none)
+//	* payload_field: the field name in tuples having a payload (default: "payload")
+//	* topic_field: the field name in tuples having a topic (default: "topic")
+//	* default_topic: the topic used when tuples don't have the topic field (default: "")
+//
+// The sink also has envelope_schema, envelope_version, compression,
+// compression_dictionary, and parameters of JSON encoding of the mqtt sink.
+func NewSNSink(ctx *core.Context, ioParams *bql.IOParams, params data.Map) (core.Sink, error) {
+	for _, k := range []string{"default_qos", "qos_field"} {
+		if _, ok := params[k]; ok {
+			return nil, errors.New(k + " isn't supported by the mqtt_sn sink, use qos instead")
+		}
+	}
+	conf, err := parseSNConfig(params)
+	if err != nil {
+		return nil, err
+	}
+	s := &snSink{
+		messageConverter: newMessageConverter(),
+		snConfig:         conf,
+	}
+
+	if v, ok := params["qos"]; ok {
+		q, err := data.AsInt(v)
+		if err != nil {
+			return nil, err
+		}
+		if q < -1 || q > 1 {
+			return nil, errors.New("qos must be -1, 0, or 1")
+		}
+		s.qos = int(q)
+	}
+
+	// the converter is parsed at last because it needs to be closed on errors
+	if err := s.messageConverter.parseParams(params); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
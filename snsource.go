@@ -0,0 +1,343 @@
+package mqtt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// snConfig has parameters of MQTT-SN clients shared by the source and the
+// sink.
+type snConfig struct {
+	gateway   string
+	clientID  string
+	keepAlive time.Duration
+	timeout   time.Duration
+
+	// predefined is a map from predefined topic IDs to topic names.
+	predefined map[uint16]string
+}
+
+// parseSNConfig parses gateway, client_id, keep_alive, timeout, and
+// predefined_topics parameters.
+func parseSNConfig(params data.Map) (*snConfig, error) {
+	c := &snConfig{
+		keepAlive:  60 * time.Second,
+		timeout:    10 * time.Second,
+		predefined: map[uint16]string{},
+	}
+
+	{ // This block is to suppress a golint warning.
+		v, ok := params["gateway"]
+		if !ok {
+			return nil, errors.New("gateway parameter is missing")
+		}
+		g, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		c.gateway = g
+	}
+
+	if v, ok := params["client_id"]; ok {
+		id, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		// gateways are only required to accept IDs of 1 to 23 bytes
+		if id == "" || len(id) > 23 {
+			return nil, errors.New("client_id must have 1 to 23 bytes")
+		}
+		c.clientID = id
+	} else {
+		b := make([]byte, 4)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		c.clientID = "sensorbee-" + hex.EncodeToString(b)
+	}
+
+	if v, ok := params["keep_alive"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d < time.Second || d > 65535*time.Second {
+			return nil, errors.New("keep_alive must be between 1s and 65535s")
+		}
+		c.keepAlive = d
+	}
+
+	if v, ok := params["timeout"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, errors.New("timeout must be positive")
+		}
+		c.timeout = d
+	}
+
+	if v, ok := params["predefined_topics"]; ok {
+		m, err := data.AsMap(v)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range m {
+			id, err := strconv.ParseUint(k, 10, 16)
+			if err != nil || id == 0 || id == 0xffff {
+				return nil, fmt.Errorf("invalid predefined topic ID: %v", k)
+			}
+			t, err := data.AsString(v)
+			if err != nil {
+				return nil, err
+			}
+			c.predefined[uint16(id)] = t
+		}
+	}
+	return c, nil
+}
+
+func (c *snConfig) dial(handler func(*snMessage)) (*snClient, error) {
+	return dialSN(c.gateway, c.predefined, c.timeout, handler)
+}
+
+func (c *snConfig) config() data.Map {
+	predefined := data.Map{}
+	for id, t := range c.predefined {
+		predefined[strconv.Itoa(int(id))] = data.String(t)
+	}
+	return data.Map{
+		"gateway":           data.String(c.gateway),
+		"client_id":         data.String(c.clientID),
+		"keep_alive":        data.String(c.keepAlive.String()),
+		"timeout":           data.String(c.timeout.String()),
+		"predefined_topics": predefined,
+	}
+}
+
+// snSource is a source receiving messages from an MQTT-SN gateway.
+type snSource struct {
+	*snConfig
+	topic  string
+	qos    int
+	format payloadFormat
+
+	minWait time.Duration
+	maxWait time.Duration
+
+	// connected is 1 while the source is connected to the gateway. It must
+	// be accessed atomically.
+	connected int32
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+func (s *snSource) GenerateStream(ctx *core.Context, w core.Writer) error {
+	wait := s.minWait
+	for {
+		connected, err := s.run(ctx, w)
+		if err == nil {
+			return nil
+		}
+		if connected {
+			wait = s.minWait
+		}
+		ctx.ErrLog(err).WithField("gateway", s.gateway).Error("Lost connection to MQTT-SN gateway")
+		select {
+		case <-s.stop:
+			return nil
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > s.maxWait {
+			wait = s.maxWait
+		}
+	}
+}
+
+// run connects to the gateway and writes tuples until the source stops or
+// the connection is lost. It returns nil when the source stops.
+func (s *snSource) run(ctx *core.Context, w core.Writer) (connected bool, err error) {
+	c, err := s.dial(func(m *snMessage) {
+		s.write(ctx, w, m)
+	})
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		c.close(connected)
+	}()
+
+	if err := c.connect(s.clientID, s.keepAlive, true); err != nil {
+		return false, err
+	}
+	connected = true
+	if err := c.subscribe(s.topic, s.qos); err != nil {
+		return connected, err
+	}
+	atomic.StoreInt32(&s.connected, 1)
+	defer atomic.StoreInt32(&s.connected, 0)
+	ctx.Log().WithField("gateway", s.gateway).Info("Connected to MQTT-SN gateway")
+
+	// pings are sent a little earlier than keep_alive
+	ticker := time.NewTicker(s.keepAlive * 3 / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return connected, nil
+		case <-c.done:
+			if c.err != nil {
+				return connected, c.err
+			}
+			return connected, errors.New("the connection is closed")
+		case <-ticker.C:
+			if err := c.ping(); err != nil {
+				return connected, err
+			}
+		}
+	}
+}
+
+func (s *snSource) write(ctx *core.Context, w core.Writer, m *snMessage) {
+	p, err := s.format.decode(m.payload)
+	if err != nil {
+		ctx.ErrLog(err).WithField("topic", m.topic).Error("Cannot decode a message")
+		return
+	}
+	t := core.NewTuple(data.Map{
+		"topic":   data.String(m.topic),
+		"payload": p,
+	})
+	if err := w.Write(ctx, t); err != nil {
+		ctx.ErrLog(err).WithField("topic", m.topic).Error("Cannot write a tuple")
+	}
+}
+
+func (s *snSource) Stop(ctx *core.Context) error {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	return nil
+}
+
+// Status returns the status of the source.
+func (s *snSource) Status() data.Map {
+	return data.Map{
+		"connected": data.Bool(atomic.LoadInt32(&s.connected) == 1),
+		"config":    s.Config(),
+	}
+}
+
+// Config returns the effective configuration of the source.
+func (s *snSource) Config() data.Map {
+	c := s.snConfig.config()
+	c["topic"] = data.String(s.topic)
+	c["qos"] = data.Int(s.qos)
+	c["format"] = data.String(s.format.String())
+	c["reconnect_min_time"] = data.String(s.minWait.String())
+	c["reconnect_max_time"] = data.String(s.maxWait.String())
+	return c
+}
+
+// NewSNSource creates a source receiving messages from an MQTT-SN gateway
+// over UDP so that constrained sensor networks can be used without bridges
+// to MQTT brokers. Tuples have the topic and payload fields like the mqtt
+// source. Topic IDs are registered by the gateway, and predefined topic IDs
+// configured in both the gateway and the source are mapped to topic names.
+//
+// The source has following required parameters:
+//
+//	* gateway: the address of the gateway like "localhost:10000"
+//	* topic: the topic or the predefined topic name to be subscribed
+//
+// The source has following optional parameters:
+//
+//	* qos: the QoS of the subscription, 0 or 1 (default: 0)
+//	* client_id: the client ID of 1 to 23 bytes (default: "sensorbee-" and a random ID)
+//	* keep_alive: the keep alive interval in Go duration format (default: 60s)
+//	* timeout: the time to wait for responses from the gateway in Go duration format (default: 10s)
+//	* predefined_topics: a map from predefined topic IDs to topic names (default: none)
+//	* format: the format of payloads, "blob" or "json" (default: "blob")
+//	* reconnect_min_time: the minimum time to wait before reconnecting in Go duration format (default: 1s)
+//	* reconnect_max_time: the maximum time to wait before reconnecting in Go duration format (default: 30s)
+func NewSNSource(ctx *core.Context, ioParams *bql.IOParams, params data.Map) (core.Source, error) {
+	conf, err := parseSNConfig(params)
+	if err != nil {
+		return nil, err
+	}
+	s := &snSource{
+		snConfig: conf,
+		minWait:  1 * time.Second,
+		maxWait:  30 * time.Second,
+		stop:     make(chan struct{}),
+	}
+
+	{ // This block is to suppress a golint warning.
+		v, ok := params["topic"]
+		if !ok {
+			return nil, errors.New("topic parameter is missing")
+		}
+		t, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		s.topic = t
+	}
+
+	if v, ok := params["qos"]; ok {
+		q, err := data.AsInt(v)
+		if err != nil {
+			return nil, err
+		}
+		if q != 0 && q != 1 {
+			return nil, errors.New("qos must be 0 or 1")
+		}
+		s.qos = int(q)
+	}
+
+	if v, ok := params["format"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		f, err := parseFormat(str)
+		if err != nil {
+			return nil, err
+		}
+		if f == csvFormat {
+			return nil, errors.New("format \"csv\" isn't supported by the mqtt_sn source")
+		}
+		s.format = f
+	}
+
+	if v, ok := params["reconnect_min_time"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		s.minWait = d
+	}
+	if v, ok := params["reconnect_max_time"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		s.maxWait = d
+	}
+	if s.minWait > s.maxWait {
+		return nil, errors.New("reconnect_min_time must not be greater than reconnect_max_time")
+	}
+	return core.ImplementSourceStop(s), nil
+}
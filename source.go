@@ -1,11 +1,18 @@
 package mqtt
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"math"
 	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/text/encoding"
 	"gopkg.in/sensorbee/sensorbee.v0/bql"
 	"gopkg.in/sensorbee/sensorbee.v0/core"
 	"gopkg.in/sensorbee/sensorbee.v0/data"
@@ -15,240 +22,2105 @@ type source struct {
 	ctx *core.Context
 	w   core.Writer
 
-	topic    string
-	broker   string
-	user     string
-	password string
+	clientConfig
+
+	topic string
+
+	// topics has the topic and topics added by AddTopic.
+	topics *topicSet
+
+	// session has parameters of the session with the broker.
+	session *session
+
+	// topicRegex drops messages whose topics don't match it if it isn't nil.
+	topicRegex *regexp.Regexp
+
+	// envelope is true when payloads are wrapped in schema envelopes.
+	envelope bool
+
+	// base64 is true when payloads are base64 encoded. They're decoded
+	// before they're decompressed.
+	base64 bool
+
+	// compression decompresses payloads if it isn't nil.
+	compression compression
+
+	// format is the format of payloads. It's ignored when envelope is true.
+	format payloadFormat
+
+	// csv has parameters of decoding CSV payloads if format is "csv".
+	csv *csvConfig
+
+	// split splits a message into records, each of which is emitted as a
+	// tuple, if it isn't nil.
+	split *splitter
+
+	// convention decodes messages following a convention like Homie into
+	// normalized tuples if it isn't nil. It replaces format.
+	convention convention
+
+	// charset converts text payloads to UTF-8 if it isn't nil. Payloads are
+	// emitted as strings instead of blobs when format is "blob".
+	charset encoding.Encoding
+
+	// empty is how messages having empty payloads are emitted.
+	empty emptyPayload
+
+	// maxPayloadBytes is the maximum size of payloads. Payloads aren't
+	// limited when it's 0.
+	maxPayloadBytes int
+
+	// sizePolicy is what to do with payloads exceeding maxPayloadBytes.
+	sizePolicy sizePolicy
+
+	// oversized is the number of messages dropped due to maxPayloadBytes. It
+	// must be accessed atomically.
+	oversized int64
+
+	// coercions converts types of fields in decoded payloads if it isn't nil.
+	// They're applied before conversions.
+	coercions coercions
+
+	// conversions converts fields in decoded payloads if it isn't nil.
+	conversions conversions
+
+	// normalizeLocation is true when a location in decoded payloads is
+	// normalized to the location field.
+	normalizeLocation bool
+
+	// filter drops decoded payloads which don't satisfy it if it isn't nil.
+	filter payloadFilter
+
+	// received and receivedBytes are the number of messages delivered by
+	// the broker and the total size of their payloads, and lastReceived is
+	// the time the last one was delivered in nanoseconds. decodeErrors is
+	// the number of messages, records, and rows which couldn't be decoded.
+	// They must be accessed atomically.
+	received      int64
+	receivedBytes int64
+	lastReceived  int64
+	decodeErrors  int64
+
+	// writeErrors is the number of tuples the writer failed to write, and
+	// writeFailing is 1 while writing fails. writeStopped is 1 once a fatal
+	// error of the writer stops the source. They must be accessed
+	// atomically.
+	writeErrors  int64
+	writeFailing int32
+	writeStopped int32
+
+	// filtered is the number of payloads dropped by the filter. It must be
+	// accessed atomically.
+	filtered int64
+
+	// topicStats counts messages of each topic if it isn't nil.
+	topicStats *topicStats
+
+	// standby makes the source emit tuples only while this instance is the
+	// leader if it isn't nil.
+	standby *standby
+
+	// router dispatches tuples to mqtt_route sources if it isn't nil.
+	router *Router
+
+	// systemTopics is how messages of topics starting with "$" are handled.
+	systemTopics systemTopicPolicy
+
+	// decodeErrorPolicy is what to do with messages which cannot be
+	// decoded, and decodeErrorRoute is the route of the router to which
+	// their error tuples are written by the "route" policy.
+	decodeErrorPolicy decodeErrorPolicy
+	decodeErrorRoute  string
+
+	// buffer has parameters of the queue between the MQTT client and the
+	// writer. Messages are written directly when its size is 0.
+	buffer *bufferConfig
 
 	minWait time.Duration
 	maxWait time.Duration
 
-	// reconnRetries is the maximum number of retry attempts. This parameter
-	// is for multi-broker support and isn't used at the momment.
-	reconnRetries int64
+	// jitter randomizes the time to wait before reconnecting so that many
+	// nodes don't reconnect to the broker at once.
+	jitter jitter
+
+	// reconnectLog limits how often failures to reconnect are logged.
+	reconnectLog *logThrottle
+
+	// reconnRetries is the maximum number of retry attempts. This parameter
+	// is for multi-broker support and isn't used at the momment.
+	reconnRetries int64
+
+	// annotateBroker is true when tuples have the broker from which messages
+	// were received and the connection generation.
+	annotateBroker bool
+
+	// connection tracks the broker the source is connected to.
+	connection connectionInfo
+
+	// presence has will and birth messages if it isn't nil.
+	presence *presence
+
+	// reporter publishes the status of the source if it isn't nil.
+	reporter *statusReporter
+
+	// deadLetter republishes undecodable and oversized messages if it isn't
+	// nil.
+	deadLetter *deadLetter
+
+	// pahoLogs writes internal logs of clients if it isn't nil.
+	pahoLogs *pahoLogTarget
+
+	// pause discards messages while the source is paused by Pause.
+	pause pauseState
+
+	// reconnect receives a value when the source should reconnect to the
+	// broker. It's created by GenerateStream unless autoReconnect is true.
+	reconnect chan struct{}
+
+	// idle detects idle connections if it isn't nil.
+	idle *idleWatchdog
+
+	// autoReconnect is true when paho's automatic reconnect is used instead
+	// of recreating clients in GenerateStream.
+	autoReconnect bool
+
+	// protocolVersion is the version of MQTT numbered like paho, that is, 4
+	// is MQTT 3.1.1 and 5 is MQTT 5.
+	protocolVersion uint
+
+	// downgrade is true when lower versions are tried when the broker
+	// rejects protocolVersion.
+	downgrade bool
+
+	// negotiated is the version with which the client connected last, or 0
+	// before the source connects. It must be accessed atomically.
+	negotiated uint32
+
+	// subscribeOptions has options of subscriptions only used with MQTT 5.
+	subscribeOptions v5SubscribeOptions
+
+	// subscriptionIDs is true when subscription identifiers are assigned to
+	// topic filters and emitted with tuples. It's only used with MQTT 5.
+	subscriptionIDs bool
+
+	// redirect has the broker to which the source has been redirected by
+	// MQTT 5 brokers. Redirects aren't followed if it's nil.
+	redirect *v5Redirect
+
+	// order is how messages delivered by the client are handled.
+	order messageOrder
+
+	// batch groups tuples into batches if it isn't nil.
+	batch *batchConfig
+
+	// maxInflight is the maximum number of messages handled at once when
+	// messages are handled in parallel. 0 means unlimited.
+	maxInflight int
+
+	// decodeWorkers is the number of goroutines decoding payloads. Messages
+	// are decoded by the goroutine writing them when it's 0.
+	decodeWorkers int
+
+	// limiter drops messages exceeding max_messages_per_second if it isn't
+	// nil.
+	limiter *rateLimiter
+
+	// rateLimited is the number of messages dropped by the limiter. It must
+	// be accessed atomically.
+	rateLimited int64
+
+	// dedup drops duplicate messages if it isn't nil.
+	dedup *deduplicator
+
+	// duplicates is the number of messages dropped by dedup. It must be
+	// accessed atomically.
+	duplicates int64
+
+	// ackAfterWrite is true when QoS 1 and 2 messages are acknowledged
+	// after their tuples are written instead of when they're received.
+	ackAfterWrite bool
+
+	// acks sends acknowledgments of written messages in batches if it isn't
+	// nil.
+	acks *ackBatcher
+
+	// name is the name of the source in the topology.
+	name string
+
+	// discardMonitor summarizes discarded messages if it isn't nil.
+	discardMonitor *DiscardMonitor
+
+	// drainTimeout is the maximum time to wait for messages being handled
+	// when the source stops.
+	drainTimeout time.Duration
+
+	// inflight is the number of message handlers in progress. It must be
+	// accessed atomically.
+	inflight int64
+
+	// channel that will be written to when the
+	// connection is lost
+	disconnect chan bool
+}
+
+func (s *source) GenerateStream(ctx *core.Context, w core.Writer) error {
+	s.ctx = ctx
+	s.w = w
+
+	if err := authorize(ctx, s.authorizer, ActionSubscribe, s.topic); err != nil {
+		return err
+	}
+
+	s.disconnect = make(chan bool, 1)
+	if !s.autoReconnect {
+		s.reconnect = make(chan struct{})
+	}
+	if s.compression != nil {
+		defer s.compression.close()
+	}
+	defer s.session.close()
+
+	// define where and how to connect; options are created for every
+	// client so that rotated credentials are used on reconnect
+	newClient := func() (supervisedClient, error) {
+		opts, err := s.clientOptions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		opts.OnConnectionLost = func(c mqtt.Client, e error) {
+			// write `true` to signal that the connection was not
+			// terminated on purpose and we should try to reconnect
+			s.connection.disconnected()
+			if s.logLevel.enabled(infoLevel) {
+				ctx.Log().Info("Lost connection to MQTT broker")
+			}
+			s.disconnect <- true
+		}
+		opts.AutoReconnect = false
+		s.session.apply(opts)
+		opts.SetOrderMatters(s.orderMatters())
+		opts.SetAutoAckDisabled(s.ackAfterWrite)
+		s.trackConnection(opts)
+		if s.presence != nil {
+			s.presence.apply(opts)
+		}
+		opts.SetOnConnectHandler(func(c mqtt.Client) {
+			s.connection.connected()
+			s.connection.setKeepAlive(keepAliveOf(c))
+			s.recordVersion(ctx, c)
+			if s.idle != nil {
+				s.idle.touch()
+			}
+			if s.presence != nil {
+				s.presence.announceOnline(ctx, c)
+			}
+			if s.reporter != nil {
+				s.reporter.attach(ctx, c)
+			}
+			if s.deadLetter != nil {
+				s.deadLetter.attach(c)
+			}
+		})
+		if s.protocolVersion == 5 {
+			c := newV5Client(opts)
+			c.subscribeOptions = s.subscribeOptions
+			c.subscriptionIDs = s.subscriptionIDs
+			if s.maxInflight > 0 && s.topics.qos > 0 {
+				// the broker doesn't send more messages than the source
+				// handles at once before they're acknowledged. Receive
+				// Maximum doesn't limit QoS 0 messages.
+				c.receiveMaximum = math.MaxUint16
+				if s.maxInflight < math.MaxUint16 {
+					c.receiveMaximum = uint16(s.maxInflight)
+				}
+			}
+			c.redirect = s.redirect
+			c.logs = s.pahoLogs
+			c.authMethod, c.authenticator = s.authMethod, s.authenticator
+			s.session.applyV5(c)
+			if s.presence != nil {
+				s.presence.applyV5(c)
+			}
+			if s.downgrade {
+				return newFallbackClient(c), nil
+			}
+			return c, nil
+		}
+		s.applyProtocolVersion(opts)
+		return mqtt.NewClient(opts), nil
+	}
+
+	// the status is published whenever a client connects and at the interval
+	if s.reporter != nil {
+		s.reporter.start(ctx, "source", s.name, s.Status)
+		defer s.reporter.close()
+	}
+
+	// acknowledgments of written messages are sent in batches
+	if s.acks != nil {
+		s.acks.start()
+		defer s.acks.close()
+	}
+
+	// tuples of messages are batched before they're written to w when the
+	// source has batch_size
+	out := w
+	if s.batch != nil {
+		b := s.batch.newWriter(ctx, w)
+		defer b.close()
+		out = b
+	}
+
+	// messages are decoded by the pool when the source has decode workers
+	write := func(m *message) {
+		s.write(ctx, out, m)
+	}
+	if s.decodeWorkers > 0 {
+		pool := newDecodePool(s.decodeWorkers, func(m *message) ([]data.Map, error) {
+			return s.decodeMessage(ctx, m.topic, m.payload)
+		}, func(m *message, ds []data.Map, err error) {
+			s.emit(ctx, out, m, ds, err)
+		})
+		defer pool.close()
+		write = pool.submit
+	}
+
+	// messages are pushed to the queue and written by another goroutine
+	// when the source is buffered
+	var queue *messageQueue
+	if s.buffer.size > 0 {
+		q, err := s.buffer.newQueue()
+		if err != nil {
+			return err
+		}
+		queue = q
+		writerDone := make(chan struct{})
+		go func() {
+			defer close(writerDone)
+			s.writeBuffered(ctx, q, write)
+		}()
+		defer func() {
+			q.close()
+			<-writerDone
+			q.discard()
+		}()
+	}
+
+	if s.discardMonitor != nil {
+		if err := s.discardMonitor.register("source", s.name, func() map[string]int64 {
+			d := map[string]int64{
+				discardRateLimit: atomic.LoadInt64(&s.rateLimited),
+				discardSizeLimit: atomic.LoadInt64(&s.oversized),
+				discardDuplicate: atomic.LoadInt64(&s.duplicates),
+				discardPaused:    s.pause.discards(),
+			}
+			if queue != nil {
+				_, d[discardBufferFull] = queue.stats()
+			}
+			return d
+		}); err != nil {
+			return err
+		}
+		defer s.discardMonitor.unregister("source", s.name)
+	}
+
+	// deliver writes a message or pushes it to the queue
+	deliver := func(msg *message) {
+		if queue == nil {
+			write(msg)
+			return
+		}
+		if err := queue.push(msg); err != nil {
+			ctx.ErrLog(err).WithField("topic", msg.topic).Error("Cannot buffer a message")
+			msg.acknowledge()
+		}
+	}
+
+	// define what to do with messages
+	msgHandler := func(c mqtt.Client, m mqtt.Message) {
+		atomic.AddInt64(&s.inflight, 1)
+		defer atomic.AddInt64(&s.inflight, -1)
+
+		// messages which aren't delivered are acknowledged here since they're
+		// never written. They're also batched to keep acknowledgments in the
+		// order messages are received.
+		delivered := false
+		if s.ackAfterWrite {
+			defer func() {
+				if delivered {
+					return
+				}
+				if s.acks != nil {
+					s.acks.add(m.Ack)
+				} else {
+					m.Ack()
+				}
+			}()
+		}
+
+		atomic.AddInt64(&s.received, 1)
+		atomic.AddInt64(&s.receivedBytes, int64(len(m.Payload())))
+		atomic.StoreInt64(&s.lastReceived, time.Now().UnixNano())
+		if s.topicStats != nil {
+			s.topicStats.record(m.Topic(), len(m.Payload()), time.Now())
+		}
+		if s.idle != nil {
+			s.idle.touch()
+		}
+		if s.pause.discard() {
+			return
+		}
+		if s.systemTopics == dropSystemTopics && isSystemTopic(m.Topic()) {
+			return
+		}
+		if !s.matchesTopicRegex(m.Topic()) {
+			return
+		}
+		if s.limiter != nil && !s.limiter.allow(time.Now()) {
+			atomic.AddInt64(&s.rateLimited, 1)
+			return
+		}
+
+		payload, ok := s.limitPayload(ctx, out, m.Topic(), m.Payload())
+		if !ok {
+			return
+		}
+
+		msg := &message{
+			topic:    m.Topic(),
+			qos:      m.Qos(),
+			retained: m.Retained(),
+			payload:  payload,
+		}
+		if pm, ok := m.(*v5Message); ok {
+			msg.properties = pm.properties()
+		}
+		if s.dedup != nil {
+			msg.id, msg.duplicate = m.MessageID(), m.Duplicate()
+			if s.dedup.duplicate(msg, time.Now()) {
+				atomic.AddInt64(&s.duplicates, 1)
+				return
+			}
+		}
+		if s.annotateBroker {
+			msg.broker, msg.generation = s.connection.current()
+		}
+		if s.standby != nil {
+			replay, ok := s.standby.admit(ctx, msg)
+			for _, r := range replay {
+				deliver(r)
+			}
+			if !ok {
+				return
+			}
+		}
+		if s.ackAfterWrite {
+			msg.ack = m.Ack
+			if s.acks != nil {
+				ack := m.Ack
+				msg.ack = func() {
+					s.acks.add(ack)
+				}
+			}
+			delivered = true
+		}
+		deliver(msg)
+	}
+
+	if s.order == parallelMessages && s.maxInflight > 0 {
+		handle := msgHandler
+		limited := limitInflight(func(c mqtt.Client, m mqtt.Message) {
+			defer atomic.AddInt64(&s.inflight, -1)
+			handle(c, m)
+		}, s.maxInflight)
+		msgHandler = func(c mqtt.Client, m mqtt.Message) {
+			// the message is counted before its goroutine starts so that
+			// drain doesn't miss it
+			atomic.AddInt64(&s.inflight, 1)
+			limited(c, m)
+		}
+	}
+
+	if s.idle != nil {
+		stop := make(chan struct{})
+		watchdogDone := make(chan struct{})
+		go func() {
+			defer close(watchdogDone)
+			s.idle.run(stop, func(idle time.Duration) {
+				s.onIdle(ctx, w, idle, s.reconnect)
+			})
+		}()
+		defer func() {
+			close(stop)
+			<-watchdogDone
+		}()
+	}
+
+	registerNode(s)
+	defer unregisterNode(s)
+	s.pahoLogs = registerPahoLogs(ctx, s.pahoLogLevel)
+	defer unregisterPahoLogs(s.pahoLogs)
+	defer s.connection.disconnected()
+
+	if s.autoReconnect {
+		return s.runAutoReconnect(ctx, msgHandler)
+	}
+
+	sv := &supervisor{
+		ctx:       ctx,
+		newClient: newClient,
+		broker:    redactBroker(s.broker),
+		topics:    s.topics,
+		handler:   msgHandler,
+		timeout:   10 * time.Second,
+		backoff: &backoff{
+			min:    s.minWait,
+			max:    s.maxWait,
+			jitter: s.jitter,
+		},
+		maxRetries:  s.reconnRetries,
+		logLevel:    s.logLevel,
+		logThrottle: s.reconnectLog,
+		disconnect:  s.disconnect,
+		reconnect:   s.reconnect,
+		drain: func() {
+			s.drain(ctx)
+		},
+	}
+	if s.presence != nil {
+		sv.beforeDisconnect = func(c supervisedClient) {
+			s.presence.announceOffline(ctx, c)
+		}
+	}
+	return sv.run()
+}
+
+// matchesTopicRegex returns true when the topic matches topic_regex or the
+// source doesn't have it.
+func (s *source) matchesTopicRegex(topic string) bool {
+	return s.topicRegex == nil || s.topicRegex.MatchString(topic)
+}
+
+// orderMatters returns true when the client must deliver messages in order.
+// Messages limited by max_inflight are handled in parallel by the source
+// itself, so the client delivers them in order to stop reading when the limit
+// is reached.
+func (s *source) orderMatters() bool {
+	return s.order != parallelMessages || s.maxInflight > 0
+}
+
+// limitPayload applies the payload size policy to a payload exceeding
+// max_payload_bytes. It returns false when the message isn't emitted.
+func (s *source) limitPayload(ctx *core.Context, w core.Writer, topic string, payload []byte) ([]byte, bool) {
+	if s.maxPayloadBytes == 0 || len(payload) <= s.maxPayloadBytes {
+		return payload, true
+	}
+	if s.sizePolicy != truncateOversized && s.deadLetter != nil {
+		s.deadLetter.publish(ctx, topic, payload, "payload_too_large", nil)
+	}
+	switch s.sizePolicy {
+	case truncateOversized:
+		return payload[:s.maxPayloadBytes], true
+	case reportOversized:
+		s.writeTuple(ctx, w, core.NewTuple(data.Map{
+			"topic":        data.String(topic),
+			"error":        data.String("payload_too_large"),
+			"payload_size": data.Int(len(payload)),
+		}))
+		return nil, false
+	default:
+		atomic.AddInt64(&s.oversized, 1)
+		return nil, false
+	}
+}
+
+// onIdle reconnects to the broker or writes an alert tuple depending on the
+// idle action. A reconnect is skipped when the supervisor isn't subscribing
+// to the topic since it's already reconnecting.
+func (s *source) onIdle(ctx *core.Context, w core.Writer, idle time.Duration, reconnect chan<- struct{}) {
+	if s.logLevel.enabled(warnLevel) {
+		ctx.Log().WithField("topic", s.topic).WithField("idleTime", idle).
+			Warn("No message has arrived from MQTT broker")
+	}
+	switch s.idle.action {
+	case idleReconnect:
+		select {
+		case reconnect <- struct{}{}:
+		default:
+		}
+	case idleAlert:
+		s.writeTuple(ctx, w, core.NewTuple(data.Map{
+			"topic":     data.String(s.topic),
+			"alert":     data.String("idle_timeout"),
+			"idle_time": data.Float(idle.Seconds()),
+		}))
+	}
+}
+
+// runAutoReconnect connects to the broker with a client which reconnects by
+// itself. The topics are subscribed every time the client connects. It returns
+// when Stop is called.
+func (s *source) runAutoReconnect(ctx *core.Context, msgHandler mqtt.MessageHandler) error {
+	opts, err := s.clientOptions(ctx)
+	if err != nil {
+		return err
+	}
+	opts.SetAutoReconnect(true)
+	s.session.apply(opts)
+	s.applyProtocolVersion(opts)
+	opts.SetOrderMatters(s.orderMatters())
+	opts.SetAutoAckDisabled(s.ackAfterWrite)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(s.minWait)
+	opts.SetMaxReconnectInterval(s.maxWait)
+	opts.SetConnectionLostHandler(func(c mqtt.Client, e error) {
+		s.topics.detach()
+		s.connection.disconnected()
+		if s.logLevel.enabled(infoLevel) {
+			ctx.ErrLog(e).Info("Lost connection to MQTT broker, reconnecting automatically")
+		}
+	})
+	s.trackConnection(opts)
+	if s.presence != nil {
+		s.presence.apply(opts)
+	}
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		s.connection.connected()
+		s.connection.setKeepAlive(keepAliveOf(c))
+		s.recordVersion(ctx, c)
+		if s.idle != nil {
+			s.idle.touch()
+		}
+		if s.presence != nil {
+			s.presence.announceOnline(ctx, c)
+		}
+		if s.reporter != nil {
+			s.reporter.attach(ctx, c)
+		}
+		if s.deadLetter != nil {
+			s.deadLetter.attach(c)
+		}
+		if s.logLevel.enabled(infoLevel) {
+			ctx.Log().WithField("broker", redactBroker(s.broker)).Info("Connected to MQTT broker")
+		}
+		if err := s.topics.subscribe(c, msgHandler, 10*time.Second); err != nil {
+			// the subscription is retried on the next reconnect
+			ctx.ErrLog(err).WithField("topics", s.topics.list()).Error("Failed to subscribe to topics")
+		}
+	})
+
+	client := mqtt.NewClient(opts)
+	if s.logLevel.enabled(infoLevel) {
+		ctx.Log().WithField("broker", redactBroker(s.broker)).Info("Connecting to MQTT broker")
+	}
+	client.Connect()
+
+	// wait until Stop() is called
+	<-s.disconnect
+	if client.IsConnected() {
+		if err := s.topics.unsubscribe(client, 10*time.Second); err != nil && s.logLevel.enabled(warnLevel) {
+			ctx.ErrLog(err).WithField("topics", s.topics.list()).Warn("Failed to unsubscribe from topics")
+		}
+	}
+	s.drain(ctx)
+	if s.presence != nil && client.IsConnected() {
+		s.presence.announceOffline(ctx, client)
+	}
+	client.Disconnect(250)
+	return nil
+}
+
+// applyProtocolVersion sets the version of MQTT 3 to the options. paho
+// tries MQTT 3.1 when MQTT 3.1.1 is rejected unless the version is set
+// explicitly.
+func (s *source) applyProtocolVersion(opts *mqtt.ClientOptions) {
+	if s.protocolVersion == 3 || !s.downgrade {
+		opts.SetProtocolVersion(s.protocolVersion)
+	}
+}
+
+// recordVersion records the version of MQTT with which the client has
+// connected. It's logged when it differs from the last connection.
+func (s *source) recordVersion(ctx *core.Context, c mqtt.Client) {
+	r := c.OptionsReader()
+	v := r.ProtocolVersion()
+	if atomic.SwapUint32(&s.negotiated, uint32(v)) == uint32(v) {
+		return
+	}
+	l := ctx.Log().WithField("broker", redactBroker(s.broker)).WithField("protocol_version", protocolVersionName(v))
+	if v < s.protocolVersion {
+		if s.logLevel.enabled(warnLevel) {
+			l.Warn("Downgraded MQTT protocol version since the broker rejected the requested one")
+		}
+		return
+	}
+	if s.logLevel.enabled(infoLevel) {
+		l.Info("Negotiated MQTT protocol version")
+	}
+}
+
+// drain waits until message handlers in progress finish writing tuples or
+// the drain timeout passes.
+func (s *source) drain(ctx *core.Context) {
+	deadline := time.Now().Add(s.drainTimeout)
+	for {
+		n := atomic.LoadInt64(&s.inflight)
+		if n == 0 {
+			return
+		}
+		if !time.Now().Before(deadline) {
+			if s.logLevel.enabled(warnLevel) {
+				ctx.Log().WithField("handlers", n).Warn("Drain timeout expired while messages are being written")
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// trackConnection sets a handler to opts to record brokers to which the
+// client attempts to connect.
+func (s *source) trackConnection(opts *mqtt.ClientOptions) {
+	opts.SetConnectionAttemptHandler(func(broker *url.URL, cfg *tls.Config) *tls.Config {
+		s.connection.attempt(redactBroker(broker.String()))
+		return cfg
+	})
+}
+
+// connectionInfo tracks the broker a client is connected to.
+type connectionInfo struct {
+	m           sync.Mutex
+	attempted   string
+	broker      string
+	generation  int64
+	isConnected bool
+	keepAlive   time.Duration
+}
+
+// attempt records the broker to which the client attempts to connect.
+func (c *connectionInfo) attempt(broker string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.attempted = broker
+}
+
+// connected records that the client has connected to the broker of the
+// last attempt.
+func (c *connectionInfo) connected() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.broker = c.attempted
+	c.generation++
+	c.isConnected = true
+}
+
+// setKeepAlive records the keepalive of the current connection.
+func (c *connectionInfo) setKeepAlive(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.keepAlive = d
+}
+
+// effectiveKeepAlive returns the keepalive of the last connection, or 0
+// before the client connects.
+func (c *connectionInfo) effectiveKeepAlive() time.Duration {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.keepAlive
+}
+
+// disconnected records that the connection has been lost or closed.
+func (c *connectionInfo) disconnected() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.isConnected = false
+}
+
+// state returns whether the client is connected and the number of
+// reconnections, that is, connections after the first one.
+func (c *connectionInfo) state() (bool, int64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.generation == 0 {
+		return c.isConnected, 0
+	}
+	return c.isConnected, c.generation - 1
+}
+
+// current returns the broker the client is connected to and the number of
+// connections made so far.
+func (c *connectionInfo) current() (string, int64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.broker, c.generation
+}
+
+// writeBuffered writes messages in the queue until it's closed and empty.
+func (s *source) writeBuffered(ctx *core.Context, q *messageQueue, write func(m *message)) {
+	for {
+		m, ok, err := q.pop()
+		if err != nil {
+			ctx.ErrLog(err).Error("Cannot read spilled messages")
+			continue
+		}
+		if !ok {
+			return
+		}
+		write(m)
+	}
+}
+
+// write decodes a message and writes it as a tuple. Tuples dispatched by
+// the router and tuples of system topics routed by the system_topics
+// parameter aren't written to the source's own stream.
+func (s *source) write(ctx *core.Context, w core.Writer, m *message) {
+	ds, err := s.decodeMessage(ctx, m.topic, m.payload)
+	s.emit(ctx, w, m, ds, err)
+}
+
+// emit writes the data decoded from a message as tuples. err is the error
+// returned from decodeMessage. The message is acknowledged unless writing a
+// tuple fails, so that the broker redelivers it when ack_after_write is true.
+func (s *source) emit(ctx *core.Context, w core.Writer, m *message, ds []data.Map, err error) {
+	var traceContext data.Map
+	if s.tracer != nil {
+		carrier, end := s.tracer.StartConsume(ctx, m.topic, extractTraceContext(m.properties))
+		if len(carrier) > 0 {
+			traceContext = traceContextValue(carrier)
+		}
+		defer func() {
+			end(err)
+		}()
+	}
+
+	if err != nil {
+		atomic.AddInt64(&s.decodeErrors, 1)
+		ctx.ErrLog(err).WithField("topic", m.topic).Error("Cannot decode a message")
+		s.emitDecodeError(ctx, w, m, err)
+		if s.deadLetter != nil {
+			s.deadLetter.publish(ctx, m.topic, m.payload, "decode_failed", err)
+		}
+		// the message would never be decoded even if it was redelivered
+		m.acknowledge()
+		return
+	}
+	written := true
+	for _, d := range ds {
+		if traceContext != nil {
+			d["trace_context"] = traceContext.Copy()
+		}
+		if !s.emitTuple(ctx, w, m, d) {
+			written = false
+		}
+	}
+	if written {
+		m.acknowledge()
+	} else {
+		err = errors.New("writing tuples of the message failed")
+	}
+}
+
+// emitTuple writes a tuple having the data. It returns false when writing the
+// tuple fails.
+func (s *source) emitTuple(ctx *core.Context, w core.Writer, m *message, d data.Map) bool {
+	if s.subscribeOptions.retainAsPublished {
+		d["retained"] = data.Bool(m.retained)
+	}
+	for k, v := range m.properties {
+		d[k] = v
+	}
+	if s.annotateBroker {
+		d["broker"] = data.String(m.broker)
+		d["connection_generation"] = data.Int(m.generation)
+	}
+	// tuples and their data aren't pooled since the topology owns them once
+	// they're written
+	t := core.NewTuple(d)
+	if s.router != nil {
+		if s.router.route(ctx, m.topic, t) {
+			return true
+		}
+		if s.systemTopics == routeSystemTopics && isSystemTopic(m.topic) {
+			// system topics without a matching route are dropped
+			return true
+		}
+	}
+	return s.writeTuple(ctx, w, t) == nil
+}
+
+// decodeMessage creates the data of tuples from a message. A message has
+// multiple records when split is given. Records which cannot be decoded are
+// logged and skipped. It returns nil when the message isn't emitted.
+func (s *source) decodeMessage(ctx *core.Context, topic string, payload []byte) ([]data.Map, error) {
+	if s.convention != nil {
+		return s.decodeConvention(topic, payload)
+	}
+	if (s.split == nil && s.csv == nil) || len(payload) == 0 {
+		d, err := s.decode(ctx, topic, payload)
+		if err != nil || d == nil {
+			return nil, err
+		}
+		return []data.Map{d}, nil
+	}
+
+	payload, err := s.unwrap(payload)
+	if err != nil {
+		return nil, err
+	}
+	if s.csv != nil {
+		return s.decodeCSV(ctx, topic, payload)
+	}
+	records, err := s.split.split(payload)
+	if err != nil {
+		// records before the malformed part are still emitted
+		atomic.AddInt64(&s.decodeErrors, 1)
+		ctx.ErrLog(err).WithField("topic", topic).Error("Cannot split a message into records")
+	}
+	var ds []data.Map
+	for _, r := range records {
+		d, err := s.decodeRecord(ctx, topic, r)
+		if err != nil {
+			atomic.AddInt64(&s.decodeErrors, 1)
+			ctx.ErrLog(err).WithField("topic", topic).Error("Cannot decode a record of a message")
+			continue
+		}
+		if d != nil {
+			ds = append(ds, d)
+		}
+	}
+	return ds, nil
+}
+
+// decodeConvention creates the data of tuples from a message following the
+// convention. Empty payloads are passed to the convention as they are.
+func (s *source) decodeConvention(topic string, payload []byte) ([]data.Map, error) {
+	if len(payload) > 0 {
+		p, err := s.unwrap(payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = p
+		if s.charset != nil {
+			if payload, err = toUTF8(s.charset, payload); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s.convention.decode(topic, payload)
+}
+
+// decodeCSV creates the data of tuples from rows of a CSV payload.
+func (s *source) decodeCSV(ctx *core.Context, topic string, payload []byte) ([]data.Map, error) {
+	if s.charset != nil {
+		p, err := toUTF8(s.charset, payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = p
+	}
+	rows, err := s.csv.decode(payload)
+	if err != nil {
+		// rows before the malformed one are still emitted
+		atomic.AddInt64(&s.decodeErrors, 1)
+		ctx.ErrLog(err).WithField("topic", topic).Error("Cannot decode a CSV payload")
+	}
+	var ds []data.Map
+	for _, r := range rows {
+		d, err := s.transform(data.Map{
+			"topic":   data.String(topic),
+			"payload": r,
+		})
+		if err != nil {
+			atomic.AddInt64(&s.decodeErrors, 1)
+			ctx.ErrLog(err).WithField("topic", topic).Error("Cannot decode a row of a CSV payload")
+			continue
+		}
+		if d != nil {
+			ds = append(ds, d)
+		}
+	}
+	return ds, nil
+}
+
+// decode creates the data of a tuple from a message. It returns nil when the
+// message isn't emitted.
+func (s *source) decode(ctx *core.Context, topic string, payload []byte) (data.Map, error) {
+	if len(payload) == 0 {
+		switch s.empty {
+		case emptyAsNull:
+			return data.Map{"topic": data.String(topic), "payload": data.Null{}}, nil
+		case dropEmpty:
+			return nil, nil
+		default:
+			return data.Map{"topic": data.String(topic), "payload": data.Blob{}}, nil
+		}
+	}
+
+	payload, err := s.unwrap(payload)
+	if err != nil {
+		return nil, err
+	}
+	return s.decodeRecord(ctx, topic, payload)
+}
+
+// unwrap decodes base64 and decompresses a payload.
+func (s *source) unwrap(payload []byte) ([]byte, error) {
+	if s.base64 {
+		p, err := decodeBase64(payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = p
+	}
+
+	if s.compression != nil {
+		p, err := s.compression.decompress(payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = p
+	}
+	return payload, nil
+}
+
+// decodeRecord creates the data of a tuple from an unwrapped payload.
+func (s *source) decodeRecord(ctx *core.Context, topic string, payload []byte) (data.Map, error) {
+	// the payload is only converted to a value once since each conversion
+	// allocates
+	d := data.Map{
+		"topic": data.String(topic),
+	}
+	if s.envelope {
+		schema, ver, p, err := unwrapEnvelope(ctx, payload)
+		if err != nil {
+			return nil, err
+		}
+		d["schema"] = data.String(schema)
+		d["schema_version"] = data.Int(ver)
+		d["payload"] = p
+	} else if s.charset != nil {
+		p, err := toUTF8(s.charset, payload)
+		if err != nil {
+			return nil, err
+		}
+		if s.format == blobFormat {
+			d["payload"] = data.String(p)
+		} else if d["payload"], err = s.format.decode(p); err != nil {
+			return nil, err
+		}
+	} else if s.format != blobFormat {
+		p, err := s.format.decode(payload)
+		if err != nil {
+			return nil, err
+		}
+		d["payload"] = p
+	} else {
+		d["payload"] = data.Blob(payload)
+	}
+	return s.transform(d)
+}
+
+// transform applies coercions, conversions, and the location normalization
+// to the decoded payload.
+func (s *source) transform(d data.Map) (data.Map, error) {
+	if s.coercions != nil {
+		if err := s.coercions.apply(d["payload"]); err != nil {
+			return nil, err
+		}
+	}
+	if s.conversions != nil {
+		if err := s.conversions.apply(d["payload"]); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.normalizeLocation {
+		// payloads without a location are emitted as they are
+		normalizeLocation(d["payload"])
+	}
+
+	if s.filter != nil && !s.filter.match(d["payload"]) {
+		atomic.AddInt64(&s.filtered, 1)
+		return nil, nil
+	}
+	return d, nil
+}
+
+// Config returns the effective configuration of the source after defaults
+// are applied and the broker URL is normalized. Secrets are masked.
+func (s *source) Config() data.Map {
+	c := s.clientConfig.config()
+	c["topic"] = data.String(s.topic)
+	if s.topics != nil {
+		c["qos"] = data.Int(s.topics.qos)
+	}
+	if s.session != nil {
+		s.session.config(c)
+	}
+	if s.topicRegex != nil {
+		c["topic_regex"] = data.String(s.topicRegex.String())
+	}
+	c["envelope"] = data.Bool(s.envelope)
+	c["format"] = data.String(s.format.String())
+	c["charset"] = data.String(charsetName(s.charset))
+	if s.filter != nil {
+		c["filter"] = s.filter.conditions()
+	}
+	if s.csv != nil {
+		c["csv_delimiter"] = data.String(string(s.csv.delimiter))
+		c["csv_header"] = data.Bool(s.csv.header)
+		columns := make(data.Array, len(s.csv.columns))
+		for i, name := range s.csv.columns {
+			columns[i] = data.String(name)
+		}
+		c["csv_columns"] = columns
+	}
+	if s.split != nil {
+		s.split.config(c)
+	} else {
+		c["split"] = data.String("none")
+	}
+	if s.convention != nil {
+		c["convention"] = data.String(s.convention.String())
+		if ha, ok := s.convention.(*homeAssistant); ok {
+			c["discovery_prefix"] = data.String(ha.prefix)
+		}
+		if z, ok := s.convention.(*zigbee2MQTT); ok {
+			c["base_topic"] = data.String(z.baseTopic)
+			c["enrich_devices"] = data.Bool(z.enrichDevices)
+		}
+		if b, ok := s.convention.(*brokerMetrics); ok {
+			c["metrics_interval"] = data.String(b.interval.String())
+		}
+	} else {
+		c["convention"] = data.String("none")
+	}
+	c["decode_base64"] = data.Bool(s.base64)
+	c["compression"] = data.Bool(s.compression != nil)
+	c["empty_payload"] = data.String(s.empty.String())
+	c["max_payload_bytes"] = data.Int(s.maxPayloadBytes)
+	c["reconnect_min_time"] = data.String(s.minWait.String())
+	c["reconnect_max_time"] = data.String(s.maxWait.String())
+	if s.reconnectLog != nil {
+		c["reconnect_log_interval"] = data.String(s.reconnectLog.interval.String())
+	}
+	c["use_auto_reconnect"] = data.Bool(s.autoReconnect)
+	c["protocol_version"] = data.String(protocolVersionName(s.protocolVersion))
+	c["protocol_downgrade"] = data.Bool(s.downgrade)
+	if s.protocolVersion == 5 {
+		s.subscribeOptions.config(c)
+		c["subscription_identifiers"] = data.Bool(s.subscriptionIDs)
+		c["follow_redirects"] = data.Bool(s.redirect != nil)
+	}
+	c["drain_timeout"] = data.String(s.drainTimeout.String())
+	c["message_order"] = data.String(s.order.String())
+	c["ack_after_write"] = data.Bool(s.ackAfterWrite)
+	c["max_inflight"] = data.Int(s.maxInflight)
+	c["decode_workers"] = data.Int(s.decodeWorkers)
+	c["buffer_size"] = data.Int(s.buffer.size)
+	if s.buffer.size > 0 {
+		c["buffer_policy"] = data.String(s.buffer.policy.String())
+	}
+	if s.batch != nil {
+		c["batch_size"] = data.Int(s.batch.size)
+		c["batch_interval"] = data.String(s.batch.interval.String())
+	}
+	if s.dedup != nil {
+		c["dedup_window"] = data.String(s.dedup.window.String())
+	}
+	if s.limiter != nil {
+		c["max_messages_per_second"] = data.Float(s.limiter.rate)
+	}
+	if s.idle != nil {
+		c["idle_timeout"] = data.String(s.idle.timeout.String())
+	}
+	if s.presence != nil {
+		s.presence.config(c)
+	}
+	if s.reporter != nil {
+		c["status_topic"] = data.String(s.reporter.topic)
+		c["status_interval"] = data.String(s.reporter.interval.String())
+	}
+	if s.topicStats != nil {
+		c["topic_stats_size"] = data.Int(s.topicStats.size)
+	}
+	if s.deadLetter != nil {
+		c["dead_letter_topic"] = data.String(s.deadLetter.topic)
+		c["dead_letter_qos"] = data.Int(s.deadLetter.qos)
+	}
+	return c
+}
+
+// Status returns whether the source is paused and connected, counters of
+// received messages, the number of payloads dropped by the filter,
+// subscribed topics, and the effective configuration of the source.
+func (s *source) Status() data.Map {
+	connected, reconnects := s.connection.state()
+	st := data.Map{
+		"paused":         data.Bool(s.pause.isPaused()),
+		"connected":      data.Bool(connected),
+		"reconnects":     data.Int(reconnects),
+		"received":       data.Int(atomic.LoadInt64(&s.received)),
+		"received_bytes": data.Int(atomic.LoadInt64(&s.receivedBytes)),
+		"decode_errors":  data.Int(atomic.LoadInt64(&s.decodeErrors)),
+		"write_errors":   data.Int(atomic.LoadInt64(&s.writeErrors)),
+		"config":         s.Config(),
+	}
+	if broker, _ := s.connection.current(); connected && broker != "" {
+		st["broker"] = data.String(broker)
+	}
+	if t := atomic.LoadInt64(&s.lastReceived); t != 0 {
+		st["last_received_at"] = data.Timestamp(time.Unix(0, t))
+	}
+	if s.topics != nil {
+		topics := s.topics.list()
+		a := make(data.Array, len(topics))
+		for i, t := range topics {
+			a[i] = data.String(t)
+		}
+		st["topics"] = a
+	}
+	if s.filter != nil {
+		st["filtered"] = data.Int(atomic.LoadInt64(&s.filtered))
+	}
+	if s.topicStats != nil {
+		a, evicted := s.topicStats.value()
+		st["topic_stats"] = a
+		st["topic_stats_evicted"] = data.Int(evicted)
+	}
+	if s.deadLetter != nil {
+		st["dead_letters"] = data.Int(atomic.LoadInt64(&s.deadLetter.published))
+		st["dead_letter_failures"] = data.Int(atomic.LoadInt64(&s.deadLetter.failed))
+	}
+	if v := atomic.LoadUint32(&s.negotiated); v != 0 {
+		st["negotiated_protocol_version"] = data.String(protocolVersionName(uint(v)))
+	}
+	if d := s.connection.effectiveKeepAlive(); d > 0 {
+		st["keep_alive"] = data.String(d.String())
+	}
+	return st
+}
+
+// Kind returns "source".
+func (s *source) Kind() string {
+	return "source"
+}
+
+// Name returns the name of the source.
+func (s *source) Name() string {
+	return s.name
+}
+
+// Pause makes the source discard messages until Resume is called.
+func (s *source) Pause() {
+	s.pause.set(true)
+}
+
+// Resume resumes the source.
+func (s *source) Resume() {
+	s.pause.set(false)
+}
+
+// Topics returns topics which the source subscribes to.
+func (s *source) Topics() []string {
+	return s.topics.list()
+}
+
+// AddTopic makes the source subscribe to the topic. It's subscribed
+// immediately when the source is subscribing, and otherwise when the source
+// connects to the broker.
+func (s *source) AddTopic(topic string) error {
+	if err := authorize(s.ctx, s.authorizer, ActionSubscribe, topic); err != nil {
+		return err
+	}
+	return s.topics.add(topic)
+}
+
+// RemoveTopic makes the source unsubscribe from the topic.
+func (s *source) RemoveTopic(topic string) error {
+	return s.topics.remove(topic)
+}
+
+// Reconnect makes the source reconnect to the broker. It fails when the
+// source uses paho's automatic reconnect or it isn't subscribing to the topic.
+func (s *source) Reconnect() error {
+	if s.autoReconnect {
+		return errors.New("reconnecting isn't supported with use_auto_reconnect")
+	}
+	select {
+	case s.reconnect <- struct{}{}:
+		s.connection.disconnected()
+		return nil
+	default:
+		return errors.New("the source isn't subscribing to the topic")
+	}
+}
+
+func (s *source) Stop(ctx *core.Context) error {
+	// write `false` to signal that we should not try to reconnect
+	s.disconnect <- false
+
+	return nil
+}
+
+// NewSource create a new Source receiving data from a MQTT broker. The source
+// emits tuples like;
+//
+//	{
+//		"topic": "foo/bar",
+//		"payload": <blob>
+//	}
+//
+// The topic field has topic of the message and the payload field has data
+// as a blob. If the data contains JSON and a user wants to manipulate it,
+// another stream needs to be created:
+//
+//	CREATE STREAM hoge AS
+//	  SELECT RSTREAM decode_json(payload) AS * FROM mqtt_src [RANGE 1 TUPLES];
+//
+// Alternatively, the source decodes JSON by itself when the format parameter
+// is "json".
+//
+// The source has following required parameters:
+//
+//	* topic: the topic to be subscribed (default: "$SYS/#" when convention is "broker_metrics", required otherwise)
+//
+// The source has following optional parameters:
+//
+//	* topic_regex: a regular expression which topics of emitted messages must match (default: "")
+//	* qos: the QoS with which the topic is subscribed, 0, 1, or 2 (default: 0)
+//	* client_id: the client ID of the source, which the broker assigns when it's empty (default: "")
+//	* clean_session: false to make the broker keep the session and unacknowledged messages while the source is disconnected (default: true)
+//	* session_expiry: how long an MQTT 5 broker keeps the session in Go duration format, which never expires when it isn't given (default: none)
+//	* broker: the address of the broker in URI scheme://"host:port" format (default: "tcp://127.0.0.1:1883")
+//	* user: the user name to be connected (default: "")
+//	* password: the password of the user (default: "")
+//	* password_file: the path to a file containing the password (default: "")
+//	* credentials: the name of a mqtt_credentials state used instead of user and password (default: "")
+//	* tls_pinned_sha256: SHA-256 fingerprints of the broker's certificate or public key in hex (default: none)
+//	* tls_verify_ca: false to verify the broker's certificate only by tls_pinned_sha256 (default: true)
+//	* oauth2_token_url: the token endpoint of the OAuth2 client credentials flow (default: "")
+//	* oauth2_client_id: the client ID of the OAuth2 client credentials flow (default: "")
+//	* oauth2_client_secret: the client secret of the OAuth2 client credentials flow (default: "")
+//	* oauth2_scopes: the scopes requested by the OAuth2 client credentials flow (default: none)
+//	* oauth2_audience: the audience requested by the OAuth2 client credentials flow (default: "")
+//	* vault_addr: the address of HashiCorp Vault issuing client certificates (default: "")
+//	* vault_token: the token used to access Vault (default: "")
+//	* vault_pki_path: the path of the PKI issue endpoint such as "pki/issue/sensorbee" (default: "")
+//	* vault_common_name: the common name of client certificates (default: "")
+//	* vault_ttl: the TTL of client certificates (default: the default TTL of the role)
+//	* vault_ca_file: the path to a PEM file having CA certificates to verify Vault (default: "")
+//	* greengrass_thing_name: the thing name used to discover a local AWS IoT Greengrass core (default: "")
+//	* greengrass_discovery_endpoint: the host of the Greengrass discovery API (default: "")
+//	* dialer: the name of a Dialer registered by RegisterDialer to connect to the broker (default: "")
+//	* authorizer: the name of an Authorizer registered by RegisterAuthorizer to veto subscriptions (default: "")
+//	* auth_method: the authentication method of MQTT 5 enhanced authentication performed by an Authenticator registered by RegisterAuthenticator (default: "")
+//	* tracer: the name of a Tracer registered by RegisterTracer to create spans around handled messages (default: "")
+//	* log_level: the minimum level of logs, "debug", "info", "warn", or "error" (default: "info")
+//	* paho_log_level: the verbosity of internal logs of the MQTT client, "none", "error", "warn", or "debug" (default: "none")
+//	* status_topic: the topic to which the status is published periodically as a retained message (default: "")
+//	* status_interval: the interval at which the status is published in Go duration format (default: 1m)
+//	* status_qos: the QoS of status messages (default: 0)
+//	* reconnect_min_time: minimal time to wait before reconnecting in Go duration format (default: 1s)
+//	* reconnect_max_time: maximal time to wait before reconnecting in Go duration format (default: 30s)
+//	* reconnect_jitter: how to randomize the time to wait before reconnecting, "none", "full", or "equal" (default: "none")
+//	* reconnect_log_interval: the minimum interval between logs of failures to reconnect in Go duration format (default: 1m)
+//	* use_auto_reconnect: true to use the automatic reconnect of paho.mqtt.golang instead of recreating clients (default: false)
+//	* protocol_version: the version of MQTT, "3.1", "3.1.1", or "5" (default: "3.1.1")
+//	* protocol_downgrade: true to try lower versions when the broker rejects protocol_version (default: true)
+//	* no_local: true not to receive messages published by the same client, requires protocol_version 5 (default: false)
+//	* retain_as_published: true to keep retain flags of messages as published and emit them as the retained field, requires protocol_version 5 (default: false)
+//	* retain_handling: when retained messages are sent, 0 on every subscription, 1 only on new subscriptions, or 2 never, requires protocol_version 5 (default: 0)
+//	* subscription_identifiers: true to assign subscription identifiers to topic filters and emit them with tuples, requires protocol_version 5 (default: false)
+//	* follow_redirects: true to connect to brokers referenced by Server Reference of MQTT 5 brokers, requires protocol_version 5 (default: true)
+//	* max_messages_per_second: the maximum number of messages emitted per second, messages exceeding it are dropped (default: none)
+//	* discard_monitor: the name of a mqtt_discard_monitor state summarizing discarded messages (default: "")
+//	* drain_timeout: the maximum time to wait for messages being written when the source stops in Go duration format (default: 5s)
+//	* idle_timeout: the time in Go duration format after which the source acts when no message arrives (default: none)
+//	* idle_action: what to do when no message arrives within idle_timeout, "reconnect" or "alert" (default: "reconnect")
+//	* envelope: true when payloads are wrapped in envelopes by the sink having envelope_schema (default: false)
+//	* compression: the compression algorithm of payloads, "gzip", "zlib", "zstd", "snappy", or "auto" (default: "")
+//	* compression_dictionary: the path to a dictionary file used by the compression (default: "")
+//	* decode_base64: true to decode base64 payloads before they're decompressed and decoded (default: false)
+//	* format: the format of payloads, "blob", "json", or "csv" (default: "blob")
+//	* csv_delimiter: the delimiter of CSV payloads (default: ",")
+//	* csv_header: true when the first row of each CSV payload has column names (default: false)
+//	* csv_columns: an array of column names of CSV payloads (default: none)
+//	* split: how a payload is split into records emitted as tuples, "none", "lines", or "length_prefixed" (default: "none")
+//	* length_prefix_size: the size of length prefixes in bytes when split is "length_prefixed", 1, 2, or 4 (default: 4)
+//	* length_prefix_byte_order: the byte order of length prefixes, "big" or "little" (default: "big")
+//	* convention: the convention of topics and payloads decoded into normalized tuples, "none", "homie", "home_assistant", "tasmota", "zigbee2mqtt", "owntracks", "ttn", "hono", "ngsi", or "broker_metrics" (default: "none")
+//	* discovery_prefix: the prefix of discovery topics when convention is "home_assistant" (default: "homeassistant")
+//	* base_topic: the base topic of Zigbee2MQTT when convention is "zigbee2mqtt" (default: "zigbee2mqtt")
+//	* enrich_devices: true to add models and vendors in bridge/devices of Zigbee2MQTT to tuples (default: true)
+//	* metrics_interval: the minimum interval of snapshots of metrics when convention is "broker_metrics" (default: 10s)
+//	* charset: the charset of text payloads converted to UTF-8, such as "latin1" or "shift_jis" (default: "utf-8")
+//	* dedup_window: the time within which duplicate messages are dropped, 0 disables deduplication (default: 0)
+//	* dedup_key: what identifies duplicate messages, "payload" or "message_id", which requires qos to be 1 or 2 (default: "payload")
+//	* max_payload_bytes: the maximum size of payloads in bytes, 0 means unlimited (default: 0)
+//	* payload_size_policy: what to do with payloads exceeding max_payload_bytes, "drop", "truncate", or "error" (default: "drop")
+//	* empty_payload: how messages having empty payloads are emitted, "blob", "null", or "drop" (default: "blob")
+//	* coercions: a map from fields in decoded payloads to types, "int", "float", "bool", "string", or "timestamp" (default: none)
+//	* conversions: a map from fields in decoded payloads to unit conversions having multiply, offset, and rename (default: none)
+//	* normalize_location: true to normalize a location in decoded payloads to the location field (default: false)
+//	* filter: a condition like "temperature > 30" or an array of conditions decoded payloads must satisfy to be emitted (default: none)
+//	* buffer_size: the maximum number of messages buffered before they're written, 0 disables buffering (default: 0)
+//	* buffer_policy: what to do when the buffer is full, "drop_newest", "drop_oldest", "spill", or "block" (default: "drop_newest")
+//	* spill_dir: the directory where the spill policy writes messages (default: the system's temporary directory)
+//	* memory_budget: the name of a mqtt_memory_budget state limiting the size of buffered messages (default: "")
+//	* message_order: how messages are handled, "ordered", "parallel", or "serialized" (default: "ordered")
+//	* batch_size: the maximum number of tuples in a batch, 0 disables batching (default: 0)
+//	* batch_interval: the maximum time a tuple waits in a batch in Go duration format (default: 100ms)
+//	* batch_mode: "writes" to write tuples in a batch one after another, or "array" to write a batch as a tuple (default: "writes")
+//	* ack_after_write: true to acknowledge messages after their tuples are written, which requires qos to be 1 or 2 (default: false)
+//	* ack_batch_size: the number of acknowledgments of written messages sent at once (default: 1)
+//	* ack_batch_interval: the maximum time an acknowledgment waits in a batch in Go duration format (default: 100ms)
+//	* max_inflight: the maximum number of messages handled at once when message_order is "parallel", 0 means unlimited (default: 0)
+//	* decode_workers: the number of goroutines decoding payloads, 0 decodes them in the goroutine writing tuples (default: 0)
+//	* will_topic: the topic of the will message published by the broker when the source is disconnected unexpectedly (default: "")
+//	* will_payload: the payload of the will message (default: "")
+//	* will_qos: the QoS of the will message (default: 0)
+//	* will_retained: true to retain the will message (default: false)
+//	* will_delay_interval: the time the broker waits before publishing the will message in Go duration format, only used with MQTT 5 (default: 0s)
+//	* will_user_properties: a map of user properties of the will message, only used with MQTT 5 (default: none)
+//	* birth_topic: the topic of the birth message published when the source connects (default: will_topic)
+//	* birth_payload: the payload of the birth message (default: will_payload)
+//	* birth_qos: the QoS of the birth message (default: will_qos)
+//	* birth_retained: true to retain the birth message (default: will_retained)
+//	* annotate_broker: true to add the broker and connection_generation fields to tuples (default: false)
+//	* router: the name of a mqtt_router state dispatching tuples to mqtt_route sources (default: "")
+//	* leader: the name of a mqtt_leader state, which makes the source a warm standby emitting tuples only while this instance is the leader (default: "")
+//	* standby_buffer: the number of recent messages kept on standby and emitted on promotion (default: 0)
+//	* system_topics: how messages of topics starting with "$" are handled, "emit", "drop", or "route" (default: "emit")
+//	* decode_error_policy: what to do with messages which cannot be decoded, "drop", "emit", or "route" (default: "drop")
+//	* decode_error_route: the route of router to which error tuples are written when decode_error_policy is "route" (default: "")
+//	* dead_letter_topic: the topic to which undecodable and oversized messages are republished with error metadata (default: "")
+//	* dead_letter_qos: the QoS of dead letters (default: 0)
+//	* topic_stats_size: the maximum number of topics whose messages and bytes are counted, 0 disables statistics (default: 0)
+//
+// When buffer_size is greater than 0, received messages are buffered and
+// written by another goroutine so that a slow downstream doesn't block the
+// MQTT client. The buffer is limited by both buffer_size and the memory
+// budget since the size of payloads can vary widely.
+//
+// When batch_size is greater than 0, tuples are grouped into batches to
+// reduce the overhead of writing each tuple at high message rates. With the
+// "array" batch_mode, a batch is written as a tuple having the messages field,
+// which is an array of the data of the tuples, and the count field.
+//
+// Tuples are emitted in the order messages are received within each QoS
+// level unless message_order is "parallel". The broker may still deliver
+// messages out of order, for example, when it has several in-flight messages.
+// decode_workers doesn't change the order since tuples decoded in parallel are
+// written in the order messages are received.
+//
+// ${NAME} in user, password, oauth2_client_id, oauth2_client_secret, and
+// vault_token is replaced with the value of the environment variable NAME.
+// When oauth2_token_url is given, an access token is passed as the password.
+func NewSource(ctx *core.Context, ioParams *bql.IOParams, params data.Map) (core.Source, error) {
+	s, err := newSource(ctx, ioParams, params)
+	if err != nil {
+		return nil, err
+	}
+	return core.ImplementSourceStop(s), nil
+}
+
+// newSource creates a source from the parameters of NewSource.
+func newSource(ctx *core.Context, ioParams *bql.IOParams, params data.Map) (*source, error) {
+	s := &source{
+		clientConfig:    newClientConfig(),
+		minWait:         1 * time.Second,
+		maxWait:         30 * time.Second,
+		reconnRetries:   -1,
+		protocolVersion: 4,
+		downgrade:       true,
+		drainTimeout:    5 * time.Second,
+		name:            ioParams.Name,
+	}
+
+	{ // This block is to suppress a golint warning.
+		v, ok := params["topic"]
+		if c, _ := params["convention"].(data.String); !ok && c == "broker_metrics" {
+			v, ok = data.String(sysTopicFilter), true
+		}
+		if !ok {
+			return nil, errors.New("topic parameter is missing")
+		}
+		t, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		s.topic = t
+		s.topics = newTopicSet(t)
+	}
+
+	if v, ok := params["topic_regex"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		if str != "" {
+			r, err := regexp.Compile(str)
+			if err != nil {
+				return nil, fmt.Errorf("invalid topic_regex: %v", err)
+			}
+			s.topicRegex = r
+		}
+	}
+
+	if err := s.clientConfig.parseParams(ctx, params); err != nil {
+		return nil, err
+	}
+	if s.storeDir != "" {
+		// the broker keeps unacknowledged messages of a persistent session,
+		// so the source has nothing to store
+		return nil, errors.New("store_dir cannot be used with the source")
+	}
+
+	if v, ok := params["qos"]; ok {
+		q, err := data.AsInt(v)
+		if err != nil {
+			return nil, err
+		}
+		if q < 0 || q > 2 {
+			return nil, errors.New("qos must be 0, 1, or 2")
+		}
+		s.topics.qos = byte(q)
+	}
+
+	sess, err := parseSession(params)
+	if err != nil {
+		return nil, err
+	}
+	s.session = sess
+
+	if v, ok := params["reconnect_min_time"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		s.minWait = d
+	}
+
+	if v, ok := params["reconnect_max_time"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		s.maxWait = d
+	}
+
+	lt, err := parseLogThrottle(params)
+	if err != nil {
+		return nil, err
+	}
+	s.reconnectLog = lt
+
+	if v, ok := params["use_auto_reconnect"]; ok {
+		b, err := data.AsBool(v)
+		if err != nil {
+			return nil, err
+		}
+		s.autoReconnect = b
+	}
+
+	if v, ok := params["reconnect_jitter"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		j, err := parseJitter(str)
+		if err != nil {
+			return nil, err
+		}
+		s.jitter = j
+	}
+
+	if v, ok := params["max_messages_per_second"]; ok {
+		r, err := data.ToFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		if r <= 0 {
+			return nil, errors.New("max_messages_per_second must be positive")
+		}
+		s.limiter = newRateLimiter(r)
+	}
+
+	dm, err := parseDiscardMonitor(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	s.discardMonitor = dm
+
+	if v, ok := params["drain_timeout"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d < 0 {
+			return nil, errors.New("drain_timeout must not be negative")
+		}
+		s.drainTimeout = d
+	}
 
-	// channel that will be written to when the
-	// connection is lost
-	disconnect chan bool
-}
+	if v, ok := params["idle_timeout"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, errors.New("idle_timeout must be positive")
+		}
+		s.idle = &idleWatchdog{
+			timeout: d,
+		}
+	}
 
-func (s *source) GenerateStream(ctx *core.Context, w core.Writer) error {
-	s.ctx = ctx
-	s.w = w
+	if v, ok := params["idle_action"]; ok {
+		if s.idle == nil {
+			return nil, errors.New("idle_action requires idle_timeout")
+		}
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		a, err := parseIdleAction(str)
+		if err != nil {
+			return nil, err
+		}
+		s.idle.action = a
+	}
+	if s.idle != nil && s.idle.action == idleReconnect && s.autoReconnect {
+		return nil, errors.New("idle_action must be \"alert\" when use_auto_reconnect is true")
+	}
 
-	s.disconnect = make(chan bool, 1)
+	if v, ok := params["envelope"]; ok {
+		e, err := data.AsBool(v)
+		if err != nil {
+			return nil, err
+		}
+		s.envelope = e
+	}
 
-	// define where and how to connect
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(s.broker)
-	if s.user != "" {
-		opts.Username = s.user
-		opts.Password = s.password
+	if v, ok := params["format"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		f, err := parseFormat(str)
+		if err != nil {
+			return nil, err
+		}
+		if f != blobFormat && s.envelope {
+			return nil, errors.New("format cannot be specified when envelope is true")
+		}
+		s.format = f
 	}
-	opts.OnConnectionLost = func(c mqtt.Client, e error) {
-		// write `true` to signal that the connection was not
-		// terminated on purpose and we should try to reconnect
-		ctx.Log().Info("Lost connection to MQTT broker")
-		s.disconnect <- true
+
+	cc, err := parseCSVConfig(params, s.format)
+	if err != nil {
+		return nil, err
 	}
-	opts.AutoReconnect = false
+	s.csv = cc
 
-	// NB. if we have just one client instance and create it here,
-	//     then the OnConnectionLost handler will only be called once;
-	//     therefore we create a new client for every reconnect
-	client := mqtt.NewClient(opts)
+	sp, err := parseSplitter(params)
+	if err != nil {
+		return nil, err
+	}
+	if sp != nil && s.envelope {
+		return nil, errors.New("split cannot be specified when envelope is true")
+	}
+	if sp != nil && s.csv != nil {
+		return nil, errors.New("split cannot be specified when format is \"csv\"")
+	}
+	s.split = sp
 
-	// define what to do with messages
-	msgHandler := func(c mqtt.Client, m mqtt.Message) {
-		t := core.NewTuple(data.Map{
-			"topic":   data.String(m.Topic()),
-			"payload": data.Blob(m.Payload()),
-		})
-		w.Write(ctx, t)
+	cv, err := parseConvention(params)
+	if err != nil {
+		return nil, err
+	}
+	if cv != nil && (s.envelope || s.format != blobFormat || s.split != nil) {
+		return nil, errors.New("convention cannot be specified with envelope, format, or split")
 	}
+	s.convention = cv
 
-	waitUntilReconnect := 0 * time.Second
-	retries := int64(0)
-	backoff := func() error {
-		// exponential backoff
-		if waitUntilReconnect == 0 {
-			waitUntilReconnect = s.minWait
-		} else {
-			waitUntilReconnect *= 2
+	if v, ok := params["charset"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		e, err := parseCharset(str)
+		if err != nil {
+			return nil, err
 		}
-		// truncate to maximum
-		if waitUntilReconnect > s.maxWait {
-			waitUntilReconnect = s.maxWait
+		if e != nil && s.envelope {
+			return nil, errors.New("charset cannot be specified when envelope is true")
 		}
+		s.charset = e
+	}
 
-		if s.reconnRetries >= 0 {
-			if retries > s.reconnRetries {
-				return errors.New("gave up to connect to MQTT broker")
-			}
-			retries++
+	if v, ok := params["decode_base64"]; ok {
+		b, err := data.AsBool(v)
+		if err != nil {
+			return nil, err
 		}
-		return nil
+		s.base64 = b
 	}
 
-	// connect in an endless loop
-ReconnectLoop:
-	for {
-		// we wait here the specified time between reconnects,
-		// but if Stop() (or another disconnect, but actually
-		// we should not be connected here) is called, return
-		// earlier
-		select {
-		case <-time.After(waitUntilReconnect):
-		case needsReconnect := <-s.disconnect:
-			if !needsReconnect {
-				break ReconnectLoop
-			}
+	if v, ok := params["empty_payload"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		e, err := parseEmptyPayload(str)
+		if err != nil {
+			return nil, err
 		}
+		s.empty = e
+	}
 
-		// try to connect
-		ctx.Log().WithField("broker", s.broker).Info("Connecting to MQTT broker")
-		if connTok := client.Connect(); connTok.WaitTimeout(10*time.Second) && connTok.Error() != nil {
-			if err := backoff(); err != nil {
-				return err
-			}
-			ctx.ErrLog(connTok.Error()).WithField("waitUntilReconnect", waitUntilReconnect).
-				Info("Failed to connect to MQTT broker")
-			continue
+	dd, err := parseDeduplicator(params)
+	if err != nil {
+		return nil, err
+	}
+	if dd != nil && dd.key == dedupByMessageID && s.topics.qos == 0 {
+		// the broker doesn't redeliver QoS 0 messages
+		return nil, errors.New("\"message_id\" dedup_key requires qos to be 1 or 2")
+	}
+	s.dedup = dd
+
+	if v, ok := params["max_payload_bytes"]; ok {
+		n, err := data.AsInt(v)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errors.New("max_payload_bytes must not be negative")
+		}
+		s.maxPayloadBytes = int(n)
+	}
+	if v, ok := params["payload_size_policy"]; ok {
+		if s.maxPayloadBytes == 0 {
+			return nil, errors.New("payload_size_policy requires max_payload_bytes")
+		}
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		p, err := parseSizePolicy(str)
+		if err != nil {
+			return nil, err
 		}
+		s.sizePolicy = p
+	}
 
-		// subscribe to topic
-		if subTok := client.Subscribe(s.topic, 0, msgHandler); subTok.WaitTimeout(10*time.Second) && subTok.Error() != nil {
-			if err := backoff(); err != nil {
-				return err
-			}
-			ctx.ErrLog(subTok.Error()).WithField("topic", s.topic).
-				Info("Failed to subscribe to topic")
-			// create a new client object for the next try
-			client.Disconnect(0)
-			client = mqtt.NewClient(opts)
-			continue
+	if v, ok := params["coercions"]; ok {
+		if s.format == blobFormat && !s.envelope {
+			return nil, errors.New("coercions requires format or envelope")
+		}
+		c, err := parseCoercions(v)
+		if err != nil {
+			return nil, err
 		}
+		s.coercions = c
+	}
 
-		// once we succeeded, we reset the reconnect and retry counters
-		waitUntilReconnect = 0 * time.Second
-		retries = 0
+	if v, ok := params["conversions"]; ok {
+		if s.format == blobFormat && !s.envelope {
+			return nil, errors.New("conversions requires format or envelope")
+		}
+		c, err := parseConversions(v)
+		if err != nil {
+			return nil, err
+		}
+		s.conversions = c
+	}
 
-		// here we wait until the handler in OnConnectionLost
-		// or Stop() pushes something into the `disconnect` channel
-		needsReconnect := <-s.disconnect
-		if !needsReconnect {
-			// if needsReconnect is false, then Stop()
-			// was called before, so we need to do a graceful
-			// shutdown
-			client.Disconnect(250)
-			break
+	if v, ok := params["normalize_location"]; ok {
+		b, err := data.AsBool(v)
+		if err != nil {
+			return nil, err
 		}
-		// create a new client object for the next try
-		client = mqtt.NewClient(opts)
+		if b && s.format == blobFormat && !s.envelope {
+			return nil, errors.New("normalize_location requires format or envelope")
+		}
+		s.normalizeLocation = b
 	}
 
-	return nil
-}
+	if v, ok := params["filter"]; ok {
+		if s.format == blobFormat && !s.envelope {
+			return nil, errors.New("filter requires format or envelope")
+		}
+		f, err := parseFilter(v)
+		if err != nil {
+			return nil, err
+		}
+		s.filter = f
+	}
 
-func (s *source) Stop(ctx *core.Context) error {
-	// write `false` to signal that we should not try to reconnect
-	s.disconnect <- false
+	buf, err := parseBufferParams(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	s.buffer = buf
 
-	return nil
-}
+	if v, ok := params["message_order"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		o, err := parseMessageOrder(str)
+		if err != nil {
+			return nil, err
+		}
+		s.order = o
+	}
+	if s.order == serializedMessages && s.buffer.size == 0 {
+		// messages are never dropped to keep them all in order
+		s.buffer.size = serializedBufferSize
+		s.buffer.policy = block
+	}
 
-// NewSource create a new Source receiving data from a MQTT broker. The source
-// emits tuples like;
-//
-//	{
-//		"topic": "foo/bar",
-//		"payload": <blob>
-//	}
-//
-// The topic field has topic of the message and the payload field has data
-// as a blob. If the data contains JSON and a user wants to manipulate it,
-// another stream needs to be created:
-//
-//	CREATE STREAM hoge AS
-//	  SELECT RSTREAM decode_json(payload) AS * FROM mqtt_src [RANGE 1 TUPLES];
-//
-// The source has following required parameters:
-//
-//	* topic: the topic to be subscribed
-//
-// The source has following optional parameters:
-//
-//	* broker: the address of the broker in URI scheme://"host:port" format (default: "tcp://127.0.0.1:1883")
-//	* user: the user name to be connected (default: "")
-//	* password: the password of the user (default: "")
-//	* reconnect_min_time: minimal time to wait before reconnecting in Go duration format (default: 1s)
-//	* reconnect_max_time: maximal time to wait before reconnecting in Go duration format (default: 30s)
-func NewSource(ctx *core.Context, ioParams *bql.IOParams, params data.Map) (core.Source, error) {
-	s := &source{
-		broker:        "tcp://127.0.0.1:1883",
-		user:          "",
-		password:      "",
-		minWait:       1 * time.Second,
-		maxWait:       30 * time.Second,
-		reconnRetries: -1,
+	if v, ok := params["ack_after_write"]; ok {
+		b, err := data.AsBool(v)
+		if err != nil {
+			return nil, err
+		}
+		if b && s.topics.qos == 0 {
+			// the broker doesn't wait for acknowledgments of QoS 0 messages
+			return nil, errors.New("ack_after_write requires qos to be 1 or 2")
+		}
+		if b && s.buffer.size > 0 && s.buffer.policy != block {
+			// messages dropped from the queue would never be acknowledged
+			return nil, errors.New("ack_after_write requires the \"block\" buffer_policy when buffer_size is given")
+		}
+		s.ackAfterWrite = b
 	}
 
-	{ // This block is to suppress a golint warning.
-		v, ok := params["topic"]
-		if !ok {
-			return nil, errors.New("topic parameter is missing")
+	if v, ok := params["protocol_version"]; ok {
+		pv, err := parseProtocolVersion(v)
+		if err != nil {
+			return nil, err
 		}
-		t, err := data.AsString(v)
+		if pv == 5 {
+			if s.autoReconnect {
+				return nil, errors.New("protocol_version 5 cannot be used with use_auto_reconnect")
+			}
+			if s.buffer.size > 0 && s.buffer.policy == spill {
+				// properties of messages aren't written to spill files
+				return nil, errors.New("protocol_version 5 cannot be used with the spill buffer policy")
+			}
+		}
+		s.protocolVersion = pv
+	}
+	if s.authenticator != nil && s.protocolVersion != 5 {
+		return nil, errors.New("auth_method requires protocol_version 5")
+	}
+
+	if v, ok := params["protocol_downgrade"]; ok {
+		b, err := data.AsBool(v)
 		if err != nil {
 			return nil, err
 		}
-		s.topic = t
+		s.downgrade = b
+	}
+
+	subOpts, given, err := parseV5SubscribeOptions(params)
+	if err != nil {
+		return nil, err
+	}
+	if given && s.protocolVersion != 5 {
+		return nil, errors.New("no_local, retain_as_published, and retain_handling require protocol_version 5")
+	}
+	s.subscribeOptions = subOpts
+
+	if v, ok := params["subscription_identifiers"]; ok {
+		b, err := data.AsBool(v)
+		if err != nil {
+			return nil, err
+		}
+		if b && s.protocolVersion != 5 {
+			return nil, errors.New("subscription_identifiers requires protocol_version 5")
+		}
+		s.subscriptionIDs = b
+	}
+
+	if s.protocolVersion == 5 {
+		s.redirect = &v5Redirect{}
+	}
+	if v, ok := params["follow_redirects"]; ok {
+		b, err := data.AsBool(v)
+		if err != nil {
+			return nil, err
+		}
+		if s.protocolVersion != 5 {
+			return nil, errors.New("follow_redirects requires protocol_version 5")
+		}
+		if !b {
+			s.redirect = nil
+		}
+	}
+
+	acks, err := parseAckBatcher(params)
+	if err != nil {
+		return nil, err
 	}
+	if acks != nil && !s.ackAfterWrite {
+		return nil, errors.New("ack_batch_size requires ack_after_write")
+	}
+	s.acks = acks
 
-	if v, ok := params["broker"]; ok {
-		b, err := data.AsString(v)
+	if v, ok := params["max_inflight"]; ok {
+		n, err := data.AsInt(v)
 		if err != nil {
 			return nil, err
 		}
-		s.broker, err = adjustOldBrokerURL(b)
+		if n < 0 {
+			return nil, errors.New("max_inflight must not be negative")
+		}
+		if n > 0 && s.order != parallelMessages {
+			return nil, errors.New("max_inflight requires \"parallel\" message_order")
+		}
+		if n > 0 && s.protocolVersion == 5 && s.topics.qos == 0 {
+			ctx.Log().WithField("max_inflight", n).
+				Warn("max_inflight isn't sent as Receive Maximum since the broker doesn't limit QoS 0 messages")
+		}
+		s.maxInflight = int(n)
+	}
+
+	bc, err := parseBatchConfig(params)
+	if err != nil {
+		return nil, err
+	}
+	if bc != nil && s.ackAfterWrite {
+		// tuples are only added to a batch, which may fail to be written
+		// after the messages have been acknowledged
+		return nil, errors.New("ack_after_write cannot be used with batch_size")
+	}
+	s.batch = bc
+
+	if v, ok := params["decode_workers"]; ok {
+		n, err := data.AsInt(v)
 		if err != nil {
 			return nil, err
 		}
+		if n < 0 {
+			return nil, errors.New("decode_workers must not be negative")
+		}
+		s.decodeWorkers = int(n)
+	}
+
+	p, err := parsePresence(params)
+	if err != nil {
+		return nil, err
+	}
+	if p != nil && p.willProperties != nil && s.protocolVersion != 5 {
+		return nil, errors.New("will_delay_interval and will_user_properties require protocol_version 5")
+	}
+	s.presence = p
+
+	r, err := parseStatusReporter(params)
+	if err != nil {
+		return nil, err
+	}
+	s.reporter = r
+
+	dl, err := parseDeadLetter(params)
+	if err != nil {
+		return nil, err
+	}
+	s.deadLetter = dl
+
+	ts, err := parseTopicStats(params)
+	if err != nil {
+		return nil, err
 	}
+	s.topicStats = ts
 
-	if v, ok := params["user"]; ok {
-		u, err := data.AsString(v)
+	if v, ok := params["annotate_broker"]; ok {
+		b, err := data.AsBool(v)
 		if err != nil {
 			return nil, err
 		}
-		s.user = u
+		s.annotateBroker = b
 	}
 
-	if v, ok := params["password"]; ok {
-		p, err := data.AsString(v)
+	if v, ok := params["router"]; ok {
+		name, err := data.AsString(v)
 		if err != nil {
 			return nil, err
 		}
-		s.password = p
+		r, err := lookupRouter(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		s.router = r
 	}
 
-	if v, ok := params["reconnect_min_time"]; ok {
-		d, err := data.ToDuration(v)
+	sb, err := parseStandby(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	s.standby = sb
+
+	if v, ok := params["system_topics"]; ok {
+		str, err := data.AsString(v)
 		if err != nil {
 			return nil, err
 		}
-		s.minWait = d
+		p, err := parseSystemTopicPolicy(str)
+		if err != nil {
+			return nil, err
+		}
+		if p == routeSystemTopics && s.router == nil {
+			return nil, errors.New("system_topics \"route\" requires router")
+		}
+		if _, ok := s.convention.(*brokerMetrics); ok && p != emitSystemTopics {
+			return nil, errors.New("convention \"broker_metrics\" requires system_topics to be \"emit\"")
+		}
+		s.systemTopics = p
 	}
 
-	if v, ok := params["reconnect_max_time"]; ok {
-		d, err := data.ToDuration(v)
+	if v, ok := params["decode_error_policy"]; ok {
+		str, err := data.AsString(v)
 		if err != nil {
 			return nil, err
 		}
-		s.maxWait = d
+		p, err := parseDecodeErrorPolicy(str)
+		if err != nil {
+			return nil, err
+		}
+		s.decodeErrorPolicy = p
 	}
 
-	return core.ImplementSourceStop(s), nil
+	if v, ok := params["decode_error_route"]; ok {
+		if s.decodeErrorPolicy != routeDecodeErrors {
+			return nil, errors.New("decode_error_route requires decode_error_policy to be \"route\"")
+		}
+		name, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		if s.router == nil {
+			return nil, errors.New("decode_error_route requires router")
+		}
+		if !s.router.has(name) {
+			return nil, fmt.Errorf("route '%v' isn't defined in the router", name)
+		}
+		s.decodeErrorRoute = name
+	} else if s.decodeErrorPolicy == routeDecodeErrors {
+		return nil, errors.New("decode_error_policy \"route\" requires decode_error_route")
+	}
+
+	// compression is created at last because it needs to be closed on errors
+	comp, err := newCompression(params)
+	if err != nil {
+		return nil, err
+	}
+	s.compression = comp
+
+	return s, nil
 }
 
 func adjustOldBrokerURL(urlStr string) (string, error) {
@@ -259,6 +2131,12 @@ func adjustOldBrokerURL(urlStr string) (string, error) {
 	if u.Scheme == "" { // hostname only
 		return "tcp://" + urlStr + ":1883", nil
 	}
+	if u.Scheme == "unix" { // unix:///path/to/socket has a path instead of a host
+		if u.Host == "" && u.Path == "" {
+			return "", errors.New("invalid broker URL")
+		}
+		return urlStr, nil
+	}
 	if u.Opaque == "" { // scheme://host:port format
 		if u.Host == "" { // reject invalid "host:" (no port number given) format
 			return "", errors.New("invalid broker URL")
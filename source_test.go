@@ -1,7 +1,16 @@
 package mqtt
 
 import (
+	"errors"
+	"regexp"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
 )
 
 func TestAdjustOldBrokerURL(t *testing.T) {
@@ -17,6 +26,9 @@ func TestAdjustOldBrokerURL(t *testing.T) {
 		{"host:1234", "tcp://host:1234", false},
 		{"host:", "", true},
 		{":1234", "", true},
+		{"unix:///var/run/mosquitto.sock", "", false},
+		{"unix://mosquitto.sock", "", false},
+		{"unix://", "", true},
 	}
 
 	for _, c := range cases {
@@ -37,3 +49,223 @@ func TestAdjustOldBrokerURL(t *testing.T) {
 		}
 	}
 }
+
+func TestSourceDrain(t *testing.T) {
+	ctx := core.NewContext(nil)
+	s := &source{drainTimeout: time.Second}
+
+	atomic.AddInt64(&s.inflight, 1)
+	var released int32
+	done := make(chan struct{})
+	go func() {
+		s.drain(ctx)
+		if atomic.LoadInt32(&released) == 0 {
+			t.Error("drain should wait until the handler finishes")
+		}
+		close(done)
+	}()
+	atomic.StoreInt32(&released, 1)
+	atomic.AddInt64(&s.inflight, -1)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain should return when the handler finishes")
+	}
+
+	// The drain gives up after the timeout.
+	s.drainTimeout = 50 * time.Millisecond
+	atomic.AddInt64(&s.inflight, 1)
+	start := time.Now()
+	s.drain(ctx)
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("drain should give up after the timeout: %v", d)
+	}
+}
+
+func TestParseMessageOrder(t *testing.T) {
+	cases := map[string]messageOrder{
+		"ordered":    orderedMessages,
+		"parallel":   parallelMessages,
+		"serialized": serializedMessages,
+	}
+	for str, expected := range cases {
+		o, err := parseMessageOrder(str)
+		if err != nil {
+			t.Errorf("%v: %v", str, err)
+		} else if o != expected {
+			t.Errorf("%v: expected %v, actual %v", str, expected, o)
+		}
+	}
+	if _, err := parseMessageOrder("random"); err == nil {
+		t.Error("an unknown order should be rejected")
+	}
+}
+
+func TestLimitInflight(t *testing.T) {
+	var running, max int64
+	release := make(chan struct{})
+	h := limitInflight(func(mqtt.Client, mqtt.Message) {
+		n := atomic.AddInt64(&running, 1)
+		for {
+			m := atomic.LoadInt64(&max)
+			if n <= m || atomic.CompareAndSwapInt64(&max, m, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt64(&running, -1)
+	}, 2)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			h(nil, nil)
+		}
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("the handler should block when the limit is reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-done
+	if m := atomic.LoadInt64(&max); m > 2 {
+		t.Errorf("too many messages were handled at once: %v", m)
+	}
+}
+
+func TestSourceAcknowledgesAfterWrite(t *testing.T) {
+	ctx := core.NewContext(nil)
+	s := &source{}
+
+	acked := 0
+	m := &message{topic: "a", payload: []byte("1"), ack: func() { acked++ }}
+	failing := core.WriterFunc(func(*core.Context, *core.Tuple) error {
+		return errors.New("cannot write")
+	})
+	s.write(ctx, failing, m)
+	if acked != 0 {
+		t.Error("the message shouldn't be acknowledged when the tuple isn't written")
+	}
+
+	s.write(ctx, &testWriter{}, m)
+	if acked != 1 {
+		t.Error("the message should be acknowledged after the tuple is written")
+	}
+
+	// messages which cannot be decoded are never written
+	s.emit(ctx, &testWriter{}, m, nil, errors.New("cannot decode"))
+	if acked != 2 {
+		t.Error("the message should be acknowledged when it cannot be decoded")
+	}
+}
+
+func TestSourceTopicRegex(t *testing.T) {
+	s := &source{topicRegex: regexp.MustCompile("^sensors/(room|hall)-[0-9]+/")}
+	cases := map[string]bool{
+		"sensors/room-1/temperature":  true,
+		"sensors/hall-20/temperature": true,
+		"sensors/roof/temperature":    false,
+		"x/sensors/room-1/":           false,
+	}
+	for topic, expected := range cases {
+		if actual := s.matchesTopicRegex(topic); actual != expected {
+			t.Errorf("%v: expected %v, actual %v", topic, expected, actual)
+		}
+	}
+
+	if !(&source{}).matchesTopicRegex("any") {
+		t.Error("all topics should match when topic_regex isn't given")
+	}
+
+	_, err := NewSource(core.NewContext(nil), &bql.IOParams{}, data.Map{
+		"topic":       data.String("a"),
+		"topic_regex": data.String("("),
+	})
+	if err == nil {
+		t.Error("an invalid regular expression should be rejected")
+	}
+}
+
+func TestSourceSplitLines(t *testing.T) {
+	ctx := core.NewContext(nil)
+	s := &source{format: jsonFormat, split: &splitter{mode: splitLines}, annotateBroker: true}
+
+	acked := 0
+	m := &message{
+		topic:   "gateway",
+		payload: []byte("{\"a\":1}\r\n\n{\"a\":2}\nbroken\n{\"a\":3}\n"),
+		broker:  "tcp://localhost:1883",
+		ack:     func() { acked++ },
+	}
+	w := &testWriter{}
+	s.write(ctx, w, m)
+	if len(w.tuples) != 3 {
+		t.Fatalf("each valid line should be emitted as a tuple: %v", len(w.tuples))
+	}
+	for i, tu := range w.tuples {
+		expected := data.Map{
+			"topic":                 data.String("gateway"),
+			"payload":               data.Map{"a": data.Int(i + 1)},
+			"broker":                data.String("tcp://localhost:1883"),
+			"connection_generation": data.Int(0),
+		}
+		if !data.Equal(expected, tu.Data) {
+			t.Errorf("expected %v, actual %v", expected, tu.Data)
+		}
+	}
+	if acked != 1 {
+		t.Errorf("the message should be acknowledged once: %v", acked)
+	}
+}
+
+// BenchmarkSourceWrite measures the cost of converting a message to a tuple
+// and writing it. Tuples and their data aren't pooled since the topology owns
+// them once they're written, so most allocations left are the ones of the
+// tuple.
+func BenchmarkSourceWrite(b *testing.B) {
+	ctx := core.NewContext(nil)
+	w := core.WriterFunc(func(*core.Context, *core.Tuple) error {
+		return nil
+	})
+	for _, c := range []struct {
+		name   string
+		format payloadFormat
+	}{
+		{"blob", blobFormat},
+		{"json", jsonFormat},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			s := &source{format: c.format}
+			payload := []byte(`{"temperature":21.5,"humidity":40}`)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.write(ctx, w, &message{
+					topic:   "sensors/1/climate",
+					payload: payload,
+				})
+			}
+		})
+	}
+}
+
+func TestConnectionInfoState(t *testing.T) {
+	c := &connectionInfo{}
+	if connected, n := c.state(); connected || n != 0 {
+		t.Errorf("wrong initial state: %v, %v", connected, n)
+	}
+	for i := 0; i < 3; i++ {
+		c.attempt("tcp://localhost:1883")
+		c.connected()
+		if connected, n := c.state(); !connected || n != int64(i) {
+			t.Errorf("%v: wrong state: %v, %v", i, connected, n)
+		}
+		c.disconnected()
+	}
+	if connected, _ := c.state(); connected {
+		t.Error("the connection should be lost")
+	}
+}
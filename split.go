@@ -0,0 +1,161 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// splitMode is how a message is split into records.
+type splitMode int
+
+const (
+	// splitLines splits a payload into newline-delimited records.
+	splitLines splitMode = iota + 1
+
+	// splitLengthPrefixed splits a payload into concatenated binary records,
+	// each of which is preceded by its length.
+	splitLengthPrefixed
+)
+
+// splitter splits a payload having multiple records so that each of them is
+// emitted as a tuple.
+type splitter struct {
+	mode splitMode
+
+	// prefixSize is the size of length prefixes in bytes, and order is their
+	// byte order. They're used by splitLengthPrefixed.
+	prefixSize int
+	order      binary.ByteOrder
+}
+
+// parseSplitter parses split, length_prefix_size, and
+// length_prefix_byte_order parameters. It returns nil when split isn't given
+// or "none".
+func parseSplitter(params data.Map) (*splitter, error) {
+	sp := &splitter{
+		prefixSize: 4,
+		order:      binary.BigEndian,
+	}
+	if v, ok := params["split"]; ok {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		switch str {
+		case "lines":
+			sp.mode = splitLines
+		case "length_prefixed":
+			sp.mode = splitLengthPrefixed
+		case "none":
+		default:
+			return nil, fmt.Errorf("unknown split: %v", str)
+		}
+	}
+
+	if v, ok := params["length_prefix_size"]; ok {
+		if sp.mode != splitLengthPrefixed {
+			return nil, errors.New("length_prefix_size requires split to be \"length_prefixed\"")
+		}
+		n, err := data.AsInt(v)
+		if err != nil {
+			return nil, err
+		}
+		switch n {
+		case 1, 2, 4:
+		default:
+			return nil, errors.New("length_prefix_size must be 1, 2, or 4")
+		}
+		sp.prefixSize = int(n)
+	}
+
+	if v, ok := params["length_prefix_byte_order"]; ok {
+		if sp.mode != splitLengthPrefixed {
+			return nil, errors.New("length_prefix_byte_order requires split to be \"length_prefixed\"")
+		}
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		switch str {
+		case "big":
+			sp.order = binary.BigEndian
+		case "little":
+			sp.order = binary.LittleEndian
+		default:
+			return nil, fmt.Errorf("unknown length_prefix_byte_order: %v", str)
+		}
+	}
+
+	if sp.mode == 0 {
+		return nil, nil
+	}
+	return sp, nil
+}
+
+func (sp *splitter) String() string {
+	switch sp.mode {
+	case splitLines:
+		return "lines"
+	case splitLengthPrefixed:
+		return "length_prefixed"
+	default:
+		return "none"
+	}
+}
+
+// config adds parameters of the splitter to c.
+func (sp *splitter) config(c data.Map) {
+	c["split"] = data.String(sp.String())
+	if sp.mode != splitLengthPrefixed {
+		return
+	}
+	c["length_prefix_size"] = data.Int(sp.prefixSize)
+	if sp.order == binary.LittleEndian {
+		c["length_prefix_byte_order"] = data.String("little")
+	} else {
+		c["length_prefix_byte_order"] = data.String("big")
+	}
+}
+
+// split returns records in the payload. When the payload is malformed, it
+// returns records before the malformed part with an error.
+func (sp *splitter) split(b []byte) ([][]byte, error) {
+	if sp.mode == splitLines {
+		var records [][]byte
+		for _, l := range bytes.Split(b, []byte{'\n'}) {
+			l = bytes.TrimSuffix(l, []byte{'\r'})
+			if len(bytes.TrimSpace(l)) == 0 {
+				continue
+			}
+			records = append(records, l)
+		}
+		return records, nil
+	}
+
+	var records [][]byte
+	for len(b) > 0 {
+		if len(b) < sp.prefixSize {
+			return records, errors.New("the payload ends in the middle of a length prefix")
+		}
+		var n uint64
+		switch sp.prefixSize {
+		case 1:
+			n = uint64(b[0])
+		case 2:
+			n = uint64(sp.order.Uint16(b))
+		default:
+			n = uint64(sp.order.Uint32(b))
+		}
+		b = b[sp.prefixSize:]
+		if uint64(len(b)) < n {
+			return records, fmt.Errorf("the record has %v bytes but only %v bytes remain", n, len(b))
+		}
+		records = append(records, b[:n])
+		b = b[n:]
+	}
+	return records, nil
+}
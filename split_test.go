@@ -0,0 +1,92 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseSplitter(t *testing.T) {
+	for _, params := range []data.Map{
+		{},
+		{"split": data.String("none")},
+	} {
+		if sp, err := parseSplitter(params); err != nil || sp != nil {
+			t.Errorf("%v shouldn't create a splitter: %v, %v", params, sp, err)
+		}
+	}
+
+	for _, params := range []data.Map{
+		{"split": data.String("words")},
+		{"split": data.String("lines"), "length_prefix_size": data.Int(2)},
+		{"length_prefix_byte_order": data.String("little")},
+		{"split": data.String("length_prefixed"), "length_prefix_size": data.Int(3)},
+		{"split": data.String("length_prefixed"), "length_prefix_byte_order": data.String("middle")},
+	} {
+		if _, err := parseSplitter(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
+
+func TestSplitterLengthPrefixed(t *testing.T) {
+	cases := []struct {
+		params   data.Map
+		payload  []byte
+		expected []string
+		fail     bool
+	}{
+		{
+			data.Map{},
+			[]byte{0, 0, 0, 2, 'a', 'b', 0, 0, 0, 0, 0, 0, 0, 1, 'c'},
+			[]string{"ab", "", "c"},
+			false,
+		},
+		{
+			data.Map{"length_prefix_size": data.Int(1)},
+			[]byte{2, 'a', 'b', 1, 'c'},
+			[]string{"ab", "c"},
+			false,
+		},
+		{
+			data.Map{"length_prefix_size": data.Int(2), "length_prefix_byte_order": data.String("little")},
+			[]byte{2, 0, 'a', 'b', 1, 0, 'c'},
+			[]string{"ab", "c"},
+			false,
+		},
+		{
+			data.Map{"length_prefix_size": data.Int(1)},
+			[]byte{2, 'a', 'b', 3, 'c'},
+			[]string{"ab"},
+			true,
+		},
+		{
+			data.Map{"length_prefix_size": data.Int(2)},
+			[]byte{0, 1, 'a', 0},
+			[]string{"a"},
+			true,
+		},
+	}
+	for i, c := range cases {
+		c.params["split"] = data.String("length_prefixed")
+		sp, err := parseSplitter(c.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := sp.split(c.payload)
+		if c.fail && err == nil {
+			t.Errorf("%v: the malformed payload should be reported", i)
+		} else if !c.fail && err != nil {
+			t.Errorf("%v: %v", i, err)
+		}
+		if len(records) != len(c.expected) {
+			t.Errorf("%v: expected %v records, actual %v", i, len(c.expected), len(records))
+			continue
+		}
+		for j, r := range records {
+			if string(r) != c.expected[j] {
+				t.Errorf("%v: expected %q, actual %q", i, c.expected[j], r)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package mqtt
+
+import (
+	"errors"
+	"sync"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// standby makes a source a warm standby of the same source running on
+// another instance. The source keeps its connection and subscription while
+// it's on standby, but only emits tuples while this instance is the leader,
+// so that it's promoted as soon as the leader is lost. Recent messages
+// received on standby are emitted on promotion to fill the gap before the
+// promotion, which may duplicate messages the old leader emitted.
+type standby struct {
+	leader *Leader
+
+	// size is the maximum number of recent messages kept on standby.
+	size int
+
+	m      sync.Mutex
+	active bool
+	recent []*message
+}
+
+// parseStandby parses leader and standby_buffer parameters. It returns nil
+// when leader isn't given.
+func parseStandby(ctx *core.Context, params data.Map) (*standby, error) {
+	v, ok := params["leader"]
+	if !ok {
+		if _, ok := params["standby_buffer"]; ok {
+			return nil, errors.New("standby_buffer requires leader")
+		}
+		return nil, nil
+	}
+	name, err := data.AsString(v)
+	if err != nil {
+		return nil, err
+	}
+	l, err := lookupLeader(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &standby{
+		leader: l,
+	}
+	if v, ok := params["standby_buffer"]; ok {
+		n, err := data.AsInt(v)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errors.New("standby_buffer must not be negative")
+		}
+		s.size = int(n)
+	}
+	return s, nil
+}
+
+// admit returns true when the message should be emitted. It also returns
+// recent messages to be emitted before the message when this instance has
+// just been promoted.
+func (s *standby) admit(ctx *core.Context, m *message) ([]*message, bool) {
+	leader := s.leader.IsLeader()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if !leader {
+		if s.active {
+			s.active = false
+			ctx.Log().Info("The source is on standby since this instance isn't the leader")
+		}
+		if s.size > 0 {
+			if len(s.recent) == s.size {
+				copy(s.recent, s.recent[1:])
+				s.recent = s.recent[:s.size-1]
+			}
+			s.recent = append(s.recent, m)
+		}
+		return nil, false
+	}
+
+	if s.active {
+		return nil, true
+	}
+	s.active = true
+	replay := s.recent
+	s.recent = nil
+	ctx.Log().WithField("replayed", len(replay)).Info("The source is promoted since this instance is the leader")
+	return replay, true
+}
@@ -0,0 +1,42 @@
+package mqtt
+
+import (
+	"fmt"
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+)
+
+func TestStandby(t *testing.T) {
+	ctx := core.NewContext(nil)
+	l := newTestLeader("me", &testClient{
+		connect: []*testToken{{}},
+	})
+	s := &standby{
+		leader: l,
+		size:   2,
+	}
+
+	// Another instance is the leader.
+	l.update("other")
+	for i := 0; i < 3; i++ {
+		if replay, ok := s.admit(ctx, &message{topic: fmt.Sprint(i)}); ok || len(replay) != 0 {
+			t.Errorf("messages shouldn't be emitted on standby: %v, %v", replay, ok)
+		}
+	}
+
+	// The leader has gone and this instance is promoted.
+	l.update("")
+	waitClaim(t, l)
+	l.update("me")
+	replay, ok := s.admit(ctx, &message{topic: "3"})
+	if !ok {
+		t.Error("the message should be emitted after promotion")
+	}
+	if len(replay) != 2 || replay[0].topic != "1" || replay[1].topic != "2" {
+		t.Errorf("recent messages should be replayed: %v", replay)
+	}
+	if replay, ok := s.admit(ctx, &message{topic: "4"}); !ok || len(replay) != 0 {
+		t.Errorf("messages should be emitted without replay: %v, %v", replay, ok)
+	}
+}
@@ -0,0 +1,154 @@
+package mqtt
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// statusClient is a client to which a status reporter publishes statuses.
+type statusClient interface {
+	publisher
+	IsConnected() bool
+}
+
+// statusReporter periodically publishes the status of a source or a sink to
+// the broker as a retained message so that dashboards watching the broker can
+// monitor SensorBee nodes.
+type statusReporter struct {
+	topic    string
+	qos      byte
+	interval time.Duration
+
+	// kind is "source" or "sink", and name is the name of the source or the
+	// sink in the topology.
+	kind string
+	name string
+
+	// status returns the current status.
+	status func() data.Map
+
+	m      sync.Mutex
+	client statusClient
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// parseStatusReporter parses status_topic, status_interval, and status_qos
+// parameters. It returns nil when status_topic isn't given.
+func parseStatusReporter(params data.Map) (*statusReporter, error) {
+	v, ok := params["status_topic"]
+	if !ok {
+		for _, k := range []string{"status_interval", "status_qos"} {
+			if _, ok := params[k]; ok {
+				return nil, errors.New(k + " requires status_topic")
+			}
+		}
+		return nil, nil
+	}
+
+	r := &statusReporter{
+		interval: time.Minute,
+	}
+	t, err := data.AsString(v)
+	if err != nil {
+		return nil, err
+	}
+	if t == "" {
+		return nil, errors.New("status_topic must not be empty")
+	}
+	r.topic = t
+
+	if v, ok := params["status_interval"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, errors.New("status_interval must be positive")
+		}
+		r.interval = d
+	}
+
+	if v, ok := params["status_qos"]; ok {
+		q, err := data.AsInt(v)
+		if err != nil {
+			return nil, err
+		}
+		if q < 0 || q > 2 {
+			return nil, errors.New("status_qos must be 0, 1, or 2")
+		}
+		r.qos = byte(q)
+	}
+	return r, nil
+}
+
+// start starts publishing statuses returned by status at the interval. The
+// reporter must be closed to stop it.
+func (r *statusReporter) start(ctx *core.Context, kind, name string, status func() data.Map) {
+	r.kind = kind
+	r.name = name
+	r.status = status
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.run(ctx)
+}
+
+func (r *statusReporter) run(ctx *core.Context) {
+	defer close(r.done)
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+			r.m.Lock()
+			c := r.client
+			r.m.Unlock()
+			if c != nil && c.IsConnected() {
+				r.publish(ctx, c)
+			}
+		}
+	}
+}
+
+// attach sets the client to which statuses are published and publishes the
+// current status. It's called whenever a client connects to the broker.
+func (r *statusReporter) attach(ctx *core.Context, c statusClient) {
+	r.m.Lock()
+	r.client = c
+	r.m.Unlock()
+	r.publish(ctx, c)
+}
+
+func (r *statusReporter) publish(ctx *core.Context, c publisher) {
+	payload := data.Map{
+		"type":      data.String(r.kind),
+		"name":      data.String(r.name),
+		"timestamp": data.Timestamp(time.Now()),
+		"status":    r.status(),
+	}
+	b, err := (*jsonEncoding)(nil).marshal(payload)
+	if err != nil {
+		ctx.ErrLog(err).Error("Cannot encode the status")
+		return
+	}
+	if err := waitToken(c.Publish(r.topic, r.qos, true, b), 10*time.Second); err != nil {
+		ctx.ErrLog(err).WithField("topic", r.topic).Warn("Cannot publish the status")
+	}
+}
+
+// close stops publishing statuses. It does nothing when the reporter hasn't
+// been started.
+func (r *statusReporter) close() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+}
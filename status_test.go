@@ -0,0 +1,95 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// statusRecorder is a connected client recording published messages.
+type statusRecorder struct {
+	m sync.Mutex
+	publishRecorder
+}
+
+func (r *statusRecorder) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.publishRecorder.Publish(topic, qos, retained, payload)
+}
+
+func (r *statusRecorder) IsConnected() bool {
+	return true
+}
+
+func (r *statusRecorder) published() []*message {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]*message(nil), r.msgs...)
+}
+
+func TestParseStatusReporter(t *testing.T) {
+	if r, err := parseStatusReporter(data.Map{}); err != nil || r != nil {
+		t.Errorf("the reporter shouldn't be created without status_topic: %v, %v", r, err)
+	}
+
+	for _, params := range []data.Map{
+		{"status_interval": data.String("1s")},
+		{"status_qos": data.Int(1)},
+		{"status_topic": data.String("")},
+		{"status_topic": data.String("a"), "status_interval": data.String("0s")},
+		{"status_topic": data.String("a"), "status_qos": data.Int(3)},
+	} {
+		if _, err := parseStatusReporter(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
+
+func TestStatusReporter(t *testing.T) {
+	r, err := parseStatusReporter(data.Map{
+		"status_topic":    data.String("sensorbee/node1/mqtt_src/status"),
+		"status_interval": data.String("10ms"),
+		"status_qos":      data.Int(1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := core.NewContext(nil)
+	c := &statusRecorder{}
+	r.start(ctx, "source", "mqtt_src", func() data.Map {
+		return data.Map{"buffered": data.Int(3)}
+	})
+	r.attach(ctx, c)
+	deadline := time.Now().Add(time.Second)
+	for len(c.published()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	r.close()
+
+	msgs := c.published()
+	if len(msgs) < 3 {
+		t.Fatalf("the status should be published periodically: %v", len(msgs))
+	}
+	m := msgs[0]
+	if m.topic != "sensorbee/node1/mqtt_src/status" || m.qos != 1 || !m.retained {
+		t.Errorf("wrong status message: %v, %v, %v", m.topic, m.qos, m.retained)
+	}
+	var st struct {
+		Type   string
+		Name   string
+		Status map[string]int
+	}
+	if err := json.Unmarshal(m.payload, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Type != "source" || st.Name != "mqtt_src" || st.Status["buffered"] != 3 {
+		t.Errorf("wrong status: %v", string(m.payload))
+	}
+}
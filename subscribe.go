@@ -0,0 +1,76 @@
+package mqtt
+
+import (
+	"errors"
+
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/bql/udf"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// subscribeUDSF is a UDSF without input streams. It generates a stream of
+// the MQTT source subscribing to the topic.
+type subscribeUDSF struct {
+	src core.Source
+}
+
+// GenerateStream emits tuples of the source until Terminate is called.
+func (u *subscribeUDSF) GenerateStream(ctx *core.Context, w core.Writer) error {
+	return u.src.GenerateStream(ctx, w)
+}
+
+func (u *subscribeUDSF) Process(ctx *core.Context, t *core.Tuple, w core.Writer) error {
+	return errors.New("mqtt_subscribe doesn't have input streams")
+}
+
+func (u *subscribeUDSF) Stop(ctx *core.Context) error {
+	return u.src.Stop(ctx)
+}
+
+func (u *subscribeUDSF) Terminate(ctx *core.Context) error {
+	return u.src.Stop(ctx)
+}
+
+type subscribeUDSFCreator struct{}
+
+func (subscribeUDSFCreator) CreateUDSF(ctx *core.Context, decl udf.UDSFDeclarer, args ...data.Value) (udf.UDSF, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return nil, errors.New("mqtt_subscribe takes a broker, a topic, and optional parameters")
+	}
+	params := data.Map{}
+	if len(args) == 3 {
+		m, err := data.AsMap(args[2])
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range m {
+			params[k] = v
+		}
+	}
+	params["broker"] = args[0]
+	params["topic"] = args[1]
+
+	src, err := NewSource(ctx, &bql.IOParams{TypeName: "mqtt", Name: "mqtt_subscribe"}, params)
+	if err != nil {
+		return nil, err
+	}
+	return &subscribeUDSF{src: src}, nil
+}
+
+func (subscribeUDSFCreator) Accept(arity int) bool {
+	return arity == 2 || arity == 3
+}
+
+// NewSubscribeUDSFCreator returns the creator of the mqtt_subscribe UDSF. The
+// UDSF taps a topic for exploratory queries without CREATE SOURCE:
+//
+//	SELECT RSTREAM * FROM mqtt_subscribe("tcp://localhost:1883", "sensors/#")
+//	  [RANGE 1 TUPLES];
+//
+// It takes the broker, the topic, and an optional map of other parameters of
+// the MQTT source such as {"format": "json"}. It emits the same tuples as the
+// source and unsubscribes when the statement is dropped.
+func NewSubscribeUDSFCreator() udf.UDSFCreator {
+	return subscribeUDSFCreator{}
+}
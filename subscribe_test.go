@@ -0,0 +1,73 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestSubscribeUDSF(t *testing.T) {
+	b := newFakeV5Broker(t, &packets.Publish{
+		Topic:      "sensors/a",
+		Payload:    []byte(`{"v":1}`),
+		Properties: &packets.Properties{},
+	})
+	defer b.l.Close()
+
+	ctx := core.NewContext(nil)
+	c := NewSubscribeUDSFCreator()
+	for _, arity := range []int{0, 1, 4} {
+		if c.Accept(arity) {
+			t.Errorf("arity %v shouldn't be accepted", arity)
+		}
+	}
+	if _, err := c.CreateUDSF(ctx, nil, data.String(b.url()), data.String("sensors/#"), data.String("json")); err == nil {
+		t.Error("parameters other than a map should be rejected")
+	}
+	u, err := c.CreateUDSF(ctx, nil, data.String(b.url()), data.String("sensors/#"), data.Map{
+		"format":           data.String("json"),
+		"protocol_version": data.String("5"),
+		"topic":            data.String("ignored"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := u.(*subscribeUDSF)
+
+	tuples := make(chan *core.Tuple, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- gen.GenerateStream(ctx, core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+			tuples <- t
+			return nil
+		}))
+	}()
+
+	sub := b.next(t, packets.SUBSCRIBE).Content.(*packets.Subscribe)
+	if len(sub.Subscriptions) != 1 || sub.Subscriptions[0].Topic != "sensors/#" {
+		t.Errorf("wrong subscription: %v", sub)
+	}
+	select {
+	case tu := <-tuples:
+		expected := data.Map{
+			"topic":   data.String("sensors/a"),
+			"payload": data.Map{"v": data.Int(1)},
+		}
+		if !data.Equal(expected, tu.Data) {
+			t.Errorf("expected %v, actual %v", expected, tu.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message wasn't emitted")
+	}
+
+	if err := u.Terminate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	b.next(t, packets.UNSUBSCRIBE)
+}
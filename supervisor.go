@@ -0,0 +1,337 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+)
+
+// errTokenTimeout is returned when an operation on a client doesn't complete
+// in time.
+var errTokenTimeout = errors.New("the operation timed out")
+
+// waitToken waits for the token to complete. Unlike checking
+// tok.WaitTimeout(d) && tok.Error() != nil, a timeout is treated as a
+// failure.
+func waitToken(tok mqtt.Token, d time.Duration) error {
+	if !tok.WaitTimeout(d) {
+		return errTokenTimeout
+	}
+	return tok.Error()
+}
+
+// connState is a state of a supervisor.
+type connState int
+
+const (
+	// stateWaiting waits before the next attempt to connect.
+	stateWaiting connState = iota
+
+	// stateConnecting connects to the broker, creating a new client if
+	// necessary.
+	stateConnecting
+
+	// stateSubscribing subscribes to the topics.
+	stateSubscribing
+
+	// stateSubscribed waits until the connection is lost or the supervisor
+	// is stopped.
+	stateSubscribed
+)
+
+func (s connState) String() string {
+	switch s {
+	case stateWaiting:
+		return "waiting"
+	case stateConnecting:
+		return "connecting"
+	case stateSubscribing:
+		return "subscribing"
+	case stateSubscribed:
+		return "subscribed"
+	default:
+		return "unknown"
+	}
+}
+
+// supervisedClient is a part of mqtt.Client used by a supervisor.
+type supervisedClient interface {
+	publisher
+	Connect() mqtt.Token
+	Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token
+	Unsubscribe(topics ...string) mqtt.Token
+	Disconnect(quiesce uint)
+}
+
+// supervisor keeps a client connected to the broker and subscribing to
+// topics. It's a state machine moving between connStates. A new client is
+// created whenever a connection fails after the client has been connected,
+// because OnConnectionLost is only called once per client.
+type supervisor struct {
+	ctx *core.Context
+
+	// newClient creates a new client. OnConnectionLost of the client must
+	// send true to disconnect.
+	newClient func() (supervisedClient, error)
+
+	broker  string
+	topics  *topicSet
+	handler mqtt.MessageHandler
+
+	// timeout is the maximum time to wait for connecting or subscribing.
+	timeout time.Duration
+
+	backoff *backoff
+
+	// maxRetries is the maximum number of consecutive failures in each
+	// state. It's unlimited when it's negative.
+	maxRetries int64
+
+	// logLevel is the minimum level of logs, and logThrottle limits how often
+	// failures to connect are logged if it isn't nil.
+	logLevel    logLevel
+	logThrottle *logThrottle
+
+	// failures has the number of consecutive failures in each state. It's
+	// reset when the client is subscribing to the topics. It's created by run.
+	failures map[connState]int64
+
+	// disconnect receives true when the connection is lost and false when
+	// the supervisor should stop.
+	disconnect chan bool
+
+	// reconnect receives a value when the client should reconnect although
+	// the connection isn't lost. It's only received while subscribed and may
+	// be nil.
+	reconnect <-chan struct{}
+
+	// drain is called after unsubscribing from the topics when the supervisor
+	// stops if it isn't nil. It waits for messages being handled.
+	drain func()
+
+	// beforeDisconnect is called before the client is disconnected when the
+	// supervisor stops if it isn't nil.
+	beforeDisconnect func(c supervisedClient)
+}
+
+// run runs the state machine until false is sent to disconnect. It returns an
+// error when it gives up connecting to the broker.
+func (sv *supervisor) run() error {
+	sv.failures = map[connState]int64{}
+	var client supervisedClient
+	state := stateWaiting
+	wait := time.Duration(0)
+
+	for {
+		switch state {
+		case stateWaiting:
+			// if Stop() is called while waiting, return earlier
+			select {
+			case <-time.After(wait):
+			case needsReconnect := <-sv.disconnect:
+				if !needsReconnect {
+					return nil
+				}
+			}
+			state = stateConnecting
+
+		case stateConnecting:
+			if client == nil {
+				c, err := sv.newClient()
+				if err != nil {
+					if wait, err = sv.fail(state, err); err != nil {
+						return err
+					}
+					state = stateWaiting
+					continue
+				}
+				client = c
+			}
+
+			// retries are logged as debug logs so that they don't flood logs
+			// during a long outage
+			if len(sv.failures) == 0 && sv.logLevel.enabled(infoLevel) {
+				sv.ctx.Log().WithField("broker", sv.broker).Info("Connecting to MQTT broker")
+			} else if len(sv.failures) > 0 && sv.logLevel.enabled(debugLevel) {
+				sv.ctx.Log().WithField("broker", sv.broker).Debug("Retrying to connect to MQTT broker")
+			}
+			if err := waitToken(client.Connect(), sv.timeout); err != nil {
+				// the client may still be connecting, so a new one is
+				// created for the next try
+				client.Disconnect(0)
+				client = nil
+				if wait, err = sv.fail(state, err); err != nil {
+					return err
+				}
+				state = stateWaiting
+				continue
+			}
+			state = stateSubscribing
+
+		case stateSubscribing:
+			if err := sv.topics.subscribe(client, sv.handler, sv.timeout); err != nil {
+				client.Disconnect(0)
+				client = nil
+				if wait, err = sv.fail(state, err); err != nil {
+					return err
+				}
+				state = stateWaiting
+				continue
+			}
+			sv.succeed()
+			wait = 0
+			state = stateSubscribed
+
+		case stateSubscribed:
+			// wait until the handler in OnConnectionLost or Stop() pushes
+			// something into the `disconnect` channel
+			select {
+			case needsReconnect := <-sv.disconnect:
+				if !needsReconnect {
+					sv.stop(client)
+					return nil
+				}
+				sv.topics.detach()
+			case <-sv.reconnect:
+				sv.topics.detach()
+				// the connection looks alive, so it has to be closed
+				if sv.logLevel.enabled(infoLevel) {
+					sv.ctx.Log().WithField("broker", sv.broker).Info("Reconnecting to MQTT broker")
+				}
+				client.Disconnect(0)
+			}
+			client = nil
+			state = stateWaiting
+		}
+	}
+}
+
+// stop unsubscribes from the topics, waits for messages being handled, and
+// disconnects the client.
+func (sv *supervisor) stop(client supervisedClient) {
+	if err := sv.topics.unsubscribe(client, sv.timeout); err != nil && sv.logLevel.enabled(warnLevel) {
+		// messages may still arrive, but they're handled until disconnected
+		sv.ctx.ErrLog(err).WithField("topics", sv.topics.list()).Warn("Failed to unsubscribe from topics")
+	}
+	if sv.drain != nil {
+		sv.drain()
+	}
+	if sv.beforeDisconnect != nil {
+		sv.beforeDisconnect(client)
+	}
+	client.Disconnect(250)
+}
+
+// fail records a failure in the state and returns the time to wait before
+// the next attempt. It returns an error when the number of consecutive
+// failures in the state exceeds maxRetries.
+func (sv *supervisor) fail(state connState, err error) (time.Duration, error) {
+	sv.failures[state]++
+	if sv.maxRetries >= 0 && sv.failures[state] > sv.maxRetries {
+		return 0, fmt.Errorf("gave up to connect to MQTT broker after %v failures in %v state: %v",
+			sv.failures[state], state, err)
+	}
+	wait := sv.backoff.next()
+	if !sv.logLevel.enabled(infoLevel) {
+		return wait, nil
+	}
+	l := sv.ctx.ErrLog(err).WithField("state", state.String()).WithField("waitUntilReconnect", wait)
+	if sv.logThrottle != nil {
+		ok, suppressed := sv.logThrottle.allow(time.Now())
+		if !ok {
+			return wait, nil
+		}
+		if suppressed > 0 {
+			l = l.WithField("suppressed", suppressed)
+		}
+	}
+	l.Info("Failed to connect to MQTT broker")
+	return wait, nil
+}
+
+// succeed resets failure counters and the backoff.
+func (sv *supervisor) succeed() {
+	for k := range sv.failures {
+		delete(sv.failures, k)
+	}
+	sv.backoff.reset()
+	if sv.logThrottle != nil {
+		sv.logThrottle.reset()
+	}
+}
+
+// backoff computes exponential backoff time.
+type backoff struct {
+	min    time.Duration
+	max    time.Duration
+	jitter jitter
+
+	base time.Duration
+}
+
+// next returns the time to wait before the next attempt.
+func (b *backoff) next() time.Duration {
+	if b.base == 0 {
+		b.base = b.min
+	} else {
+		b.base *= 2
+	}
+	// truncate to maximum
+	if b.base > b.max {
+		b.base = b.max
+	}
+	return b.jitter.apply(b.base)
+}
+
+// reset resets the backoff time to the minimum.
+func (b *backoff) reset() {
+	b.base = 0
+}
+
+// jitter is a strategy to randomize backoff time.
+type jitter int
+
+const (
+	// noJitter doesn't randomize backoff time.
+	noJitter jitter = iota
+
+	// fullJitter chooses a random time between 0 and the backoff time.
+	fullJitter
+
+	// equalJitter keeps a half of the backoff time and randomizes the other
+	// half.
+	equalJitter
+)
+
+func parseJitter(s string) (jitter, error) {
+	switch s {
+	case "none":
+		return noJitter, nil
+	case "full":
+		return fullJitter, nil
+	case "equal":
+		return equalJitter, nil
+	default:
+		return 0, fmt.Errorf("unknown reconnect jitter: %v", s)
+	}
+}
+
+// apply returns randomized backoff time.
+func (j jitter) apply(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	switch j {
+	case fullJitter:
+		return time.Duration(rand.Int63n(int64(d) + 1))
+	case equalJitter:
+		half := d / 2
+		return d - half + time.Duration(rand.Int63n(int64(half)+1))
+	default:
+		return d
+	}
+}
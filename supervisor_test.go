@@ -0,0 +1,292 @@
+package mqtt
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+)
+
+type testToken struct {
+	err     error
+	timeout bool
+}
+
+func (t *testToken) Wait() bool {
+	return !t.timeout
+}
+
+func (t *testToken) WaitTimeout(time.Duration) bool {
+	return !t.timeout
+}
+
+func (t *testToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	if !t.timeout {
+		close(ch)
+	}
+	return ch
+}
+
+func (t *testToken) Error() error {
+	return t.err
+}
+
+// testClient returns tokens from connect and subscribe in order. The last
+// token is repeated. When subscribed isn't nil, it receives a value each time
+// the client is subscribed successfully.
+type testClient struct {
+	connect      []*testToken
+	subscribe    []*testToken
+	subscribed   chan struct{}
+	unsubscribed bool
+	disconnected bool
+}
+
+func (c *testClient) Connect() mqtt.Token {
+	t := c.connect[0]
+	if len(c.connect) > 1 {
+		c.connect = c.connect[1:]
+	}
+	return t
+}
+
+func (c *testClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	t := c.subscribe[0]
+	if len(c.subscribe) > 1 {
+		c.subscribe = c.subscribe[1:]
+	}
+	if c.subscribed != nil && t.err == nil && !t.timeout {
+		c.subscribed <- struct{}{}
+	}
+	return t
+}
+
+// waitSubscribed waits until c is subscribed.
+func waitSubscribed(t *testing.T, c *testClient) {
+	select {
+	case <-c.subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client should be subscribed")
+	}
+}
+
+func (c *testClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.unsubscribed = true
+	return &testToken{}
+}
+
+func (c *testClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return &testToken{}
+}
+
+func (c *testClient) Disconnect(quiesce uint) {
+	c.disconnected = true
+}
+
+// newTestSupervisor returns a supervisor creating the clients in order and
+// the number of created clients, which must be accessed atomically.
+func newTestSupervisor(maxRetries int64, clients ...*testClient) (*supervisor, *int32) {
+	var created int32
+	sv := &supervisor{
+		ctx: core.NewContext(nil),
+		newClient: func() (supervisedClient, error) {
+			n := atomic.LoadInt32(&created)
+			if int(n) >= len(clients) {
+				return nil, errors.New("no more client")
+			}
+			atomic.AddInt32(&created, 1)
+			return clients[n], nil
+		},
+		topics:     newTopicSet("test"),
+		timeout:    time.Millisecond,
+		backoff:    &backoff{min: time.Millisecond, max: time.Millisecond},
+		maxRetries: maxRetries,
+		disconnect: make(chan bool, 1),
+	}
+	return sv, &created
+}
+
+func TestSupervisorTreatsTimeoutAsFailure(t *testing.T) {
+	timedOut := &testClient{
+		connect:   []*testToken{{timeout: true}},
+		subscribe: []*testToken{{}},
+	}
+	ok := &testClient{
+		connect:    []*testToken{{}},
+		subscribe:  []*testToken{{}},
+		subscribed: make(chan struct{}, 1),
+	}
+	sv, created := newTestSupervisor(-1, timedOut, ok)
+
+	done := make(chan error)
+	go func() {
+		done <- sv.run()
+	}()
+	waitSubscribed(t, ok)
+	sv.disconnect <- false
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt32(created) != 2 {
+		t.Errorf("a new client should be created after the timeout: %v clients", atomic.LoadInt32(created))
+	}
+	if !timedOut.disconnected || !ok.disconnected {
+		t.Error("clients should be disconnected")
+	}
+}
+
+func TestSupervisorGivesUp(t *testing.T) {
+	failing := &testClient{
+		connect:   []*testToken{{}},
+		subscribe: []*testToken{{err: errors.New("not authorized")}},
+	}
+	clients := []*testClient{failing, failing, failing, failing}
+	sv, created := newTestSupervisor(2, clients...)
+
+	if err := sv.run(); err == nil {
+		t.Fatal("the supervisor should give up")
+	}
+	if atomic.LoadInt32(created) != 3 {
+		t.Errorf("the supervisor should give up after 2 retries: %v clients", atomic.LoadInt32(created))
+	}
+	if n := sv.failures[stateSubscribing]; n != 3 {
+		t.Errorf("wrong number of failures in subscribing: %v", n)
+	}
+	if n := sv.failures[stateConnecting]; n != 0 {
+		t.Errorf("wrong number of failures in connecting: %v", n)
+	}
+}
+
+func TestSupervisorResetsFailures(t *testing.T) {
+	// Each state fails once, so maxRetries 1 isn't exceeded.
+	c1 := &testClient{
+		connect:   []*testToken{{err: errors.New("refused")}},
+		subscribe: []*testToken{{}},
+	}
+	c2 := &testClient{
+		connect:   []*testToken{{}},
+		subscribe: []*testToken{{timeout: true}},
+	}
+	c3 := &testClient{
+		connect:    []*testToken{{}},
+		subscribe:  []*testToken{{}},
+		subscribed: make(chan struct{}, 1),
+	}
+	c4 := &testClient{
+		connect:   []*testToken{{err: errors.New("refused")}},
+		subscribe: []*testToken{{}},
+	}
+	sv, created := newTestSupervisor(1, c1, c2, c3, c4, c3)
+
+	done := make(chan error)
+	go func() {
+		done <- sv.run()
+	}()
+	waitSubscribed(t, c3)
+	if atomic.LoadInt32(created) != 3 {
+		t.Fatalf("the third client should be subscribed: %v clients", atomic.LoadInt32(created))
+	}
+
+	// The failure after reconnect is the first one again.
+	sv.disconnect <- true
+	waitSubscribed(t, c3)
+	sv.disconnect <- false
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(created) != 5 {
+		t.Errorf("wrong number of clients: %v", atomic.LoadInt32(created))
+	}
+}
+
+func TestSupervisorReconnects(t *testing.T) {
+	c1 := &testClient{
+		connect:   []*testToken{{}},
+		subscribe: []*testToken{{}},
+	}
+	c2 := &testClient{
+		connect:    []*testToken{{}},
+		subscribe:  []*testToken{{}},
+		subscribed: make(chan struct{}, 1),
+	}
+	sv, created := newTestSupervisor(-1, c1, c2)
+	reconnect := make(chan struct{})
+	sv.reconnect = reconnect
+
+	done := make(chan error)
+	go func() {
+		done <- sv.run()
+	}()
+	// The reconnect is only received while subscribed.
+	reconnect <- struct{}{}
+	waitSubscribed(t, c2)
+	sv.disconnect <- false
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(created) != 2 {
+		t.Errorf("a new client should be created after the reconnect: %v clients", atomic.LoadInt32(created))
+	}
+	if !c1.disconnected {
+		t.Error("the first client should be disconnected by the reconnect")
+	}
+}
+
+func TestSupervisorStopsGracefully(t *testing.T) {
+	c := &testClient{
+		connect:    []*testToken{{}},
+		subscribe:  []*testToken{{}},
+		subscribed: make(chan struct{}, 1),
+	}
+	sv, _ := newTestSupervisor(-1, c)
+	drained := false
+	sv.drain = func() {
+		if !c.unsubscribed || c.disconnected {
+			t.Error("messages should be drained after unsubscribing and before disconnecting")
+		}
+		drained = true
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- sv.run()
+	}()
+	waitSubscribed(t, c)
+	sv.disconnect <- false
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !drained || !c.disconnected {
+		t.Error("the client should be drained and disconnected")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	d := 10 * time.Second
+	cases := []struct {
+		jitter jitter
+		min    time.Duration
+	}{
+		{noJitter, d},
+		{fullJitter, 0},
+		{equalJitter, d / 2},
+	}
+	for _, c := range cases {
+		for i := 0; i < 100; i++ {
+			res := c.jitter.apply(d)
+			if res < c.min || res > d {
+				t.Errorf("jitter %v: %v isn't in [%v, %v]", c.jitter, res, c.min, d)
+				break
+			}
+		}
+	}
+
+	if _, err := parseJitter("decorrelated"); err == nil {
+		t.Error("an unknown jitter should be rejected")
+	}
+}
@@ -0,0 +1,41 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// systemTopicPolicy is how a source handles messages of topics starting with
+// "$" such as "$SYS/broker/uptime". Brokers differ on whether wildcards match
+// such topics, so a source subscribing to a broad filter may receive them.
+type systemTopicPolicy int
+
+const (
+	// emitSystemTopics emits messages of system topics like other messages.
+	emitSystemTopics systemTopicPolicy = iota
+
+	// dropSystemTopics drops messages of system topics.
+	dropSystemTopics
+
+	// routeSystemTopics dispatches messages of system topics only to the
+	// router so that they're emitted by a separate mqtt_route source.
+	routeSystemTopics
+)
+
+func parseSystemTopicPolicy(s string) (systemTopicPolicy, error) {
+	switch s {
+	case "emit":
+		return emitSystemTopics, nil
+	case "drop":
+		return dropSystemTopics, nil
+	case "route":
+		return routeSystemTopics, nil
+	default:
+		return 0, fmt.Errorf("unknown system_topics: %v", s)
+	}
+}
+
+// isSystemTopic returns true when the topic is a system topic.
+func isSystemTopic(topic string) bool {
+	return strings.HasPrefix(topic, "$")
+}
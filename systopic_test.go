@@ -0,0 +1,47 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestRouteSystemTopics(t *testing.T) {
+	ctx := core.NewContext(nil)
+	st, err := NewRouter(ctx, data.Map{
+		"routes": data.Map{"uptime": data.String("$SYS/broker/uptime")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := st.(*Router)
+	uptime := &testWriter{}
+	if err := r.attach("uptime", uptime); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &source{router: r, systemTopics: routeSystemTopics}
+	w := &testWriter{}
+	for _, topic := range []string{"$SYS/broker/uptime", "$SYS/broker/load", "sensors/1"} {
+		s.write(ctx, w, &message{topic: topic, payload: []byte("1")})
+	}
+
+	if len(uptime.tuples) != 1 {
+		t.Errorf("the system topic should be routed: %v", uptime.tuples)
+	}
+	if len(w.tuples) != 1 || !data.Equal(w.tuples[0].Data["topic"], data.String("sensors/1")) {
+		t.Errorf("only the normal topic should be emitted: %v", w.tuples)
+	}
+}
+
+func TestParseSystemTopicPolicy(t *testing.T) {
+	for _, s := range []string{"emit", "drop", "route"} {
+		if _, err := parseSystemTopicPolicy(s); err != nil {
+			t.Errorf("%v: %v", s, err)
+		}
+	}
+	if _, err := parseSystemTopicPolicy("ignore"); err == nil {
+		t.Error("an unknown policy should be rejected")
+	}
+}
@@ -0,0 +1,91 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// tasmota decodes telemetry of Tasmota devices published to
+// tele/<device>/SENSOR and results of commands published to
+// stat/<device>/RESULT. Nested JSON objects are flattened by joining keys
+// with "_", for example, {"AM2301":{"Temperature":21.5}} is emitted as
+// {"AM2301_Temperature":21.5}.
+type tasmota struct{}
+
+func (tasmota) String() string {
+	return "tasmota"
+}
+
+func (tasmota) decode(topic string, payload []byte) ([]data.Map, error) {
+	levels := strings.Split(topic, "/")
+	if len(levels) != 3 {
+		return nil, nil
+	}
+	switch {
+	case levels[0] == "tele" && levels[2] == "SENSOR":
+	case levels[0] == "stat" && levels[2] == "RESULT":
+	default:
+		return nil, nil
+	}
+
+	v, err := decodeJSON(payload)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(data.Map)
+	if !ok {
+		return nil, fmt.Errorf("the payload must be a JSON object: %v", v)
+	}
+
+	d := data.Map{
+		"topic":   data.String(topic),
+		"device":  data.String(levels[1]),
+		"message": data.String(levels[2]),
+	}
+	if t, ok := m["Time"]; ok {
+		delete(m, "Time")
+		ts, err := parseTasmotaTime(t)
+		if err != nil {
+			return nil, err
+		}
+		d["time"] = ts
+	}
+	values := data.Map{}
+	flattenMap("", m, values)
+	d["values"] = values
+	return []data.Map{d}, nil
+}
+
+// parseTasmotaTime parses the Time field. Tasmota omits the offset unless
+// it's configured to include it, in which case the time is regarded as UTC.
+func parseTasmotaTime(v data.Value) (data.Value, error) {
+	str, err := data.AsString(v)
+	if err != nil {
+		return nil, err
+	}
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return data.Timestamp(t), nil
+	}
+	t, err := time.Parse("2006-01-02T15:04:05", str)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Time: %v", str)
+	}
+	return data.Timestamp(t), nil
+}
+
+// flattenMap copies fields of m to dst joining keys of nested maps with "_".
+func flattenMap(prefix string, m data.Map, dst data.Map) {
+	for k, v := range m {
+		if prefix != "" {
+			k = prefix + "_" + k
+		}
+		if nested, ok := v.(data.Map); ok {
+			flattenMap(k, nested, dst)
+			continue
+		}
+		dst[k] = v
+	}
+}
@@ -0,0 +1,48 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestTasmotaDecode(t *testing.T) {
+	ds, err := tasmota{}.decode("tele/kitchen/SENSOR", []byte(`{"Time":"2024-01-02T03:04:05","AM2301":{"Temperature":21.5,"Humidity":40},"TempUnit":"C"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := data.Map{
+		"topic":   data.String("tele/kitchen/SENSOR"),
+		"device":  data.String("kitchen"),
+		"message": data.String("SENSOR"),
+		"time":    data.Timestamp(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)),
+		"values": data.Map{
+			"AM2301_Temperature": data.Float(21.5),
+			"AM2301_Humidity":    data.Int(40),
+			"TempUnit":           data.String("C"),
+		},
+	}
+	if len(ds) != 1 || !data.Equal(expected, ds[0]) {
+		t.Errorf("expected %v, actual %v", expected, ds)
+	}
+
+	ds, err = tasmota{}.decode("stat/plug/RESULT", []byte(`{"POWER":"ON"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1 || !data.Equal(ds[0]["values"], data.Map{"POWER": data.String("ON")}) {
+		t.Errorf("the result should be emitted: %v", ds)
+	}
+
+	for _, topic := range []string{"tele/kitchen/LWT", "stat/plug/POWER", "cmnd/plug/POWER", "tele/a/b/SENSOR"} {
+		if ds, err := (tasmota{}).decode(topic, []byte(`{}`)); err != nil || ds != nil {
+			t.Errorf("%v shouldn't be emitted: %v, %v", topic, ds, err)
+		}
+	}
+	for _, payload := range []string{`Online`, `[1]`, `{"Time":"yesterday"}`} {
+		if _, err := (tasmota{}).decode("tele/kitchen/SENSOR", []byte(payload)); err == nil {
+			t.Errorf("%v should be rejected", payload)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package mqtt
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// throttle limits the publish rate of a sink and adapts it to quotas of the
+// broker. The rate is halved whenever the broker tells that the client exceeds
+// its quota with a reason code of MQTT 5, and it's raised step by step while
+// publishing succeeds to probe if the broker has recovered. Brokers using
+// MQTT 3.1.1 can't tell it, so the rate is only limited with them.
+type throttle struct {
+	m sync.Mutex
+
+	// min and max are the range of the rate in messages per second.
+	min float64
+	max float64
+
+	// rate is the current rate in messages per second.
+	rate float64
+
+	// probeInterval is the time to keep a rate before raising it.
+	probeInterval time.Duration
+
+	// changed is the time when the rate was changed last time.
+	changed time.Time
+
+	// next is the time when the next message can be published.
+	next time.Time
+}
+
+// parseThrottle parses max_publish_rate, min_publish_rate, and
+// publish_rate_probe_interval parameters. It returns nil when
+// max_publish_rate isn't given.
+func parseThrottle(params data.Map) (*throttle, error) {
+	v, ok := params["max_publish_rate"]
+	if !ok {
+		for _, k := range []string{"min_publish_rate", "publish_rate_probe_interval"} {
+			if _, ok := params[k]; ok {
+				return nil, errors.New(k + " requires max_publish_rate")
+			}
+		}
+		return nil, nil
+	}
+
+	t := &throttle{
+		probeInterval: 10 * time.Second,
+		changed:       time.Now(),
+	}
+	max, err := data.ToFloat(v)
+	if err != nil {
+		return nil, err
+	}
+	if max <= 0 {
+		return nil, errors.New("max_publish_rate must be positive")
+	}
+	t.max = max
+	t.rate = max
+	t.min = max / 100
+
+	if v, ok := params["min_publish_rate"]; ok {
+		min, err := data.ToFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		if min <= 0 || min > max {
+			return nil, errors.New("min_publish_rate must be positive and not greater than max_publish_rate")
+		}
+		t.min = min
+	}
+
+	if v, ok := params["publish_rate_probe_interval"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, errors.New("publish_rate_probe_interval must be positive")
+		}
+		t.probeInterval = d
+	}
+	return t, nil
+}
+
+// wait blocks until the next message can be published. It returns false when
+// closing is closed before that.
+func (t *throttle) wait(closing <-chan struct{}) bool {
+	t.m.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	d := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(float64(time.Second) / t.rate))
+	t.m.Unlock()
+
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-closing:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// throttled returns true when err tells that the broker throttles the client,
+// that is, PUBACK or DISCONNECT has the reason code 0x96 (Message rate too
+// high) or 0x97 (Quota exceeded). AWS IoT also disconnects clients exceeding
+// its limits with these reason codes.
+func throttled(err error) bool {
+	code, ok := v5ReasonCode(err)
+	return ok && (code == v5MessageRateTooHigh || code == v5QuotaExceeded)
+}
+
+// penalize halves the rate because the broker pushed back.
+func (t *throttle) penalize(now time.Time) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.rate /= 2
+	if t.rate < t.min {
+		t.rate = t.min
+	}
+	t.changed = now
+}
+
+// succeed raises the rate by a tenth of max_publish_rate when it has been
+// kept for the probe interval.
+func (t *throttle) succeed(now time.Time) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.rate >= t.max || now.Sub(t.changed) < t.probeInterval {
+		return
+	}
+	t.rate += t.max / 10
+	if t.rate > t.max {
+		t.rate = t.max
+	}
+	t.changed = now
+}
+
+// currentRate returns the current rate in messages per second.
+func (t *throttle) currentRate() float64 {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.rate
+}
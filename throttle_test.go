@@ -0,0 +1,117 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseThrottle(t *testing.T) {
+	if th, err := parseThrottle(data.Map{}); err != nil || th != nil {
+		t.Errorf("throttle shouldn't be created without max_publish_rate: %v, %v", th, err)
+	}
+
+	th, err := parseThrottle(data.Map{"max_publish_rate": data.Int(100)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th.max != 100 || th.min != 1 || th.rate != 100 || th.probeInterval != 10*time.Second {
+		t.Errorf("wrong default parameters: %+v", th)
+	}
+
+	for _, params := range []data.Map{
+		{"min_publish_rate": data.Int(1)},
+		{"max_publish_rate": data.Int(0)},
+		{"max_publish_rate": data.Int(10), "min_publish_rate": data.Int(20)},
+		{"max_publish_rate": data.Int(10), "publish_rate_probe_interval": data.String("0s")},
+	} {
+		if _, err := parseThrottle(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
+
+func TestThrottleAdaptsRate(t *testing.T) {
+	now := time.Now()
+	th := &throttle{
+		min:           10,
+		max:           100,
+		rate:          100,
+		probeInterval: time.Second,
+		changed:       now,
+	}
+
+	th.penalize(now)
+	th.penalize(now)
+	if r := th.currentRate(); r != 25 {
+		t.Errorf("the rate should be halved twice: %v", r)
+	}
+	th.penalize(now)
+	th.penalize(now)
+	if r := th.currentRate(); r != 10 {
+		t.Errorf("the rate shouldn't be lower than the minimum: %v", r)
+	}
+
+	th.succeed(now.Add(500 * time.Millisecond))
+	if r := th.currentRate(); r != 10 {
+		t.Errorf("the rate shouldn't be raised before the probe interval: %v", r)
+	}
+	th.succeed(now.Add(time.Second))
+	if r := th.currentRate(); r != 20 {
+		t.Errorf("the rate should be raised by a tenth of the maximum: %v", r)
+	}
+	for i := 2; i < 20; i++ {
+		th.succeed(now.Add(time.Duration(i) * time.Second))
+	}
+	if r := th.currentRate(); r != 100 {
+		t.Errorf("the rate shouldn't exceed the maximum: %v", r)
+	}
+}
+
+func TestThrottled(t *testing.T) {
+	cases := []struct {
+		err       error
+		throttled bool
+	}{
+		{&v5ReasonError{code: v5QuotaExceeded, err: errors.New("quota exceeded")}, true},
+		{&v5ReasonError{code: v5MessageRateTooHigh, err: errors.New("message rate too high")}, true},
+		{fmt.Errorf("publishing failed: %w", &v5ReasonError{code: v5QuotaExceeded, err: errors.New("quota exceeded")}), true},
+		{&v5ReasonError{code: 0x87, err: errors.New("not authorized")}, false},
+		{errors.New("publishing a message to 'a' timed out after 1s"), false},
+		{io.EOF, false},
+	}
+	for _, c := range cases {
+		if throttled(c.err) != c.throttled {
+			t.Errorf("%v: throttled should be %v", c.err, c.throttled)
+		}
+	}
+}
+
+func TestThrottleWait(t *testing.T) {
+	th := &throttle{
+		min:  1,
+		max:  100,
+		rate: 100,
+	}
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if !th.wait(nil) {
+			t.Fatal("wait shouldn't fail")
+		}
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("6 messages at 100 messages per second should take 50ms: %v", d)
+	}
+
+	closing := make(chan struct{})
+	close(closing)
+	th.rate = 1
+	th.wait(closing)
+	if th.wait(closing) {
+		t.Error("wait should fail when the sink is closed")
+	}
+}
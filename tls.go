@@ -0,0 +1,132 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// tlsFiles has paths to PEM files used to establish TLS connections.
+type tlsFiles struct {
+	caFile   string
+	certFile string
+	keyFile  string
+}
+
+// tlsConfig loads files and creates a new tls.Config. It returns nil when no
+// file is specified.
+func (f *tlsFiles) tlsConfig() (*tls.Config, error) {
+	if f.caFile == "" && f.certFile == "" && f.keyFile == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{}
+	if f.caFile != "" {
+		pem, err := ioutil.ReadFile(f.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate was found in %v", f.caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if f.certFile != "" || f.keyFile != "" {
+		if f.certFile == "" || f.keyFile == "" {
+			return nil, errors.New("both a client certificate and its key must be specified")
+		}
+		cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// isTLSBroker returns true when the broker URL has a scheme using TLS.
+func isTLSBroker(broker string) bool {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "wss":
+		return true
+	}
+	return false
+}
+
+// parsePins parses SHA-256 fingerprints in hex. Bytes in a fingerprint can be
+// separated by colons as printed by "openssl x509 -fingerprint -sha256". The
+// value can be a string or an array of strings.
+func parsePins(v data.Value) ([][]byte, error) {
+	var strs []string
+	if v.Type() == data.TypeArray {
+		a, _ := data.AsArray(v)
+		for _, e := range a {
+			str, err := data.AsString(e)
+			if err != nil {
+				return nil, err
+			}
+			strs = append(strs, str)
+		}
+	} else {
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, str)
+	}
+	if len(strs) == 0 {
+		return nil, errors.New("no fingerprint is given")
+	}
+
+	pins := make([][]byte, len(strs))
+	for i, str := range strs {
+		p, err := hex.DecodeString(strings.Replace(str, ":", "", -1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid fingerprint '%v': %v", str, err)
+		}
+		if len(p) != sha256.Size {
+			return nil, fmt.Errorf("fingerprint '%v' isn't SHA-256", str)
+		}
+		pins[i] = p
+	}
+	return pins, nil
+}
+
+// verifyPinnedCertificate returns a function which can be used as
+// tls.Config.VerifyPeerCertificate. It accepts the broker's certificate when
+// the SHA-256 fingerprint of either the certificate or its public key matches
+// one of the pins.
+func verifyPinnedCertificate(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("the broker didn't send a certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		certSum := sha256.Sum256(cert.Raw)
+		keySum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, p := range pins {
+			if bytes.Equal(p, certSum[:]) || bytes.Equal(p, keySum[:]) {
+				return nil
+			}
+		}
+		return errors.New("the broker's certificate doesn't match any pinned fingerprint")
+	}
+}
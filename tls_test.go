@@ -0,0 +1,95 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParsePins(t *testing.T) {
+	sum := sha256.Sum256([]byte("hoge"))
+	h := hex.EncodeToString(sum[:])
+	var colons []string
+	for i := 0; i < len(h); i += 2 {
+		colons = append(colons, strings.ToUpper(h[i:i+2]))
+	}
+
+	cases := []struct {
+		value data.Value
+		fail  bool
+	}{
+		{data.String(h), false},
+		{data.String(strings.Join(colons, ":")), false},
+		{data.Array{data.String(h), data.String(h)}, false},
+		{data.String(h[:len(h)-2]), true},
+		{data.String("xyz"), true},
+		{data.Array{}, true},
+		{data.Int(1), true},
+	}
+
+	for _, c := range cases {
+		pins, err := parsePins(c.value)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%v should fail", c.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v failed: %v", c.value, err)
+			continue
+		}
+		for _, p := range pins {
+			if string(p) != string(sum[:]) {
+				t.Errorf("%v: wrong fingerprint %x", c.value, p)
+			}
+		}
+	}
+}
+
+func TestVerifyPinnedCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "broker"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certSum := sha256.Sum256(der)
+	keySum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	other := sha256.Sum256([]byte("other"))
+
+	if err := verifyPinnedCertificate([][]byte{other[:], certSum[:]})([][]byte{der}, nil); err != nil {
+		t.Errorf("the certificate fingerprint should match: %v", err)
+	}
+	if err := verifyPinnedCertificate([][]byte{keySum[:]})([][]byte{der}, nil); err != nil {
+		t.Errorf("the public key fingerprint should match: %v", err)
+	}
+	if err := verifyPinnedCertificate([][]byte{other[:]})([][]byte{der}, nil); err == nil {
+		t.Error("a wrong fingerprint should be rejected")
+	}
+	if err := verifyPinnedCertificate([][]byte{certSum[:]})(nil, nil); err == nil {
+		t.Error("no certificate should be rejected")
+	}
+}
@@ -0,0 +1,126 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// topicSubscriber is a part of mqtt.Client used by a topicSet.
+type topicSubscriber interface {
+	Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token
+	Unsubscribe(topics ...string) mqtt.Token
+}
+
+// topicSet has topics subscribed by a source. Topics can be added and
+// removed while the source is running. They're subscribed and unsubscribed
+// on the client attached by subscribe, and subscribed on the next client
+// when the source isn't subscribing.
+type topicSet struct {
+	m      sync.Mutex
+	topics []string
+
+	// qos is the QoS with which the topics are subscribed.
+	qos byte
+
+	// client is the client subscribing to the topics. It's nil while the
+	// source isn't subscribing.
+	client  topicSubscriber
+	handler mqtt.MessageHandler
+	timeout time.Duration
+}
+
+func newTopicSet(topics ...string) *topicSet {
+	return &topicSet{topics: topics}
+}
+
+// list returns the topics in the order they were added.
+func (ts *topicSet) list() []string {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	return append([]string(nil), ts.topics...)
+}
+
+func (ts *topicSet) indexOf(topic string) int {
+	for i, t := range ts.topics {
+		if t == topic {
+			return i
+		}
+	}
+	return -1
+}
+
+// subscribe subscribes to all topics with the client and attaches it to the
+// set so that topics added later are subscribed with it.
+func (ts *topicSet) subscribe(c topicSubscriber, handler mqtt.MessageHandler, timeout time.Duration) error {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	for _, t := range ts.topics {
+		if err := waitToken(c.Subscribe(t, ts.qos, handler), timeout); err != nil {
+			return fmt.Errorf("cannot subscribe to topic '%v': %v", t, err)
+		}
+	}
+	ts.client = c
+	ts.handler = handler
+	ts.timeout = timeout
+	return nil
+}
+
+// detach detaches the client when the connection is closed.
+func (ts *topicSet) detach() {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	ts.client = nil
+}
+
+// unsubscribe detaches the client and unsubscribes from all topics with it.
+func (ts *topicSet) unsubscribe(c topicSubscriber, timeout time.Duration) error {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	ts.client = nil
+	return waitToken(c.Unsubscribe(ts.topics...), timeout)
+}
+
+// add adds the topic to the set. It's subscribed immediately when a client is
+// attached, and it isn't added when the subscription fails.
+func (ts *topicSet) add(topic string) error {
+	if err := validateTopicFilter(topic); err != nil {
+		return err
+	}
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	if ts.indexOf(topic) >= 0 {
+		return nil
+	}
+	if ts.client != nil {
+		if err := waitToken(ts.client.Subscribe(topic, ts.qos, ts.handler), ts.timeout); err != nil {
+			return fmt.Errorf("cannot subscribe to topic '%v': %v", topic, err)
+		}
+	}
+	ts.topics = append(ts.topics, topic)
+	return nil
+}
+
+// remove removes the topic from the set. It's unsubscribed immediately when
+// a client is attached. The last topic cannot be removed.
+func (ts *topicSet) remove(topic string) error {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	i := ts.indexOf(topic)
+	if i < 0 {
+		return fmt.Errorf("the source isn't subscribing to topic '%v'", topic)
+	}
+	if len(ts.topics) == 1 {
+		return errors.New("the last topic cannot be removed")
+	}
+	if ts.client != nil {
+		if err := waitToken(ts.client.Unsubscribe(topic), ts.timeout); err != nil {
+			return fmt.Errorf("cannot unsubscribe from topic '%v': %v", topic, err)
+		}
+	}
+	ts.topics = append(ts.topics[:i], ts.topics[i+1:]...)
+	return nil
+}
@@ -0,0 +1,119 @@
+package mqtt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+)
+
+// recordingSubscriber records subscribed topics. Subscribing to a topic in
+// fail fails.
+type recordingSubscriber struct {
+	subscribed []string
+	fail       map[string]bool
+}
+
+func (c *recordingSubscriber) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	if c.fail[topic] {
+		return &testToken{err: errors.New("not authorized")}
+	}
+	c.subscribed = append(c.subscribed, topic)
+	return &testToken{}
+}
+
+func (c *recordingSubscriber) Unsubscribe(topics ...string) mqtt.Token {
+	for _, t := range topics {
+		for i, s := range c.subscribed {
+			if s == t {
+				c.subscribed = append(c.subscribed[:i], c.subscribed[i+1:]...)
+				break
+			}
+		}
+	}
+	return &testToken{}
+}
+
+func TestTopicSet(t *testing.T) {
+	ts := newTopicSet("a/#")
+
+	// topics added before subscribing are subscribed with the client
+	if err := ts.add("b/+"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.add("b/+"); err != nil {
+		t.Fatal(err)
+	}
+	c := &recordingSubscriber{fail: map[string]bool{"denied": true}}
+	if err := ts.subscribe(c, nil, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a/#", "b/+"}; !reflect.DeepEqual(c.subscribed, expected) {
+		t.Errorf("expected %v, actual %v", expected, c.subscribed)
+	}
+
+	// topics are subscribed immediately while the client is attached
+	if err := ts.add("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.add("denied"); err == nil {
+		t.Error("a rejected topic shouldn't be added")
+	}
+	if err := ts.add("d/#/e"); err == nil {
+		t.Error("an invalid topic filter shouldn't be added")
+	}
+	if err := ts.remove("a/#"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"b/+", "c"}; !reflect.DeepEqual(c.subscribed, expected) {
+		t.Errorf("expected %v, actual %v", expected, c.subscribed)
+	}
+	if l := ts.list(); !reflect.DeepEqual(l, []string{"b/+", "c"}) {
+		t.Errorf("wrong topics: %v", l)
+	}
+
+	// the detached client isn't touched
+	ts.detach()
+	if err := ts.add("f"); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.subscribed) != 2 {
+		t.Errorf("the detached client shouldn't subscribe: %v", c.subscribed)
+	}
+
+	if err := ts.remove("g"); err == nil {
+		t.Error("removing an unknown topic should fail")
+	}
+	if err := ts.remove("b/+"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.remove("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.remove("f"); err == nil {
+		t.Error("the last topic shouldn't be removed")
+	}
+}
+
+func TestSourceAddTopic(t *testing.T) {
+	s := &source{topics: newTopicSet("a")}
+	s.authorizer = AuthorizerFunc(func(_ *core.Context, _ TopicAction, topic string) error {
+		if topic == "secret" {
+			return errors.New("denied")
+		}
+		return nil
+	})
+	var _ TopicSubscriber = s
+	if err := s.AddTopic("secret"); err == nil {
+		t.Error("a denied topic shouldn't be added")
+	}
+	if err := s.AddTopic("b"); err != nil {
+		t.Fatal(err)
+	}
+	if topics := s.Topics(); !reflect.DeepEqual(topics, []string{"a", "b"}) {
+		t.Errorf("wrong topics: %v", topics)
+	}
+}
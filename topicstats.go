@@ -0,0 +1,141 @@
+package mqtt
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// topicStats counts messages and bytes received from each concrete topic so
+// that operators can see which devices dominate a wildcard subscription. The
+// number of topics is limited by size, and the least recently received topic
+// is evicted when a new topic arrives at the limit.
+type topicStats struct {
+	size int
+
+	m       sync.Mutex
+	lru     *list.List
+	topics  map[string]*list.Element
+	evicted int64
+}
+
+// topicStat is the statistics of a topic.
+type topicStat struct {
+	topic        string
+	messages     int64
+	bytes        int64
+	lastReceived time.Time
+}
+
+// parseTopicStats parses the topic_stats_size parameter. It returns nil when
+// the size is 0.
+func parseTopicStats(params data.Map) (*topicStats, error) {
+	v, ok := params["topic_stats_size"]
+	if !ok {
+		return nil, nil
+	}
+	n, err := data.AsInt(v)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, errors.New("topic_stats_size must not be negative")
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	return &topicStats{
+		size:   int(n),
+		lru:    list.New(),
+		topics: map[string]*list.Element{},
+	}, nil
+}
+
+// record counts a message of the topic having the payload of the size.
+func (s *topicStats) record(topic string, size int, now time.Time) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	e, ok := s.topics[topic]
+	if ok {
+		s.lru.MoveToFront(e)
+	} else {
+		if s.lru.Len() >= s.size {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.topics, oldest.Value.(*topicStat).topic)
+			s.evicted++
+		}
+		e = s.lru.PushFront(&topicStat{topic: topic})
+		s.topics[topic] = e
+	}
+	st := e.Value.(*topicStat)
+	st.messages++
+	st.bytes += int64(size)
+	st.lastReceived = now
+}
+
+// snapshot returns statistics of topics sorted by the number of messages in
+// descending order, and the number of evicted topics.
+func (s *topicStats) snapshot() ([]topicStat, int64) {
+	s.m.Lock()
+	res := make([]topicStat, 0, s.lru.Len())
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		res = append(res, *e.Value.(*topicStat))
+	}
+	evicted := s.evicted
+	s.m.Unlock()
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].messages > res[j].messages
+	})
+	return res, evicted
+}
+
+// value returns statistics of topics as an array of maps, and the number of
+// evicted topics.
+func (s *topicStats) value() (data.Array, int64) {
+	stats, evicted := s.snapshot()
+	a := make(data.Array, len(stats))
+	for i, st := range stats {
+		a[i] = data.Map{
+			"topic":            data.String(st.topic),
+			"messages":         data.Int(st.messages),
+			"bytes":            data.Int(st.bytes),
+			"last_received_at": data.Timestamp(st.lastReceived),
+		}
+	}
+	return a, evicted
+}
+
+// TopicStats is a UDF returning statistics of topics from which the MQTT
+// source having the given name has received messages. The source must be
+// generating a stream and have topic_stats_size. Statistics are sorted by the
+// number of messages in descending order, and each of them is a map like:
+//
+//	{
+//		"topic": "sensors/1/temperature",
+//		"messages": 120,
+//		"bytes": 2400,
+//		"last_received_at": <timestamp>
+//	}
+func TopicStats(ctx *core.Context, name string) (data.Value, error) {
+	for _, n := range Nodes() {
+		s, ok := n.(*source)
+		if !ok || s.Name() != name {
+			continue
+		}
+		if s.topicStats == nil {
+			return nil, fmt.Errorf("source '%v' doesn't have topic_stats_size", name)
+		}
+		a, _ := s.topicStats.value()
+		return a, nil
+	}
+	return nil, fmt.Errorf("source '%v' isn't an active MQTT source", name)
+}
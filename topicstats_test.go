@@ -0,0 +1,59 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseTopicStats(t *testing.T) {
+	for _, params := range []data.Map{{}, {"topic_stats_size": data.Int(0)}} {
+		if s, err := parseTopicStats(params); err != nil || s != nil {
+			t.Errorf("%v: statistics shouldn't be created: %v, %v", params, s, err)
+		}
+	}
+	if _, err := parseTopicStats(data.Map{"topic_stats_size": data.Int(-1)}); err == nil {
+		t.Error("a negative size should be rejected")
+	}
+}
+
+func TestTopicStats(t *testing.T) {
+	s, err := parseTopicStats(data.Map{"topic_stats_size": data.Int(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s.record("a", 10, now)
+	s.record("b", 1, now)
+	s.record("b", 2, now)
+	s.record("a", 10, now)
+	s.record("a", 10, now)
+	// b is evicted since a has been received more recently
+	s.record("c", 5, now)
+
+	stats, evicted := s.snapshot()
+	if evicted != 1 {
+		t.Errorf("wrong number of evicted topics: %v", evicted)
+	}
+	if len(stats) != 2 || stats[0].topic != "a" || stats[0].messages != 3 || stats[0].bytes != 30 ||
+		stats[1].topic != "c" || stats[1].messages != 1 {
+		t.Errorf("wrong statistics: %+v", stats)
+	}
+
+	src := &source{name: "stats", topicStats: s}
+	registerNode(src)
+	defer unregisterNode(src)
+	ctx := core.NewContext(nil)
+	v, err := TopicStats(ctx, "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := data.AsArray(v); len(a) != 2 {
+		t.Errorf("wrong statistics: %v", v)
+	}
+	if _, err := TopicStats(ctx, "undefined"); err == nil {
+		t.Error("an undefined source should be rejected")
+	}
+}
@@ -0,0 +1,119 @@
+package mqtt
+
+import (
+	"fmt"
+	"sync"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// Tracer creates spans of distributed tracing around messages handled by
+// sources and published by sinks. Trace contexts are passed as carriers,
+// which are maps of W3C Trace Context headers such as "traceparent" and
+// "tracestate". They're user properties of MQTT 5 messages, so a Tracer can
+// be implemented with OpenTelemetry's propagation.TraceContext and
+// propagation.MapCarrier. A Tracer is registered by RegisterTracer and
+// referred by the tracer parameter of the source and the sink.
+type Tracer interface {
+	// StartConsume starts a span of handling a message received from the
+	// topic by a source. parent has the trace context extracted from user
+	// properties of the message, and it's empty when the message doesn't
+	// have one. It returns the trace context of the new span, which is
+	// emitted with tuples of the message as the trace_context field, and a
+	// function ending the span.
+	StartConsume(ctx *core.Context, topic string, parent map[string]string) (map[string]string, func(err error))
+
+	// StartPublish starts a span of publishing a message to the topic by a
+	// sink. parent has the trace context in the trace_context field of the
+	// tuple. It returns the trace context of the new span, which is
+	// injected into user properties of the message, and a function ending
+	// the span.
+	StartPublish(ctx *core.Context, topic string, parent map[string]string) (map[string]string, func(err error))
+}
+
+var (
+	tracersMutex sync.RWMutex
+	tracers      = map[string]Tracer{}
+)
+
+// RegisterTracer registers a Tracer with the name. It fails when a tracer is
+// already registered with the name.
+func RegisterTracer(name string, t Tracer) error {
+	tracersMutex.Lock()
+	defer tracersMutex.Unlock()
+
+	if _, ok := tracers[name]; ok {
+		return fmt.Errorf("tracer '%v' is already registered", name)
+	}
+	tracers[name] = t
+	return nil
+}
+
+// MustRegisterTracer is like RegisterTracer but panics on failure.
+func MustRegisterTracer(name string, t Tracer) {
+	if err := RegisterTracer(name, t); err != nil {
+		panic(err)
+	}
+}
+
+func lookupTracer(name string) (Tracer, error) {
+	tracersMutex.RLock()
+	defer tracersMutex.RUnlock()
+
+	t, ok := tracers[name]
+	if !ok {
+		return nil, fmt.Errorf("tracer '%v' isn't registered", name)
+	}
+	return t, nil
+}
+
+// traceContextKeys are user properties having the W3C trace context.
+var traceContextKeys = []string{"traceparent", "tracestate"}
+
+// extractTraceContext returns the trace context in user properties of a
+// message. props is the map returned by v5Message.properties, and the first
+// value is used when a property is given more than once.
+func extractTraceContext(props data.Map) map[string]string {
+	carrier := map[string]string{}
+	user, ok := props["user_properties"].(data.Map)
+	if !ok {
+		return carrier
+	}
+	for _, k := range traceContextKeys {
+		v := user[k]
+		if a, ok := v.(data.Array); ok && len(a) > 0 {
+			v = a[0]
+		}
+		if s, ok := v.(data.String); ok {
+			carrier[k] = string(s)
+		}
+	}
+	return carrier
+}
+
+// traceContextFromTuple returns the trace context in the trace_context field
+// of the tuple, which is emitted by sources having a tracer.
+func traceContextFromTuple(t *core.Tuple) map[string]string {
+	carrier := map[string]string{}
+	m, ok := t.Data["trace_context"].(data.Map)
+	if !ok {
+		return carrier
+	}
+	for k, v := range m {
+		if s, ok := v.(data.String); ok {
+			carrier[k] = string(s)
+		}
+	}
+	return carrier
+}
+
+// traceContextValue converts the trace context into the value of the
+// trace_context field.
+func traceContextValue(carrier map[string]string) data.Map {
+	m := make(data.Map, len(carrier))
+	for k, v := range carrier {
+		m[k] = data.String(v)
+	}
+	return m
+}
@@ -0,0 +1,132 @@
+package mqtt
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// testTracer records parents of spans and returns trace contexts named after
+// the kinds of spans.
+type testTracer struct {
+	m       sync.Mutex
+	parents []map[string]string
+	errs    []error
+}
+
+func (tr *testTracer) start(parent map[string]string, kind string) (map[string]string, func(error)) {
+	tr.m.Lock()
+	defer tr.m.Unlock()
+	tr.parents = append(tr.parents, parent)
+	return map[string]string{"traceparent": parent["traceparent"] + "/" + kind}, func(err error) {
+		tr.m.Lock()
+		defer tr.m.Unlock()
+		tr.errs = append(tr.errs, err)
+	}
+}
+
+func (tr *testTracer) StartConsume(ctx *core.Context, topic string, parent map[string]string) (map[string]string, func(error)) {
+	return tr.start(parent, "consume")
+}
+
+func (tr *testTracer) StartPublish(ctx *core.Context, topic string, parent map[string]string) (map[string]string, func(error)) {
+	return tr.start(parent, "publish")
+}
+
+var sharedTestTracer = &testTracer{}
+
+func init() {
+	MustRegisterTracer("test_tracer", sharedTestTracer)
+}
+
+func TestExtractTraceContext(t *testing.T) {
+	cases := []struct {
+		props    data.Map
+		expected map[string]string
+	}{
+		{data.Map{}, map[string]string{}},
+		{data.Map{"user_properties": data.Map{
+			"traceparent": data.String("00-a"),
+			"tracestate":  data.Array{data.String("x=1"), data.String("y=2")},
+			"site":        data.String("tokyo"),
+		}}, map[string]string{"traceparent": "00-a", "tracestate": "x=1"}},
+	}
+	for _, c := range cases {
+		actual := extractTraceContext(c.props)
+		if len(actual) != len(c.expected) {
+			t.Errorf("expected %v, actual %v", c.expected, actual)
+			continue
+		}
+		for k, v := range c.expected {
+			if actual[k] != v {
+				t.Errorf("%v: expected %v, actual %v", k, v, actual[k])
+			}
+		}
+	}
+}
+
+func TestV5Tracing(t *testing.T) {
+	b := newFakeV5Broker(t, &packets.Publish{
+		Topic:   "in",
+		Payload: []byte("a"),
+		Properties: &packets.Properties{
+			User: []packets.User{{Key: "traceparent", Value: "00-root"}},
+		},
+	})
+	defer b.l.Close()
+
+	ctx := core.NewContext(nil)
+	src, err := NewSource(ctx, &bql.IOParams{}, data.Map{
+		"broker":           data.String(b.url()),
+		"topic":            data.String("in"),
+		"protocol_version": data.String("5"),
+		"tracer":           data.String("test_tracer"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snk, err := NewSink(ctx, &bql.IOParams{}, data.Map{
+		"broker":           data.String(b.url()),
+		"protocol_version": data.String("5"),
+		"tracer":           data.String("test_tracer"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snk.Close(ctx)
+
+	done := make(chan error, 1)
+	go func() {
+		// tuples of the source are published by the sink
+		done <- src.GenerateStream(ctx, core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+			return snk.Write(ctx, t)
+		}))
+	}()
+
+	p := b.next(t, packets.PUBLISH).Content.(*packets.Publish)
+	if len(p.Properties.User) != 1 || p.Properties.User[0].Value != "00-root/consume/publish" {
+		t.Errorf("wrong trace context: %v", p.Properties.User)
+	}
+
+	if err := src.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	sharedTestTracer.m.Lock()
+	defer sharedTestTracer.m.Unlock()
+	if len(sharedTestTracer.parents) != 2 || sharedTestTracer.parents[0]["traceparent"] != "00-root" {
+		t.Errorf("wrong parents of spans: %v", sharedTestTracer.parents)
+	}
+	for _, err := range sharedTestTracer.errs {
+		if err != nil {
+			t.Errorf("spans should end without errors: %v", err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// ttn decodes uplink messages published to
+// v3/<application>@<tenant>/devices/<device>/up by the MQTT integration of
+// The Things Stack (The Things Network v3). Other messages, such as join
+// accepts and downlink events, aren't emitted.
+type ttn struct{}
+
+// ttnUplink has fields of uplink messages used by the source.
+type ttnUplink struct {
+	EndDeviceIDs struct {
+		DeviceID       string `json:"device_id"`
+		DevEUI         string `json:"dev_eui"`
+		ApplicationIDs struct {
+			ApplicationID string `json:"application_id"`
+		} `json:"application_ids"`
+	} `json:"end_device_ids"`
+	ReceivedAt    time.Time `json:"received_at"`
+	UplinkMessage *struct {
+		FPort          int             `json:"f_port"`
+		FRMPayload     []byte          `json:"frm_payload"`
+		DecodedPayload json.RawMessage `json:"decoded_payload"`
+		RxMetadata     []struct {
+			GatewayIDs struct {
+				GatewayID string `json:"gateway_id"`
+			} `json:"gateway_ids"`
+			RSSI float64 `json:"rssi"`
+			SNR  float64 `json:"snr"`
+		} `json:"rx_metadata"`
+	} `json:"uplink_message"`
+}
+
+func (ttn) String() string {
+	return "ttn"
+}
+
+func (ttn) decode(topic string, payload []byte) ([]data.Map, error) {
+	levels := strings.Split(topic, "/")
+	if len(levels) != 5 || levels[0] != "v3" || levels[2] != "devices" || levels[4] != "up" {
+		return nil, nil
+	}
+	var up ttnUplink
+	if err := json.Unmarshal(payload, &up); err != nil {
+		return nil, err
+	}
+	msg := up.UplinkMessage
+	if msg == nil {
+		return nil, errors.New("the message doesn't have uplink_message")
+	}
+
+	d := data.Map{
+		"topic":          data.String(topic),
+		"device_id":      data.String(up.EndDeviceIDs.DeviceID),
+		"application_id": data.String(up.EndDeviceIDs.ApplicationIDs.ApplicationID),
+		"received_at":    data.Timestamp(up.ReceivedAt),
+		"f_port":         data.Int(msg.FPort),
+		"frm_payload":    data.Blob(msg.FRMPayload),
+	}
+	if up.EndDeviceIDs.DevEUI != "" {
+		d["dev_eui"] = data.String(up.EndDeviceIDs.DevEUI)
+	}
+	if len(msg.DecodedPayload) > 0 {
+		v, err := decodeJSON(msg.DecodedPayload)
+		if err != nil {
+			return nil, err
+		}
+		d["decoded_payload"] = v
+	}
+
+	// the metadata of the gateway which received the message best
+	best := -1
+	for i, m := range msg.RxMetadata {
+		if best < 0 || m.RSSI > msg.RxMetadata[best].RSSI {
+			best = i
+		}
+	}
+	if best >= 0 {
+		m := msg.RxMetadata[best]
+		d["rssi"] = data.Float(m.RSSI)
+		d["snr"] = data.Float(m.SNR)
+		d["gateway_id"] = data.String(m.GatewayIDs.GatewayID)
+	}
+	return []data.Map{d}, nil
+}
@@ -0,0 +1,55 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestTTNDecode(t *testing.T) {
+	payload := []byte(`{
+  "end_device_ids": {"device_id": "node-1", "application_ids": {"application_id": "sensors"}, "dev_eui": "0004A30B001C0530"},
+  "received_at": "2024-01-02T03:04:05.5Z",
+  "uplink_message": {
+    "f_port": 1,
+    "frm_payload": "AQI=",
+    "decoded_payload": {"temperature": 21.5},
+    "rx_metadata": [
+      {"gateway_ids": {"gateway_id": "far"}, "rssi": -110, "snr": -3.5},
+      {"gateway_ids": {"gateway_id": "near"}, "rssi": -42, "snr": 9.25}
+    ]
+  }
+}`)
+	ds, err := ttn{}.decode("v3/sensors@ttn/devices/node-1/up", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := data.Map{
+		"topic":           data.String("v3/sensors@ttn/devices/node-1/up"),
+		"device_id":       data.String("node-1"),
+		"application_id":  data.String("sensors"),
+		"dev_eui":         data.String("0004A30B001C0530"),
+		"received_at":     data.Timestamp(time.Date(2024, 1, 2, 3, 4, 5, 500000000, time.UTC)),
+		"f_port":          data.Int(1),
+		"frm_payload":     data.Blob{1, 2},
+		"decoded_payload": data.Map{"temperature": data.Float(21.5)},
+		"rssi":            data.Float(-42),
+		"snr":             data.Float(9.25),
+		"gateway_id":      data.String("near"),
+	}
+	if len(ds) != 1 || !data.Equal(expected, ds[0]) {
+		t.Errorf("expected %v, actual %v", expected, ds)
+	}
+
+	for _, topic := range []string{"v3/sensors@ttn/devices/node-1/join", "v3/sensors@ttn/devices/node-1/down/queued", "sensors/up"} {
+		if ds, err := (ttn{}).decode(topic, payload); err != nil || ds != nil {
+			t.Errorf("%v shouldn't be emitted: %v, %v", topic, ds, err)
+		}
+	}
+	for _, payload := range []string{`{}`, `up`} {
+		if _, err := (ttn{}).decode("v3/sensors@ttn/devices/node-1/up", []byte(payload)); err == nil {
+			t.Errorf("%v should be rejected", payload)
+		}
+	}
+}
@@ -0,0 +1,954 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	"github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// v5Client is a client of MQTT 5 brokers implementing mqtt.Client so that
+// it can be used in place of paho's MQTT 3.1.1 clients. It's built from the
+// same client options, but it doesn't retry the first connection, doesn't
+// persist sessions in stores, and doesn't support websockets.
+type v5Client struct {
+	opts *mqtt.ClientOptions
+
+	m         sync.Mutex
+	client    *paho.Client
+	connected bool
+
+	// closing is true when Disconnect is called so that the connection
+	// isn't reported as lost.
+	closing bool
+
+	// handlers is a map from topic filters to handlers of messages
+	// matching them.
+	handlers map[string]mqtt.MessageHandler
+
+	// subscribeOptions are applied to all subscriptions.
+	subscribeOptions v5SubscribeOptions
+
+	// redirect has the broker to which the broker redirected clients if it
+	// isn't nil. It's shared by clients created for the same node so that
+	// the next client connects to the broker.
+	redirect *v5Redirect
+
+	// subscriptionIDs is true when subscription identifiers are assigned to
+	// topic filters. filterIDs and idFilters map filters and identifiers
+	// to each other.
+	subscriptionIDs bool
+	filterIDs       map[string]int
+	idFilters       map[int]string
+
+	// logs writes internal logs of paho.golang if it isn't nil.
+	logs *pahoLogTarget
+
+	// session is the state of the persistent session shared by connections
+	// if it isn't nil. The broker keeps the session for sessionExpiry
+	// seconds after the connection is closed.
+	session       *state.State
+	sessionExpiry uint32
+
+	// receiveMaximum is the number of unacknowledged QoS 1 and 2 messages
+	// the broker can send at once. It isn't sent to the broker when it's 0.
+	receiveMaximum uint16
+
+	// authenticator performs enhanced authentication with the method
+	// authMethod on each connection if it isn't nil.
+	authMethod    string
+	authenticator Authenticator
+
+	// willProperties are sent with the will message if it isn't nil.
+	willProperties *paho.WillProperties
+
+	// keepAlive is the keepalive of the current connection, which is the
+	// Server Keep Alive when the broker overrides the requested one.
+	keepAlive time.Duration
+}
+
+func newV5Client(opts *mqtt.ClientOptions) *v5Client {
+	return &v5Client{
+		opts:      opts,
+		handlers:  map[string]mqtt.MessageHandler{},
+		filterIDs: map[string]int{},
+		idFilters: map[int]string{},
+	}
+}
+
+func (c *v5Client) IsConnected() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.connected
+}
+
+func (c *v5Client) IsConnectionOpen() bool {
+	return c.IsConnected()
+}
+
+func (c *v5Client) Connect() mqtt.Token {
+	return runV5Token(c.connect)
+}
+
+// connect connects to the brokers in order until one of them accepts the
+// connection.
+func (c *v5Client) connect() error {
+	if len(c.opts.Servers) == 0 {
+		return errors.New("no broker is specified")
+	}
+	// brokers are copied since redirects are inserted into them
+	servers := append([]*url.URL(nil), c.opts.Servers...)
+	if u := c.redirect.take(); u != nil {
+		servers = append([]*url.URL{u}, servers...)
+	}
+	var err error
+	redirects := 0
+	for i := 0; i < len(servers); i++ {
+		if err = c.connectTo(servers[i]); err == nil {
+			return nil
+		}
+		c.redirect.failed(servers[i])
+		// the broker may refuse the connection and redirect the client to
+		// another broker, which is tried right away
+		if u := c.redirect.take(); u != nil && redirects < maxV5Redirects {
+			redirects++
+			servers = append(servers[:i+1], append([]*url.URL{u}, servers[i+1:]...)...)
+		}
+	}
+	return err
+}
+
+func (c *v5Client) connectTo(u *url.URL) error {
+	cfg := c.opts.TLSConfig
+	if c.opts.OnConnectAttempt != nil {
+		cfg = c.opts.OnConnectAttempt(u, cfg)
+	}
+	nc, err := c.dial(u, cfg)
+	if err != nil {
+		return err
+	}
+	conn := &headConn{Conn: nc}
+
+	var (
+		client *paho.Client
+		once   sync.Once
+	)
+	lost := func(err error) {
+		once.Do(func() {
+			c.lost(client, err)
+		})
+	}
+	pc := paho.ClientConfig{
+		Conn: conn,
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+			func(r paho.PublishReceived) (bool, error) {
+				c.route(&v5Message{p: r.Packet, client: r.Client, manualAck: c.opts.AutoAckDisabled})
+				return true, nil
+			},
+		},
+		OnClientError: lost,
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			if d.Properties != nil {
+				c.redirect.set(u, d.ReasonCode, d.Properties.ServerReference)
+			}
+			lost(&v5ReasonError{
+				code: d.ReasonCode,
+				err:  fmt.Errorf("the broker disconnected the client: reason code %v", d.ReasonCode),
+			})
+		},
+		EnableManualAcknowledgment: c.opts.AutoAckDisabled,
+	}
+	if c.session != nil {
+		pc.Session = c.session
+	}
+	var (
+		auther   *v5Auther
+		authData []byte
+	)
+	if c.authenticator != nil {
+		exchange, d, err := c.authenticator.Start()
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("authentication method '%v' failed: %v", c.authMethod, err)
+		}
+		auther = &v5Auther{method: c.authMethod, exchange: exchange, conn: conn}
+		authData = d
+		pc.AuthHandler = auther
+	}
+	client = paho.NewClient(pc)
+	if l := c.logs.logger(pahoLogError); l != nil {
+		client.SetErrorLogger(l)
+	}
+	if l := c.logs.logger(pahoLogDebug); l != nil {
+		client.SetDebugLogger(l)
+	}
+
+	cp := &paho.Connect{
+		ClientID:   c.opts.ClientID,
+		KeepAlive:  uint16(c.opts.KeepAlive),
+		CleanStart: c.opts.CleanSession,
+	}
+	if c.session != nil {
+		// in-flight messages in the session are resent when the broker
+		// still has the session
+		expiry := c.sessionExpiry
+		cp.CleanStart = false
+		cp.Properties = &paho.ConnectProperties{SessionExpiryInterval: &expiry}
+	}
+	if c.receiveMaximum > 0 {
+		if cp.Properties == nil {
+			cp.Properties = &paho.ConnectProperties{}
+		}
+		receiveMaximum := c.receiveMaximum
+		cp.Properties.ReceiveMaximum = &receiveMaximum
+	}
+	if auther != nil {
+		if cp.Properties == nil {
+			cp.Properties = &paho.ConnectProperties{}
+		}
+		cp.Properties.AuthMethod = c.authMethod
+		cp.Properties.AuthData = authData
+	}
+	user, password := c.opts.Username, c.opts.Password
+	if c.opts.CredentialsProvider != nil {
+		user, password = c.opts.CredentialsProvider()
+	}
+	if user != "" {
+		cp.Username, cp.UsernameFlag = user, true
+	}
+	if password != "" {
+		cp.Password, cp.PasswordFlag = []byte(password), true
+	}
+	if c.opts.WillEnabled {
+		cp.WillMessage = &paho.WillMessage{
+			Retain:  c.opts.WillRetained,
+			QoS:     c.opts.WillQos,
+			Topic:   c.opts.WillTopic,
+			Payload: c.opts.WillPayload,
+		}
+		cp.WillProperties = c.willProperties
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	ca, err := client.Connect(ctx, cp)
+	if err != nil {
+		conn.Close()
+		if ca != nil && ca.Properties != nil {
+			c.redirect.set(u, ca.ReasonCode, ca.Properties.ServerReference)
+		}
+		if conn.rejectsVersion() || (ca != nil && ca.ReasonCode == v5UnsupportedProtocolVersion) {
+			return errV5Unsupported
+		}
+		if auther != nil && auther.error() != nil {
+			return auther.error()
+		}
+		return err
+	}
+	if auther != nil {
+		var data []byte
+		if ca.Properties != nil {
+			data = ca.Properties.AuthData
+		}
+		if err := auther.finish(data); err != nil {
+			client.Disconnect(&paho.Disconnect{})
+			return err
+		}
+	}
+
+	keepAlive := cp.KeepAlive
+	if ca.Properties != nil && ca.Properties.ServerKeepAlive != nil {
+		keepAlive = *ca.Properties.ServerKeepAlive
+	}
+
+	c.m.Lock()
+	c.client = client
+	c.connected = true
+	c.closing = false
+	c.keepAlive = time.Duration(keepAlive) * time.Second
+	c.m.Unlock()
+	if c.opts.OnConnect != nil {
+		go c.opts.OnConnect(c)
+	}
+	return nil
+}
+
+// dial opens a connection to the broker. A custom function set to the
+// options is used if any.
+func (c *v5Client) dial(u *url.URL, cfg *tls.Config) (net.Conn, error) {
+	if c.opts.CustomOpenConnectionFn != nil {
+		return c.opts.CustomOpenConnectionFn(u, *c.opts)
+	}
+	d := &net.Dialer{Timeout: c.opts.ConnectTimeout}
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		return d.Dial("tcp", u.Host)
+	case "unix":
+		// unix://socket.sock has a relative path in the host
+		if u.Host != "" {
+			return d.Dial("unix", u.Host)
+		}
+		return d.Dial("unix", u.Path)
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		return tls.DialWithDialer(d, "tcp", u.Host, cfg)
+	default:
+		return nil, fmt.Errorf("scheme %v isn't supported by MQTT 5 clients", u.Scheme)
+	}
+}
+
+// lost marks the client disconnected and calls the connection lost handler
+// unless the client is being disconnected on purpose. Errors of clients
+// which have been replaced or haven't connected are ignored.
+func (c *v5Client) lost(client *paho.Client, err error) {
+	c.m.Lock()
+	if c.client != client {
+		c.m.Unlock()
+		return
+	}
+	closing := c.closing
+	c.connected = false
+	c.m.Unlock()
+	if closing {
+		return
+	}
+	if c.opts.OnConnectionLost != nil {
+		c.opts.OnConnectionLost(c, err)
+	}
+	if c.opts.AutoReconnect {
+		go c.reconnect()
+	}
+}
+
+// reconnect connects to the broker again after the connection is lost. Like
+// paho's automatic reconnect, the interval between attempts starts from a
+// second and doubles up to MaxReconnectInterval. It gives up when
+// Disconnect is called.
+func (c *v5Client) reconnect() {
+	wait := time.Second
+	for {
+		c.m.Lock()
+		closing := c.closing
+		c.m.Unlock()
+		if closing {
+			return
+		}
+		if err := c.connect(); err == nil {
+			return
+		}
+		time.Sleep(wait)
+		if wait *= 2; c.opts.MaxReconnectInterval > 0 && wait > c.opts.MaxReconnectInterval {
+			wait = c.opts.MaxReconnectInterval
+		}
+	}
+}
+
+// route calls the handler of the topic filter whose subscription identifier
+// the message has, or the first topic filter matching the message.
+func (c *v5Client) route(m *v5Message) {
+	c.m.Lock()
+	var h mqtt.MessageHandler
+	if props := m.p.Properties; props != nil && props.SubscriptionIdentifier != nil {
+		id := *props.SubscriptionIdentifier
+		if f, ok := c.idFilters[id]; ok {
+			m.subscriptionID, m.filter = id, f
+			h = c.handlers[f]
+		}
+	}
+	if h == nil {
+		for f, fh := range c.handlers {
+			if topicMatches(sharedTopicFilter(f), m.Topic()) {
+				h = fh
+				break
+			}
+		}
+	}
+	c.m.Unlock()
+	if h == nil {
+		h = c.opts.DefaultPublishHandler
+	}
+	if h == nil {
+		m.Ack()
+		return
+	}
+	h(c, m)
+}
+
+// sharedTopicFilter returns the topic filter of a shared subscription like
+// "$share/group/filter".
+func sharedTopicFilter(f string) string {
+	if !strings.HasPrefix(f, "$share/") {
+		return f
+	}
+	ls := strings.SplitN(f, "/", 3)
+	if len(ls) < 3 {
+		return f
+	}
+	return ls[2]
+}
+
+// context returns a context of a request timing out after ConnectTimeout.
+func (c *v5Client) context() (context.Context, context.CancelFunc) {
+	if c.opts.ConnectTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), c.opts.ConnectTimeout)
+}
+
+// current returns the underlying client if it's connected.
+func (c *v5Client) current() (*paho.Client, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if !c.connected {
+		return nil, mqtt.ErrNotConnected
+	}
+	return c.client, nil
+}
+
+func (c *v5Client) Disconnect(quiesce uint) {
+	c.m.Lock()
+	client, connected := c.client, c.connected
+	c.closing = true
+	c.connected = false
+	c.m.Unlock()
+	if client != nil && connected {
+		client.Disconnect(&paho.Disconnect{})
+	}
+}
+
+func (c *v5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	switch v := payload.(type) {
+	case []byte:
+		return c.publishWithProperties(topic, qos, retained, v, nil)
+	case string:
+		return c.publishWithProperties(topic, qos, retained, []byte(v), nil)
+	default:
+		return runV5Token(func() error {
+			return fmt.Errorf("unsupported type of payload: %T", payload)
+		})
+	}
+}
+
+// propertiesPublisher is a client which can publish messages having MQTT 5
+// user properties.
+type propertiesPublisher interface {
+	publishWithProperties(topic string, qos byte, retained bool, payload []byte, user map[string]string) mqtt.Token
+}
+
+// publishWithProperties publishes a message having the user properties.
+func (c *v5Client) publishWithProperties(topic string, qos byte, retained bool, payload []byte, user map[string]string) mqtt.Token {
+	return runV5Token(func() error {
+		client, err := c.current()
+		if err != nil {
+			return err
+		}
+		p := &paho.Publish{
+			Topic:   topic,
+			QoS:     qos,
+			Retain:  retained,
+			Payload: payload,
+		}
+		if len(user) > 0 {
+			keys := make([]string, 0, len(user))
+			for k := range user {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			p.Properties = &paho.PublishProperties{}
+			for _, k := range keys {
+				p.Properties.User.Add(k, user[k])
+			}
+		}
+		ctx, cancel := c.context()
+		defer cancel()
+		if r, err := client.Publish(ctx, p); err != nil {
+			if r != nil && r.ReasonCode >= 0x80 {
+				return &v5ReasonError{code: r.ReasonCode, err: err}
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+func (c *v5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (c *v5Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	return runV5Token(func() error {
+		client, err := c.current()
+		if err != nil {
+			return err
+		}
+		// a subscription identifier applies to all filters in a SUBSCRIBE
+		// packet, so each filter is subscribed separately when identifiers
+		// are assigned
+		var subs []*paho.Subscribe
+		for f, q := range filters {
+			o := paho.SubscribeOptions{
+				Topic:             f,
+				QoS:               q,
+				NoLocal:           c.subscribeOptions.noLocal,
+				RetainAsPublished: c.subscribeOptions.retainAsPublished,
+				RetainHandling:    c.subscribeOptions.retainHandling,
+			}
+			if c.subscriptionIDs {
+				id := c.subscriptionID(f)
+				subs = append(subs, &paho.Subscribe{
+					Properties:    &paho.SubscribeProperties{SubscriptionIdentifier: &id},
+					Subscriptions: []paho.SubscribeOptions{o},
+				})
+				continue
+			}
+			if len(subs) == 0 {
+				subs = append(subs, &paho.Subscribe{})
+			}
+			subs[0].Subscriptions = append(subs[0].Subscriptions, o)
+		}
+		if callback != nil {
+			// handlers are added first not to drop retained messages sent
+			// before SUBACK
+			for f := range filters {
+				c.AddRoute(f, callback)
+			}
+		}
+		for _, sub := range subs {
+			ctx, cancel := c.context()
+			_, err = client.Subscribe(ctx, sub)
+			cancel()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// subscriptionID returns the subscription identifier of the topic filter,
+// assigning a new one unless the filter has been subscribed before.
+func (c *v5Client) subscriptionID(filter string) int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if id, ok := c.filterIDs[filter]; ok {
+		return id
+	}
+	id := len(c.filterIDs) + 1
+	c.filterIDs[filter] = id
+	c.idFilters[id] = filter
+	return id
+}
+
+func (c *v5Client) Unsubscribe(topics ...string) mqtt.Token {
+	return runV5Token(func() error {
+		client, err := c.current()
+		if err != nil {
+			return err
+		}
+		c.m.Lock()
+		for _, t := range topics {
+			delete(c.handlers, t)
+		}
+		c.m.Unlock()
+		ctx, cancel := c.context()
+		defer cancel()
+		_, err = client.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+		return err
+	})
+}
+
+func (c *v5Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.handlers[topic] = callback
+}
+
+// effectiveKeepAlive returns the keepalive of the current connection.
+func (c *v5Client) effectiveKeepAlive() time.Duration {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.keepAlive
+}
+
+// keepAliveReporter is implemented by clients whose keepalive can be
+// overridden by the broker.
+type keepAliveReporter interface {
+	effectiveKeepAlive() time.Duration
+}
+
+// keepAliveOf returns the keepalive with which c pings the broker.
+func keepAliveOf(c mqtt.Client) time.Duration {
+	if r, ok := c.(keepAliveReporter); ok {
+		return r.effectiveKeepAlive()
+	}
+	r := c.OptionsReader()
+	return r.KeepAlive()
+}
+
+// OptionsReader returns a reader of the options having 5 as the protocol
+// version.
+func (c *v5Client) OptionsReader() mqtt.ClientOptionsReader {
+	o := *c.opts
+	o.ProtocolVersion = 5
+	return mqtt.NewOptionsReader(&o)
+}
+
+// Reason codes of CONNACK and DISCONNECT redirecting clients to another
+// broker.
+const (
+	v5UseAnotherServer byte = 0x9c
+	v5ServerMoved      byte = 0x9d
+)
+
+// v5UnsupportedProtocolVersion is the reason code of CONNACK rejecting the
+// protocol version.
+const v5UnsupportedProtocolVersion byte = 0x84
+
+// Reason codes of PUBACK and DISCONNECT telling that the client exceeds
+// limits of the broker.
+const (
+	v5MessageRateTooHigh byte = 0x96
+	v5QuotaExceeded      byte = 0x97
+)
+
+// v5ReasonError is an error caused by a packet having a reason code of a
+// failure.
+type v5ReasonError struct {
+	code byte
+	err  error
+}
+
+func (e *v5ReasonError) Error() string {
+	return e.err.Error()
+}
+
+func (e *v5ReasonError) Unwrap() error {
+	return e.err
+}
+
+// v5ReasonCode returns the reason code causing err. It returns false when err
+// isn't caused by a packet of MQTT 5.
+func v5ReasonCode(err error) (byte, bool) {
+	var e *v5ReasonError
+	if errors.As(err, &e) {
+		return e.code, true
+	}
+	return 0, false
+}
+
+// errV5Unsupported is returned when the broker rejects MQTT 5.
+var errV5Unsupported = errors.New("the broker doesn't support MQTT 5")
+
+// headConn is a connection recording the first bytes read from it, so that
+// CONNACK of MQTT 3.1.1, which cannot be parsed as MQTT 5, can be detected.
+type headConn struct {
+	net.Conn
+
+	m    sync.Mutex
+	head []byte
+}
+
+func (c *headConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.m.Lock()
+	for i := 0; i < n && len(c.head) < 4; i++ {
+		c.head = append(c.head, b[i])
+	}
+	c.m.Unlock()
+	return n, err
+}
+
+// rejectsVersion returns true when the broker responded with CONNACK of
+// MQTT 3.1 or 3.1.1 having "unacceptable protocol version".
+func (c *headConn) rejectsVersion() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return len(c.head) == 4 && c.head[0] == 0x20 && c.head[1] == 0x02 && c.head[3] == 0x01
+}
+
+// maxV5Redirects is the maximum number of redirects followed in an attempt
+// to connect, which prevents brokers redirecting clients to each other from
+// looping forever.
+const maxV5Redirects = 3
+
+// v5Redirect has the broker to which a client has been redirected by Server
+// Reference of CONNACK or DISCONNECT. A broker of "Use another server" is
+// only used for the next connection, and a broker of "Server moved" is used
+// until connecting to it fails. Methods can be called on nil, which never
+// redirects clients.
+type v5Redirect struct {
+	m         sync.Mutex
+	url       *url.URL
+	permanent bool
+}
+
+// set records the broker referenced by ref if the reason code redirects the
+// client. ref is a space separated list of brokers like "host:1883", and
+// the first one is used with the scheme of the current broker.
+func (r *v5Redirect) set(current *url.URL, code byte, ref string) {
+	if r == nil || (code != v5UseAnotherServer && code != v5ServerMoved) {
+		return
+	}
+	fs := strings.Fields(ref)
+	if len(fs) == 0 {
+		return
+	}
+	u, err := serverReferenceURL(current, fs[0])
+	if err != nil {
+		return
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.url = u
+	r.permanent = code == v5ServerMoved
+}
+
+// serverReferenceURL returns the URL of a broker referenced by Server
+// Reference.
+func serverReferenceURL(current *url.URL, ref string) (*url.URL, error) {
+	if strings.Contains(ref, "://") {
+		return url.Parse(ref)
+	}
+	u := *current
+	if _, _, err := net.SplitHostPort(ref); err != nil {
+		// the port of the current broker is used when it's omitted
+		if _, port, err := net.SplitHostPort(current.Host); err == nil {
+			ref = net.JoinHostPort(ref, port)
+		}
+	}
+	u.Host = ref
+	return &u, nil
+}
+
+// take returns the broker to connect to, or nil if the client isn't
+// redirected.
+func (r *v5Redirect) take() *url.URL {
+	if r == nil {
+		return nil
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	u := r.url
+	if !r.permanent {
+		r.url = nil
+	}
+	return u
+}
+
+// failed forgets the broker of "Server moved" when connecting to it fails.
+func (r *v5Redirect) failed(u *url.URL) {
+	if r == nil {
+		return
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.url != nil && r.url.String() == u.String() {
+		r.url = nil
+	}
+}
+
+// v5SubscribeOptions has options of MQTT 5 subscriptions.
+type v5SubscribeOptions struct {
+	// noLocal is true when messages published by the client itself aren't
+	// delivered to it.
+	noLocal bool
+
+	// retainAsPublished is true when the retain flag of messages forwarded
+	// by the broker is kept as it was published.
+	retainAsPublished bool
+
+	// retainHandling is when retained messages are sent: 0 on every
+	// subscription, 1 only on new subscriptions, and 2 never.
+	retainHandling byte
+}
+
+// parseV5SubscribeOptions parses no_local, retain_as_published, and
+// retain_handling parameters. It also returns true when any of them is
+// given.
+func parseV5SubscribeOptions(params data.Map) (v5SubscribeOptions, bool, error) {
+	var (
+		o     v5SubscribeOptions
+		given bool
+	)
+	if v, ok := params["no_local"]; ok {
+		b, err := data.AsBool(v)
+		if err != nil {
+			return o, false, err
+		}
+		o.noLocal = b
+		given = true
+	}
+	if v, ok := params["retain_as_published"]; ok {
+		b, err := data.AsBool(v)
+		if err != nil {
+			return o, false, err
+		}
+		o.retainAsPublished = b
+		given = true
+	}
+	if v, ok := params["retain_handling"]; ok {
+		h, err := data.AsInt(v)
+		if err != nil {
+			return o, false, err
+		}
+		if h < 0 || h > 2 {
+			return o, false, errors.New("retain_handling must be 0, 1, or 2")
+		}
+		o.retainHandling = byte(h)
+		given = true
+	}
+	return o, given, nil
+}
+
+func (o v5SubscribeOptions) config(c data.Map) {
+	c["no_local"] = data.Bool(o.noLocal)
+	c["retain_as_published"] = data.Bool(o.retainAsPublished)
+	c["retain_handling"] = data.Int(o.retainHandling)
+}
+
+// v5Token is a token completed when a request of v5Client finishes.
+type v5Token struct {
+	done chan struct{}
+	err  error
+}
+
+// runV5Token runs f in a new goroutine and returns the token completed with
+// the error returned from f.
+func runV5Token(f func() error) *v5Token {
+	t := &v5Token{done: make(chan struct{})}
+	go func() {
+		defer close(t.done)
+		t.err = f()
+	}()
+	return t
+}
+
+func (t *v5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *v5Token) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *v5Token) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *v5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// v5Message is a message received by v5Client. It has MQTT 5 properties in
+// addition to the fields of MQTT 3.1.1 messages.
+type v5Message struct {
+	p      *paho.Publish
+	client *paho.Client
+
+	// manualAck is true when the message must be acknowledged by Ack.
+	manualAck bool
+	ackOnce   sync.Once
+
+	// subscriptionID is the subscription identifier assigned by the client
+	// to the topic filter the message matched, or 0 if it's unknown.
+	subscriptionID int
+	filter         string
+}
+
+func (m *v5Message) Duplicate() bool {
+	return m.p.Duplicate()
+}
+
+func (m *v5Message) Qos() byte {
+	return m.p.QoS
+}
+
+func (m *v5Message) Retained() bool {
+	return m.p.Retain
+}
+
+func (m *v5Message) Topic() string {
+	return m.p.Topic
+}
+
+func (m *v5Message) MessageID() uint16 {
+	return m.p.PacketID
+}
+
+func (m *v5Message) Payload() []byte {
+	return m.p.Payload
+}
+
+func (m *v5Message) Ack() {
+	if !m.manualAck {
+		return
+	}
+	m.ackOnce.Do(func() {
+		m.client.Ack(m.p)
+	})
+}
+
+// properties returns the user properties, the content type, the
+// correlation data, and the response topic of the message as fields of
+// tuples. Properties which the message doesn't have are omitted. Values of
+// user properties having the same key are joined into an array. The
+// subscription identifier and the topic filter are also added when they're
+// known.
+func (m *v5Message) properties() data.Map {
+	d := data.Map{}
+	if m.subscriptionID != 0 {
+		d["subscription_id"] = data.Int(m.subscriptionID)
+		d["subscription_filter"] = data.String(m.filter)
+	}
+	props := m.p.Properties
+	if props == nil {
+		return d
+	}
+	if len(props.User) > 0 {
+		user := data.Map{}
+		for _, p := range props.User {
+			switch v := user[p.Key].(type) {
+			case nil:
+				user[p.Key] = data.String(p.Value)
+			case data.Array:
+				user[p.Key] = append(v, data.String(p.Value))
+			default:
+				user[p.Key] = data.Array{v, data.String(p.Value)}
+			}
+		}
+		d["user_properties"] = user
+	}
+	if props.ContentType != "" {
+		d["content_type"] = data.String(props.ContentType)
+	}
+	if props.CorrelationData != nil {
+		d["correlation_data"] = data.Blob(props.CorrelationData)
+	}
+	if props.ResponseTopic != "" {
+		d["response_topic"] = data.String(props.ResponseTopic)
+	}
+	return d
+}
@@ -0,0 +1,868 @@
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/sensorbee/sensorbee.v0/bql"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// fakeV5Broker is an MQTT 5 broker accepting connections of clients. It
+// publishes messages to clients when they subscribe.
+type fakeV5Broker struct {
+	l        net.Listener
+	messages []*packets.Publish
+	packets  chan *packets.ControlPacket
+
+	// connack is sent to clients instead of a successful CONNACK if it
+	// isn't nil.
+	connack *packets.Connack
+
+	// properties are sent with a successful CONNACK if it isn't nil.
+	properties *packets.Properties
+
+	// challenge is sent in AUTH when a client connects with an
+	// authentication method if it isn't nil. CONNACK is sent after the
+	// client replies to it.
+	challenge []byte
+}
+
+func newFakeV5Broker(t *testing.T, messages ...*packets.Publish) *fakeV5Broker {
+	return startFakeV5Broker(t, &fakeV5Broker{messages: messages})
+}
+
+// startFakeV5Broker starts the broker configured by the caller.
+func startFakeV5Broker(t *testing.T, b *fakeV5Broker) *fakeV5Broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.l = l
+	b.packets = make(chan *packets.ControlPacket, 100)
+	go b.run()
+	return b
+}
+
+func (b *fakeV5Broker) url() string {
+	return "tcp://" + b.l.Addr().String()
+}
+
+func (b *fakeV5Broker) run() {
+	for {
+		conn, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(conn)
+	}
+}
+
+func (b *fakeV5Broker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		b.packets <- p
+		switch c := p.Content.(type) {
+		case *packets.Connect:
+			if b.connack != nil {
+				b.connack.WriteTo(conn)
+				return
+			}
+			if b.challenge != nil && c.Properties != nil && c.Properties.AuthMethod != "" {
+				(&packets.Auth{
+					ReasonCode: packets.AuthContinueAuthentication,
+					Properties: &packets.Properties{AuthMethod: c.Properties.AuthMethod, AuthData: b.challenge},
+				}).WriteTo(conn)
+				continue
+			}
+			b.accept(conn)
+		case *packets.Auth:
+			b.accept(conn)
+		case *packets.Subscribe:
+			reasons := make([]byte, len(c.Subscriptions))
+			for i, s := range c.Subscriptions {
+				reasons[i] = s.QoS
+			}
+			(&packets.Suback{PacketID: c.PacketID, Reasons: reasons, Properties: &packets.Properties{}}).WriteTo(conn)
+			for _, m := range b.messages {
+				m.WriteTo(conn)
+			}
+		case *packets.Unsubscribe:
+			reasons := make([]byte, len(c.Topics))
+			(&packets.Unsuback{PacketID: c.PacketID, Reasons: reasons, Properties: &packets.Properties{}}).WriteTo(conn)
+		case *packets.Pingreq:
+			(&packets.Pingresp{}).WriteTo(conn)
+		case *packets.Disconnect:
+			return
+		}
+	}
+}
+
+// accept sends a successful CONNACK.
+func (b *fakeV5Broker) accept(conn net.Conn) {
+	props := b.properties
+	if props == nil {
+		props = &packets.Properties{}
+	}
+	(&packets.Connack{Properties: props}).WriteTo(conn)
+}
+
+// next returns the next packet of the type received by the broker.
+func (b *fakeV5Broker) next(t *testing.T, typ byte) *packets.ControlPacket {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case p := <-b.packets:
+			if p.Type == typ {
+				return p
+			}
+		case <-timeout:
+			t.Fatalf("the broker didn't receive a packet of type %v", typ)
+		}
+	}
+}
+
+func TestV5Source(t *testing.T) {
+	b := newFakeV5Broker(t, &packets.Publish{
+		Topic:   "sensors/a",
+		Payload: []byte(`{"v":1}`),
+		Properties: &packets.Properties{
+			ContentType:     "application/json",
+			ResponseTopic:   "replies/a",
+			CorrelationData: []byte{1, 2},
+			User: []packets.User{
+				{Key: "site", Value: "tokyo"},
+				{Key: "tag", Value: "x"},
+				{Key: "tag", Value: "y"},
+			},
+		},
+	}, &packets.Publish{
+		Topic:      "sensors/b",
+		Payload:    []byte(`{"v":2}`),
+		Properties: &packets.Properties{},
+	})
+	defer b.l.Close()
+
+	ctx := core.NewContext(nil)
+	src, err := NewSource(ctx, &bql.IOParams{Name: "v5"}, data.Map{
+		"broker":           data.String(b.url()),
+		"topic":            data.String("sensors/#"),
+		"format":           data.String("json"),
+		"protocol_version": data.String("5"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuples := make(chan *core.Tuple, 2)
+	done := make(chan error, 1)
+	go func() {
+		done <- src.GenerateStream(ctx, core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+			tuples <- t
+			return nil
+		}))
+	}()
+
+	connect := b.next(t, packets.CONNECT).Content.(*packets.Connect)
+	if connect.ProtocolVersion != 5 {
+		t.Errorf("wrong protocol version: %v", connect.ProtocolVersion)
+	}
+	sub := b.next(t, packets.SUBSCRIBE).Content.(*packets.Subscribe)
+	if len(sub.Subscriptions) != 1 || sub.Subscriptions[0].Topic != "sensors/#" {
+		t.Errorf("wrong subscription: %v", sub)
+	}
+
+	expected := []data.Map{{
+		"topic":            data.String("sensors/a"),
+		"payload":          data.Map{"v": data.Int(1)},
+		"content_type":     data.String("application/json"),
+		"response_topic":   data.String("replies/a"),
+		"correlation_data": data.Blob{1, 2},
+		"user_properties": data.Map{
+			"site": data.String("tokyo"),
+			"tag":  data.Array{data.String("x"), data.String("y")},
+		},
+	}, {
+		"topic":   data.String("sensors/b"),
+		"payload": data.Map{"v": data.Int(2)},
+	}}
+	for _, e := range expected {
+		select {
+		case tu := <-tuples:
+			if !data.Equal(e, tu.Data) {
+				t.Errorf("expected %v, actual %v", e, tu.Data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the message wasn't emitted")
+		}
+	}
+
+	st := findNode(t, "source", "v5").Status()
+	for k, v := range map[string]data.Value{
+		"connected":      data.Bool(true),
+		"broker":         data.String(b.url()),
+		"reconnects":     data.Int(0),
+		"received":       data.Int(2),
+		"received_bytes": data.Int(14),
+		"decode_errors":  data.Int(0),
+	} {
+		if !data.Equal(v, st[k]) {
+			t.Errorf("%v: expected %v, actual %v", k, v, st[k])
+		}
+	}
+	if _, ok := st["last_received_at"]; !ok {
+		t.Error("the status should have the time of the last message")
+	}
+
+	if err := src.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	b.next(t, packets.DISCONNECT)
+}
+
+func TestV5SourceAckAfterWrite(t *testing.T) {
+	for _, failing := range []bool{false, true} {
+		b := newFakeV5Broker(t, &packets.Publish{
+			Topic:      "sensors/a",
+			QoS:        1,
+			PacketID:   1,
+			Payload:    []byte("1"),
+			Properties: &packets.Properties{},
+		})
+		defer b.l.Close()
+
+		ctx := core.NewContext(nil)
+		src, err := NewSource(ctx, &bql.IOParams{}, data.Map{
+			"broker":           data.String(b.url()),
+			"topic":            data.String("sensors/#"),
+			"protocol_version": data.String("5"),
+			"qos":              data.Int(1),
+			"client_id":        data.String("sensorbee-test"),
+			"clean_session":    data.Bool(false),
+			"ack_after_write":  data.Bool(true),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		written := make(chan struct{}, 1)
+		done := make(chan error, 1)
+		go func() {
+			done <- src.GenerateStream(ctx, core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+				written <- struct{}{}
+				if failing {
+					return errors.New("cannot write")
+				}
+				return nil
+			}))
+		}()
+
+		connect := b.next(t, packets.CONNECT).Content.(*packets.Connect)
+		if connect.ClientID != "sensorbee-test" || connect.CleanStart {
+			t.Errorf("the source should connect with the persistent session: %v, %v", connect.ClientID, connect.CleanStart)
+		}
+		sub := b.next(t, packets.SUBSCRIBE).Content.(*packets.Subscribe)
+		if len(sub.Subscriptions) != 1 || sub.Subscriptions[0].QoS != 1 {
+			t.Errorf("the topic should be subscribed with QoS 1: %v", sub)
+		}
+		select {
+		case <-written:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the message should be written")
+		}
+		if !failing {
+			if ack := b.next(t, packets.PUBACK).Content.(*packets.Puback); ack.PacketID != 1 {
+				t.Errorf("wrong acknowledgment: %v", ack)
+			}
+		} else {
+			// give the source time to acknowledge the message by mistake
+			time.Sleep(50 * time.Millisecond)
+		}
+		src.Stop(ctx)
+		<-done
+
+		if !failing {
+			continue
+		}
+		for disconnected := false; !disconnected; {
+			select {
+			case p := <-b.packets:
+				if p.Type == packets.PUBACK {
+					t.Error("the message shouldn't be acknowledged when the tuple isn't written")
+				}
+				disconnected = p.Type == packets.DISCONNECT
+			case <-time.After(5 * time.Second):
+				t.Fatal("the client should disconnect")
+			}
+		}
+	}
+}
+
+func TestV5SourceAckBatch(t *testing.T) {
+	publish := func(id uint16) *packets.Publish {
+		return &packets.Publish{
+			Topic:      "a",
+			QoS:        1,
+			PacketID:   id,
+			Payload:    []byte{byte('0' + id)},
+			Properties: &packets.Properties{},
+		}
+	}
+	b := newFakeV5Broker(t, publish(1), publish(2), publish(3), publish(4))
+	defer b.l.Close()
+
+	ctx := core.NewContext(nil)
+	src, err := NewSource(ctx, &bql.IOParams{}, data.Map{
+		"broker":             data.String(b.url()),
+		"topic":              data.String("a"),
+		"protocol_version":   data.String("5"),
+		"qos":                data.Int(1),
+		"ack_after_write":    data.Bool(true),
+		"ack_batch_size":     data.Int(3),
+		"ack_batch_interval": data.String("500ms"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	begin := time.Now()
+	write := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- src.GenerateStream(ctx, core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+			<-write
+			return nil
+		}))
+	}()
+	defer func() {
+		src.Stop(ctx)
+		<-done
+	}()
+
+	// notAcked fails when a PUBACK is received within d
+	notAcked := func(d time.Duration) {
+		timeout := time.After(d)
+		for {
+			select {
+			case p := <-b.packets:
+				if p.Type == packets.PUBACK {
+					t.Fatalf("the message shouldn't be acknowledged yet: %v", p.Content)
+				}
+			case <-timeout:
+				return
+			}
+		}
+	}
+	acked := func(id uint16) {
+		if ack := b.next(t, packets.PUBACK).Content.(*packets.Puback); ack.PacketID != id {
+			t.Errorf("wrong acknowledgment: %v, expected %v", ack.PacketID, id)
+		}
+	}
+
+	// the first batch is held until all of its messages are written
+	b.next(t, packets.SUBSCRIBE)
+	write <- struct{}{}
+	write <- struct{}{}
+	notAcked(50 * time.Millisecond)
+	write <- struct{}{}
+	for id := uint16(1); id <= 3; id++ {
+		acked(id)
+	}
+	if d := time.Since(begin); d >= 500*time.Millisecond {
+		t.Errorf("the full batch should be sent without waiting for the interval: %v", d)
+	}
+
+	// a partial batch is sent after the interval
+	write <- struct{}{}
+	acked(4)
+}
+
+func TestV5ReceiveMaximum(t *testing.T) {
+	for _, qos := range []int64{0, 1} {
+		b := newFakeV5Broker(t)
+		defer b.l.Close()
+
+		ctx := core.NewContext(nil)
+		src, err := NewSource(ctx, &bql.IOParams{}, data.Map{
+			"broker":           data.String(b.url()),
+			"topic":            data.String("a"),
+			"protocol_version": data.String("5"),
+			"qos":              data.Int(qos),
+			"message_order":    data.String("parallel"),
+			"max_inflight":     data.Int(8),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- src.GenerateStream(ctx, core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+				return nil
+			}))
+		}()
+
+		connect := b.next(t, packets.CONNECT).Content.(*packets.Connect)
+		r := connect.Properties.ReceiveMaximum
+		if qos == 0 && r != nil {
+			t.Errorf("Receive Maximum shouldn't be sent with QoS 0: %v", *r)
+		} else if qos > 0 && (r == nil || *r != 8) {
+			t.Errorf("max_inflight should be sent as Receive Maximum: %v", r)
+		}
+		src.Stop(ctx)
+		<-done
+	}
+}
+
+func TestV5DedupByMessageID(t *testing.T) {
+	publish := func(id uint16, dup bool, payload string) *packets.Publish {
+		return &packets.Publish{
+			Topic:      "a",
+			QoS:        1,
+			PacketID:   id,
+			Duplicate:  dup,
+			Payload:    []byte(payload),
+			Properties: &packets.Properties{},
+		}
+	}
+	b := newFakeV5Broker(t, publish(1, false, "1"), publish(1, true, "1"), publish(2, false, "2"))
+	defer b.l.Close()
+
+	ctx := core.NewContext(nil)
+	params := data.Map{
+		"broker":           data.String(b.url()),
+		"topic":            data.String("a"),
+		"protocol_version": data.String("5"),
+		"dedup_window":     data.String("10s"),
+		"dedup_key":        data.String("message_id"),
+	}
+	if _, err := NewSource(ctx, &bql.IOParams{}, params); err == nil {
+		t.Error("\"message_id\" dedup_key should be rejected with QoS 0")
+	}
+	params["qos"] = data.Int(1)
+	src, err := NewSource(ctx, &bql.IOParams{}, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuples := make(chan *core.Tuple, 3)
+	done := make(chan error, 1)
+	go func() {
+		done <- src.GenerateStream(ctx, core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+			tuples <- t
+			return nil
+		}))
+	}()
+	defer func() {
+		src.Stop(ctx)
+		<-done
+	}()
+
+	// messages are written in order, so the redelivery has been dropped
+	// when the second message is written
+	for _, p := range []string{"1", "2"} {
+		select {
+		case tu := <-tuples:
+			if b, _ := data.AsBlob(tu.Data["payload"]); string(b) != p {
+				t.Errorf("the redelivery should be dropped: %v", tu.Data["payload"])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the message wasn't emitted")
+		}
+	}
+}
+
+func TestV5SubscribeOptions(t *testing.T) {
+	b := newFakeV5Broker(t, &packets.Publish{
+		Topic:      "a",
+		Payload:    []byte("on"),
+		Retain:     true,
+		Properties: &packets.Properties{},
+	})
+	defer b.l.Close()
+
+	ctx := core.NewContext(nil)
+	src, err := NewSource(ctx, &bql.IOParams{}, data.Map{
+		"broker":              data.String(b.url()),
+		"topic":               data.String("a"),
+		"protocol_version":    data.String("5"),
+		"no_local":            data.Bool(true),
+		"retain_as_published": data.Bool(true),
+		"retain_handling":     data.Int(1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuples := make(chan *core.Tuple, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- src.GenerateStream(ctx, core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+			tuples <- t
+			return nil
+		}))
+	}()
+	defer func() {
+		src.Stop(ctx)
+		<-done
+	}()
+
+	sub := b.next(t, packets.SUBSCRIBE).Content.(*packets.Subscribe)
+	if o := sub.Subscriptions[0]; !o.NoLocal || !o.RetainAsPublished || o.RetainHandling != 1 {
+		t.Errorf("wrong subscription options: %+v", o)
+	}
+	select {
+	case tu := <-tuples:
+		if r, _ := tu.Data["retained"].(data.Bool); !r {
+			t.Errorf("the tuple should have the retain flag: %v", tu.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message wasn't emitted")
+	}
+}
+
+func TestV5SubscriptionIdentifiers(t *testing.T) {
+	id := 1
+	b := newFakeV5Broker(t, &packets.Publish{
+		Topic:      "a/b",
+		Payload:    []byte("on"),
+		Properties: &packets.Properties{SubscriptionIdentifier: &id},
+	})
+	defer b.l.Close()
+
+	ctx := core.NewContext(nil)
+	src, err := NewSource(ctx, &bql.IOParams{}, data.Map{
+		"broker":                   data.String(b.url()),
+		"topic":                    data.String("a/#"),
+		"protocol_version":         data.String("5"),
+		"subscription_identifiers": data.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuples := make(chan *core.Tuple, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- src.GenerateStream(ctx, core.WriterFunc(func(ctx *core.Context, t *core.Tuple) error {
+			tuples <- t
+			return nil
+		}))
+	}()
+	defer func() {
+		src.Stop(ctx)
+		<-done
+	}()
+
+	sub := b.next(t, packets.SUBSCRIBE).Content.(*packets.Subscribe)
+	if p := sub.Properties.SubscriptionIdentifier; p == nil || *p != 1 {
+		t.Errorf("wrong subscription identifier: %v", p)
+	}
+	select {
+	case tu := <-tuples:
+		id, _ := tu.Data["subscription_id"].(data.Int)
+		filter, _ := tu.Data["subscription_filter"].(data.String)
+		if id != 1 || filter != "a/#" {
+			t.Errorf("the tuple should have the subscription: %v", tu.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message wasn't emitted")
+	}
+}
+
+func TestV5ClientPublish(t *testing.T) {
+	b := newFakeV5Broker(t)
+	defer b.l.Close()
+
+	c := newV5Client(mqtt.NewClientOptions().AddBroker(b.url()))
+	if err := waitToken(c.Connect(), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect(0)
+	if !c.IsConnected() {
+		t.Error("the client should be connected")
+	}
+
+	if err := waitToken(c.Publish("a/b", 0, true, "on"), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	pub := b.next(t, packets.PUBLISH).Content.(*packets.Publish)
+	if pub.Topic != "a/b" || !pub.Retain || string(pub.Payload) != "on" {
+		t.Errorf("wrong message: %v", pub)
+	}
+	if err := waitToken(c.Publish("a/b", 0, false, 1), 5*time.Second); err == nil {
+		t.Error("payloads other than strings and bytes should be rejected")
+	}
+}
+
+func TestV5ServerKeepAlive(t *testing.T) {
+	b := newFakeV5Broker(t)
+	defer b.l.Close()
+
+	c := newV5Client(mqtt.NewClientOptions().AddBroker(b.url()).SetKeepAlive(20 * time.Second))
+	if err := waitToken(c.Connect(), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	c.Disconnect(0)
+	if d := keepAliveOf(c); d != 20*time.Second {
+		t.Errorf("the requested keepalive should be used without Server Keep Alive: %v", d)
+	}
+
+	serverKeepAlive := uint16(5)
+	b = startFakeV5Broker(t, &fakeV5Broker{
+		properties: &packets.Properties{ServerKeepAlive: &serverKeepAlive},
+	})
+	defer b.l.Close()
+
+	ctx := core.NewContext(nil)
+	snk, err := NewSink(ctx, &bql.IOParams{}, data.Map{
+		"broker":           data.String(b.url()),
+		"protocol_version": data.String("5"),
+		"keep_alive":       data.String("20s"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snk.Close(ctx)
+
+	// the connection is recorded after Connect returns
+	s := snk.(*sink)
+	for i := 0; i < 100; i++ {
+		if _, ok := s.Status()["keep_alive"]; ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if k := s.Status()["keep_alive"]; k != data.String("5s") {
+		t.Errorf("Server Keep Alive should be reported as the keepalive: %v", k)
+	}
+}
+
+func TestV5WillProperties(t *testing.T) {
+	b := newFakeV5Broker(t)
+	defer b.l.Close()
+
+	ctx := core.NewContext(nil)
+	snk, err := NewSink(ctx, &bql.IOParams{}, data.Map{
+		"broker":               data.String(b.url()),
+		"protocol_version":     data.String("5"),
+		"will_topic":           data.String("status"),
+		"will_payload":         data.String("offline"),
+		"will_delay_interval":  data.String("30s"),
+		"will_user_properties": data.Map{"host": data.String("edge-1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snk.Close(ctx)
+
+	connect := b.next(t, packets.CONNECT).Content.(*packets.Connect)
+	if !connect.WillFlag || connect.WillTopic != "status" {
+		t.Fatalf("the will message should be sent: %+v", connect)
+	}
+	wp := connect.WillProperties
+	if wp == nil || wp.WillDelayInterval == nil || *wp.WillDelayInterval != 30 {
+		t.Fatalf("will_delay_interval should be sent as Will Delay Interval: %+v", wp)
+	}
+	if len(wp.User) != 1 || wp.User[0].Key != "host" || wp.User[0].Value != "edge-1" {
+		t.Errorf("wrong user properties: %v", wp.User)
+	}
+
+	_, err = NewSink(ctx, &bql.IOParams{}, data.Map{
+		"will_topic":          data.String("status"),
+		"will_delay_interval": data.String("30s"),
+	})
+	if err == nil {
+		t.Error("will properties should require protocol_version 5")
+	}
+}
+
+func TestV5ClientUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeV5Broker{l: l, packets: make(chan *packets.ControlPacket, 100)}
+	go b.run()
+	defer l.Close()
+
+	c := newV5Client(mqtt.NewClientOptions().AddBroker("unix://" + path))
+	if err := waitToken(c.Connect(), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect(0)
+	b.next(t, packets.CONNECT)
+}
+
+func TestV5ClientReconnect(t *testing.T) {
+	b := newFakeV5Broker(t)
+	defer b.l.Close()
+
+	opts := mqtt.NewClientOptions().AddBroker(b.url()).SetAutoReconnect(true)
+	connected := make(chan struct{}, 2)
+	opts.SetOnConnectHandler(func(mqtt.Client) {
+		connected <- struct{}{}
+	})
+	c := newV5Client(opts)
+	if err := waitToken(c.Connect(), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect(0)
+	<-connected
+
+	c.m.Lock()
+	client := c.client
+	c.m.Unlock()
+	c.lost(client, errors.New("lost"))
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client should reconnect")
+	}
+	if !c.IsConnected() {
+		t.Error("the client should be connected")
+	}
+}
+
+func TestV5Redirect(t *testing.T) {
+	target := newFakeV5Broker(t)
+	defer target.l.Close()
+	b := startFakeV5Broker(t, &fakeV5Broker{
+		connack: &packets.Connack{
+			ReasonCode: v5UseAnotherServer,
+			Properties: &packets.Properties{ServerReference: target.l.Addr().String()},
+		},
+	})
+	defer b.l.Close()
+
+	r := &v5Redirect{}
+	c := newV5Client(mqtt.NewClientOptions().AddBroker(b.url()))
+	c.redirect = r
+	if err := waitToken(c.Connect(), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect(0)
+	target.next(t, packets.CONNECT)
+	if u := r.take(); u != nil {
+		t.Errorf("the redirect shouldn't be used again: %v", u)
+	}
+
+	// brokers which moved are used until they fail
+	current, _ := url.Parse("tcp://node1:1883")
+	r.set(current, v5ServerMoved, "node2 node3:1884")
+	for i := 0; i < 2; i++ {
+		if u := r.take(); u == nil || u.String() != "tcp://node2:1883" {
+			t.Errorf("wrong redirect: %v", u)
+		}
+	}
+	r.failed(&url.URL{Scheme: "tcp", Host: "node2:1883"})
+	if u := r.take(); u != nil {
+		t.Errorf("the failed redirect should be forgotten: %v", u)
+	}
+	r.set(current, 0x8b, "node2:1883")
+	if u := r.take(); u != nil {
+		t.Errorf("reason codes other than redirects should be ignored: %v", u)
+	}
+}
+
+func TestV5RedirectKeepsBrokers(t *testing.T) {
+	target := newFakeV5Broker(t)
+	defer target.l.Close()
+	b := startFakeV5Broker(t, &fakeV5Broker{
+		connack: &packets.Connack{
+			ReasonCode: v5UseAnotherServer,
+			Properties: &packets.Properties{ServerReference: target.l.Addr().String()},
+		},
+	})
+	defer b.l.Close()
+
+	brokers := []string{b.url(), "tcp://127.0.0.1:1", "tcp://127.0.0.1:2"}
+	opts := mqtt.NewClientOptions()
+	for _, u := range brokers {
+		opts.AddBroker(u)
+	}
+	c := newV5Client(opts)
+	c.redirect = &v5Redirect{}
+	if err := waitToken(c.Connect(), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect(0)
+	target.next(t, packets.CONNECT)
+
+	if len(opts.Servers) != len(brokers) {
+		t.Fatalf("the redirect shouldn't be added to the brokers: %v", opts.Servers)
+	}
+	for i, u := range opts.Servers {
+		if u.String() != brokers[i] {
+			t.Errorf("broker %v: expected %v, actual %v", i, brokers[i], u)
+		}
+	}
+}
+
+func TestServerReferenceURL(t *testing.T) {
+	current, _ := url.Parse("ssl://node1:8883")
+	cases := map[string]string{
+		"node2:8884":       "ssl://node2:8884",
+		"node2":            "ssl://node2:8883",
+		"tcp://node2:1883": "tcp://node2:1883",
+	}
+	for ref, expected := range cases {
+		u, err := serverReferenceURL(current, ref)
+		if err != nil {
+			t.Errorf("%v: %v", ref, err)
+			continue
+		}
+		if u.String() != expected {
+			t.Errorf("%v: expected %v, actual %v", ref, expected, u)
+		}
+	}
+}
+
+func TestSharedTopicFilter(t *testing.T) {
+	cases := map[string]string{
+		"a/#":               "a/#",
+		"$share/group/a/+":  "a/+",
+		"$share/group":      "$share/group",
+		"$SYS/broker/load/": "$SYS/broker/load/",
+	}
+	for f, expected := range cases {
+		if actual := sharedTopicFilter(f); actual != expected {
+			t.Errorf("%v: expected %v, actual %v", f, expected, actual)
+		}
+	}
+}
+
+func TestNewSourceProtocolVersion(t *testing.T) {
+	ctx := core.NewContext(nil)
+	for _, v := range []data.Value{data.String("3.1.1"), data.String("5"), data.Int(5)} {
+		if _, err := NewSource(ctx, &bql.IOParams{}, data.Map{
+			"topic":            data.String("a"),
+			"protocol_version": v,
+		}); err != nil {
+			t.Errorf("%v should be accepted: %v", v, err)
+		}
+	}
+	for _, params := range []data.Map{
+		{"protocol_version": data.String("6")},
+		{"protocol_version": data.String("5"), "use_auto_reconnect": data.Bool(true)},
+		{"store_dir": data.String("/tmp")},
+		{"protocol_version": data.String("5"), "buffer_size": data.Int(10), "buffer_policy": data.String("spill")},
+		{"protocol_version": data.String("5"), "retain_handling": data.Int(3)},
+		{"no_local": data.Bool(true)},
+		{"subscription_identifiers": data.Bool(true)},
+		{"follow_redirects": data.Bool(false)},
+	} {
+		params["topic"] = data.String("a")
+		if _, err := NewSource(ctx, &bql.IOParams{}, params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
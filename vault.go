@@ -0,0 +1,190 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// vaultPKI issues client certificates from a PKI secrets engine of HashiCorp
+// Vault. A certificate is cached and a new one is issued when it's about to
+// expire.
+type vaultPKI struct {
+	url        string
+	token      string
+	commonName string
+	ttl        string
+	client     *http.Client
+
+	m          sync.Mutex
+	cert       *tls.Certificate
+	caPool     *x509.CertPool
+	renewAfter time.Time
+}
+
+// newVaultPKI creates a vaultPKI from vault_* parameters. It returns nil when
+// the vault_addr parameter isn't given.
+func newVaultPKI(params data.Map) (*vaultPKI, error) {
+	v, ok := params["vault_addr"]
+	if !ok {
+		for _, k := range []string{"vault_token", "vault_pki_path", "vault_common_name", "vault_ttl", "vault_ca_file"} {
+			if _, ok := params[k]; ok {
+				return nil, errors.New(k + " requires vault_addr")
+			}
+		}
+		return nil, nil
+	}
+	addr, err := data.AsString(v)
+	if err != nil {
+		return nil, err
+	}
+
+	required := map[string]string{}
+	for _, k := range []string{"vault_token", "vault_pki_path", "vault_common_name"} {
+		v, ok := params[k]
+		if !ok {
+			return nil, fmt.Errorf("%v parameter is missing", k)
+		}
+		str, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		required[k] = str
+	}
+	token, err := expandEnv(required["vault_token"])
+	if err != nil {
+		return nil, err
+	}
+
+	p := &vaultPKI{
+		url:        strings.TrimRight(addr, "/") + "/v1/" + strings.Trim(required["vault_pki_path"], "/"),
+		token:      token,
+		commonName: required["vault_common_name"],
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+
+	if v, ok := params["vault_ttl"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		p.ttl = fmt.Sprintf("%ds", int64(d/time.Second))
+	}
+
+	if v, ok := params["vault_ca_file"]; ok {
+		path, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := (&tlsFiles{caFile: path}).tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		p.client.Transport = &http.Transport{TLSClientConfig: cfg}
+	}
+	return p, nil
+}
+
+// current returns the current client certificate and the pool of the CA
+// which issued it. It issues a new certificate if necessary.
+func (p *vaultPKI) current() (*tls.Certificate, *x509.CertPool, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.cert == nil || time.Now().After(p.renewAfter) {
+		if err := p.issue(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return p.cert, p.caPool, nil
+}
+
+// issue issues a new certificate. The caller must hold the lock.
+func (p *vaultPKI) issue() error {
+	reqBody := map[string]string{"common_name": p.commonName}
+	if p.ttl != "" {
+		reqBody["ttl"] = p.ttl
+	}
+	b, err := json.Marshal(reqBody)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault returned status %v: %v", res.StatusCode, string(body))
+	}
+
+	var issued struct {
+		Data struct {
+			Certificate string   `json:"certificate"`
+			PrivateKey  string   `json:"private_key"`
+			IssuingCA   string   `json:"issuing_ca"`
+			CAChain     []string `json:"ca_chain"`
+			Expiration  int64    `json:"expiration"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &issued); err != nil {
+		return err
+	}
+	d := &issued.Data
+
+	cert, err := tls.X509KeyPair([]byte(d.Certificate), []byte(d.PrivateKey))
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(d.IssuingCA)) {
+		return errors.New("vault didn't return an issuing CA certificate")
+	}
+	for _, c := range d.CAChain {
+		pool.AppendCertsFromPEM([]byte(c))
+	}
+
+	// Renew the certificate when 90% of its lifetime has passed so that a
+	// connection established right before the expiration doesn't fail.
+	now := time.Now()
+	expiration := time.Unix(d.Expiration, 0)
+	p.cert = &cert
+	p.caPool = pool
+	p.renewAfter = now.Add(expiration.Sub(now) * 9 / 10)
+	return nil
+}
+
+// apply configures cfg to use certificates issued by Vault. The broker is
+// verified by the CA issuing client certificates.
+func (p *vaultPKI) apply(cfg *tls.Config) error {
+	_, pool, err := p.current()
+	if err != nil {
+		return err
+	}
+	cfg.RootCAs = pool
+	cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert, _, err := p.current()
+		return cert, err
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestVaultPKI(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiration := time.Now().Add(time.Hour)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "sensorbee"},
+		NotBefore:    time.Now(),
+		NotAfter:     expiration,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caTmpl, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/v1/pki/issue/sensorbee" {
+			t.Errorf("wrong path: %v", r.URL.Path)
+		}
+		if tok := r.Header.Get("X-Vault-Token"); tok != "token" {
+			t.Errorf("wrong token: %v", tok)
+		}
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		if req["common_name"] != "sensorbee" || req["ttl"] != "3600s" {
+			t.Errorf("wrong request: %v", req)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"certificate": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+				"private_key": string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+				"issuing_ca":  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})),
+				"expiration":  expiration.Unix(),
+			},
+		})
+	}))
+	defer server.Close()
+
+	p, err := newVaultPKI(data.Map{
+		"vault_addr":        data.String(server.URL + "/"),
+		"vault_token":       data.String("token"),
+		"vault_pki_path":    data.String("/pki/issue/sensorbee"),
+		"vault_common_name": data.String("sensorbee"),
+		"vault_ttl":         data.String("1h"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, pool, err := p.current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+		t.Errorf("the certificate should be verified by the issuing CA: %v", err)
+	}
+
+	if _, _, err := p.current(); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("the certificate should be cached: %v requests", requests)
+	}
+
+	p.renewAfter = time.Now().Add(-time.Second)
+	if _, _, err := p.current(); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Errorf("the certificate should be renewed: %v requests", requests)
+	}
+}
+
+func TestNewVaultPKI(t *testing.T) {
+	if p, err := newVaultPKI(data.Map{}); err != nil || p != nil {
+		t.Errorf("vaultPKI shouldn't be created without the parameter: %v, %v", p, err)
+	}
+
+	for _, params := range []data.Map{
+		{"vault_token": data.String("token")},
+		{"vault_addr": data.String("http://localhost:8200")},
+		{"vault_addr": data.String("http://localhost:8200"), "vault_token": data.String("token"),
+			"vault_pki_path": data.String("pki/issue/a")},
+	} {
+		if _, err := newVaultPKI(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+// presence has a will message published by the broker when the client is
+// disconnected unexpectedly and a birth message published by the client when
+// it connects, so that other systems can observe whether the client is
+// online.
+type presence struct {
+	will  *message
+	birth *message
+
+	// willProperties are MQTT 5 properties of the will message if it isn't
+	// nil.
+	willProperties *willProperties
+}
+
+// willProperties are MQTT 5 properties of a will message. The broker waits
+// for delay before publishing the will message so that a brief reconnect
+// doesn't announce the client offline.
+type willProperties struct {
+	delay time.Duration
+	user  map[string]string
+}
+
+// parsePresence parses will_* and birth_* parameters. It returns nil when
+// neither will_topic nor birth_topic is given.
+func parsePresence(params data.Map) (*presence, error) {
+	will, err := parsePresenceMessage(params, "will", nil)
+	if err != nil {
+		return nil, err
+	}
+	birth, err := parsePresenceMessage(params, "birth", will)
+	if err != nil {
+		return nil, err
+	}
+	wp, err := parseWillProperties(params)
+	if err != nil {
+		return nil, err
+	}
+	if wp != nil && will == nil {
+		return nil, errors.New("will_delay_interval and will_user_properties require will_topic")
+	}
+	if will == nil && birth == nil {
+		return nil, nil
+	}
+	return &presence{
+		will:           will,
+		birth:          birth,
+		willProperties: wp,
+	}, nil
+}
+
+// parseWillProperties parses will_delay_interval and will_user_properties
+// parameters. It returns nil when neither of them is given. Message Expiry
+// Interval isn't supported since paho.golang doesn't send it in CONNECT.
+func parseWillProperties(params data.Map) (*willProperties, error) {
+	p := &willProperties{}
+	given := false
+	if v, ok := params["will_delay_interval"]; ok {
+		d, err := data.ToDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if d < 0 || d > math.MaxUint32*time.Second {
+			return nil, errors.New("will_delay_interval must be between 0s and 4294967295s")
+		}
+		p.delay = d
+		given = true
+	}
+
+	if v, ok := params["will_user_properties"]; ok {
+		m, err := data.AsMap(v)
+		if err != nil {
+			return nil, err
+		}
+		p.user = make(map[string]string, len(m))
+		for k, v := range m {
+			s, err := data.AsString(v)
+			if err != nil {
+				return nil, fmt.Errorf("will_user_properties of '%v' must be a string: %v", k, err)
+			}
+			p.user[k] = s
+		}
+		given = true
+	}
+
+	if !given {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// parsePresenceMessage parses <prefix>_topic, <prefix>_payload, <prefix>_qos,
+// and <prefix>_retained parameters. Parameters which aren't given are
+// inherited from def if it isn't nil.
+func parsePresenceMessage(params data.Map, prefix string, def *message) (*message, error) {
+	m := &message{}
+	if def != nil {
+		*m = *def
+	}
+
+	given := false
+	if v, ok := params[prefix+"_topic"]; ok {
+		t, err := data.AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		if t == "" {
+			return nil, fmt.Errorf("%v_topic must not be empty", prefix)
+		}
+		m.topic = t
+		given = true
+	}
+
+	if v, ok := params[prefix+"_payload"]; ok {
+		if v.Type() == data.TypeString {
+			s, _ := data.AsString(v)
+			m.payload = []byte(s)
+		} else {
+			b, err := data.AsBlob(v)
+			if err != nil {
+				return nil, fmt.Errorf("%v_payload must be a string or a blob: %v", prefix, err)
+			}
+			m.payload = b
+		}
+		given = true
+	}
+
+	if v, ok := params[prefix+"_qos"]; ok {
+		q, err := data.AsInt(v)
+		if err != nil {
+			return nil, err
+		}
+		if q < 0 || q > 2 {
+			return nil, fmt.Errorf("%v_qos must be 0, 1, or 2", prefix)
+		}
+		m.qos = byte(q)
+		given = true
+	}
+
+	if v, ok := params[prefix+"_retained"]; ok {
+		b, err := data.AsBool(v)
+		if err != nil {
+			return nil, err
+		}
+		m.retained = b
+		given = true
+	}
+
+	if !given {
+		if prefix == "birth" {
+			// A birth message isn't published unless it's configured.
+			return nil, nil
+		}
+		return def, nil
+	}
+	if m.topic == "" {
+		return nil, errors.New(prefix + "_topic parameter is missing")
+	}
+	return m, nil
+}
+
+// apply sets the will message to opts.
+func (p *presence) apply(opts *mqtt.ClientOptions) {
+	if p.will != nil {
+		opts.SetBinaryWill(p.will.topic, p.will.payload, p.will.qos, p.will.retained)
+	}
+}
+
+// applyV5 sets the will properties to the MQTT 5 client.
+func (p *presence) applyV5(c *v5Client) {
+	if p.willProperties == nil {
+		return
+	}
+	wp := &paho.WillProperties{}
+	delay := uint32(p.willProperties.delay / time.Second)
+	wp.WillDelayInterval = &delay
+	keys := make([]string, 0, len(p.willProperties.user))
+	for k := range p.willProperties.user {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		wp.User.Add(k, p.willProperties.user[k])
+	}
+	c.willProperties = wp
+}
+
+// config reports the will properties if any.
+func (p *presence) config(c data.Map) {
+	if p.will != nil {
+		c["will_topic"] = data.String(p.will.topic)
+	}
+	if wp := p.willProperties; wp != nil {
+		c["will_delay_interval"] = data.String(wp.delay.String())
+		user := make(data.Map, len(wp.user))
+		for k, v := range wp.user {
+			user[k] = data.String(v)
+		}
+		c["will_user_properties"] = user
+	}
+}
+
+// publisher is a client which can publish messages.
+type publisher interface {
+	Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
+}
+
+// announceOnline publishes the birth message.
+func (p *presence) announceOnline(ctx *core.Context, c publisher) {
+	if p.birth != nil {
+		p.publish(ctx, c, p.birth)
+	}
+}
+
+// announceOffline publishes the will message. The broker doesn't publish the
+// will message when the client disconnects gracefully, so the client needs to
+// publish it by itself.
+func (p *presence) announceOffline(ctx *core.Context, c publisher) {
+	if p.will != nil {
+		p.publish(ctx, c, p.will)
+	}
+}
+
+func (p *presence) publish(ctx *core.Context, c publisher, m *message) {
+	if err := waitToken(c.Publish(m.topic, m.qos, m.retained, m.payload), 10*time.Second); err != nil {
+		ctx.ErrLog(err).WithField("topic", m.topic).Error("Cannot publish a presence message")
+	}
+}
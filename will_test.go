@@ -0,0 +1,82 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParsePresence(t *testing.T) {
+	if p, err := parsePresence(data.Map{}); err != nil || p != nil {
+		t.Errorf("presence shouldn't be created without parameters: %v, %v", p, err)
+	}
+
+	p, err := parsePresence(data.Map{
+		"will_topic":    data.String("status/sensorbee"),
+		"will_payload":  data.String("offline"),
+		"will_qos":      data.Int(1),
+		"will_retained": data.Bool(true),
+		"birth_payload": data.String("online"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := p.will; w.topic != "status/sensorbee" || string(w.payload) != "offline" || w.qos != 1 || !w.retained {
+		t.Errorf("wrong will message: %+v", w)
+	}
+	if b := p.birth; b.topic != "status/sensorbee" || string(b.payload) != "online" || b.qos != 1 || !b.retained {
+		t.Errorf("the birth message should inherit the will message: %+v", b)
+	}
+
+	p, err = parsePresence(data.Map{"will_topic": data.String("status")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.birth != nil {
+		t.Errorf("the birth message shouldn't be created: %+v", p.birth)
+	}
+
+	for _, params := range []data.Map{
+		{"will_payload": data.String("offline")},
+		{"birth_payload": data.String("online")},
+		{"will_topic": data.String("status"), "will_qos": data.Int(3)},
+		{"will_topic": data.String("")},
+	} {
+		if _, err := parsePresence(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
+
+func TestParseWillProperties(t *testing.T) {
+	p, err := parsePresence(data.Map{
+		"will_topic":           data.String("status"),
+		"will_delay_interval":  data.String("30s"),
+		"will_user_properties": data.Map{"host": data.String("edge-1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wp := p.willProperties; wp == nil || wp.delay != 30*time.Second || wp.user["host"] != "edge-1" {
+		t.Errorf("wrong will properties: %+v", wp)
+	}
+
+	p, err = parsePresence(data.Map{"will_topic": data.String("status")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.willProperties != nil {
+		t.Errorf("will properties shouldn't be created: %+v", p.willProperties)
+	}
+
+	for _, params := range []data.Map{
+		{"will_delay_interval": data.String("30s")},
+		{"will_topic": data.String("status"), "will_delay_interval": data.String("-1s")},
+		{"will_topic": data.String("status"), "will_user_properties": data.Map{"host": data.Int(1)}},
+	} {
+		if _, err := parsePresence(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
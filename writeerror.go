@@ -0,0 +1,58 @@
+package mqtt
+
+import (
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+)
+
+const (
+	// writeRetries is the number of times a tuple is written again when the
+	// writer returns a temporary error, for example, because a queue of the
+	// topology is full.
+	writeRetries = 3
+
+	// writeRetryInterval is the time to wait before writing a tuple again.
+	// It's doubled on every retry so that the source slows down while the
+	// topology is congested.
+	writeRetryInterval = 10 * time.Millisecond
+)
+
+// writeTuple writes the tuple to w. Temporary errors are retried, and a fatal
+// error, which means the topology won't accept tuples anymore, stops the
+// source. Other errors are counted and logged once until writing succeeds
+// again so that a broken downstream doesn't flood the log.
+func (s *source) writeTuple(ctx *core.Context, w core.Writer, t *core.Tuple) error {
+	err := w.Write(ctx, t)
+	wait := writeRetryInterval
+	for i := 0; i < writeRetries && err != nil && core.IsTemporaryError(err); i++ {
+		time.Sleep(wait)
+		wait *= 2
+		err = w.Write(ctx, t)
+	}
+	if err == nil {
+		if atomic.CompareAndSwapInt32(&s.writeFailing, 1, 0) {
+			ctx.Log().Info("Writing tuples succeeded again")
+		}
+		return nil
+	}
+
+	atomic.AddInt64(&s.writeErrors, 1)
+	if core.IsFatalError(err) {
+		if atomic.CompareAndSwapInt32(&s.writeStopped, 0, 1) {
+			ctx.ErrLog(err).Error("Stopping the source since the topology doesn't accept tuples")
+			// Stop may be called concurrently, so the source isn't stopped
+			// again when the signal is already pending
+			select {
+			case s.disconnect <- false:
+			default:
+			}
+		}
+		return err
+	}
+	if atomic.CompareAndSwapInt32(&s.writeFailing, 0, 1) {
+		ctx.ErrLog(err).Warn("Cannot write tuples, errors are counted until writing succeeds")
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/core"
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestSourceWriteTuple(t *testing.T) {
+	ctx := core.NewContext(nil)
+	tu := core.NewTuple(data.Map{"topic": data.String("a")})
+
+	// errors are returned from the writer in order and the last one is
+	// repeated
+	newWriter := func(errs ...error) (core.Writer, *int) {
+		n := 0
+		return core.WriterFunc(func(*core.Context, *core.Tuple) error {
+			err := errs[0]
+			if len(errs) > 1 {
+				errs = errs[1:]
+			}
+			n++
+			return err
+		}), &n
+	}
+
+	s := &source{disconnect: make(chan bool, 1)}
+	w, n := newWriter(core.TemporaryError(errors.New("full")), nil)
+	if err := s.writeTuple(ctx, w, tu); err != nil || *n != 2 {
+		t.Errorf("a temporary error should be retried: %v, %v writes", err, *n)
+	}
+	w, n = newWriter(core.TemporaryError(errors.New("full")))
+	if err := s.writeTuple(ctx, w, tu); err == nil || *n != writeRetries+1 {
+		t.Errorf("retries should be limited: %v, %v writes", err, *n)
+	}
+
+	w, _ = newWriter(errors.New("broken"))
+	for i := 0; i < 2; i++ {
+		if err := s.writeTuple(ctx, w, tu); err == nil {
+			t.Error("the error should be returned")
+		}
+	}
+	if s.writeFailing != 1 || s.writeErrors != 3 {
+		t.Errorf("wrong state: failing %v, errors %v", s.writeFailing, s.writeErrors)
+	}
+	w, _ = newWriter(nil)
+	s.writeTuple(ctx, w, tu)
+	if s.writeFailing != 0 {
+		t.Error("writing should succeed again")
+	}
+	select {
+	case <-s.disconnect:
+		t.Error("the source shouldn't be stopped by non-fatal errors")
+	default:
+	}
+
+	w, n = newWriter(core.FatalError(errors.New("stopped")))
+	for i := 0; i < 2; i++ {
+		s.writeTuple(ctx, w, tu)
+	}
+	if *n != 2 {
+		t.Errorf("a fatal error shouldn't be retried: %v writes", *n)
+	}
+	if reconnect := <-s.disconnect; reconnect {
+		t.Error("a fatal error should stop the source")
+	}
+	select {
+	case <-s.disconnect:
+		t.Error("the source should be stopped only once")
+	default:
+	}
+}
@@ -0,0 +1,113 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+const defaultZigbee2MQTTBaseTopic = "zigbee2mqtt"
+
+// zigbee2MQTT decodes states of devices published to
+// <base_topic>/<friendly_name> by Zigbee2MQTT. When enrichDevices is true,
+// the device list published to <base_topic>/bridge/devices is tracked and
+// states are emitted with models and vendors of devices.
+type zigbee2MQTT struct {
+	baseTopic     string
+	enrichDevices bool
+
+	m sync.RWMutex
+
+	// devices is a map from friendly names to devices.
+	devices map[string]*zigbeeDevice
+}
+
+// zigbeeDevice is a device in the device list of the bridge.
+type zigbeeDevice struct {
+	FriendlyName string `json:"friendly_name"`
+	IEEEAddress  string `json:"ieee_address"`
+	Definition   *struct {
+		Model  string `json:"model"`
+		Vendor string `json:"vendor"`
+	} `json:"definition"`
+}
+
+func newZigbee2MQTT(baseTopic string, enrichDevices bool) *zigbee2MQTT {
+	return &zigbee2MQTT{
+		baseTopic:     baseTopic,
+		enrichDevices: enrichDevices,
+		devices:       map[string]*zigbeeDevice{},
+	}
+}
+
+func (z *zigbee2MQTT) String() string {
+	return "zigbee2mqtt"
+}
+
+func (z *zigbee2MQTT) decode(topic string, payload []byte) ([]data.Map, error) {
+	if !strings.HasPrefix(topic, z.baseTopic+"/") {
+		return nil, nil
+	}
+	name := topic[len(z.baseTopic)+1:]
+	if name == "bridge/devices" {
+		if z.enrichDevices {
+			return nil, z.setDevices(payload)
+		}
+		return nil, nil
+	}
+	if strings.HasPrefix(name, "bridge/") || len(payload) == 0 {
+		return nil, nil
+	}
+	switch name[strings.LastIndex(name, "/")+1:] {
+	case "set", "get", "availability":
+		// commands to devices and their availability
+		return nil, nil
+	}
+
+	v, err := decodeJSON(payload)
+	if err != nil {
+		return nil, err
+	}
+	if v.Type() != data.TypeMap {
+		return nil, fmt.Errorf("the state must be a JSON object: %v", v)
+	}
+	d := data.Map{
+		"topic":  data.String(topic),
+		"device": data.String(name),
+		"state":  v,
+	}
+	if z.enrichDevices {
+		z.m.RLock()
+		dev, ok := z.devices[name]
+		z.m.RUnlock()
+		if ok {
+			d["ieee_address"] = data.String(dev.IEEEAddress)
+			if dev.Definition != nil {
+				d["model"] = data.String(dev.Definition.Model)
+				d["vendor"] = data.String(dev.Definition.Vendor)
+			}
+		}
+	}
+	return []data.Map{d}, nil
+}
+
+// setDevices replaces the device list with the payload of bridge/devices.
+func (z *zigbee2MQTT) setDevices(payload []byte) error {
+	var list []*zigbeeDevice
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &list); err != nil {
+			return fmt.Errorf("invalid device list: %v", err)
+		}
+	}
+	devices := make(map[string]*zigbeeDevice, len(list))
+	for _, dev := range list {
+		devices[dev.FriendlyName] = dev
+	}
+	z.m.Lock()
+	defer z.m.Unlock()
+	z.devices = devices
+	return nil
+}
@@ -0,0 +1,82 @@
+package mqtt
+
+import (
+	"testing"
+
+	"gopkg.in/sensorbee/sensorbee.v0/data"
+)
+
+func TestParseConventionZigbee2MQTT(t *testing.T) {
+	for _, params := range []data.Map{
+		{"base_topic": data.String("z2m")},
+		{"convention": data.String("homie"), "enrich_devices": data.Bool(false)},
+		{"convention": data.String("zigbee2mqtt"), "base_topic": data.String("z2m/+")},
+		{"convention": data.String("zigbee2mqtt"), "enrich_devices": data.String("yes")},
+	} {
+		if _, err := parseConvention(params); err == nil {
+			t.Errorf("%v should be rejected", params)
+		}
+	}
+}
+
+func TestZigbee2MQTTDecode(t *testing.T) {
+	z := newZigbee2MQTT(defaultZigbee2MQTTBaseTopic, true)
+
+	state := []byte(`{"temperature":21.5}`)
+	ds, err := z.decode("zigbee2mqtt/kitchen/sensor", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := data.Map{
+		"topic":  data.String("zigbee2mqtt/kitchen/sensor"),
+		"device": data.String("kitchen/sensor"),
+		"state":  data.Map{"temperature": data.Float(21.5)},
+	}
+	if len(ds) != 1 || !data.Equal(expected, ds[0]) {
+		t.Errorf("expected %v, actual %v", expected, ds)
+	}
+
+	devices := []byte(`[{"friendly_name":"Coordinator","ieee_address":"0x00","type":"Coordinator"},{"friendly_name":"kitchen/sensor","ieee_address":"0x01","definition":{"model":"WSDCGQ11LM","vendor":"Aqara"}}]`)
+	if ds, err := z.decode("zigbee2mqtt/bridge/devices", devices); err != nil || ds != nil {
+		t.Fatalf("the device list shouldn't be emitted: %v, %v", ds, err)
+	}
+	ds, err = z.decode("zigbee2mqtt/kitchen/sensor", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected["ieee_address"] = data.String("0x01")
+	expected["model"] = data.String("WSDCGQ11LM")
+	expected["vendor"] = data.String("Aqara")
+	if len(ds) != 1 || !data.Equal(expected, ds[0]) {
+		t.Errorf("expected %v, actual %v", expected, ds)
+	}
+
+	for _, topic := range []string{
+		"zigbee2mqtt/bridge/state",
+		"zigbee2mqtt/kitchen/sensor/set",
+		"zigbee2mqtt/kitchen/sensor/availability",
+		"other/kitchen",
+	} {
+		if ds, err := z.decode(topic, []byte(`{"state":"online"}`)); err != nil || ds != nil {
+			t.Errorf("%v shouldn't be emitted: %v, %v", topic, ds, err)
+		}
+	}
+	if _, err := z.decode("zigbee2mqtt/bridge/devices", []byte(`{}`)); err == nil {
+		t.Error("an invalid device list should be rejected")
+	}
+	if _, err := z.decode("zigbee2mqtt/kitchen/sensor", []byte(`1`)); err == nil {
+		t.Error("a state which isn't an object should be rejected")
+	}
+
+	z = newZigbee2MQTT("z2m", false)
+	if _, err := z.decode("z2m/bridge/devices", devices); err != nil {
+		t.Fatal(err)
+	}
+	ds, err = z.decode("z2m/kitchen/sensor", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ds[0]["model"]; ok {
+		t.Errorf("the device shouldn't be enriched: %v", ds)
+	}
+}